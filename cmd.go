@@ -3,10 +3,20 @@
 package main
 
 import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
     "fmt"
     "os"
+    "os/signal"
+    "path/filepath"
+    "strconv"
     "strings"
+    "text/tabwriter"
+    "time"
 
+    units "github.com/docker/go-units"
     "github.com/sirupsen/logrus"
     "github.com/spf13/cobra"
     "github.com/spf13/viper"
@@ -16,34 +26,594 @@ import (
 var rootCmd = &cobra.Command{
     Use:   "dev-environment-manager",
     Short: "Manage development environments using Docker and Neovim",
+    PersistentPreRun: func(cmd *cobra.Command, args []string) {
+        // Record every operation except reading the log itself and the per-prompt lookups
+        if cmd != historyCmd && cmd.Annotations[annotationQuiet] == "" && !isCompletionRequest(cmd.Name()) {
+            beginAudit(cmd.CommandPath(), args)
+        }
+    },
+}
+
+// pendingUpdateHint delivers the result of the update check started for this command
+var pendingUpdateHint <-chan string
+
+// beginUpdateCheck starts the daily update check once the config is loaded, except for
+// self-update, --offline starts and commands whose output is read by other programs
+func beginUpdateCheck() {
+    if cmd, _, err := rootCmd.Find(os.Args[1:]); (err == nil && cmd == selfUpdateCmd) || quietInvocation() || jsonOutputRequested() {
+        return
+    }
+    // An --offline start must not reach the network, not even for the release check
+    if offline {
+        return
+    }
+    pendingUpdateHint = StartUpdateCheck()
+}
+
+// Annotation marking commands whose stdout is read by scripts; they log only warnings, to stderr
+const annotationQuiet = "quiet"
+
+// quietInvocation reports whether the command line runs a command annotated as quiet or is a
+// shell completion request
+func quietInvocation() bool {
+    if len(os.Args) > 1 && isCompletionRequest(os.Args[1]) {
+        return true
+    }
+    cmd, _, err := rootCmd.Find(os.Args[1:])
+    return err == nil && cmd.Annotations[annotationQuiet] != ""
+}
+
+// jsonOutputRequested reports whether the command line asks for JSON output, with --json or a
+// json --format / --output
+func jsonOutputRequested() bool {
+    args := os.Args[1:]
+    for i, arg := range args {
+        switch arg {
+        case "--json", "--json=true", "--format=json", "--output=json":
+            return true
+        case "--format", "--output":
+            if i+1 < len(args) && args[i+1] == "json" {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// isCompletionRequest reports whether name is cobra's hidden shell completion command
+func isCompletionRequest(name string) bool {
+    return name == cobra.ShellCompRequestCmd || name == cobra.ShellCompNoDescRequestCmd
 }
 
 // Execute runs the root command
 func Execute() {
+    // Fatal errors exit the process, so record their outcome from a logrus exit handler
+    logrus.AddHook(auditHook{})
+    logrus.RegisterExitHandler(func() { finishAudit(1) })
+
     if err := rootCmd.Execute(); err != nil {
         logrus.Fatal(err)
         os.Exit(1)
     }
+    finishAudit(0)
+
+    // Printed after the command's own output if the check is done by then; exiting never waits on it
+    if pendingUpdateHint != nil {
+        select {
+        case hint := <-pendingUpdateHint:
+            if hint != "" {
+                fmt.Fprintln(os.Stderr, hint)
+            }
+        default:
+        }
+    }
 }
 
 func init() {
-    cobra.OnInitialize(initConfig)
+    cobra.OnInitialize(initConfig, beginUpdateCheck)
 
     // Global flags
     rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.dev-env-manager.yaml)")
+    rootCmd.PersistentFlags().BoolVar(&cfgReadOnly, "config-readonly", false, "never write to the config file (also DEM_CONFIG_READONLY=1)")
+    rootCmd.PersistentFlags().StringVar(&userOverride, "user", "", "config section to use instead of the current username (e.g. to administer another user's entries)")
+    rootCmd.PersistentFlags().StringVar(&profileOverride, "profile", "", "apply this profile's overrides of repository settings (default is the profile config key)")
+    rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "answer yes to confirmation prompts, e.g. in scripts")
+    rootCmd.PersistentFlags().BoolVar(&noImageCache, "no-cache", false, "bypass the cached image inspections")
+    rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "also write logs to this file")
+    rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "format of --log-file: text or json")
+    rootCmd.PersistentFlags().BoolVar(&logAppend, "log-append", false, "append to --log-file instead of moving the previous log to <file>.1")
+
+    // Complete project and repo arguments from the config; commands that act on existing
+    // containers also offer projects and repos that only have containers
+    for _, cmd := range []*cobra.Command{startCmd, vscodeCmd, squashCmd, editCmd, syncCmd, versionsCheckCmd, copyProjectCmd, pathCmd, pinProjectCmd, logTailCmd, benchmarkCmd, stopCmd, lockCmd, unlockCmd} {
+        cmd.ValidArgsFunction = completeProjectRepo(false)
+    }
+    for _, cmd := range []*cobra.Command{containerRenameCmd, watchCmd, cleanCmd} {
+        cmd.ValidArgsFunction = completeProjectRepo(true)
+    }
+
+    // Start flags
+    addStartFlags(startCmd)
+    startCmd.Flags().BoolVar(&useVSCode, "vscode", false, "attach VS Code to the container instead of nvim (implies --keep)")
+    startCmd.Flags().StringVar(&startPath, "path", "", "start an environment for this directory instead of a registered project")
+    startCmd.Flags().StringVar(&startImage, "image", "", "Docker image to use with --path")
+    startCmd.RegisterFlagCompletionFunc("image", completeLocalImages)
+    startCmd.Flags().StringVar(&startSave, "save", "", "with --path, register the git checkout under this project (. for the parent directory name)")
+
+    // VS Code flags
+    addStartFlags(vscodeCmd)
+
+    // Open flags
+    addStartFlags(openCmd)
+    openCmd.Flags().BoolVar(&openPrint, "print", false, "print the inferred project and repo instead of starting")
+
+    // Attach flags
+    attachCmd.Flags().StringVar(&branch, "branch", "", "attach to the environment of this branch's worktree")
+    attachCmd.Flags().StringVar(&devCmd, "cmd", "", "command to run in the container instead of the editor (e.g. \"bash -l\")")
+    attachCmd.Flags().StringVar(&editorFlag, "editor", "", "editor command to run in the container, {dir} being the project directory (e.g. \"hx {dir}\")")
+    attachCmd.Flags().StringVar(&detachKeysFlag, "detach-keys", "", "key sequence that detaches and leaves the environment running (default ctrl-p,ctrl-q)")
+    attachCmd.Flags().BoolVar(&keepContainer, "keep", false, "leave the container running after the session ends")
+
+    // History flags
+    historyCmd.Flags().StringVar(&historyProject, "project", "", "only show entries for this project directory")
+    historyCmd.Flags().StringVar(&historySince, "since", "", "only show entries newer than this duration (e.g. 24h, 7d)")
+    historyCmd.Flags().BoolVar(&historyFailedOnly, "failed-only", false, "only show operations that failed")
+    historyCmd.Flags().IntVar(&historyLimit, "limit", 20, "maximum number of entries to show (0 for all)")
+
+    // Report flags
+    reportCmd.Flags().StringVar(&reportOutput, "output", "", "write the report to this file instead of stdout")
+    reportCmd.Flags().BoolVar(&reportAllUsers, "all-users", false, "include projects of every user in the config")
+    reportCmd.Flags().StringVar(&reportFormat, "format", "markdown", "report format: markdown or html")
+
+    // Stats flags
+    statsCmd.Flags().BoolVar(&statsUsage, "usage", false, "show time spent per project and repository")
+    statsCmd.Flags().StringVar(&statsSince, "since", "30d", "only include sessions newer than this duration (e.g. 30d, 12h)")
+    statsCmd.Flags().BoolVar(&statsJSON, "json", false, "print usage totals as JSON")
+
+    // Config subcommands
+    configShowCmd.Flags().BoolVar(&configJSON, "json", false, "print the effective config as JSON")
+    configCmd.AddCommand(configShowCmd)
+    configCmd.AddCommand(configUseCmd)
+    configCmd.AddCommand(configProjectDiffCmd)
+    configCmd.AddCommand(configExportCmd)
+    configCmd.AddCommand(configImportCmd)
+    configExportCmd.Flags().StringVar(&exportProject, "project", "", "only export this project's repositories")
+    configExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "write the bundle to this file instead of stdout")
+    configImportCmd.Flags().BoolVar(&importOverwrite, "overwrite", false, "replace repositories that are already configured")
+    configImportCmd.Flags().BoolVar(&importSkipExisting, "skip-existing", false, "keep repositories that are already configured")
+
+    // Workspace subcommands
+    workspaceCmd.AddCommand(workspaceUpCmd)
+    workspaceCmd.AddCommand(workspaceDownCmd)
+    workspaceCmd.AddCommand(workspaceStatusCmd)
+    workspaceCmd.AddCommand(workspaceExportCmd)
+    workspaceCmd.AddCommand(workspaceImportCmd)
+    for _, cmd := range []*cobra.Command{workspaceUpCmd, workspaceDownCmd} {
+        cmd.Flags().IntVar(&workspaceParallel, "parallel", defaultParallelism(), "number of members to handle at once")
+    }
+    workspaceUpCmd.Flags().BoolVar(&workspaceAtomic, "atomic", false, "stop the members this run started if any member fails")
+    addStartFlags(workspaceUpCmd)
+    workspaceExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "write the workspace to this file instead of stdout")
+    workspaceImportCmd.Flags().BoolVar(&importOverwrite, "overwrite", false, "replace repositories and workspaces that are already configured")
+    workspaceImportCmd.Flags().BoolVar(&importSkipExisting, "skip-existing", false, "keep repositories and workspaces that are already configured")
+
+    // Versions subcommands
+    versionsCmd.AddCommand(versionsCheckCmd)
+
+    // Env flags
+    envCmd.Flags().BoolVar(&envPorcelain, "porcelain", false, "print stable KEY=value lines for scripts and prompts")
+    envCmd.Flags().StringVar(&envPath, "path", "", "directory to resolve instead of the current one")
+
+    // Export-env flags
+    exportEnvCmd.Flags().BoolVar(&exportEnvReveal, "reveal", false, "export credential values too instead of leaving them out")
+
+    // Add flags
+    addProjectCmd.Flags().StringVar(&addDockerImage, "docker-image", "", "Docker image for the repository (default cdaprod/<repo>:latest)")
+    addProjectCmd.RegisterFlagCompletionFunc("docker-image", completeLocalImages)
+
+    // Commit flags
+    commitCmd.Flags().StringVarP(&commitMessage, "message", "m", "", "commit message")
+    commitCmd.Flags().BoolVarP(&commitAll, "all", "a", false, "stage every change, including new and deleted files, before committing")
+    commitCmd.Flags().StringVar(&commitAuthor, "author", "", "author as \"Name <email>\" (default: the repository's git config, then ~/.gitconfig)")
+    commitCmd.MarkFlagRequired("message")
+
+    // Push flags
+    pushCmd.Flags().StringVar(&pushRemote, "remote", "origin", "remote to push to")
+    pushCmd.Flags().StringVar(&pushBranch, "branch", "", "branch to push (default: the current branch)")
+
+    // Adopt flags
+    adoptCmd.Flags().StringVar(&adoptRepoURL, "repo-url", "", "repository URL for the config entry (asked for when not given)")
+    adoptCmd.Flags().BoolVar(&adoptForce, "force", false, "adopt a container that belongs to a compose project")
+
+    // Archive flags
+    archiveCmd.Flags().StringVarP(&archiveOutput, "output", "o", "", "archive path (default <project>-<repo>.tar.gz)")
+    archiveCmd.Flags().BoolVar(&archiveNoMetadata, "no-metadata", false, "leave the config entry out of the archive")
+    archiveCmd.Flags().BoolVar(&archiveIncludeGit, "include-git", true, "include the checkout's .git directory (the history is bundled either way)")
+    archiveCmd.Flags().StringArrayVar(&archiveExclude, "exclude", nil, "gitignore-style pattern of checkout paths to leave out, repeatable (e.g. node_modules/)")
+    archiveCmd.Flags().BoolVar(&archiveContainer, "container", false, "also export the container's filesystem to <archive>-container.tar")
+
+    // Copy-project flags
+    copyProjectCmd.Flags().StringVar(&copyRepoURL, "repo-url", "", "repository URL for the copy (derived from the source by default)")
+
+    // Schedule subcommands
+    scheduleCmd.AddCommand(scheduleAddCmd)
+    scheduleCmd.AddCommand(scheduleListCmd)
+    scheduleCmd.AddCommand(scheduleRemoveCmd)
+    scheduleCmd.AddCommand(scheduleDaemonCmd)
+
+    // Watch flags
+    watchCmd.Flags().BoolVar(&watchInitialRun, "initial-run", false, "run the command once before waiting for changes")
+
+    // Sync flags
+    syncCmd.Flags().BoolVar(&syncWatch, "watch", false, "keep syncing as files change")
+    syncCmd.Flags().StringVar(&syncRemote, "remote", "", "rsync the checkout to user@host:/path instead of the sync volume")
+
+    // Cache subcommands
+    cacheCmd.AddCommand(cacheClearCmd)
+
+    // Dry-run flags of the destructive commands
+    for _, cmd := range []*cobra.Command{cleanCmd, cacheClearCmd, scheduleRemoveCmd, pruneVolumesCmd} {
+        cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print what would be removed without removing it")
+    }
+
+    // Container subcommands
+    containerCmd.AddCommand(containerRenameCmd)
+    containerCmd.AddCommand(containerListCmd)
+    containerListCmd.Flags().BoolVar(&containerListAll, "all", false, "include stopped containers")
+    containerListCmd.Flags().StringVar(&containerListFormat, "format", "table", "output format: table or json")
+
+    // Squash flags
+    squashCmd.Flags().StringVarP(&squashMessage, "message", "m", "", "message for the squashed commit (defaults to the joined messages)")
+    squashCmd.Flags().BoolVar(&squashPush, "push", false, "force-push the squashed branch to the remote")
+    squashCmd.Flags().StringVar(&squashRemote, "remote", "origin", "remote to push to with --push")
+
+    // Update-images flags
+    updateImagesCmd.Flags().IntVar(&updateParallel, "parallel", defaultParallelism(), "number of images to pull at once")
+    updateImagesCmd.Flags().BoolVar(&updateRelock, "relock", false, "lock the locked repositories again to the digests just pulled")
+    updateImagesCmd.Flags().BoolVar(&quietPull, "quiet-pull", false, "don't print image pull progress (log lines are kept)")
+
+    // List flags
+    listCmd.Flags().StringVar(&listSince, "since", "", "only list repositories opened (or added) within this duration (e.g. 7d, 48h)")
+    listCmd.Flags().StringVar(&listBefore, "before", "", "only list repositories not opened (or added) within this duration")
+    listCmd.Flags().BoolVar(&listJSON, "json", false, "print the repositories as JSON")
+    listCmd.Flags().BoolVar(&listAllUsers, "all-users", false, "list the repositories of every user in the config")
+
+    // Status flags
+    statusCmd.Flags().StringVar(&statusSince, "since", "", "only show repositories opened (or added) within this duration (e.g. 7d, 48h)")
+    statusCmd.Flags().StringVar(&statusBefore, "before", "", "only show repositories not opened (or added) within this duration")
+    statusCmd.Flags().BoolVar(&statusRunningOnly, "running-only", false, "only show repositories whose container is running")
+    statusCmd.Flags().BoolVar(&statusJSON, "json", false, "print the statuses as JSON")
+    statusCmd.Flags().BoolVar(&statusAllUsers, "all-users", false, "show the repositories of every user in the config")
+    statusCmd.Flags().BoolVar(&statusCheckLocks, "check-locks", false, "ask the registry whether locked repositories' tags have moved past their digests")
+
+    // Pin-project flags
+    lockCmd.Flags().BoolVar(&lockAll, "all", false, "lock every configured repository")
+    pinProjectCmd.Flags().StringVar(&pinDigest, "digest", "", "pin this sha256:... digest instead of resolving the tag's current one")
+
+    // Template flags
+    templateListCmd.Flags().BoolVar(&templateRemote, "remote", false, "list the templates in the registry at template_registry_url instead of the installed ones")
+
+    // Path flags
+    pathCmd.Flags().StringVar(&pathBranch, "branch", "", "print the worktree of this branch instead of the base checkout")
+    pathCmd.Flags().BoolVar(&pathCreate, "create", false, "create the parent directories when the checkout doesn't exist yet")
+
+    // Audit flags
+    auditCmd.Flags().BoolVar(&auditFix, "fix", false, "offer to apply the remediation of each finding")
 
     // Add subcommands
     rootCmd.AddCommand(startCmd)
     rootCmd.AddCommand(addProjectCmd)
+    rootCmd.AddCommand(historyCmd)
+    rootCmd.AddCommand(reportCmd)
+    rootCmd.AddCommand(statsCmd)
+    rootCmd.AddCommand(configCmd)
+    rootCmd.AddCommand(squashCmd)
+    rootCmd.AddCommand(commitCmd)
+    rootCmd.AddCommand(pushCmd)
+    rootCmd.AddCommand(adoptCmd)
+    rootCmd.AddCommand(editCmd)
+    rootCmd.AddCommand(openCmd)
+    rootCmd.AddCommand(listCmd)
+    rootCmd.AddCommand(statusCmd)
+    rootCmd.AddCommand(auditCmd)
+    rootCmd.AddCommand(pathCmd)
+    rootCmd.AddCommand(doctorCmd)
+    rootCmd.AddCommand(selfUpdateCmd)
+    rootCmd.AddCommand(selfTestCmd)
+    stopCmd.Flags().BoolVar(&stopForce, "force", false, "kill the container at once instead of waiting for its grace period")
+    rootCmd.AddCommand(stopCmd)
+    pruneVolumesCmd.Flags().StringVar(&pruneProject, "project", "", "remove the volumes of this repository (dir/repo) instead of orphaned ones")
+    pruneCmd.AddCommand(pruneVolumesCmd)
+    rootCmd.AddCommand(pruneCmd)
+    logTailCmd.Flags().BoolVarP(&logFollow, "follow", "f", false, "keep streaming new log output")
+    logTailCmd.Flags().StringVar(&logTail, "tail", "all", "number of lines to show from the end of the logs, or all")
+    logTailCmd.Flags().StringVar(&logSince, "since", "", "only show logs newer than a duration (e.g. 10m) or timestamp")
+    rootCmd.AddCommand(logTailCmd)
+    rootCmd.Version = version
+    benchmarkCmd.Flags().IntVar(&benchmarkRuns, "runs", 10, "number of containers to start")
+    benchmarkCmd.Flags().BoolVar(&benchmarkSkipPull, "skip-pull", false, "use the local image instead of pulling it first")
+    rootCmd.AddCommand(benchmarkCmd)
+    rootCmd.AddCommand(pinProjectCmd)
+    rootCmd.AddCommand(lockCmd)
+    rootCmd.AddCommand(unlockCmd)
+    templateCmd.AddCommand(templateListCmd)
+    templateCmd.AddCommand(templateInstallCmd)
+    rootCmd.AddCommand(templateCmd)
+    rootCmd.AddCommand(cdInitCmd)
+    rootCmd.AddCommand(vscodeCmd)
+    rootCmd.AddCommand(containerCmd)
+    rootCmd.AddCommand(updateImagesCmd)
+    rootCmd.AddCommand(watchConfigCmd)
+    rootCmd.AddCommand(cacheCmd)
+    rootCmd.AddCommand(versionsCmd)
+    rootCmd.AddCommand(cleanCmd)
+    rootCmd.AddCommand(syncCmd)
+    rootCmd.AddCommand(watchCmd)
+    rootCmd.AddCommand(scheduleCmd)
+    rootCmd.AddCommand(copyProjectCmd)
+    rootCmd.AddCommand(envCmd)
+    rootCmd.AddCommand(promptInitCmd)
+    rootCmd.AddCommand(shellInitCmd)
+    rootCmd.AddCommand(workspaceCmd)
+    rootCmd.AddCommand(exportEnvCmd)
+    rootCmd.AddCommand(attachCmd)
+    rootCmd.AddCommand(archiveCmd)
+    rootCmd.AddCommand(importArchiveCmd)
+
+    // Cobra adds its completion command lazily; create it now to hang install under it
+    rootCmd.InitDefaultCompletionCmd()
+    if completionCmd, _, err := rootCmd.Find([]string{"completion"}); err == nil && completionCmd != rootCmd {
+        completionCmd.AddCommand(completionInstallCmd)
+    }
 }
 
 // Config file path
 var cfgFile string
 
+// Whether the config file must never be written
+var cfgReadOnly bool
+
+// Log file flag values
+var (
+    logFile   string
+    logFormat string
+    logAppend bool
+)
+
+// Report command flag values
+var (
+    reportOutput   string
+    reportAllUsers bool
+    reportFormat   string
+)
+
+// Squash command flag values
+var (
+    squashMessage string
+    squashPush    bool
+    squashRemote  string
+)
+
+// Config command flag values
+var configJSON bool
+
+// Stats command flag values
+var (
+    statsUsage bool
+    statsSince string
+    statsJSON  bool
+)
+
+// History command flag values
+var (
+    historyProject    string
+    historySince      string
+    historyFailedOnly bool
+    historyLimit      int
+)
+
+// Start command flag values
+var (
+    promptHint           bool
+    memoryLimit          string
+    memorySwap           string
+    memorySwappiness     int64
+    cgroupParent         string
+    cpusetCpus           string
+    cpusetMems           string
+    startPath            string
+    startImage           string
+    startSave            string
+    noSharedCache        bool
+    gpus                 string
+    gpuMemoryFraction    float64
+    keepContainer        bool
+    useVSCode            bool
+    sandbox              bool
+    quietPull            bool
+    noVerifyBinds        bool
+    branch               string
+    networkDisabledFlag  bool
+    skipPull             bool
+    offline              bool
+    subpath              string
+    networkName          string
+    networkAliases       []string
+    benchmarkRuns        int
+    benchmarkSkipPull    bool
+    logFollow            bool
+    logTail              string
+    logSince             string
+    cloneTimeout         time.Duration
+    pruneProject         string
+    stopForce            bool
+    overridePolicy       bool
+    skipModuleVerify     bool
+    timezoneFlag         string
+    noTimezone           bool
+    extraEnv             []string
+    devCmd               string
+    entrypoint           string
+    debugShell           string
+    detachKeysFlag       string
+    mountConsistencyFlag string
+    ipcModeFlag          string
+    stopSignalFlag       string
+    stopTimeout          time.Duration
+    oomKillDisable       bool
+    forceAttach          bool
+    dnsServers           []string
+    dnsSearch            []string
+    dnsOptions           []string
+    remoteSync           string
+    noEnvFile            bool
+    editorFlag           string
+    logDriver            string
+    logOpts              []string
+)
+
+// Container list flag values
+var (
+    containerListAll    bool
+    containerListFormat string
+)
+
+// Env command flag values
+var (
+    envPorcelain bool
+    envPath      string
+)
+
+// Export-env command flag values
+var exportEnvReveal bool
+
+// Add command flag values
+var addDockerImage string
+
+// Commit command flag values
+var (
+    commitMessage string
+    commitAll     bool
+    commitAuthor  string
+)
+
+// Push command flag values
+var (
+    pushRemote string
+    pushBranch string
+)
+
+// Adopt command flag values
+var (
+    adoptRepoURL string
+    adoptForce   bool
+)
+
+// Archive command flag values
+var (
+    archiveOutput     string
+    archiveNoMetadata bool
+    archiveIncludeGit bool
+    archiveExclude    []string
+    archiveContainer  bool
+)
+
+// Copy-project command flag values
+var copyRepoURL string
+
+// Watch command flag values
+var watchInitialRun bool
+
+// Sync command flag values
+var (
+    syncWatch  bool
+    syncRemote string
+)
+
+// Workspace command flag values
+var (
+    workspaceParallel int
+    workspaceAtomic   bool
+)
+
+// Update-images command flag values
+var (
+    updateParallel int
+    updateRelock   bool
+)
+
+// List command flag values
+var (
+    listSince    string
+    listBefore   string
+    listJSON     bool
+    listAllUsers bool
+)
+
+// Status command flag values
+var (
+    statusSince       string
+    statusBefore      string
+    statusRunningOnly bool
+    statusJSON        bool
+    statusAllUsers    bool
+    statusCheckLocks  bool
+)
+
+// Open command flag values
+var openPrint bool
+
+// Audit command flag values
+var auditFix bool
+
+// Pin-project command flag values
+var pinDigest string
+
+// Lock command flag values
+var lockAll bool
+
+// Config export/import flag values
+var (
+    exportProject      string
+    exportOutput       string
+    importOverwrite    bool
+    importSkipExisting bool
+)
+
+// Template command flag values
+var templateRemote bool
+
+// Path command flag values
+var (
+    pathBranch string
+    pathCreate bool
+)
+
+// --save value registering under the directory's parent name
+const saveDefaultProject = "."
+
 // Initialize configuration using Viper
 func initConfig() {
+    if logFile != "" {
+        if err := OpenLogFile(logFile, logFormat, logAppend); err != nil {
+            logrus.Fatalf("Error setting up log file: %v", err)
+        }
+    }
+
+    configReadOnly = cfgReadOnly
+    if env := os.Getenv("DEM_CONFIG_READONLY"); env != "" {
+        readOnly, err := strconv.ParseBool(env)
+        if err != nil {
+            logrus.Warnf("Ignoring invalid DEM_CONFIG_READONLY value %q", env)
+        }
+        configReadOnly = configReadOnly || readOnly
+    }
+
     if cfgFile != "" {
         viper.SetConfigFile(cfgFile)
+    } else if preferred := preferredConfigPath(); preferred != "" {
+        // Set by `config use`
+        viper.SetConfigFile(preferred)
     } else {
         home, err := os.UserHomeDir()
         cobra.CheckErr(err)
@@ -57,6 +627,8 @@ func initConfig() {
 
     if err := viper.ReadInConfig(); err == nil {
         logrus.Infof("Using config file: %s", viper.ConfigFileUsed())
+    } else if configReadOnly {
+        logrus.Warn("No config file found; running with defaults (config is read-only).")
     } else {
         logrus.Warn("No config file found; a new one will be created upon adding projects.")
     }
@@ -66,12 +638,342 @@ func initConfig() {
 var startCmd = &cobra.Command{
     Use:   "start [project-dir-name] [repo-name]",
     Short: "Start development environment for a project",
-    Args:  cobra.ExactArgs(2),
+    Long: `Start development environment for a project.
+
+Resource limits:
+  --memory, --memory-swap and --memory-swappiness mirror docker run and are
+  saved for the project once given.
+
+  --oom-kill-disable (or oom_kill_disable: true) keeps the OOM killer away
+  from JVM or ML workloads with allocation spikes. It needs a memory limit
+  and, the first time, --yes: a container at its limit then hangs instead of
+  being killed, which can freeze the host.
+
+  --cgroup-parent (or the cgroup_parent config key) places the container under
+  an existing cgroup, e.g. /user.slice/user-1000.slice on systemd cgroup v2
+  hosts, for per-user accounting. Memory limits still apply to the container's
+  own cgroup and are additionally bounded by any limits on the parent slice.
+  CPU works the same way: the slice's CPU quota and weight cap the container
+  on top of its own settings, and --cpuset-cpus and --cpuset-mems must stay
+  within the slice's cpuset or the container fails to start. The option is
+  ignored by Docker Desktop, whose daemon runs inside a VM.
+
+  --ipc (or the ipc_mode key) sets the IPC namespace. With host on Docker
+  Desktop or WSL 2 the container shares the VM's namespace rather than your
+  machine's, which the start warns about; container:<name> shares another
+  container's namespace instead.
+
+GPUs:
+  --gpus (or the gpus config key) takes the docker run --gpus syntax and
+  assumes the NVIDIA container runtime. NVIDIA_VISIBLE_DEVICES and
+  CUDA_VISIBLE_DEVICES are injected to match the request unless the project's
+  env already sets them; CUDA indices are container-side (starting at 0).
+  --gpu-memory-fraction sets XLA_PYTHON_CLIENT_MEM_FRACTION for JAX/XLA and
+  TF_FORCE_GPU_ALLOW_GROWTH for TensorFlow. PyTorch has no equivalent
+  variable; call torch.cuda.set_per_process_memory_fraction in code.
+
+Sandbox:
+  --sandbox is meant for reviewing untrusted code: the project, the editor
+  config and any configured volumes are mounted read-only, the network mode
+  is none, all capabilities are dropped and the root filesystem is read-only
+  with a tmpfs /tmp. The cap_add, cap_drop and read_only config keys override
+  these piecemeal; network_mode and network_aliases are ignored and --network
+  is refused. The shared caches and session restore are left out and
+  init_commands are skipped in this mode.
+
+Shell rc:
+  A project's ~/Projects/<project>/.dev-env-rc, or the file named by the
+  shell_rc key (relative to the project directory), is mounted read-only and
+  sourced by shells in the container via $ENV. A missing file is skipped.
+
+Offline:
+  --offline starts from the local image and the existing checkout without
+  pulling or cloning, and fails before creating anything with a list of every
+  missing resource. Start switches to it by itself when the image's registry
+  doesn't resolve within two seconds, e.g. on a plane.
+
+Branches:
+  --branch NAME checks the branch out as a git worktree of the existing clone
+  under ~/Projects/<project>/.worktrees/<repo>/ and runs it in a container
+  named after the branch, so several branches can be open at once. Use
+  clean to prune worktrees whose directories have been deleted.
+
+Monorepos:
+  --subpath DIR (or the subpath key) makes DIR, relative to the repository
+  root, the container's working directory and the editor's {dir}, so the
+  editor and its language servers start there. The whole repository is
+  still mounted; start fails if DIR doesn't exist in the checkout.
+
+Timezone:
+  The container gets TZ set to the host's zone (from $TZ, /etc/localtime or
+  /etc/timezone); --timezone ZONE or the timezone key picks another, and
+  --no-timezone or timezone: none keeps the image's. With the host's zone on
+  a local Linux daemon, /etc/localtime and /etc/timezone are also bind-mounted
+  read-only. A TZ in the env config always wins.
+
+Extra environment:
+  --extra-env KEY=VALUE (repeatable) adds a variable for this session only,
+  replacing any entry with the same key from the env config. Unlike most
+  start flags, extra-env values are not saved between sessions.
+
+Entrypoint:
+  Docker runs the container as its entrypoint followed by its command, which
+  is an idle shell loop the editor is exec'd beside. Images whose entrypoint
+  ignores its arguments (some docker-entrypoint.sh or dumb-init wrappers)
+  exit or never idle; --entrypoint "" (or entrypoint: [] in the config) drops
+  the image's entrypoint, and --entrypoint "tini --" or a list in the config
+  replaces it. The editor itself is started by exec and never goes through
+  the entrypoint.
+
+Image policy:
+  An optional top-level policy section restricts the images environments run:
+    policy:
+      allowed_registries: [registry.corp.example.com]  # or *.corp.example.com
+      denied_registries: [docker.io]
+      require_digest_pin: true   # image must be name@sha256:..., see pin-project
+      max_image_age_days: 90     # checked on the pulled image
+  A start that breaks a rule fails before pulling or creating anything, naming
+  the rule and the image, and exits with status 3. --override-policy starts
+  anyway and logs the violation prominently. Every other pull, by update,
+  benchmark, self-test or a schedule, refuses images the registry and digest
+  rules forbid too. doctor checks the section.
+
+Debug shell:
+  --debug-shell SHELL (e.g. --debug-shell /bin/sh) replaces the entrypoint,
+  skips init_commands and session restore, and attaches that shell instead
+  of the editor, to inspect a misbehaving image's filesystem. Add --no-rm
+  (same as --keep) to leave the container for another look afterwards.
+
+Detaching:
+  ctrl-p,ctrl-q (or --detach-keys / the detach_keys key) detaches from the
+  editor and leaves the container running; the command prints how to
+  reattach. Terminal resizes are passed on to the editor throughout.
+
+Shared sessions:
+  Starting an environment that another start (in another terminal, or by
+  another user on the same Docker host) is creating or running waits for the
+  container and then joins its session with a new editor. Only the start that
+  created the container removes it; joined sessions just leave.
+
+Env file:
+  With env_file set to an absolute container path (e.g. /run/devenv/.env),
+  the env config is also written there as a dotenv file, mode 0600 and owned
+  by the container's user, for tools that read .env instead of the process
+  environment. Values are never logged. Paths inside a bind mount, such as the
+  project checkout, are refused so secrets never land on the host.
+  --no-env-file skips it for one start.
+
+Profiles:
+  A profiles section, at the top level or in a repository's entry, overrides
+  any repository setting while that profile is active:
+    profiles:
+      staging:
+        docker_image: registry.corp.example.com/app:staging
+        memory: 4g
+  --profile NAME (or the top-level profile key) selects the profile. A
+  repository's own override wins over the top-level one, which only replaces
+  global defaults. Settings start saves from flags go into the active
+  profile's overrides.
+
+Ad-hoc directories:
+  --path DIR --image IMAGE starts an environment for any directory without
+  registering or cloning anything. Add --save PROJECT to register a git
+  checkout under a project using its origin URL, or --save . to use the
+  name of the directory's parent.`,
+    Args: func(cmd *cobra.Command, args []string) error {
+        if startPath != "" {
+            return cobra.NoArgs(cmd, args)
+        }
+        return cobra.ExactArgs(2)(cmd, args)
+    },
     Run: func(cmd *cobra.Command, args []string) {
+        opts := startOptionsFromFlags(cmd)
+
+        if startPath != "" {
+            saveProject := startSave
+            if saveProject == saveDefaultProject {
+                // --save . registers under the directory's parent, mirroring ~/Projects/<project>/<repo>
+                abs, err := filepath.Abs(startPath)
+                if err != nil {
+                    logrus.Fatalf("Error resolving path: %v", err)
+                }
+                saveProject = filepath.Base(filepath.Dir(abs))
+            }
+            if err := StartPath(startPath, startImage, saveProject, opts); err != nil {
+                fatalStart("Error starting environment: %v", err)
+            }
+            return
+        }
+
         projectDirName := args[0]
         repoName := args[1]
-        if err := StartProject(projectDirName, repoName); err != nil {
-            logrus.Fatalf("Error starting project: %v", err)
+        if err := StartProject(projectDirName, repoName, opts); err != nil {
+            fatalStart("Error starting project: %v", err)
+        }
+    },
+}
+
+// exitPolicyViolation is the exit status of a start the image policy refused
+const exitPolicyViolation = 3
+
+// fatalStart reports a failed start and exits, with exitPolicyViolation for policy violations
+func fatalStart(format string, err error) {
+    if errors.Is(err, errPolicyViolation) {
+        logrus.StandardLogger().ExitFunc = func(int) { os.Exit(exitPolicyViolation) }
+    }
+    logrus.Fatalf(format, err)
+}
+
+// addStartFlags registers the environment flags shared by start and the commands that behave like it
+func addStartFlags(cmd *cobra.Command) {
+    cmd.Flags().BoolVar(&promptHint, "prompt-hint", false, "prefix the container shell prompt with the environment name")
+    cmd.Flags().StringVar(&memoryLimit, "memory", "", "memory limit for the container (e.g. 4g); saved for the project")
+    cmd.Flags().StringVar(&memorySwap, "memory-swap", "", "total memory plus swap limit (e.g. 6g, -1 for unlimited); saved for the project")
+    cmd.Flags().Int64Var(&memorySwappiness, "memory-swappiness", -1, "container memory swappiness (0-100); saved for the project")
+    cmd.Flags().BoolVar(&oomKillDisable, "oom-kill-disable", false, "don't let the OOM killer stop the container; needs --memory and --yes (saved for the project)")
+    cmd.Flags().BoolVar(&forceAttach, "force", false, "attach even if the image lacks the editor or git")
+    cmd.Flags().StringVar(&cpusetCpus, "cpuset-cpus", "", "CPUs the container may run on, e.g. 0-3,8 (default: cpu_set_cpus key)")
+    cmd.Flags().StringVar(&cpusetMems, "cpuset-mems", "", "NUMA memory nodes the container may allocate from, e.g. 0 (default: cpu_set_mems key)")
+    cmd.Flags().StringVar(&cgroupParent, "cgroup-parent", "", "absolute cgroup path to place the container under (e.g. /user.slice/user-1000.slice); its memory and CPU limits also bound the container")
+    cmd.Flags().BoolVar(&noSharedCache, "no-shared-cache", false, "don't mount the shared Go module / npm cache volumes")
+    cmd.Flags().StringVar(&gpus, "gpus", "", "GPUs to expose: all, a count, or device=ID[,ID...] (sets NVIDIA/CUDA_VISIBLE_DEVICES)")
+    cmd.Flags().StringArrayVar(&dnsServers, "dns", nil, "DNS server IP for the container, repeatable (saved for the repository)")
+    cmd.Flags().StringArrayVar(&dnsSearch, "dns-search", nil, "DNS search domain, repeatable (saved for the repository)")
+    cmd.Flags().BoolVar(&noEnvFile, "no-env-file", false, "don't write the env config to the env_file path in the container")
+    cmd.Flags().StringVar(&remoteSync, "remote", "", "rsync the project to user@host:/path on the remote Docker host and bind it from there, syncing back afterwards")
+    cmd.Flags().StringArrayVar(&dnsOptions, "dns-option", nil, "resolv.conf option such as ndots:2, repeatable (saved for the repository)")
+    cmd.Flags().StringVar(&logDriver, "log-driver", "", "logging driver for the container (saved for the repository)")
+    cmd.Flags().StringSliceVar(&logOpts, "log-opt", nil, "logging driver options, e.g. max-size=10m,max-file=3 (saved for the repository; the driver defaults to json-file)")
+    cmd.Flags().StringVar(&devCmd, "cmd", "", "command to run in the container instead of the editor (e.g. \"bash -l\")")
+    cmd.Flags().StringVar(&detachKeysFlag, "detach-keys", "", "key sequence that detaches and leaves the environment running (default ctrl-p,ctrl-q)")
+    cmd.Flags().StringVar(&mountConsistencyFlag, "mount-consistency", "", "consistency of the project bind on Docker Desktop for Mac: consistent, cached or delegated")
+    cmd.Flags().StringVar(&stopSignalFlag, "stop-signal", "", "signal asking the container to exit on stop: TERM, INT, HUP, QUIT, USR1, USR2 or KILL (default: stop_signal key, else SIGTERM)")
+    cmd.Flags().DurationVar(&stopTimeout, "stop-timeout", 0, "how long the container gets to exit after its stop signal before it is killed, rounded up to whole seconds (default: stop_grace_period key, else 10s)")
+    cmd.Flags().StringVar(&ipcModeFlag, "ipc", "", "IPC namespace: none, private, shareable, host or container:<name> (default: ipc_mode key)")
+    cmd.Flags().StringVar(&entrypoint, "entrypoint", "", "override the image entrypoint (\"\" clears it; default: entrypoint key)")
+    cmd.Flags().StringVar(&editorFlag, "editor", "", "editor command to run in the container, {dir} being the project directory (e.g. \"hx {dir}\"; default: editor key, image label, then nvim)")
+    cmd.Flags().StringVar(&networkName, "network", "", "network to connect the container to (saved for the repository as network_mode)")
+    cmd.Flags().StringArrayVar(&networkAliases, "network-alias", nil, "name other containers on the --network can reach this one by, repeatable (saved for the repository)")
+    cmd.Flags().BoolVar(&networkDisabledFlag, "network-disabled", false, "create the container with no network access (implies --skip-pull)")
+    cmd.Flags().BoolVar(&skipPull, "skip-pull", false, "use the local image instead of pulling it")
+    cmd.Flags().StringArrayVar(&extraEnv, "extra-env", nil, "KEY=VALUE for this session only, repeatable; overrides the env config and is not saved")
+    cmd.Flags().StringVar(&timezoneFlag, "timezone", "", "TZ for the container, e.g. Europe/Berlin (default: timezone key, else the host's zone)")
+    cmd.Flags().BoolVar(&noTimezone, "no-timezone", false, "keep the image's timezone instead of the host's")
+    cmd.Flags().BoolVar(&skipModuleVerify, "skip-module-verify", false, "don't run go mod verify after cloning a Go module (also verify_modules: false)")
+    cmd.Flags().BoolVar(&overridePolicy, "override-policy", false, "start even if the image breaks the config's policy section (logged prominently)")
+    cmd.Flags().DurationVar(&cloneTimeout, "clone-timeout", 0, "give up on a missing repository's clone after this long (e.g. 10m), removing the partial clone")
+    cmd.Flags().BoolVar(&offline, "offline", false, "start from the local image and checkout only, failing early on anything missing (detected when the registry doesn't resolve)")
+    cmd.Flags().StringVar(&subpath, "subpath", "", "repository directory to start the editor in, e.g. services/api (default: subpath key, else the root)")
+    cmd.Flags().StringVar(&branch, "branch", "", "run in a git worktree of this branch, with its own container")
+    cmd.Flags().BoolVar(&noVerifyBinds, "no-verify-binds", false, "don't check that configured volume sources exist on the Docker host; missing ones are created as empty directories")
+    cmd.Flags().BoolVar(&quietPull, "quiet-pull", false, "don't print image pull progress (log lines are kept)")
+    cmd.Flags().BoolVar(&sandbox, "sandbox", false, "review mode: read-only mounts, no network, no capabilities, private IPC, read-only rootfs")
+    cmd.Flags().BoolVar(&keepContainer, "keep", false, "leave the container running after the session ends")
+    cmd.Flags().BoolVar(&keepContainer, "no-rm", false, "same as --keep")
+    cmd.Flags().StringVar(&debugShell, "debug-shell", "", "use this shell, e.g. /bin/sh, as the entrypoint and attach it instead of the editor")
+    cmd.Flags().Float64Var(&gpuMemoryFraction, "gpu-memory-fraction", 0, "fraction of GPU memory ML frameworks may claim (0-1, see --help)")
+}
+
+// startOptionsFromFlags collects the shared environment flags into StartOptions
+func startOptionsFromFlags(cmd *cobra.Command) StartOptions {
+    vscode := useVSCode || cmd.Name() == "vscode"
+    keep := keepContainer
+    if vscode && !cmd.Flags().Changed("keep") && !cmd.Flags().Changed("no-rm") {
+        // VS Code attaches after the CLI exits, so don't remove the container under it
+        keep = true
+    }
+
+    return StartOptions{
+        Sandbox:           sandbox,
+        Keep:              keep,
+        VSCode:            vscode,
+        PromptHint:        promptHint,
+        Memory:            memoryLimit,
+        MemorySwap:        memorySwap,
+        MemorySwappiness:  memorySwappiness,
+        CgroupParent:      cgroupParent,
+        CpusetCpus:        cpusetCpus,
+        CpusetMems:        cpusetMems,
+        NoSharedCache:     noSharedCache,
+        GPUs:              gpus,
+        GPUMemoryFraction: gpuMemoryFraction,
+        QuietPull:         quietPull,
+        NoVerifyBinds:     noVerifyBinds,
+        Branch:            branch,
+        NetworkDisabled:   networkDisabledFlag,
+        SkipPull:          skipPull,
+        Offline:           offline,
+        CloneTimeout:      cloneTimeout,
+        OverridePolicy:    overridePolicy,
+        SkipModuleVerify:  skipModuleVerify,
+        Timezone:          timezoneFlag,
+        NoTimezone:        noTimezone,
+        ExtraEnv:          extraEnv,
+        Subpath:           subpath,
+        Network:           networkName,
+        NetworkAliases:    networkAliases,
+        Cmd:               strings.Fields(devCmd),
+        Entrypoint:        entrypointFromFlag(cmd),
+        DetachKeys:        detachKeysFlag,
+        MountConsistency:  mountConsistencyFlag,
+        IpcMode:           ipcModeFlag,
+        StopSignal:        stopSignalFlag,
+        StopTimeout:       stopTimeout,
+        OOMKillDisable:    oomKillDisable,
+        Yes:               assumeYes,
+        Force:             forceAttach,
+        DNS:               dnsServers,
+        DNSSearch:         dnsSearch,
+        DNSOptions:        dnsOptions,
+        Remote:            remoteSync,
+        NoEnvFile:         noEnvFile,
+        DebugShell:        debugShell,
+        Editor:            editorFlag,
+        LogDriver:         logDriver,
+        LogOpts:           logOpts,
+    }
+}
+
+// entrypointFromFlag returns the --entrypoint override: nil when the flag wasn't given and [""],
+// which Docker treats as no entrypoint, when it was given empty
+func entrypointFromFlag(cmd *cobra.Command) []string {
+    if !cmd.Flags().Changed("entrypoint") {
+        return nil
+    }
+    if fields := strings.Fields(entrypoint); len(fields) > 0 {
+        return fields
+    }
+    return []string{""}
+}
+
+// Command to start the environment for the project containing the current directory
+var openCmd = &cobra.Command{
+    Use:   "open",
+    Short: "Start the environment for the project containing the current directory",
+    Long: `Start the environment for the project containing the current directory.
+
+The project and repo are inferred from the path when it lies under
+~/Projects/<project>/<repo>; otherwise the checkout's origin URL is matched
+against the configured repo_url values. With --print the inferred pair is
+written to stdout instead, for use in shell scripts.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        cwd, err := os.Getwd()
+        if err != nil {
+            logrus.Fatalf("Error getting current directory: %v", err)
+        }
+
+        projectDirName, repoName, err := ResolveProjectFromDir(cwd)
+        if err != nil {
+            logrus.Fatalf("Error resolving project: %v", err)
+        }
+
+        if openPrint {
+            fmt.Printf("%s %s\n", projectDirName, repoName)
+            return
+        }
+        if err := StartProject(projectDirName, repoName, startOptionsFromFlags(cmd)); err != nil {
+            fatalStart("Error starting project: %v", err)
         }
     },
 }
@@ -87,11 +989,1862 @@ var addProjectCmd = &cobra.Command{
         repoURL := args[2]
 
         // Derive Docker image and container name based on project name using Registry pattern
-        dockerImage := fmt.Sprintf("cdaprod/%s:latest", strings.ToLower(repoName))
+        dockerImage := addDockerImage
+        if dockerImage == "" {
+            dockerImage = fmt.Sprintf("cdaprod/%s:latest", strings.ToLower(repoName))
+        }
         containerName := fmt.Sprintf("nvim-%s", strings.ToLower(repoName))
 
         if err := AddProjectConfig(projectDirName, repoName, repoURL, dockerImage, containerName); err != nil {
             logrus.Fatalf("Error adding project: %v", err)
         }
     },
-}
\ No newline at end of file
+}
+
+// Command to pretty-print recent audit log entries
+var historyCmd = &cobra.Command{
+    Use:   "history",
+    Short: "Show recent operations recorded in the audit log",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        entries, err := ReadAuditLog()
+        if err != nil {
+            logrus.Fatalf("Error reading audit log: %v", err)
+        }
+
+        var cutoff time.Time
+        if historySince != "" {
+            since, err := parseSince(historySince)
+            if err != nil {
+                logrus.Fatalf("Invalid --since value: %v", err)
+            }
+            cutoff = time.Now().Add(-since)
+        }
+
+        var filtered []AuditEntry
+        for _, entry := range entries {
+            if historyProject != "" && entry.Project != historyProject {
+                continue
+            }
+            if !cutoff.IsZero() && entry.Time.Before(cutoff) {
+                continue
+            }
+            if historyFailedOnly && entry.ExitStatus == 0 {
+                continue
+            }
+            filtered = append(filtered, entry)
+        }
+        if historyLimit > 0 && len(filtered) > historyLimit {
+            filtered = filtered[len(filtered)-historyLimit:]
+        }
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "TIME\tCOMMAND\tTARGET\tSTATUS\tDETAILS")
+        for _, entry := range filtered {
+            target := "-"
+            if entry.Project != "" {
+                target = fmt.Sprintf("%s/%s", entry.Project, entry.Repo)
+            }
+            status := "ok"
+            if entry.ExitStatus != 0 {
+                status = fmt.Sprintf("failed (%d)", entry.ExitStatus)
+            }
+
+            var details []string
+            if len(entry.ImagesPulled) > 0 {
+                details = append(details, "pulled="+strings.Join(entry.ImagesPulled, ","))
+            }
+            if len(entry.ContainersCreated) > 0 {
+                details = append(details, "created="+strings.Join(shortIDs(entry.ContainersCreated), ","))
+            }
+            if len(entry.ContainersRemoved) > 0 {
+                details = append(details, "removed="+strings.Join(shortIDs(entry.ContainersRemoved), ","))
+            }
+            if entry.Error != "" {
+                details = append(details, "error="+entry.Error)
+            }
+
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+                entry.Time.Local().Format("2006-01-02 15:04:05"),
+                strings.TrimSpace(entry.Command+" "+strings.Join(entry.Args, " ")),
+                target, status, strings.Join(details, " "))
+        }
+        w.Flush()
+    },
+}
+
+// shortIDs truncates container IDs to the 12-character form Docker displays
+func shortIDs(ids []string) []string {
+    short := make([]string, len(ids))
+    for i, id := range ids {
+        if len(id) > 12 {
+            id = id[:12]
+        }
+        short[i] = id
+    }
+    return short
+}
+
+// Command to generate project documentation for onboarding
+var reportCmd = &cobra.Command{
+    Use:   "report",
+    Short: "Generate a Markdown (or HTML) summary of configured projects",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        out := os.Stdout
+        if reportOutput != "" {
+            f, err := os.Create(reportOutput)
+            if err != nil {
+                logrus.Fatalf("Error creating report file: %v", err)
+            }
+            defer f.Close()
+            out = f
+        }
+
+        if err := GenerateReport(out, reportAllUsers, reportFormat); err != nil {
+            logrus.Fatalf("Error generating report: %v", err)
+        }
+        if reportOutput != "" {
+            logrus.Infof("Report written to %s", reportOutput)
+        }
+    },
+}
+
+// Command to show local usage statistics
+var statsCmd = &cobra.Command{
+    Use:   "stats",
+    Short: "Show local usage statistics (set telemetry_local: false to stop recording)",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        if !statsUsage {
+            cmd.Help()
+            return
+        }
+
+        since, err := parseSince(statsSince)
+        if err != nil {
+            logrus.Fatalf("Invalid --since value: %v", err)
+        }
+        totals, err := UsageSince(time.Now().Add(-since))
+        if err != nil {
+            logrus.Fatalf("Error reading usage: %v", err)
+        }
+
+        if statsJSON {
+            enc := json.NewEncoder(os.Stdout)
+            enc.SetIndent("", "  ")
+            if err := enc.Encode(totals); err != nil {
+                logrus.Fatalf("Error encoding usage: %v", err)
+            }
+            return
+        }
+
+        if len(totals) == 0 {
+            fmt.Printf("No sessions recorded in the last %s.\n", statsSince)
+            return
+        }
+
+        // Scale bars relative to the most used repository
+        const barWidth = 30
+        max := totals[0].Seconds
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        for _, total := range totals {
+            width := 0
+            if max > 0 {
+                width = int(total.Seconds / max * barWidth)
+            }
+            if width == 0 && total.Seconds > 0 {
+                width = 1
+            }
+            duration := time.Duration(total.Seconds * float64(time.Second)).Round(time.Minute)
+            fmt.Fprintf(w, "%s/%s\t%s\t%s\t%d sessions\n", total.Project, total.Repo,
+                strings.Repeat("#", width), duration, total.Sessions)
+        }
+        w.Flush()
+    },
+}
+
+// Parent command for inspecting and selecting the config file
+var configCmd = &cobra.Command{
+    Use:   "config",
+    Short: "Inspect and manage the configuration",
+}
+
+// Command to print the merged effective config and where each value came from
+var configShowCmd = &cobra.Command{
+    Use:   "show",
+    Short: "Show the effective config and the source of each key",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        values, err := EffectiveConfig()
+        if err != nil {
+            logrus.Fatalf("Error reading config: %v", err)
+        }
+
+        if configJSON {
+            enc := json.NewEncoder(os.Stdout)
+            enc.SetIndent("", "  ")
+            out := map[string]interface{}{
+                "config_file": viper.ConfigFileUsed(),
+                "keys":        values,
+            }
+            if err := enc.Encode(out); err != nil {
+                logrus.Fatalf("Error encoding config: %v", err)
+            }
+            return
+        }
+
+        fmt.Printf("Config file: %s\n\n", viper.ConfigFileUsed())
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+        for _, v := range values {
+            fmt.Fprintf(w, "%s\t%v\t%s\n", v.Key, v.Value, v.Source)
+        }
+        w.Flush()
+    },
+}
+
+// Command to record which config file should be used by default
+var configUseCmd = &cobra.Command{
+    Use:   "use <path>",
+    Short: "Use the given config file whenever --config is not passed",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        if err := SetPreferredConfigPath(args[0]); err != nil {
+            logrus.Fatalf("Error setting config file: %v", err)
+        }
+    },
+}
+
+// Command to squash the last N commits of a project's checkout
+var squashCmd = &cobra.Command{
+    Use:   "squash [project-dir-name] [repo-name] <n>",
+    Short: "Squash the last N commits of a project's current branch into one",
+    Args:  cobra.ExactArgs(3),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectDirName := args[0]
+        repoName := args[1]
+        n, err := strconv.Atoi(args[2])
+        if err != nil {
+            logrus.Fatalf("Invalid commit count %q: %v", args[2], err)
+        }
+
+        projectPath, err := repoCheckoutPath(projectDirName, repoName)
+        if err != nil {
+            logrus.Fatalf("Error locating repository: %v", err)
+        }
+        auditTarget(projectDirName, repoName)
+
+        if err := SquashCommits(projectPath, n, squashMessage); err != nil {
+            logrus.Fatalf("Error squashing commits: %v", err)
+        }
+        if squashPush {
+            if err := PushBranch(projectPath, squashRemote); err != nil {
+                logrus.Fatalf("Error pushing squashed branch: %v", err)
+            }
+        }
+    },
+}
+
+// Command to commit a project's changes from the host
+var commitCmd = &cobra.Command{
+    Use:               "commit [project-dir-name] [repo-name]",
+    Short:             "Commit a project's changes from the host",
+    Args:              cobra.ExactArgs(2),
+    ValidArgsFunction: completeProjectRepo(false),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectPath, err := repoCheckoutPath(args[0], args[1])
+        if err != nil {
+            logrus.Fatalf("Error locating repository: %v", err)
+        }
+        auditTarget(args[0], args[1])
+
+        var name, email string
+        if commitAuthor != "" {
+            if name, email, err = parseAuthor(commitAuthor); err != nil {
+                logrus.Fatal(err)
+            }
+        }
+        hash, err := CommitChanges(projectPath, commitMessage, name, email, commitAll)
+        if err != nil {
+            logrus.Fatalf("Error committing changes: %v", err)
+        }
+        fmt.Println(hash.String()[:7])
+    },
+}
+
+// Command to push a project's commits from the host
+var pushCmd = &cobra.Command{
+    Use:               "push [project-dir-name] [repo-name]",
+    Short:             "Push a project's branch from the host",
+    Args:              cobra.ExactArgs(2),
+    ValidArgsFunction: completeProjectRepo(false),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectPath, err := repoCheckoutPath(args[0], args[1])
+        if err != nil {
+            logrus.Fatalf("Error locating repository: %v", err)
+        }
+        auditTarget(args[0], args[1])
+
+        if err := PushChanges(projectPath, pushRemote, pushBranch, nil); err != nil {
+            logrus.Fatalf("Error pushing: %v", err)
+        }
+    },
+}
+
+// Command to bring a hand-made container under management
+var adoptCmd = &cobra.Command{
+    Use:   "adopt <container-name> [project-dir-name] [repo-name]",
+    Short: "Register an existing container as a project environment",
+    Long: `Register a container created outside this tool: its image, binds, env and
+ports become a new config entry (project "adopted" and the container name
+unless given). The repository URL can't be read from the container and is
+asked for unless --repo-url is given. Docker can't relabel a container, so it
+is then recreated from a commit of itself with the manager's labels, after
+confirmation (or --yes). Containers of compose stacks need --force.`,
+    Args: cobra.RangeArgs(1, 3),
+    Run: func(cmd *cobra.Command, args []string) {
+        var projectDirName, repoName string
+        if len(args) > 1 {
+            projectDirName = args[1]
+        }
+        if len(args) > 2 {
+            repoName = args[2]
+        }
+        if err := AdoptContainer(args[0], projectDirName, repoName, adoptRepoURL, adoptForce); err != nil {
+            logrus.Fatalf("Error adopting container: %v", err)
+        }
+    },
+}
+
+// Command to hand-edit a repository entry or the whole config file
+var editCmd = &cobra.Command{
+    Use:   "edit [project-dir-name] [repo-name]",
+    Short: "Edit a repository's config entry (or the whole config) in $EDITOR with validation",
+    Args: func(cmd *cobra.Command, args []string) error {
+        if len(args) != 0 && len(args) != 2 {
+            return fmt.Errorf("accepts 0 or 2 arg(s), received %d", len(args))
+        }
+        return nil
+    },
+    Run: func(cmd *cobra.Command, args []string) {
+        var projectDirName, repoName string
+        if len(args) == 2 {
+            projectDirName, repoName = args[0], args[1]
+            auditTarget(projectDirName, repoName)
+        }
+        if err := EditConfig(projectDirName, repoName); err != nil {
+            logrus.Fatalf("Error editing config: %v", err)
+        }
+    },
+}
+
+// Command to list configured projects
+var listCmd = &cobra.Command{
+    Use:   "project-list",
+    Short: "List configured projects and repositories",
+    Long: `List configured projects and repositories. --since and --before filter by
+when a repository's environment was last opened, or when it was added if it
+was never opened; repositories with neither recorded only pass --before.
+
+Repositories under the "shared" pseudo-user (users.shared.projects...) are
+visible to everyone and listed with source "shared", unless the user has a
+personal entry of the same name, which wins.
+
+--all-users lists the repositories of every users.* section instead, with the
+owning user in a USER column, e.g. for admins of a shared machine. Times are
+only known for the current user's and shared repositories.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        filter, err := activityFilter(listSince, listBefore)
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        repos, err := ListProjects(filter, listAllUsers)
+        if err != nil {
+            logrus.Fatalf("Error listing projects: %v", err)
+        }
+
+        if listJSON {
+            printJSON(repos)
+            return
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        if listAllUsers {
+            fmt.Fprintln(w, "USER\tPROJECT\tREPO\tIMAGE\tADDED\tLAST OPENED")
+            for _, repo := range repos {
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", repo.User, repo.Project, repo.Repo, repo.Image, formatListTime(repo.AddedAt), formatListTime(repo.LastOpened))
+            }
+            w.Flush()
+            return
+        }
+        fmt.Fprintln(w, "PROJECT\tREPO\tIMAGE\tADDED\tLAST OPENED\tSOURCE")
+        for _, repo := range repos {
+            source := "personal"
+            if repo.User == sharedUser {
+                source = "shared"
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", repo.Project, repo.Repo, repo.Image, formatListTime(repo.AddedAt), formatListTime(repo.LastOpened), source)
+        }
+        w.Flush()
+    },
+}
+
+// Command to show configured repositories with their container states
+var statusCmd = &cobra.Command{
+    Use:   "status",
+    Short: "Show configured repositories with their container state and last use",
+    Long: `Show configured repositories with their container and its state (absent when
+there is none). --since and --before filter like in project-list. LOCK is "locked" for
+repositories locked with lock; with --check-locks, which asks the registry
+about each locked image, it is "outdated" once their tag points to a newer
+image than the locked digest. --all-users shows every users.* section's
+repositories with a USER column, like in project-list.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        filter, err := activityFilter(statusSince, statusBefore)
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        statuses, err := ProjectStatus(filter, statusRunningOnly, statusAllUsers, statusCheckLocks)
+        if err != nil {
+            logrus.Fatalf("Error reading status: %v", err)
+        }
+
+        if statusJSON {
+            printJSON(statuses)
+            return
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        header := "PROJECT\tREPO\tCONTAINER\tSTATE\tLOCK\tLAST OPENED"
+        if statusAllUsers {
+            header = "USER\t" + header
+        }
+        fmt.Fprintln(w, header)
+        for _, s := range statuses {
+            lock := s.Lock
+            if lock == "" {
+                lock = "-"
+            }
+            if statusAllUsers {
+                fmt.Fprintf(w, "%s\t", s.User)
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Project, s.Repo, s.Container, s.State, lock, formatListTime(s.LastOpened))
+        }
+        w.Flush()
+    },
+}
+
+// activityFilter builds a last-activity filter from --since and --before durations
+func activityFilter(since, before string) (ActivityFilter, error) {
+    var filter ActivityFilter
+    if since != "" {
+        d, err := parseSince(since)
+        if err != nil {
+            return filter, fmt.Errorf("invalid --since value: %v", err)
+        }
+        filter.Since = time.Now().Add(-d)
+    }
+    if before != "" {
+        d, err := parseSince(before)
+        if err != nil {
+            return filter, fmt.Errorf("invalid --before value: %v", err)
+        }
+        filter.Before = time.Now().Add(-d)
+    }
+    return filter, nil
+}
+
+// formatListTime formats a timestamp for a table column, "-" when unknown
+func formatListTime(t time.Time) string {
+    if t.IsZero() {
+        return "-"
+    }
+    return t.Local().Format("2006-01-02 15:04")
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) {
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(v); err != nil {
+        logrus.Fatalf("Error encoding JSON: %v", err)
+    }
+}
+
+// Command to print a project's checkout directory, for cd "$(dev-environment-manager path web api)"
+var pathCmd = &cobra.Command{
+    Use:   "path [project-dir-name] [repo-name]",
+    Short: "Print the absolute path of a project's checkout",
+    Long: `Print the absolute path of a project's checkout, or of a branch's worktree
+with --branch, as start would use it. Only the path is printed. The exit status
+is 2 when the directory doesn't exist yet; --create makes its parent
+directories and prints the path anyway.`,
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        path, err := CheckoutPath(args[0], args[1], pathBranch)
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        if _, err := os.Stat(path); os.IsNotExist(err) {
+            if !pathCreate {
+                fmt.Fprintf(os.Stderr, "%s does not exist yet; start the project or pass --create\n", path)
+                os.Exit(2)
+            }
+            if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+                logrus.Fatalf("Error creating %s: %v", filepath.Dir(path), err)
+            }
+        }
+        fmt.Println(path)
+    },
+}
+
+// Command to print the devcd shell function
+var cdInitCmd = &cobra.Command{
+    Use:         "cd-init zsh|bash|fish",
+    Short:       "Print a shell function, devcd, that changes to a project's checkout",
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        script, err := CdInitScript(args[0], rootCmd.Name())
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        fmt.Print(script)
+    },
+}
+
+// Command to report drift between checkouts, config entries and containers
+var auditCmd = &cobra.Command{
+    Use:   "audit",
+    Short: "Report checkouts, config entries and containers that no longer match up",
+    Long: `Cross-reference the checkouts under ~/Projects, the configured repositories
+and the managed containers, and report:
+
+  unregistered checkout  a clone with no config entry (fix: add it)
+  missing checkout       a config entry whose opened checkout was deleted (fix: remove the entry)
+  orphaned container     a container labelled for a repository no user has configured (fix: remove it)
+
+Nothing is changed unless --fix is given, which asks before applying each
+remediation (--yes applies them all). The exit status is 1 while findings remain, so the audit can run
+from cron.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        findings, err := AuditDrift()
+        if err != nil {
+            logrus.Fatalf("Error auditing: %v", err)
+        }
+        if len(findings) == 0 {
+            fmt.Println("No drift found.")
+            return
+        }
+
+        remaining := 0
+        for _, kind := range []string{driftUnregisteredCheckout, driftMissingCheckout, driftOrphanContainer} {
+            printed := false
+            for _, finding := range findings {
+                if finding.Kind != kind {
+                    continue
+                }
+                if !printed {
+                    fmt.Printf("%ss:\n", strings.ToUpper(kind[:1])+kind[1:])
+                    printed = true
+                }
+                fmt.Printf("  %s\n    fix: %s\n", finding.Detail, finding.Remedy)
+                if auditFix && confirm("    Apply?") {
+                    if err := FixDrift(finding); err != nil {
+                        logrus.Errorf("Error fixing %s/%s: %v", finding.Project, finding.Repo, err)
+                    } else {
+                        continue
+                    }
+                }
+                remaining++
+            }
+        }
+        if remaining > 0 {
+            fmt.Printf("%d finding(s) remain.\n", remaining)
+            os.Exit(1)
+        }
+    },
+}
+
+// Command to start a project and attach VS Code instead of nvim
+var vscodeCmd = &cobra.Command{
+    Use:   "vscode [project-dir-name] [repo-name]",
+    Short: "Start a project's environment and attach VS Code to it",
+    Long: `Start a project's environment and attach VS Code to it via the Dev Containers
+"Attach to Running Container" URI. The container is kept running after the CLI
+exits unless --keep=false is given. If the code CLI isn't installed, the URI
+to open manually is printed instead.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        if err := StartProject(args[0], args[1], startOptionsFromFlags(cmd)); err != nil {
+            fatalStart("Error starting project: %v", err)
+        }
+    },
+}
+
+// Parent command for managing a project's container
+var containerCmd = &cobra.Command{
+    Use:   "container",
+    Short: "Manage project containers",
+}
+
+// Command to list the containers this tool manages
+var containerListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "List containers created by dev-environment-manager",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        if containerListFormat != "table" && containerListFormat != "json" {
+            logrus.Fatalf("Unknown format %q (want table or json)", containerListFormat)
+        }
+        containers, err := ListManagedContainers(containerListAll)
+        if err != nil {
+            logrus.Fatalf("Error listing containers: %v", err)
+        }
+
+        if containerListFormat == "json" {
+            enc := json.NewEncoder(os.Stdout)
+            enc.SetIndent("", "  ")
+            if err := enc.Encode(containers); err != nil {
+                logrus.Fatalf("Error encoding containers: %v", err)
+            }
+            return
+        }
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "NAME\tPROJECT\tREPO\tIMAGE\tSTATUS\tUPTIME\tPORTS")
+        for _, c := range containers {
+            uptime := "-"
+            if c.Uptime > 0 {
+                uptime = c.Uptime.String()
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Name, c.ProjectDir, c.Repo, c.Image, c.Status, uptime, strings.Join(c.Ports, ", "))
+        }
+        w.Flush()
+    },
+}
+
+// Command to rename a project's container and update its container_name
+var containerRenameCmd = &cobra.Command{
+    Use:   "rename [project-dir-name] [repo-name] <new-name>",
+    Short: "Rename a project's container and save the new container_name",
+    Args:  cobra.ExactArgs(3),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectDirName := args[0]
+        repoName := args[1]
+        auditTarget(projectDirName, repoName)
+
+        if err := RenameContainer(projectDirName, repoName, args[2]); err != nil {
+            logrus.Fatalf("Error renaming container: %v", err)
+        }
+    },
+}
+
+// Command to pull the latest version of every configured image
+var updateImagesCmd = &cobra.Command{
+    Use:   "update-images",
+    Short: "Pull the images of all configured repositories in parallel",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        if err := UpdateImages(updateParallel, quietPull, updateRelock); err != nil {
+            logrus.Fatalf("Error updating images: %v", err)
+        }
+    },
+}
+
+// Command to report config changes live while the file is edited by hand
+var watchConfigCmd = &cobra.Command{
+    Use:   "watch-config",
+    Short: "Watch the config file and report project changes and validation problems on each save",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        if err := WatchConfig(ctx, viper.ConfigFileUsed(), os.Stdout); err != nil {
+            logrus.Fatalf("Error watching config: %v", err)
+        }
+    },
+}
+
+// Parent command for the on-disk caches
+var cacheCmd = &cobra.Command{
+    Use:   "cache",
+    Short: "Manage cached image inspections",
+}
+
+// Command to drop all cached image inspections
+var cacheClearCmd = &cobra.Command{
+    Use:   "clear",
+    Short: "Remove all cached image inspections",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        if !dryRun && !confirm("Remove all cached image inspections?") {
+            logrus.Fatal("Aborted.")
+        }
+        if err := ClearImageCache(); err != nil {
+            logrus.Fatalf("Error clearing cache: %v", err)
+        }
+        if !dryRun {
+            logrus.Info("Image cache cleared.")
+        }
+    },
+}
+
+// Parent command for inspecting the runtimes shipped in project images
+var versionsCmd = &cobra.Command{
+    Use:   "versions",
+    Short: "Inspect language runtime versions in project images",
+}
+
+// Command group for project templates
+var templateCmd = &cobra.Command{
+    Use:   "template",
+    Short: "Manage project templates",
+    Long: `Manage project templates, kept one directory each under
+~/.dev-env-manager/templates/. A registry is a YAML index at the
+template_registry_url global key:
+
+  templates:
+    - name: go-service
+      description: Go HTTP service with a Dockerfile
+      url: https://example.com/templates/go-service.tar.gz
+
+Fetches time out after template_registry_timeout (default 10s); the last
+fetched index is cached under ~/.dev-env-manager/template-cache/ and used
+when the registry can't be reached.`,
+}
+
+// Command to list installed or registry templates
+var templateListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "List installed templates, or those in the registry with --remote",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        if !templateRemote {
+            names, err := ListLocalTemplates()
+            if err != nil {
+                logrus.Fatalf("Error listing templates: %v", err)
+            }
+            if len(names) == 0 {
+                fmt.Println("No templates installed; see `template list --remote`.")
+            }
+            for _, name := range names {
+                fmt.Println(name)
+            }
+            return
+        }
+
+        templates, err := FetchTemplateIndex(context.Background())
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        installed, err := ListLocalTemplates()
+        if err != nil {
+            logrus.Fatalf("Error listing templates: %v", err)
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "NAME\tINSTALLED\tDESCRIPTION")
+        for _, t := range templates {
+            mark := "no"
+            for _, name := range installed {
+                if name == t.Name {
+                    mark = "yes"
+                }
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, mark, t.Description)
+        }
+        w.Flush()
+    },
+}
+
+// Command to install a template from the registry
+var templateInstallCmd = &cobra.Command{
+    Use:   "install <name>",
+    Short: "Download a template from the registry into the local templates directory",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        path, err := InstallTemplate(context.Background(), args[0])
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        logrus.Infof("Installed template %s to %s.", args[0], path)
+    },
+}
+
+// Command to pin a repository's image to a digest
+var pinProjectCmd = &cobra.Command{
+    Use:   "pin-project [project-dir-name] [repo-name]",
+    Short: "Pin a repository's docker_image to the digest its tag points to now",
+    Long: `Resolve the tag of a repository's docker_image to its current digest (from
+the registry, or the local image when the registry can't be reached) and
+write it back to the config as name:tag@sha256:..., so everyone starting the
+repository gets the same image. Docker ignores the tag once a digest is
+given; it is kept so running pin-project again moves the pin to the tag's
+newest image. --digest pins a known digest instead.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        pinned, err := PinProjectImage(args[0], args[1], pinDigest)
+        if err != nil {
+            logrus.Fatalf("Error pinning image: %v", err)
+        }
+        logrus.Infof("Pinned %s/%s to %s.", args[0], args[1], pinned)
+    },
+}
+
+// Command to lock repositories' images to the digests their tags point to now
+var lockCmd = &cobra.Command{
+    Use:   "lock [project-dir-name] [repo-name]",
+    Short: "Lock a repository's image to the digest its tag points to now",
+    Long: `Resolve the tag of a repository's docker_image to its current digest (from
+the registry, or the local image when the registry can't be reached) and store
+it as docker_image_digest. Later starts pull and run name:tag@digest, so a
+moved :latest doesn't change the environment, while output still shows the
+tag. status marks repositories whose tag has moved past the lock as outdated;
+update-images --relock moves the locks after pulling, and unlock removes one.
+--all locks every configured repository. Unlike pin-project, docker_image
+itself is left as written.`,
+    Args: func(cmd *cobra.Command, args []string) error {
+        if lockAll {
+            return cobra.NoArgs(cmd, args)
+        }
+        return cobra.ExactArgs(2)(cmd, args)
+    },
+    Run: func(cmd *cobra.Command, args []string) {
+        repos := []RepoEntry{}
+        if lockAll {
+            var err error
+            if repos, err = configuredRepos(false); err != nil {
+                logrus.Fatalf("Error listing projects: %v", err)
+            }
+        } else {
+            auditTarget(args[0], args[1])
+            repos = append(repos, RepoEntry{Project: args[0], Repo: args[1]})
+        }
+
+        failed := false
+        for _, repo := range repos {
+            locked, err := LockProjectImage(repo.Project, repo.Repo)
+            if err != nil {
+                logrus.Errorf("Error locking %s/%s: %v", repo.Project, repo.Repo, err)
+                failed = true
+                continue
+            }
+            logrus.Infof("Locked %s/%s to %s.", repo.Project, repo.Repo, locked)
+        }
+        if failed {
+            logrus.Fatal("Some images could not be locked.")
+        }
+    },
+}
+
+// Command to remove a repository's image lock
+var unlockCmd = &cobra.Command{
+    Use:   "unlock [project-dir-name] [repo-name]",
+    Short: "Remove a repository's image lock so start follows its tag again",
+    Args:  cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        if err := UnlockProjectImage(args[0], args[1]); err != nil {
+            logrus.Fatalf("Error unlocking image: %v", err)
+        }
+        logrus.Infof("Unlocked %s/%s.", args[0], args[1])
+    },
+}
+
+// Command to check the host's prerequisites
+var doctorCmd = &cobra.Command{
+    Use:   "doctor",
+    Short: "Check that docker, git and ssh are installed in supported versions",
+    Long: `Check that docker, git and ssh are installed in supported versions, and
+that the config's policy section, if any, is well-formed. Exits 1 when any
+check fails.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        failed := false
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "BINARY\tREQUIRED\tACTUAL\tSTATUS")
+        for _, prereq := range hostPrerequisites {
+            actual, ok, err := CheckBinaryVersion(prereq.Binary, prereq.MinVersion)
+            status := "ok"
+            switch {
+            case err != nil:
+                status = err.Error()
+                actual = "-"
+            case !ok:
+                status = fmt.Sprintf("too old (needed for %s)", prereq.Reason)
+            }
+            if status != "ok" {
+                failed = true
+            }
+            fmt.Fprintf(w, "%s\t>= %s\t%s\t%s\n", prereq.Binary, prereq.MinVersion, actual, status)
+        }
+        w.Flush()
+
+        if viper.IsSet("policy") {
+            errs := ValidatePolicy()
+            for _, err := range errs {
+                fmt.Printf("policy: %v\n", err)
+            }
+            if len(errs) > 0 {
+                failed = true
+            } else {
+                fmt.Println("policy: ok")
+            }
+        }
+        if failed {
+            os.Exit(1)
+        }
+    },
+}
+
+// Command to show a repository container's logs without looking up its ID
+var logTailCmd = &cobra.Command{
+    Use:   "log-tail [project-dir-name] [repo-name]",
+    Short: "Show or follow the logs of a repository's container",
+    Args:  cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        if err := TailContainerLogs(args[0], args[1], logFollow, logTail, logSince); err != nil {
+            logrus.Fatalf("Error tailing logs: %v", err)
+        }
+    },
+}
+
+// Command to shut a repository's environment down from another terminal
+var stopCmd = &cobra.Command{
+    Use:   "stop [project-dir-name] [repo-name]",
+    Short: "Stop and remove a repository's container",
+    Long: `Stop and remove a repository's container. The container is sent its
+stop_signal (default SIGTERM), so entrypoints and sidecars can trap it and
+flush their state, and is killed only if it is still running after its
+stop_grace_period (default 10s, e.g. stop_grace_period: 30s). Both keys can be
+set per repository or globally, and apply whenever the manager removes a
+container; a container started with start --stop-signal or --stop-timeout
+keeps those instead. --force kills it at once.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        if stopForce && !confirm(fmt.Sprintf("Kill %s/%s's container without waiting for it to stop?", args[0], args[1])) {
+            logrus.Fatal("Aborted.")
+        }
+        if err := StopProject(args[0], args[1], stopForce); err != nil {
+            logrus.Fatalf("Error stopping project: %v", err)
+        }
+    },
+}
+
+// Parent command for removing leftover Docker resources
+var pruneCmd = &cobra.Command{
+    Use:   "prune",
+    Short: "Remove Docker resources left behind by removed projects",
+}
+
+// Command to remove the named volumes of repositories that are no longer configured
+var pruneVolumesCmd = &cobra.Command{
+    Use:   "volumes",
+    Short: "Remove sync and state volumes whose repository is no longer configured",
+    Long: `Remove the dev-env-manager-src-* (sync mode) and dev-env-manager-state-*
+(init_commands state) volumes whose container belongs to no configured
+repository of any user. --project dir/repo removes that repository's volumes
+instead, e.g. to rerun its init_commands. The shared Go and npm cache volumes
+and volumes named in any repository's volumes key are kept, as are volumes
+still used by a container. A volume's repository comes from its labels;
+unlabelled volumes from older versions are matched by exact container name,
+with branch containers found by their labels.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        var project, repo string
+        if pruneProject != "" {
+            var err error
+            if project, repo, err = splitRepoRef(pruneProject); err != nil {
+                logrus.Fatal(err)
+            }
+            auditTarget(project, repo)
+        }
+        volumes, err := FindPrunableVolumes(project, repo)
+        if err != nil {
+            logrus.Fatalf("Error finding volumes: %v", err)
+        }
+        if len(volumes) == 0 {
+            fmt.Println("No volumes to remove.")
+            return
+        }
+
+        var reclaimed int64
+        failed := false
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "VOLUME\tCONTAINER\tSIZE")
+        for _, v := range volumes {
+            size := "-"
+            if v.Size >= 0 {
+                size = units.BytesSize(float64(v.Size))
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, v.Container, size)
+        }
+        w.Flush()
+        if !dryRun && !confirm(fmt.Sprintf("Remove these %d volumes?", len(volumes))) {
+            logrus.Fatal("Aborted.")
+        }
+        for _, v := range volumes {
+            if err := RemoveVolume(v.Name); err != nil {
+                logrus.Error(err)
+                failed = true
+                continue
+            }
+            if v.Size > 0 {
+                reclaimed += v.Size
+            }
+        }
+        verb := "Reclaimed"
+        if dryRun {
+            verb = "Would reclaim"
+        }
+        fmt.Printf("%s %s.\n", verb, units.BytesSize(float64(reclaimed)))
+        if failed {
+            os.Exit(1)
+        }
+    },
+}
+
+// Command to smoke-test the tool against a throwaway environment
+var selfTestCmd = &cobra.Command{
+    Use:   "self-test",
+    Short: "Check the tool works end to end against a throwaway environment",
+    Long: `Run a smoke test of the tool's flow after installing or upgrading: pull
+alpine:3, run a container with a temp directory bound, exec a command in it
+and check its output, remove the container, and clone a tiny public
+repository into the temp directory. Each step is reported with its time; a
+step whose prerequisite failed is skipped. Only its own temp directory and a
+dev-env-manager-selftest-* container are used, never the config, ~/Projects or
+existing containers, and both are removed afterwards. Exits 1 when a step
+fails.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+
+        failed := false
+        SelfTest(ctx, func(step SelfTestStep) {
+            switch {
+            case step.Skipped:
+                fmt.Printf("SKIP  %s\n", step.Name)
+            case step.Err != nil:
+                failed = true
+                fmt.Printf("FAIL  %s (%s): %v\n", step.Name, step.Duration.Round(time.Millisecond), step.Err)
+            default:
+                fmt.Printf("PASS  %s (%s)\n", step.Name, step.Duration.Round(time.Millisecond))
+            }
+        })
+        if failed {
+            logrus.Fatal("Self-test failed.")
+        }
+    },
+}
+
+// Command to replace the binary with the latest release
+var selfUpdateCmd = &cobra.Command{
+    Use:   "self-update",
+    Short: "Replace this binary with the latest release",
+    Long: `Download the latest release's binary for this OS and architecture, verify it
+against the release's checksums.txt and atomically replace the running
+binary. Binaries installed by a package manager (under /usr/bin, Homebrew,
+Nix or snap paths) are refused; update those with the package manager.
+
+Once a day other commands check for a newer release in the background and
+print a one-line hint after they finish (never for --json or other
+machine-read output). Set updates.check: false in the config to disable both
+the check and self-update.`,
+    Args: cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        installed, err := SelfUpdate(cmd.Context())
+        if err != nil {
+            logrus.Fatalf("Error updating: %v", err)
+        }
+        if installed == "" {
+            fmt.Printf("Already up to date (%s).\n", version)
+            return
+        }
+        fmt.Printf("Updated from %s to %s.\n", version, installed)
+    },
+}
+
+// Command to measure how long a repository's container takes to start
+var benchmarkCmd = &cobra.Command{
+    Use:   "benchmark [project-dir-name] [repo-name]",
+    Short: "Measure container startup latency of a repository's image over several runs",
+    Long: `Create and start a container from the repository's image --runs times, running
+echo ok instead of the editor, and report the min, max, mean and 95th
+percentile of the time from create to started. Each container is removed
+before the next run. The image is pulled once first, outside the timings,
+unless --skip-pull is given. Use it to compare base images or Docker hosts.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        result, err := BenchmarkStartup(args[0], args[1], benchmarkRuns, benchmarkSkipPull)
+        if err != nil {
+            logrus.Fatalf("Error benchmarking: %v", err)
+        }
+        round := func(d time.Duration) time.Duration { return d.Round(time.Millisecond) }
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "RUNS\tMIN\tMAX\tMEAN\tP95")
+        fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", len(result.Runs), round(result.Min), round(result.Max), round(result.Mean), round(result.P95))
+        w.Flush()
+    },
+}
+
+// Command to compare an image's runtimes with their latest releases
+var versionsCheckCmd = &cobra.Command{
+    Use:   "check [project-dir-name] [repo-name]",
+    Short: "Report whether the Go, Node.js and Python runtimes in a project's image are current",
+    Long: `Start a short-lived container from the project's image, probe the Go, Node.js
+and Python runtimes it ships and compare each with the release data published
+by endoflife.date. A runtime is current on the newest release, outdated when a
+newer release exists and EOL when its release line is no longer supported.
+Runtimes missing from the image are not listed.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        results, err := CheckRuntimeVersions(args[0], args[1])
+        if err != nil {
+            logrus.Fatalf("Error checking versions: %v", err)
+        }
+        if len(results) == 0 {
+            fmt.Println("No known runtimes found in the image.")
+            return
+        }
+
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "RUNTIME\tVERSION\tLATEST\tSTATUS")
+        for _, r := range results {
+            latest := r.Latest
+            if latest == "" {
+                latest = "-"
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Runtime, r.Version, latest, r.Status)
+        }
+        w.Flush()
+    },
+}
+
+// Command to prune stale git worktrees of project checkouts
+var cleanCmd = &cobra.Command{
+    Use:   "clean [project-dir-name] [repo-name]",
+    Short: "Prune worktrees whose directories were deleted, for one repository or all of them",
+    Args: func(cmd *cobra.Command, args []string) error {
+        if len(args) != 0 && len(args) != 2 {
+            return fmt.Errorf("accepts 0 or 2 arg(s), received %d", len(args))
+        }
+        return nil
+    },
+    Run: func(cmd *cobra.Command, args []string) {
+        var repos []RepoEntry
+        if len(args) == 2 {
+            auditTarget(args[0], args[1])
+            repos = []RepoEntry{{Project: args[0], Repo: args[1]}}
+        } else {
+            var err error
+            if repos, err = configuredRepos(false); err != nil {
+                logrus.Fatalf("Error listing projects: %v", err)
+            }
+        }
+
+        if len(repos) > 1 && !dryRun && !confirm(fmt.Sprintf("Prune the stale worktrees of %d repositories?", len(repos))) {
+            logrus.Fatal("Aborted.")
+        }
+
+        failed := false
+        for _, repo := range repos {
+            projectPath, err := repoCheckoutPath(repo.Project, repo.Repo)
+            if err != nil {
+                logrus.Fatalf("Error locating repository: %v", err)
+            }
+            if _, err := os.Stat(filepath.Join(projectPath, ".git")); err != nil {
+                continue // not cloned
+            }
+            if err := PruneWorktrees(projectPath); err != nil {
+                logrus.Error(err)
+                failed = true
+            }
+        }
+        if failed {
+            logrus.Fatal("Some worktrees could not be pruned.")
+        }
+    },
+}
+
+// splitRepoRef splits a "<project-dir>/<repo>" argument
+func splitRepoRef(ref string) (string, string, error) {
+    parts := strings.SplitN(ref, "/", 2)
+    if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+        return "", "", fmt.Errorf("expected <project-dir>/<repo>, got %q", ref)
+    }
+    return parts[0], parts[1], nil
+}
+
+// Command to export repository entries as a portable bundle
+var configExportCmd = &cobra.Command{
+    Use:   "export",
+    Short: "Write the repository entries as a portable YAML bundle for another machine",
+    Long: `Write the current user's repository entries (or one project's) as a YAML
+bundle that config import reads on another machine. Host paths under the home
+directory are written as $HOME/..., which is expanded on the importing
+machine; volumes with other absolute host sources, shell_rc outside the home
+directory and the host-specific cgroup_parent, cpu_set_cpus and cpu_set_mems
+are left out with a warning.`,
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        data, err := ExportConfig(exportProject)
+        if err != nil {
+            logrus.Fatalf("Error exporting config: %v", err)
+        }
+        if exportOutput == "" {
+            os.Stdout.Write(data)
+            return
+        }
+        if err := os.WriteFile(exportOutput, data, 0644); err != nil {
+            logrus.Fatalf("Error writing bundle: %v", err)
+        }
+        fmt.Fprintf(os.Stderr, "Exported %s.\n", exportOutput)
+    },
+}
+
+// Command to merge a config export bundle into the local config
+var configImportCmd = &cobra.Command{
+    Use:   "import <file>",
+    Short: "Merge a bundle written by config export into the local config",
+    Long: `Merge a bundle written by config export into the current user's entries.
+Repositories that are already configured are asked about one by one, or
+replaced with --overwrite, or kept with --skip-existing. The bundle is
+validated before anything is written; start clones the imported
+repositories on first use.`,
+    Args: cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        if importOverwrite && importSkipExisting {
+            logrus.Fatal("--overwrite and --skip-existing are mutually exclusive")
+        }
+        onConflict := ImportAsk
+        if importOverwrite {
+            onConflict = ImportOverwrite
+        } else if importSkipExisting {
+            onConflict = ImportSkip
+        }
+
+        data, err := os.ReadFile(args[0])
+        if err != nil {
+            logrus.Fatalf("Error reading bundle: %v", err)
+        }
+        imported, err := ImportConfig(data, onConflict)
+        if err != nil {
+            logrus.Fatalf("Error importing config: %v", err)
+        }
+        logrus.Infof("Imported %d repositories.", imported)
+    },
+}
+
+// Parent command for the workspaces section
+var workspaceCmd = &cobra.Command{
+    Use:   "workspace",
+    Short: "Start, stop and share the groups of repositories in the workspaces section",
+    Long: `Workspaces are named, ordered groups of repositories in the config's
+workspaces section; a member is project/repo, or a mapping with repo and an
+optional branch, which runs in its own worktree and container like start
+--branch, so one repository can be a member more than once:
+
+  workspaces:
+    payments:
+      - web/api
+      - repo: web/frontend
+        branch: next`,
+}
+
+// Command to start every member of a workspace
+var workspaceUpCmd = &cobra.Command{
+    Use:   "up <name>",
+    Short: "Start every member of a workspace and leave them running",
+    Long: `Start every member of a workspace on --parallel workers, like start but
+without attaching; attach to a member afterwards with attach. Members already
+running are left alone. A summary table follows; the exit status is 1 when
+any member failed, with the others left running unless --atomic is given,
+which stops the members this run started.
+
+The start flags apply to every member for this run; unlike start they are
+not saved for the repositories, and options that would ask for confirmation
+need --yes.`,
+    Args: cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        results, err := WorkspaceUp(ctx, args[0], workspaceParallel, workspaceAtomic, startOptionsFromFlags(cmd))
+        finishWorkspace(results, err)
+    },
+}
+
+// Command to stop every member of a workspace
+var workspaceDownCmd = &cobra.Command{
+    Use:   "down <name>",
+    Short: "Stop and remove the containers of every member of a workspace",
+    Long: `Stop and remove the containers of every member of a workspace on --parallel
+workers, giving each its stop_signal and stop_grace_period like stop. A
+summary table follows; the exit status is 1 when any member failed.`,
+    Args: cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        results, err := WorkspaceDown(ctx, args[0], workspaceParallel)
+        finishWorkspace(results, err)
+    },
+}
+
+// Command to show the combined state of a workspace
+var workspaceStatusCmd = &cobra.Command{
+    Use:   "status <name>",
+    Short: "Show the container state of every member of a workspace",
+    Long: `Show the container state of every member of a workspace, followed by the
+group's combined state: running when every member runs, stopped when none
+does, partial otherwise.`,
+    Args: cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        results, combined, err := WorkspaceStatus(args[0])
+        if err != nil {
+            logrus.Fatalf("Error reading workspace status: %v", err)
+        }
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "MEMBER\tCONTAINER\tSTATE")
+        for _, r := range results {
+            fmt.Fprintf(w, "%s\t%s\t%s\n", r.Member.Name(), r.Container, r.State)
+        }
+        w.Flush()
+        fmt.Printf("Workspace %s: %s\n", args[0], combined)
+    },
+}
+
+// finishWorkspace prints the summary table of workspace up or down and exits 1 if a member failed
+func finishWorkspace(results []WorkspaceResult, err error) {
+    if results == nil && err != nil {
+        logrus.Fatal(err)
+    }
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "MEMBER\tCONTAINER\tRESULT\tTIME\tERROR")
+    for _, r := range results {
+        container, msg := r.Container, "-"
+        if container == "" {
+            container = "-"
+        }
+        if r.Err != nil {
+            msg = strings.SplitN(r.Err.Error(), "\n", 2)[0]
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Member.Name(), container, r.State, r.Duration.Round(time.Millisecond), msg)
+    }
+    w.Flush()
+    if err != nil {
+        logrus.Fatal("Some workspace members failed.")
+    }
+}
+
+// Command to write a workspace and its repositories as a portable file
+var workspaceExportCmd = &cobra.Command{
+    Use:   "export <name>",
+    Short: "Write a workspace and its repositories' entries as a portable YAML file",
+    Long: `Write a workspace's definition and its members' repository entries, laid out
+like the config file under users.default, for teammates to load with
+workspace import. Images, repository URLs and named volumes are kept; bind
+mounts of host paths, shell_rc, env_file and the host-specific cgroup_parent,
+cpu_set_cpus and cpu_set_mems are left out with a warning.`,
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        data, err := ExportWorkspace(args[0])
+        if err != nil {
+            logrus.Fatalf("Error exporting workspace: %v", err)
+        }
+        if exportOutput == "" {
+            os.Stdout.Write(data)
+            return
+        }
+        if err := os.WriteFile(exportOutput, data, 0644); err != nil {
+            logrus.Fatalf("Error writing workspace file: %v", err)
+        }
+        fmt.Fprintf(os.Stderr, "Exported %s.\n", exportOutput)
+    },
+}
+
+// Command to merge a workspace file into the local config
+var workspaceImportCmd = &cobra.Command{
+    Use:   "import <file>",
+    Short: "Merge a file written by workspace export into the local config",
+    Long: `Merge a file written by workspace export: its repositories become the current
+user's, as with config import, and its workspaces are defined. Repositories
+and workspaces that already exist are asked about one by one, or replaced
+with --overwrite, or kept with --skip-existing. The file is validated before
+anything is written.`,
+    Args: cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        if importOverwrite && importSkipExisting {
+            logrus.Fatal("--overwrite and --skip-existing are mutually exclusive")
+        }
+        onConflict := ImportAsk
+        if importOverwrite {
+            onConflict = ImportOverwrite
+        } else if importSkipExisting {
+            onConflict = ImportSkip
+        }
+
+        data, err := os.ReadFile(args[0])
+        if err != nil {
+            logrus.Fatalf("Error reading workspace file: %v", err)
+        }
+        imported, err := ImportWorkspace(data, onConflict)
+        if err != nil {
+            logrus.Fatalf("Error importing workspace: %v", err)
+        }
+        logrus.Infof("Imported %d repositories.", imported)
+    },
+}
+
+// Command to diff the effective settings of two repositories
+var configProjectDiffCmd = &cobra.Command{
+    Use:   "project-diff <dir1>/<repo1> <dir2>/<repo2>",
+    Short: "Diff the effective settings of two repositories; exits non-zero if they differ",
+    Long: `Diff the effective settings of two repositories, as start would resolve them:
+global defaults are filled in and the overrides of the active profile (--profile
+or the profile key) are applied. Exits non-zero if they differ.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectA, repoA, err := splitRepoRef(args[0])
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        projectB, repoB, err := splitRepoRef(args[1])
+        if err != nil {
+            logrus.Fatal(err)
+        }
+
+        differ, err := DiffRepoSettings(os.Stdout, projectA, repoA, projectB, repoB)
+        if err != nil {
+            logrus.Fatalf("Error diffing config: %v", err)
+        }
+        if differ {
+            logrus.Fatalf("%s and %s differ", args[0], args[1])
+        }
+    },
+}
+
+// Command to push a project's files into its sync volume
+var syncCmd = &cobra.Command{
+    Use:   "sync [project-dir-name] [repo-name]",
+    Short: "Copy changed project files into the project's sync volume",
+    Long: `Copy a project into the named volume used instead of a bind mount when the
+repository sets sync: true (useful with remote Docker daemons). Only files
+whose size or modification time changed since the last sync are sent, and
+files deleted locally are removed from the volume.
+
+.git, node_modules, target and dist are never synced; add more patterns in
+gitignore syntax to a .devenvignore file at the project root.
+
+With --remote user@host:/path the checkout is mirrored to a directory on the
+remote Docker host with rsync -avz --delete instead, excluding .devenvignore
+patterns; --watch then re-syncs a second after files stop changing. start
+--remote does this before creating the container, binds the remote path, and
+syncs back after the container is removed (not when it is kept or detached).
+Syncing back copies changed files with the same exclusions but never deletes
+local files.`,
+    Args: cobra.ExactArgs(2),
+    Run: func(cmd *cobra.Command, args []string) {
+        projectDirName := args[0]
+        repoName := args[1]
+        _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+        if err != nil {
+            logrus.Fatalf("Error reading project config: %v", err)
+        }
+        projectPath, err := repoCheckoutPath(projectDirName, repoName)
+        if err != nil {
+            logrus.Fatalf("Error locating repository: %v", err)
+        }
+        auditTarget(projectDirName, repoName)
+
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        switch {
+        case syncRemote != "" && syncWatch:
+            err = WatchRemoteSync(ctx, projectPath, syncRemote)
+        case syncRemote != "":
+            if _, err = remoteSyncPath(syncRemote); err == nil {
+                err = RsyncProject(ctx, projectPath, syncRemote, false)
+            }
+        case syncWatch:
+            err = WatchSync(ctx, projectPath, containerName, volumeLabels(projectDirName, repoName, ""))
+        default:
+            err = SyncProject(ctx, projectPath, containerName, volumeLabels(projectDirName, repoName, ""))
+        }
+        if err != nil {
+            logrus.Fatalf("Error syncing project: %v", err)
+        }
+    },
+}
+
+// Command to rerun a command in the environment whenever project files change
+var watchCmd = &cobra.Command{
+    Use:   "watch [project-dir-name] [repo-name] -- <command> [args...]",
+    Short: "Run a command in a running environment each time project files change",
+    Long: `Watch a project's checkout and run the given command in its running container
+after each change, e.g.
+
+  dev-environment-manager watch myproj api -- go test ./...
+
+Changes are debounced, and paths matched by .git, node_modules, target, dist
+or the project's .devenvignore are ignored. Ctrl-C stops watching and leaves
+the container running.`,
+    Args: func(cmd *cobra.Command, args []string) error {
+        if cmd.ArgsLenAtDash() != 2 || len(args) < 3 {
+            return fmt.Errorf("usage: watch <project-dir-name> <repo-name> -- <command> [args...]")
+        }
+        return nil
+    },
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        if err := WatchAndRun(ctx, args[0], args[1], args[2:], watchInitialRun); err != nil {
+            logrus.Fatalf("Error watching project: %v", err)
+        }
+    },
+}
+
+// Parent command for recurring actions
+var scheduleCmd = &cobra.Command{
+    Use:   "schedule",
+    Short: "Run pulls, image updates or commands on a cron schedule",
+}
+
+// Command to add a recurring action
+var scheduleAddCmd = &cobra.Command{
+    Use:   "add [project-dir-name] [repo-name] <cron-expr> <command> [args...]",
+    Short: "Schedule pull, update-image or run-in -- <cmd> for a repository",
+    Long: `Schedule a recurring action for a repository using a standard five-field cron
+expression. Commands:
+
+  pull                 fast-forward the checkout from origin
+  update-image         pull the repository's image
+  run-in -- CMD ARGS   run a command in the running environment container
+
+Example:
+
+  dev-environment-manager schedule add myproj api "0 3 * * *" run-in -- go test ./...
+
+Entries only run while ` + "`schedule daemon`" + ` is running.`,
+    Args: cobra.MinimumNArgs(4),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        entry, err := AddSchedule(args[0], args[1], args[2], args[3:])
+        if err != nil {
+            logrus.Fatalf("Error adding schedule entry: %v", err)
+        }
+        fmt.Println(entry.ID)
+    },
+}
+
+// Command to list recurring actions
+var scheduleListCmd = &cobra.Command{
+    Use:   "list",
+    Short: "List scheduled actions and when they fire next",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        entries, err := ReadSchedule()
+        if err != nil {
+            logrus.Fatalf("Error reading schedule: %v", err)
+        }
+
+        now := time.Now()
+        w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "ID\tPROJECT\tREPO\tCRON\tCOMMAND\tNEXT")
+        for _, entry := range entries {
+            next := "-"
+            if t, err := NextScheduleRun(entry, now); err == nil {
+                next = t.Format("2006-01-02 15:04")
+            }
+            fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", entry.ID, entry.Project, entry.Repo, entry.Cron, strings.Join(entry.Command, " "), next)
+        }
+        w.Flush()
+    },
+}
+
+// Command to delete a recurring action
+var scheduleRemoveCmd = &cobra.Command{
+    Use:   "remove <id>",
+    Short: "Remove a scheduled action",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        if !dryRun && !confirm(fmt.Sprintf("Remove schedule entry %s?", args[0])) {
+            logrus.Fatal("Aborted.")
+        }
+        if err := RemoveSchedule(args[0]); err != nil {
+            logrus.Fatalf("Error removing schedule entry: %v", err)
+        }
+    },
+}
+
+// Command to run scheduled actions in the foreground
+var scheduleDaemonCmd = &cobra.Command{
+    Use:   "daemon",
+    Short: "Run scheduled actions at their times until interrupted",
+    Args:  cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        defer stop()
+        if err := RunScheduleDaemon(ctx); err != nil {
+            logrus.Fatalf("Error running schedule: %v", err)
+        }
+    },
+}
+
+// Command to archive a finished repository with its full history
+var archiveCmd = &cobra.Command{
+    Use:   "archive [project-dir-name] [repo-name] [out.tar.gz]",
+    Short: "Write a tar.gz of a repository's checkout, a git bundle of its history and its config",
+    Long: `Write a self-contained tar.gz of a repository: the checkout under <repo>/,
+bundle.git created with git bundle create --all, and unless --no-metadata the
+repository's config entry as dev-env-metadata.yaml. Restore it with
+import-archive, which needs the metadata.
+
+The checkout is archived as it is on disk, uncommitted changes included, which
+makes the archive a safety snapshot before removing a repository.
+--include-git=false leaves .git out (import-archive restores the history from
+the bundle) and --exclude drops paths such as build output. --container also
+exports the container's filesystem, like docker export, next to the archive.`,
+    Args:              cobra.RangeArgs(2, 3),
+    ValidArgsFunction: completeProjectRepo(false),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        output := archiveOutput
+        if len(args) == 3 {
+            output = args[2]
+        }
+        opts := ArchiveOptions{
+            Output:     output,
+            Metadata:   !archiveNoMetadata,
+            IncludeGit: archiveIncludeGit,
+            Exclude:    archiveExclude,
+            Container:  archiveContainer,
+        }
+        if err := ArchiveProject(args[0], args[1], opts); err != nil {
+            logrus.Fatalf("Error archiving project: %v", err)
+        }
+    },
+}
+
+// Command to restore an archived repository
+var importArchiveCmd = &cobra.Command{
+    Use:   "import-archive <file>",
+    Short: "Restore a repository written by archive into ~/Projects and the config",
+    Args:  cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        if err := ImportArchive(args[0]); err != nil {
+            logrus.Fatalf("Error importing archive: %v", err)
+        }
+    },
+}
+
+// Command to register a repository with the settings of an existing one
+var copyProjectCmd = &cobra.Command{
+    Use:   "copy-project [src-project] [src-repo] [dst-project] [dst-repo]",
+    Short: "Add a repository by copying another repository's config entry",
+    Args:  cobra.ExactArgs(4),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[2], args[3])
+        if err := CopyProjectConfig(args[0], args[1], args[2], args[3], copyRepoURL); err != nil {
+            logrus.Fatalf("Error copying project: %v", err)
+        }
+    },
+}
+
+// Command to reattach to an environment left running by detaching
+var attachCmd = &cobra.Command{
+    Use:   "attach [project-dir-name] [repo-name]",
+    Short: "Start a new editor session in a running environment",
+    Long: `Start a new editor session in a repository's running environment, such as
+one left behind by detaching with the detach keys (ctrl-p,ctrl-q unless
+--detach-keys or the detach_keys key say otherwise). The editor that was
+detached from keeps running in the container. When the session ends the
+container is removed unless --keep is given or the session is detached again.`,
+    Args:              cobra.ExactArgs(2),
+    ValidArgsFunction: completeProjectRepo(true),
+    Run: func(cmd *cobra.Command, args []string) {
+        auditTarget(args[0], args[1])
+        if err := AttachProject(args[0], args[1], startOptionsFromFlags(cmd)); err != nil {
+            logrus.Fatalf("Error attaching: %v", err)
+        }
+    },
+}
+
+// Command to print a repository's env config for sourcing into the host shell
+var exportEnvCmd = &cobra.Command{
+    Use:   "export-env [project-dir] [repo]",
+    Short: "Print a repository's env config as export lines for the host shell",
+    Long: `Print the env entries of a repository as shell export lines, for use as
+
+    eval "$(dev-environment-manager export-env myproject api)"
+
+Entries whose keys contain TOKEN, SECRET, KEY or PASSWORD are left out, with
+a comment in their place, unless --reveal is passed.`,
+    Annotations:       map[string]string{annotationQuiet: "true"},
+    Args:              cobra.ExactArgs(2),
+    ValidArgsFunction: completeProjectRepo(false),
+    Run: func(cmd *cobra.Command, args []string) {
+        lines, err := ExportEnv(args[0], args[1], exportEnvReveal)
+        if err != nil {
+            logrus.Fatalf("Error exporting env: %v", err)
+        }
+        for _, line := range lines {
+            fmt.Println(line)
+        }
+    },
+}
+
+// Command to show the environment of the current directory, for shell prompts
+var envCmd = &cobra.Command{
+    Use:   "env",
+    Short: "Show the environment for the current directory and whether its container is running",
+    Long: `Show the configured environment containing the current directory (or --path).
+With --porcelain, print PROJECT, REPO, CONTAINER, STATE and IMAGE as KEY=value
+lines in that order. Outside a known project nothing is printed and the exit
+status is 1. STATE is the container status, absent when there is no container,
+or unknown when Docker didn't answer within the prompt time budget.`,
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.NoArgs,
+    Run: func(cmd *cobra.Command, args []string) {
+        dir := envPath
+        if dir == "" {
+            var err error
+            if dir, err = os.Getwd(); err != nil {
+                os.Exit(1)
+            }
+        }
+        env, err := ResolvePromptEnv(dir)
+        if err != nil {
+            if !envPorcelain {
+                fmt.Fprintln(os.Stderr, err)
+            }
+            os.Exit(1)
+        }
+
+        if envPorcelain {
+            fmt.Printf("PROJECT=%s\nREPO=%s\nCONTAINER=%s\nSTATE=%s\nIMAGE=%s\n", env.Project, env.Repo, env.Container, env.State, env.Image)
+            return
+        }
+        fmt.Printf("%s/%s  container %s (%s)  image %s\n", env.Project, env.Repo, env.Container, env.State, env.Image)
+    },
+}
+
+// Command to install the completion script where the shell finds it
+var completionInstallCmd = &cobra.Command{
+    Use:       "install bash|zsh|fish",
+    Short:     "Install the completion script for a shell and load it from the shell's rc file",
+    Args:      cobra.ExactValidArgs(1),
+    ValidArgs: []string{"bash", "zsh", "fish"},
+    Run: func(cmd *cobra.Command, args []string) {
+        var script bytes.Buffer
+        var err error
+        switch args[0] {
+        case "bash":
+            err = rootCmd.GenBashCompletionV2(&script, true)
+        case "zsh":
+            err = rootCmd.GenZshCompletion(&script)
+        case "fish":
+            err = rootCmd.GenFishCompletion(&script, true)
+        }
+        if err != nil {
+            logrus.Fatalf("Error generating completion script: %v", err)
+        }
+
+        path, err := InstallCompletion(args[0], rootCmd.Name(), script.Bytes())
+        if err != nil {
+            logrus.Fatalf("Error installing completion: %v", err)
+        }
+        fmt.Printf("Installed %s completion to %s. Restart your shell (or run `exec %s`) to use it.\n", args[0], path, args[0])
+    },
+}
+
+// Command to print the shell integration snippet for an rc file
+var shellInitCmd = &cobra.Command{
+    Use:   "shell-init bash|zsh|fish",
+    Short: "Print the shell integration snippet: the dem alias, completion and DEV_ENV_MANAGER_HOME",
+    Long: `Print a snippet that sets up the shell for the tool: a dem alias, completion
+for both names and DEV_ENV_MANAGER_HOME (default ~/.dev-env-manager), the
+directory of the tool's generated files. Add it to the shell's rc file with
+
+  eval "$(dev-environment-manager shell-init bash)"       # ~/.bashrc
+  eval "$(dev-environment-manager shell-init zsh)"        # ~/.zshrc
+  dev-environment-manager shell-init fish | source        # config.fish
+
+Evaluating it more than once, e.g. when the rc file is sourced again, is
+harmless.`,
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.ExactValidArgs(1),
+    ValidArgs:   []string{"bash", "zsh", "fish"},
+    Run: func(cmd *cobra.Command, args []string) {
+        script, err := ShellInitScript(args[0], rootCmd.Name())
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        fmt.Print(script)
+    },
+}
+
+// Command to print a shell snippet showing the environment in the prompt
+var promptInitCmd = &cobra.Command{
+    Use:         "prompt-init zsh|bash|fish",
+    Short:       "Print a shell snippet that shows the current environment in the prompt",
+    Annotations: map[string]string{annotationQuiet: "true"},
+    Args:        cobra.ExactArgs(1),
+    Run: func(cmd *cobra.Command, args []string) {
+        script, err := PromptInitScript(args[0], rootCmd.Name())
+        if err != nil {
+            logrus.Fatal(err)
+        }
+        fmt.Print(script)
+    },
+}
+
+// completeLocalImages completes an image flag with the tags of local images
+func completeLocalImages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+    return LocalImageRefs(toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeProjectRepo completes a project directory for the first argument and one of its repos
+// for the second. With withContainers it merges in managed containers, annotated with their state;
+// if Docker doesn't answer quickly the completion is config-only.
+func completeProjectRepo(withContainers bool) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+    return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+        if len(args) > 1 {
+            return nil, cobra.ShellCompDirectiveNoFileComp
+        }
+        // Completion initializes before the command's flags are parsed, so --config arrives late
+        if cfgFile != "" && viper.ConfigFileUsed() != cfgFile {
+            viper.SetConfigFile(cfgFile)
+            viper.ReadInConfig()
+        }
+        candidates, err := CompletionCandidates(withContainers)
+        if err != nil {
+            return nil, cobra.ShellCompDirectiveNoFileComp
+        }
+
+        var completions []string
+        if len(args) == 0 {
+            for _, project := range candidates.Projects() {
+                completions = append(completions, project)
+            }
+        } else {
+            for _, repo := range candidates.Repos(args[0]) {
+                if desc := candidates.Describe(args[0], repo); desc != "" {
+                    repo += "\t" + desc
+                }
+                completions = append(completions, repo)
+            }
+        }
+        return completions, cobra.ShellCompDirectiveNoFileComp
+    }
+}
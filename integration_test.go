@@ -0,0 +1,98 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+    "context"
+    "io"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/client"
+)
+
+// TestSelfTest runs the self-test against the real Docker daemon and network:
+//
+//	go test -tags=integration -run SelfTest .
+func TestSelfTest(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+    defer cancel()
+
+    steps := SelfTest(ctx, func(step SelfTestStep) {
+        t.Logf("%s (%s)", step.Name, step.Duration.Round(time.Millisecond))
+    })
+    if len(steps) == 0 {
+        t.Fatal("SelfTest ran no steps")
+    }
+    for _, step := range steps {
+        switch {
+        case step.Err != nil:
+            t.Errorf("%s: %v", step.Name, step.Err)
+        case step.Skipped:
+            t.Errorf("%s: skipped", step.Name)
+        }
+    }
+    if last := steps[len(steps)-1]; last.Name != "clean up" {
+        t.Errorf("SelfTest stopped after %q", last.Name)
+    }
+}
+
+// TestSingleEditorProcess checks that an environment's container runs only the idle loop, so the
+// exec that attaches is the one editor process. sleep 300 stands in for the editor.
+func TestSingleEditorProcess(t *testing.T) {
+    ctx := context.Background()
+    if err := PullImage(ctx, selfTestImage, io.Discard); err != nil {
+        t.Fatal(err)
+    }
+    containerID, err := RunContainer(ContainerSpec{
+        Image:       selfTestImage,
+        Name:        "dev-env-manager-editor-test",
+        Cmd:         idleCommand(defaultStopSignal),
+        StopSignal:  defaultStopSignal,
+        StopTimeout: time.Second,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer removeContainer(containerID, true)
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        t.Fatal(err)
+    }
+    editors := func() int {
+        top, err := cli.ContainerTop(ctx, containerID, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        column := len(top.Titles) - 1
+        count := 0
+        for _, process := range top.Processes {
+            if strings.Contains(process[column], "sleep 300") {
+                count++
+            }
+        }
+        return count
+    }
+    if n := editors(); n != 0 {
+        t.Fatalf("%d editor processes before attaching, want 0", n)
+    }
+
+    exec, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{Cmd: []string{"sleep", "300"}, Tty: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := cli.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true, Tty: true}); err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(10 * time.Second)
+    for editors() == 0 && time.Now().Before(deadline) {
+        time.Sleep(100 * time.Millisecond)
+    }
+    if n := editors(); n != 1 {
+        t.Errorf("%d editor processes after attaching, want 1", n)
+    }
+}
@@ -14,6 +14,20 @@ func main() {
     logrus.SetOutput(os.Stdout)
     logrus.SetLevel(logrus.InfoLevel)
 
+    // Commands whose output is parsed by other programs only log warnings, to stderr; JSON
+    // output keeps the usual logging, on stderr so stdout holds only the JSON
+    if quietInvocation() {
+        logrus.SetOutput(os.Stderr)
+        logrus.SetLevel(logrus.WarnLevel)
+    } else if jsonOutputRequested() {
+        logrus.SetOutput(os.Stderr)
+    }
+
+    // Scripts reading JSON output get a failure as a JSON error object on stdout instead
+    if jsonOutputRequested() {
+        logrus.SetFormatter(jsonErrorFormatter{base: logrus.StandardLogger().Formatter, out: os.Stdout})
+    }
+
     logrus.Info("Starting Development Environment Manager...")
     Execute() // Executes the root command defined in cmd.go
 }
\ No newline at end of file
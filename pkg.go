@@ -3,255 +3,9928 @@
 package main
 
 import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "compress/gzip"
     "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    htmltemplate "html/template"
     "io"
+    "net"
+    "net/http"
     "os"
+    "os/exec"
+    "os/signal"
+    "path"
     "path/filepath"
+    "reflect"
+    "regexp"
+    "runtime"
+    "sort"
+    "strconv"
     "strings"
-    "os/exec"
+    "sync"
+    "syscall"
+    texttemplate "text/template"
+    "time"
 
     "github.com/docker/docker/api/types"
     "github.com/docker/docker/api/types/container"
+    "github.com/docker/docker/api/types/filters"
+    "github.com/docker/docker/api/types/mount"
+    "github.com/docker/docker/api/types/network"
     "github.com/docker/docker/client"
+    "github.com/docker/docker/errdefs"
+    "github.com/docker/docker/pkg/stdcopy"
+    units "github.com/docker/go-units"
+    "github.com/fsnotify/fsnotify"
     git "github.com/go-git/go-git/v5"
+    gitconfig "github.com/go-git/go-git/v5/config"
+    "github.com/go-git/go-git/v5/plumbing"
+    "github.com/go-git/go-git/v5/plumbing/format/gitignore"
+    "github.com/go-git/go-git/v5/plumbing/object"
+    "github.com/go-git/go-git/v5/plumbing/transport"
+    "github.com/robfig/cron/v3"
+    "github.com/sergi/go-diff/diffmatchpatch"
     "github.com/sirupsen/logrus"
     "github.com/spf13/viper"
+    "golang.org/x/mod/semver"
+    "gopkg.in/yaml.v3"
     "os/user"
 )
 
-// StartProject initiates the development environment for a specified project
-func StartProject(projectDirName, repoName string) error {
-    homeDir, err := os.UserHomeDir()
-    if err != nil {
-        return fmt.Errorf("error getting home directory: %v", err)
+// Label keys applied to every container created by the tool
+const (
+    labelProject  = "dev-env-manager.project"
+    labelRepo     = "dev-env-manager.repo"
+    labelHostname = "dev-env-manager.hostname"
+    labelBranch   = "dev-env-manager.branch"
+    labelManaged  = "dev-env-manager.managed"
+)
+
+// Path of the prompt snippet inside the container
+const promptSnippetTarget = "/etc/profile.d/dev-env-name.sh"
+
+// Where a project's shell rc file is mounted inside the container
+const shellRCTarget = "/etc/profile.d/dev-env-shell-rc.sh"
+
+// Name of the shell rc file looked up in the project directory when shell_rc isn't set
+const defaultShellRCName = ".dev-env-rc"
+
+// Where a repository's editor session directory is mounted inside the container
+const sessionTarget = "/var/lib/dev-env-session"
+
+// Plugins that save and restore sessions themselves; session_restore stays out of their way
+var sessionPlugins = []string{"auto-session", "persistence.nvim", "possession.nvim", "vim-obsession"}
+
+// Mount point of the per-container state volume and the first-run marker inside it
+const (
+    stateVolumeTarget = "/var/lib/dev-env-manager"
+    initMarkerPath    = stateVolumeTarget + "/initialized"
+)
+
+// idleCommand keeps the container's PID 1 alive without a terminal, exiting cleanly on TERM, INT
+// and the container's stop signal; the interactive editor is the single process started later
+// through docker exec
+func idleCommand(stopSignal string) []string {
+    traps := "TERM INT"
+    if name := signalName(stopSignal); name != "TERM" && name != "INT" && name != "KILL" {
+        traps += " " + name
     }
+    return []string{"sh", "-c", fmt.Sprintf("trap 'exit 0' %s; while :; do sleep 3600 & wait $!; done", traps)}
+}
 
-    // Derive project values using Registry pattern
-    repoURL, dockerImage, containerName := deriveProjectValues(projectDirName, repoName)
+// Stop signals the idle loop can trap; KILL needs no trap
+var idleStopSignals = map[string]bool{"TERM": true, "INT": true, "HUP": true, "QUIT": true, "USR1": true, "USR2": true, "KILL": true}
 
-    projectPath := filepath.Join(homeDir, "Projects", projectDirName, repoName)
-    if _, err := os.Stat(projectPath); os.IsNotExist(err) {
-        err := CloneRepo(repoURL, projectPath)
-        if err != nil {
-            return fmt.Errorf("error cloning repository: %v", err)
-        }
-    } else {
-        logrus.Infof("Project directory %s already exists. Skipping clone.", projectPath)
+// signalName normalizes a signal such as SIGTERM or term to TERM
+func signalName(signal string) string {
+    return strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+}
+
+// checkStopSignal rejects stop signals the idle loop can't trap, which would leave the container
+// to be killed at the end of every grace period
+func checkStopSignal(signal string) error {
+    if !idleStopSignals[signalName(signal)] {
+        return fmt.Errorf("unsupported stop signal %q: use TERM, INT, HUP, QUIT, USR1, USR2 or KILL", signal)
     }
+    return nil
+}
 
-    // Automatically detect and set volume bindings
-    binds := getVolumeBindings(homeDir, projectPath)
+// wholeSeconds rounds a duration up to whole seconds, the unit of Docker's stop timeout, so a
+// sub-second grace period doesn't become no grace at all
+func wholeSeconds(d time.Duration) int {
+    return int((d + time.Second - 1) / time.Second)
+}
 
-    // Environment variables
-    env := []string{"HOME=/home/cdaprod"}
+// noImageCache bypasses the on-disk image inspect cache (--no-cache)
+var noImageCache bool
 
-    // Command to run Neovim
-    cmdArgs := []string{"nvim"}
+// userOverride replaces the detected username in config keys (--user)
+var userOverride string
 
-    // Run Docker container with combined binds
-    containerID, err := RunContainer(dockerImage, containerName, binds, cmdArgs, env)
-    if err != nil {
-        return fmt.Errorf("error running container: %v", err)
+// profileOverride selects the profile whose overrides apply to repository settings (--profile)
+var profileOverride string
+
+// sharedUser is the pseudo-user whose projects every user sees, under their own entries
+const sharedUser = "shared"
+
+// dryRun makes destructive helpers print what they would remove or change instead (--dry-run)
+var dryRun bool
+
+// skipForDryRun reports whether a destructive step should be skipped, printing it as what would happen
+func skipForDryRun(format string, args ...interface{}) bool {
+    if !dryRun {
+        return false
     }
+    fmt.Printf("Would "+format+"\n", args...)
+    return true
+}
 
-    // Attach to the container
-    err = AttachToContainer(containerID)
-    if err != nil {
-        return fmt.Errorf("error attaching to container: %v", err)
+// Image label naming the command an image wants to be developed with
+const labelDevCmd = "com.cdaprod.dev-cmd"
+
+// How long a cached image inspection is trusted
+const imageCacheTTL = 10 * time.Minute
+
+// configReadOnly disables every write to the config file (--config-readonly / DEM_CONFIG_READONLY)
+var configReadOnly bool
+
+// errConfigReadOnly is returned by operations whose purpose is to change the config
+var errConfigReadOnly = errors.New("config is read-only (--config-readonly or DEM_CONFIG_READONLY is set)")
+
+var (
+    errDaemonUnreachable   = errors.New("Docker daemon is not reachable")
+    errContainerConflict   = errors.New("container name is already in use")
+    errContainerNotRunning = errors.New("container is not running")
+    errPolicyViolation     = errors.New("policy violation")
+)
+
+// errorCodes maps the sentinel errors to the stable codes of JSON error output:
+//
+//	config_read_only       the config may not be written (--config-readonly)
+//	daemon_unreachable     the Docker daemon can't be reached
+//	container_conflict     a container with the environment's name already exists
+//	container_not_running  the command needs the environment's container to be running
+//	policy_violation       the image breaks a rule of the policy section
+//
+// Any other failure is reported with the code error.
+var errorCodes = []struct {
+    err  error
+    code string
+}{
+    {errConfigReadOnly, "config_read_only"},
+    {errDaemonUnreachable, "daemon_unreachable"},
+    {errContainerConflict, "container_conflict"},
+    {errContainerNotRunning, "container_not_running"},
+    {errPolicyViolation, "policy_violation"},
+}
+
+// errorCode returns the JSON error code of a failure message. Commands report errors formatted
+// into log lines, so the sentinel is recognized by its text, which %w and %v both carry.
+func errorCode(message string) string {
+    for _, known := range errorCodes {
+        if strings.Contains(message, known.err.Error()) {
+            return known.code
+        }
     }
+    return "error"
+}
 
-    // Cleanup after exit
-    err = RemoveContainer(containerID)
+// jsonError is the object a --json invocation prints on stdout when it fails
+type jsonError struct {
+    Error struct {
+        Code    string                 `json:"code"`
+        Message string                 `json:"message"`
+        Details map[string]interface{} `json:"details,omitempty"`
+    } `json:"error"`
+}
+
+// jsonErrorFormatter reports the fatal error of a --json invocation as a jsonError on out, in
+// place of the human log line; other entries keep the base formatter
+type jsonErrorFormatter struct {
+    base logrus.Formatter
+    out  io.Writer
+}
+
+func (f jsonErrorFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+    if entry.Level != logrus.FatalLevel {
+        return f.base.Format(entry)
+    }
+    var report jsonError
+    report.Error.Code = errorCode(entry.Message)
+    report.Error.Message = entry.Message
+    if len(entry.Data) > 0 {
+        report.Error.Details = map[string]interface{}{}
+        for key, value := range entry.Data {
+            if err, ok := value.(error); ok {
+                value = err.Error()
+            }
+            report.Error.Details[key] = value
+        }
+    }
+    data, err := json.Marshal(report)
     if err != nil {
-        return fmt.Errorf("error removing container: %v", err)
+        return nil, err
     }
+    fmt.Fprintln(f.out, string(data))
+    return nil, nil
+}
 
-    return nil
+// StartOptions carries per-invocation settings from the start command flags
+type StartOptions struct {
+    PromptHint        bool
+    Memory            string
+    MemorySwap        string
+    MemorySwappiness  int64 // -1 leaves the configured value untouched
+    CgroupParent      string
+    CpusetCpus        string // CPUs the container may run on, e.g. 0-3,8
+    CpusetMems        string // NUMA memory nodes the container may allocate from
+    NoSharedCache     bool
+    GPUs              string
+    GPUMemoryFraction float64  // 0 leaves the configured value untouched
+    Keep              bool     // leave the container running after the session ends
+    VSCode            bool     // attach VS Code instead of a terminal nvim session
+    Sandbox           bool     // read-only project, no network, no capabilities, read-only rootfs
+    QuietPull         bool     // discard the image pull progress stream, keeping log lines
+    NoVerifyBinds     bool     // skip checking that configured bind sources exist on the daemon host
+    Branch            string   // run in a git worktree of this branch instead of the base clone
+    NetworkDisabled   bool     // create the container without networking; implies SkipPull
+    SkipPull          bool     // use the local image instead of pulling it
+    Cmd               []string // run this instead of the editor
+    Editor            string   // editor to run, overriding the editor key and image label
+    LogDriver         string   // Docker logging driver
+    LogOpts           []string // key=value logging driver options
+    Entrypoint        []string // nil keeps the configured or image entrypoint; [""] clears it
+    DetachKeys        string   // key sequence that detaches from the editor, in docker's --detach-keys syntax
+    MountConsistency  string   // consistency mode of the project bind: consistent, cached or delegated
+    OOMKillDisable    bool     // keep the kernel OOM killer away from the container; needs a memory limit
+    Yes               bool     // confirm risky options without asking
+    Force             bool     // attach even if the image lacks the editor or git
+    DNS               []string // DNS servers
+    DNSSearch         []string // DNS search domains
+    DNSOptions        []string // resolv.conf options
+    Remote            string   // user@host:/path the project is rsynced to for a remote Docker daemon
+    NoEnvFile         bool     // don't write the env config to the env_file path in the container
+    DebugShell        string   // shell used as entrypoint and attached instead of the editor
+    IpcMode           string   // IPC namespace: none, private, shareable, host or container:<name>
+    StopSignal        string   // signal asking the container to exit, overriding the stop_signal key
+    Offline           bool     // work from the local image and checkout only; implies SkipPull
+    Subpath           string   // directory inside the repository to work in, e.g. services/api
+    Network           string   // network to join, overriding the network_mode key
+    OverridePolicy    bool     // start even if the image breaks the policy section, logging it
+    SkipModuleVerify  bool     // don't run go mod verify on a fresh clone of a Go module
+    Timezone          string   // TZ for the container, overriding the timezone key and the host's zone
+    NoTimezone        bool     // leave the container in the image's timezone
+    ExtraEnv          []string // KEY=value entries for this session only, overriding the env config
+    NetworkAliases    []string // names the container is reachable by on its named network
+    Detached          bool     // set up the container and leave it running without attaching
+    NoSave            bool     // apply flag values for this run only instead of saving them for the repository
+    NonInteractive    bool     // never prompt; risky options need Yes
+
+    StopTimeout  time.Duration // grace period after StopSignal, overriding the stop_grace_period key
+    CloneTimeout time.Duration // give up on a clone that takes longer; 0 waits indefinitely
 }
 
-// getVolumeBindings dynamically generates volume bindings
-func getVolumeBindings(homeDir, projectPath string) []string {
-    // Default binds for config files
-    binds := []string{
-        fmt.Sprintf("%s/.config/nvim:/root/.config/nvim", homeDir),
-        fmt.Sprintf("%s/.vim:/root/.vim", homeDir),
-        fmt.Sprintf("%s/.vimrc:/root/.vimrc", homeDir),
-        fmt.Sprintf("%s:/usr/src/app", projectPath),
-    }
-    return binds
+// ContainerSpec describes the container RunContainer creates
+type ContainerSpec struct {
+    Image    string
+    Name     string
+    Hostname string
+    Binds    []string
+    Mounts   []mount.Mount
+    Cmd      []string
+    Env      []string
+    Labels   map[string]string
+
+    // Entrypoint replaces the image's; nil keeps it and [""] clears it
+    Entrypoint []string
+    WorkingDir string
+
+    // OneShot marks a Cmd that exits on its own, so the container isn't expected to keep running
+    OneShot bool
+
+    // StopSignal and StopTimeout make docker stop ask the container to exit like removal does
+    StopSignal  string
+    StopTimeout time.Duration
+
+    Resources container.Resources
+    LogConfig container.LogConfig
+
+    DNS        []string
+    DNSSearch  []string
+    DNSOptions []string
+
+    NetworkMode     string
+    NetworkAliases  []string
+    NetworkDisabled bool
+    IpcMode         string
+    CapAdd          []string
+    CapDrop         []string
+    ReadonlyRootfs  bool
+    Tmpfs           map[string]string
 }
 
-// AddProjectConfig dynamically adds a new project configuration to the config file
-func AddProjectConfig(projectDirName, repoName, repoURL, dockerImage, containerName string) error {
-    username, err := getUsername()
+// StartProject initiates the development environment for a specified project
+func StartProject(projectDirName, repoName string, opts StartOptions) error {
+    // Derive project values using Registry pattern
+    repoURL, dockerImage, containerName, err := deriveProjectValues(projectDirName, repoName)
     if err != nil {
-        return fmt.Errorf("error getting username: %v", err)
+        return fmt.Errorf("error reading project config: %v", err)
+    }
+    dockerImage = lockedImage(projectDirName, repoName, dockerImage)
+    auditTarget(projectDirName, repoName)
+    if networkDisabled(projectDirName, repoName, opts) {
+        // Working offline: don't reach for the registry
+        opts.SkipPull = true
     }
 
-    projectKey := fmt.Sprintf("users.%s.projects.%s.repos.%s", username, projectDirName, repoName)
-
-    // Check if repository already exists
-    if viper.IsSet(projectKey) {
-        return fmt.Errorf("repository %s already exists under project %s for user %s", repoName, projectDirName, username)
+    // The image policy is checked before anything is pulled or created
+    if err := enforcePolicy(checkImagePolicy(dockerImage), opts.OverridePolicy); err != nil {
+        return err
     }
 
-    // Update Viper's in-memory config
-    viper.Set(fmt.Sprintf("%s.repo_url", projectKey), repoURL)
-    viper.Set(fmt.Sprintf("%s.docker_image", projectKey), dockerImage)
-    viper.Set(fmt.Sprintf("%s.container_name", projectKey), containerName)
+    // Reject malformed env entries before touching git or Docker
+    if _, err := repoEnv(projectDirName, repoName); err != nil {
+        return err
+    }
 
-    // Persist changes to the config file
-    err = viper.WriteConfigAs(viper.ConfigFileUsed())
+    projectPath, err := repoCheckoutPath(projectDirName, repoName)
     if err != nil {
-        // If no file exists, create a new one
-        if os.IsNotExist(err) {
-            err = viper.SafeWriteConfigAs(viper.ConfigFileUsed())
-            if err != nil {
-                return fmt.Errorf("error creating config file: %v", err)
-            }
-        } else {
-            return fmt.Errorf("error writing config file: %v", err)
+        return err
+    }
+
+    // Without a network, start only from what is already here, naming everything that's missing
+    if !opts.Offline && !opts.SkipPull && registryUnreachable(dockerImage) {
+        logrus.Warnf("The registry of %s can't be resolved; continuing in offline mode.", dockerImage)
+        opts.Offline = true
+    }
+    if opts.Offline {
+        if err := checkOfflineResources(context.Background(), dockerImage, projectPath); err != nil {
+            return err
         }
+        opts.SkipPull = true
     }
 
-    logrus.Infof("Repository %s added under project %s for user %s.", repoName, projectDirName, username)
-    return nil
+    // Catch an unreachable daemon or a mistyped image before any clone work
+    if err := preflightImage(context.Background(), dockerImage, opts.SkipPull); err != nil {
+        return err
+    }
+
+    // Each branch gets its own worktree of the base clone and its own container
+    if opts.Branch != "" {
+        containerName = fmt.Sprintf("%s-%s", containerName, sanitizeHostname(opts.Branch))
+    }
+
+    // A start of an environment that is already starting or running joins its session instead
+    if !opts.VSCode {
+        lock, joined, err := claimSession(projectDirName, repoName, containerName, dockerImage, opts)
+        if err != nil || joined {
+            return err
+        }
+        defer lock.release()
+    }
+
+    if key := repoSettingKey(projectDirName, repoName, "verify_modules"); viper.IsSet(key) && !viper.GetBool(key) {
+        opts.SkipModuleVerify = true
+    }
+
+    // Clone and pull concurrently; Ctrl-C cancels both
+    if err := prepareEnvironment(repoURL, projectPath, dockerImage, opts); err != nil {
+        return err
+    }
+    if err := enforcePolicy(checkImageAge(context.Background(), dockerImage), opts.OverridePolicy); err != nil {
+        return err
+    }
+
+    if opts.Branch != "" {
+        worktree, err := ensureWorktree(projectPath, projectDirName, repoName, opts.Branch)
+        if err != nil {
+            return err
+        }
+        projectPath = worktree
+    }
+
+    return launchEnvironment(projectDirName, repoName, projectPath, dockerImage, containerName, opts)
 }
 
-// CloneRepo clones the repository to the destination path
-func CloneRepo(repoURL, destPath string) error {
-    logrus.Infof("Cloning repository %s into %s", repoURL, destPath)
-    _, err := git.PlainClone(destPath, false, &git.CloneOptions{
-        URL:      repoURL,
-        Progress: os.Stdout,
-    })
-    if err != nil {
-        logrus.Errorf("Error cloning repository: %v", err)
+// offlineProbeTimeout bounds the DNS lookup that decides whether start falls back to offline mode
+const offlineProbeTimeout = 2 * time.Second
+
+// imageRegistryHost returns the registry host of an image reference, following Docker's rule that
+// a first path component with a dot or port (or localhost) names the registry
+func imageRegistryHost(image string) string {
+    if i := strings.Index(image, "/"); i > 0 {
+        first := image[:i]
+        if strings.ContainsAny(first, ".:") || first == "localhost" {
+            if host, _, err := net.SplitHostPort(first); err == nil {
+                return host
+            }
+            return first
+        }
     }
-    return err
+    return "registry-1.docker.io"
 }
 
-// deriveProjectValues uses the Registry pattern to derive repository URL, Docker image, and container name
-func deriveProjectValues(projectDirName, repoName string) (repoURL, dockerImage, containerName string) {
-    username, err := getUsername()
+// registryUnreachable reports whether the image's registry host fails to resolve within
+// offlineProbeTimeout, the quick tell of having no network
+func registryUnreachable(image string) bool {
+    host := imageRegistryHost(image)
+    if host == "localhost" || net.ParseIP(host) != nil {
+        return false
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), offlineProbeTimeout)
+    defer cancel()
+    _, err := net.DefaultResolver.LookupHost(ctx, host)
+    return err != nil
+}
+
+// checkOfflineResources verifies that everything a start needs without a network is present,
+// listing every missing resource in one error
+func checkOfflineResources(ctx context.Context, dockerImage, projectPath string) error {
+    var missing []string
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
-        logrus.Warnf("Unable to get username, deriving defaults: %v", err)
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if _, _, err := cli.ImageInspectWithRaw(ctx, dockerImage); err != nil {
+        if !client.IsErrNotFound(err) {
+            return fmt.Errorf("%w: %v", errDaemonUnreachable, err)
+        }
+        missing = append(missing, fmt.Sprintf("image %s is not available locally (pull it while online)", dockerImage))
+    }
+    if projectPath != "" {
+        if _, err := os.Stat(projectPath); os.IsNotExist(err) {
+            missing = append(missing, fmt.Sprintf("checkout %s is absent (clone it while online)", projectPath))
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("offline mode: cannot start:\n  %s", strings.Join(missing, "\n  "))
     }
+    logrus.Infof("Offline mode: using local image %s and the existing checkout", dockerImage)
+    return nil
+}
 
-    projectKey := fmt.Sprintf("users.%s.projects.%s.repos.%s", username, projectDirName, repoName)
+// PolicyViolation is the error of an image that breaks a rule of the policy section
+type PolicyViolation struct {
+    Rule   string
+    Image  string
+    Reason string
+}
 
-    if viper.IsSet(projectKey) {
-        projectConfig := viper.GetStringMapString(projectKey)
-        return projectConfig["repo_url"], projectConfig["docker_image"], projectConfig["container_name"]
+func (v *PolicyViolation) Error() string {
+    return fmt.Sprintf("%v: image %s %s (policy.%s)", errPolicyViolation, v.Image, v.Reason, v.Rule)
+}
+
+// Is makes every violation match errPolicyViolation
+func (v *PolicyViolation) Is(target error) bool {
+    return target == errPolicyViolation
+}
+
+// imageRegistry returns the registry of an image reference with its port, docker.io for Docker Hub
+func imageRegistry(image string) string {
+    if host := imageRegistryHost(image); host == "registry-1.docker.io" {
+        return "docker.io"
     }
+    return image[:strings.Index(image, "/")]
+}
 
-    // If not set in config, derive defaults
-    repoURL = fmt.Sprintf("https://github.com/Cdaprod/%s.git", strings.ToLower(repoName))
-    dockerImage = fmt.Sprintf("cdaprod/%s:latest", strings.ToLower(repoName))
-    containerName = fmt.Sprintf("nvim-%s", strings.ToLower(repoName))
+// registryMatches reports whether an image's registry matches a policy entry, which is a host,
+// a host:port, or a pattern such as *.corp.example.com
+func registryMatches(registry, entry string) bool {
+    entry = strings.ToLower(strings.TrimSuffix(entry, "/"))
+    if entry == "index.docker.io" || entry == "registry-1.docker.io" {
+        entry = "docker.io"
+    }
+    host := registry
+    if h, _, err := net.SplitHostPort(registry); err == nil {
+        host = h
+    }
+    for _, candidate := range []string{strings.ToLower(registry), strings.ToLower(host)} {
+        if ok, _ := path.Match(entry, candidate); ok {
+            return true
+        }
+    }
+    return false
+}
 
-    return repoURL, dockerImage, containerName
+// checkImagePolicy applies the registry and digest rules of the policy section to an image
+// reference; they need nothing but the name, so they run before the pull
+func checkImagePolicy(image string) error {
+    registry := imageRegistry(image)
+    for _, entry := range viper.GetStringSlice("policy.denied_registries") {
+        if registryMatches(registry, entry) {
+            return &PolicyViolation{Rule: "denied_registries", Image: image, Reason: fmt.Sprintf("comes from denied registry %s", registry)}
+        }
+    }
+    if allowed := viper.GetStringSlice("policy.allowed_registries"); len(allowed) > 0 {
+        ok := false
+        for _, entry := range allowed {
+            ok = ok || registryMatches(registry, entry)
+        }
+        if !ok {
+            return &PolicyViolation{Rule: "allowed_registries", Image: image, Reason: fmt.Sprintf("comes from %s, which is not an allowed registry (%s)", registry, strings.Join(allowed, ", "))}
+        }
+    }
+    if viper.GetBool("policy.require_digest_pin") && unpinnedImage(image) == image {
+        return &PolicyViolation{Rule: "require_digest_pin", Image: image, Reason: "is not pinned to a digest (see lock or pin-project)"}
+    }
+    return nil
 }
 
-// RunContainer creates and starts a Docker container with additional default bindings
-func RunContainer(imageName, containerName string, binds []string, cmdArgs []string, env []string) (string, error) {
-    ctx := context.Background()
+// checkImageAge applies policy.max_image_age_days to the local image, once it has been pulled
+func checkImageAge(ctx context.Context, image string) error {
+    maxDays := viper.GetInt("policy.max_image_age_days")
+    if maxDays <= 0 {
+        return nil
+    }
     cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
     if err != nil {
-        logrus.Errorf("Error creating Docker client: %v", err)
-        return "", err
+        return fmt.Errorf("error creating Docker client: %v", err)
     }
-
-    // Pull the image if not present
-    logrus.Infof("Pulling Docker image %s...", imageName)
-    reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
+    info, _, err := cli.ImageInspectWithRaw(ctx, image)
     if err != nil {
-        logrus.Errorf("Error pulling image %s: %v", imageName, err)
-        return "", err
+        return fmt.Errorf("error inspecting image %s: %v", image, err)
     }
-    defer reader.Close()
-    io.Copy(os.Stdout, reader) // Display pull progress
+    created, err := time.Parse(time.RFC3339Nano, info.Created)
+    if err != nil {
+        return fmt.Errorf("image %s has no valid creation time: %v", image, err)
+    }
+    if age := time.Since(created); age > time.Duration(maxDays)*24*time.Hour {
+        return &PolicyViolation{Rule: "max_image_age_days", Image: image, Reason: fmt.Sprintf("was built %d days ago, more than the %d allowed", int(age.Hours()/24), maxDays)}
+    }
+    return nil
+}
 
-    // Define container configuration
-    containerConfig := &container.Config{
-        Image: imageName,
-        Cmd:   cmdArgs,
-        Env:   env,
-        Tty:   true, // Allocate a pseudo-TTY
+// enforcePolicy returns a policy check's violation, or with override logs it prominently and
+// lets the start continue
+func enforcePolicy(err error, override bool) error {
+    var violation *PolicyViolation
+    if err == nil || !override || !errors.As(err, &violation) {
+        return err
     }
+    logrus.Warn(strings.Repeat("!", 64))
+    logrus.Warnf("POLICY OVERRIDDEN with --override-policy: %v", err)
+    logrus.Warn(strings.Repeat("!", 64))
+    return nil
+}
 
-    // Define host configuration with volume bindings
-    hostConfig := &container.HostConfig{
-        Binds: binds, // Volume bindings passed as arguments
+// validatePolicyTree checks the syntax of the policy section
+func validatePolicyTree(prefix string, value interface{}) []error {
+    policy, ok := value.(map[string]interface{})
+    if !ok {
+        return []error{fmt.Errorf("%s: expected a mapping", prefix)}
+    }
+    schema := map[string]string{
+        "allowed_registries": kindList,
+        "denied_registries":  kindList,
+        "require_digest_pin": kindBool,
+        "max_image_age_days": kindInt,
+    }
+    var errs []error
+    for _, key := range sortedKeys(policy) {
+        kind, ok := schema[strings.ToLower(key)]
+        switch {
+        case !ok:
+            errs = append(errs, fmt.Errorf("%s.%s: unknown key", prefix, key))
+        case !checkKind(kind, policy[key]):
+            errs = append(errs, fmt.Errorf("%s.%s: expected %s", prefix, key, kind))
+        case kind == kindList:
+            for _, entry := range policy[key].([]interface{}) {
+                if s, ok := entry.(string); !ok || s == "" {
+                    errs = append(errs, fmt.Errorf("%s.%s: entries must be registry names", prefix, key))
+                    break
+                }
+            }
+        }
+    }
+    if days, ok := policy["max_image_age_days"].(int); ok && days < 0 {
+        errs = append(errs, fmt.Errorf("%s.max_image_age_days: must not be negative", prefix))
     }
+    return errs
+}
 
-    // Create the container
-    logrus.Infof("Creating Docker container %s...", containerName)
-    resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, containerName)
-    if err != nil {
-        logrus.Errorf("Error creating container %s: %v", containerName, err)
-        return "", err
+// ValidatePolicy checks the config's policy section, if any
+func ValidatePolicy() []error {
+    if !viper.IsSet("policy") {
+        return nil
     }
+    return validatePolicyTree("policy", viper.Get("policy"))
+}
 
-    // Start the container
-    logrus.Infof("Starting Docker container %s...", containerName)
-    if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-        logrus.Errorf("Error starting container %s: %v", containerName, err)
-        return "", err
+// preflightImage pings the daemon and then checks that dockerImage exists, locally or in its
+// registry. Registry errors other than a missing image (e.g. auth) only warn; the pull decides.
+// With skipPull the image must already be present locally.
+func preflightImage(ctx context.Context, dockerImage string, skipPull bool) error {
+    ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+    defer cancel()
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if _, err := cli.Ping(ctx); err != nil {
+        return fmt.Errorf("%w: %v", errDaemonUnreachable, err)
     }
 
-    logrus.Infof("Container %s started successfully with ID %s", containerName, resp.ID)
-    return resp.ID, nil
+    if _, _, err := cli.ImageInspectWithRaw(ctx, dockerImage); err == nil {
+        return nil
+    } else if skipPull {
+        return fmt.Errorf("image %s is not available locally and pulling is disabled: %v", dockerImage, err)
+    }
+    if _, err := cli.DistributionInspect(ctx, dockerImage, ""); err != nil {
+        msg := strings.ToLower(err.Error())
+        if strings.Contains(msg, "manifest unknown") || strings.Contains(msg, "not found") {
+            return fmt.Errorf("image %s does not exist: %v", dockerImage, err)
+        }
+        logrus.Warnf("Unable to check image %s in its registry: %v", dockerImage, err)
+    }
+    return nil
 }
 
-// AttachToContainer attaches the user's terminal to the running container and starts Neovim
-func AttachToContainer(containerID string) error {
-    // Use Docker's exec to run Neovim interactively
-    cmd := exec.Command("docker", "exec", "-it", containerID, "nvim")
-    cmd.Stdin = os.Stdin
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
+// prepareEnvironment clones the repository (if missing) while pulling the image in the background
+func prepareEnvironment(repoURL, projectPath, dockerImage string, opts StartOptions) error {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
 
-    logrus.Infof("Attaching to container %s with Neovim...", containerID)
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("error executing Neovim: %v", err)
+    var mu sync.Mutex
+    pullOut := &prefixWriter{mu: &mu, out: os.Stdout, prefix: "[pull] "}
+    cloneOut := &prefixWriter{mu: &mu, out: os.Stdout, prefix: "[clone] "}
+
+    pullErr := make(chan error, 1)
+    if opts.SkipPull {
+        logrus.Infof("Skipping pull; using local image %s", dockerImage)
+        pullErr <- nil
+    } else {
+        go func() {
+            pullErr <- pullImage(ctx, dockerImage, pullProgress(pullOut, opts.QuietPull))
+            pullOut.Flush()
+        }()
+    }
+
+    var cloneErr error
+    cloned := false
+    if _, err := os.Stat(projectPath); os.IsNotExist(err) {
+        cloned = true
+        cloneCtx := ctx
+        if opts.CloneTimeout > 0 {
+            var cancel context.CancelFunc
+            cloneCtx, cancel = context.WithTimeout(ctx, opts.CloneTimeout)
+            defer cancel()
+        }
+        cloneErr = CloneRepo(cloneCtx, repoURL, projectPath, cloneOut)
+        cloneOut.Flush()
+        if cloneErr != nil && errors.Is(cloneCtx.Err(), context.DeadlineExceeded) {
+            cloneErr = fmt.Errorf("the clone did not finish within --clone-timeout %s; the partial clone in %s was removed", opts.CloneTimeout, projectPath)
+        }
+    } else {
+        logrus.Infof("Project directory %s already exists. Skipping clone.", projectPath)
+    }
+
+    var errs []string
+    if cloneErr != nil {
+        errs = append(errs, fmt.Sprintf("error cloning repository: %v", cloneErr))
+    }
+    if err := <-pullErr; err != nil {
+        errs = append(errs, fmt.Sprintf("error pulling image: %v", err))
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%s", strings.Join(errs, "; "))
     }
 
+    // A fresh clone of a Go module has its go.sum checked against the downloaded modules
+    if cloned && !opts.SkipModuleVerify {
+        if err := verifyGoModules(ctx, projectPath); err != nil {
+            // Removing the clone makes the next start clone and verify again
+            os.RemoveAll(projectPath)
+            logrus.Warnf("Removed the clone %s, which failed verification.", projectPath)
+            return err
+        }
+    }
     return nil
 }
 
-// RemoveContainer removes the Docker container after use
-func RemoveContainer(containerID string) error {
-    ctx := context.Background()
-    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// verifyGoModules runs go mod verify in a checkout that has a go.mod, failing with the modules
+// whose contents don't match go.sum. Other failures, such as a module that can't be downloaded,
+// say nothing about tampering and only warn, as does a missing go toolchain on the host.
+func verifyGoModules(ctx context.Context, projectPath string) error {
+    if _, err := os.Stat(filepath.Join(projectPath, "go.mod")); err != nil {
+        return nil
+    }
+    goPath, err := exec.LookPath("go")
     if err != nil {
-        return fmt.Errorf("error creating Docker client: %v", err)
+        logrus.Warnf("Not verifying the Go modules of %s: go is not installed.", projectPath)
+        return nil
     }
 
-    logrus.Infof("Removing Docker container %s...", containerID)
-    // Remove the container
-    err = cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true})
-    if err != nil {
-        logrus.Errorf("Error removing container %s: %v", containerID, err)
-        return err
+    logrus.Infof("Verifying the Go modules of %s...", projectPath)
+    cmd := exec.CommandContext(ctx, goPath, "mod", "verify")
+    cmd.Dir = projectPath
+    out, err := cmd.CombinedOutput()
+    if err == nil {
+        return nil
+    }
+    failing := moduleChecksumFailures(string(out))
+    if len(failing) == 0 {
+        logrus.Warnf("go mod verify could not check the modules of %s (%v); continuing:\n%s", projectPath, err, strings.TrimSpace(string(out)))
+        return nil
     }
+    return fmt.Errorf("go mod verify failed in %s (%v):\n  %s\nUse --skip-module-verify or verify_modules: false to start anyway", projectPath, err, strings.Join(failing, "\n  "))
+}
 
-    logrus.Infof("Container %s removed successfully.", containerID)
-    return nil
+// moduleChecksumFailures returns the lines of go mod verify output that report a module whose
+// contents don't match its checksum
+func moduleChecksumFailures(out string) []string {
+    var failing []string
+    for _, line := range strings.Split(out, "\n") {
+        line = strings.TrimSpace(line)
+        if strings.Contains(line, "checksum mismatch") || strings.Contains(line, "SECURITY ERROR") || strings.Contains(line, "has been modified") {
+            failing = append(failing, line)
+        }
+    }
+    return failing
 }
 
-// getUsername retrieves the current user's username
-func getUsername() (string, error) {
-    usr, err := user.Current()
+// StartPath starts an environment for an arbitrary directory, bypassing the project registry and clone.
+// When saveProject is non-empty and the directory is a git checkout, it is registered under that project.
+func StartPath(path, dockerImage, saveProject string, opts StartOptions) error {
+    projectPath, err := filepath.Abs(path)
     if err != nil {
-        return "", err
+        return fmt.Errorf("error resolving path %s: %v", path, err)
     }
-    // On Unix, usr.Username might include the path like "/home/cdaprod", so extract the actual username
-    username := usr.Username
-    if strings.Contains(username, "/") {
-        parts := strings.Split(username, "/")
-        username = parts[len(parts)-1]
+    if info, err := os.Stat(projectPath); err != nil || !info.IsDir() {
+        return fmt.Errorf("%s is not a directory", projectPath)
     }
-    return username, nil
-}
\ No newline at end of file
+    if dockerImage == "" {
+        return fmt.Errorf("an image is required when starting from a path")
+    }
+    if opts.Branch != "" {
+        return fmt.Errorf("--branch can't be combined with --path")
+    }
+
+    repoName := filepath.Base(projectPath)
+    containerName := fmt.Sprintf("nvim-%s", sanitizeHostname(repoName))
+    if _, err := repoEnv("", repoName); err != nil {
+        return err
+    }
+
+    if networkDisabled("", repoName, opts) {
+        opts.SkipPull = true
+    }
+    if err := enforcePolicy(checkImagePolicy(dockerImage), opts.OverridePolicy); err != nil {
+        return err
+    }
+    if !opts.Offline && !opts.SkipPull && registryUnreachable(dockerImage) {
+        logrus.Warnf("The registry of %s can't be resolved; continuing in offline mode.", dockerImage)
+        opts.Offline = true
+    }
+    if opts.Offline {
+        if err := checkOfflineResources(context.Background(), dockerImage, ""); err != nil {
+            return err
+        }
+        opts.SkipPull = true
+    }
+    if !opts.SkipPull {
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+        err = pullImage(ctx, dockerImage, pullProgress(os.Stdout, opts.QuietPull))
+        stop()
+        if err != nil {
+            return fmt.Errorf("error pulling image: %v", err)
+        }
+    }
+    if err := enforcePolicy(checkImageAge(context.Background(), dockerImage), opts.OverridePolicy); err != nil {
+        return err
+    }
+
+    if saveProject != "" {
+        repoURL, err := originURL(projectPath)
+        if err != nil {
+            return fmt.Errorf("cannot save %s: %v", projectPath, err)
+        }
+        if err := AddProjectConfig(saveProject, repoName, repoURL, dockerImage, containerName); err != nil {
+            return err
+        }
+        auditTarget(saveProject, repoName)
+        return launchEnvironment(saveProject, repoName, projectPath, dockerImage, containerName, opts)
+    }
+
+    return launchEnvironment("", repoName, projectPath, dockerImage, containerName, opts)
+}
+
+// originURL returns the URL of the origin remote of a git checkout
+func originURL(projectPath string) (string, error) {
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return "", fmt.Errorf("not a git repository: %v", err)
+    }
+    remote, err := repo.Remote("origin")
+    if err != nil {
+        return "", fmt.Errorf("no origin remote: %v", err)
+    }
+    urls := remote.Config().URLs
+    if len(urls) == 0 {
+        return "", fmt.Errorf("origin remote has no URL")
+    }
+    return urls[0], nil
+}
+
+// mountTarget returns where the project directory is mounted inside the container
+func mountTarget(projectDirName, repoName string) string {
+    target := viper.GetString(repoSettingKey(projectDirName, repoName, "mount_target"))
+    if target == "" {
+        target = "/usr/src/app"
+    }
+    return target
+}
+
+// repoSubpath returns the repository-relative directory to work in from --subpath or the subpath
+// key, cleaned and with forward slashes; empty means the repository root
+func repoSubpath(projectDirName, repoName string, opts StartOptions) string {
+    subpath := opts.Subpath
+    if subpath == "" {
+        subpath = viper.GetString(repoSettingKey(projectDirName, repoName, "subpath"))
+    }
+    subpath = path.Clean("/" + filepath.ToSlash(subpath))
+    return strings.TrimPrefix(subpath, "/")
+}
+
+// workDir returns the container directory the editor starts in: the mount target, or the
+// configured subpath within it
+func workDir(projectDirName, repoName string, opts StartOptions) string {
+    return path.Join(mountTarget(projectDirName, repoName), repoSubpath(projectDirName, repoName, opts))
+}
+
+// validateSubpath checks that the subpath exists as a directory in the checkout
+func validateSubpath(projectPath, subpath string) error {
+    if subpath == "" {
+        return nil
+    }
+    info, err := os.Stat(filepath.Join(projectPath, filepath.FromSlash(subpath)))
+    if err != nil || !info.IsDir() {
+        return fmt.Errorf("subpath %s is not a directory in %s", subpath, projectPath)
+    }
+    return nil
+}
+
+// launchEnvironment runs the container for a checked-out project, attaches to it and cleans up on exit.
+// An empty projectDirName denotes an ad-hoc environment with no config entry; only global settings apply.
+func launchEnvironment(projectDirName, repoName, projectPath, dockerImage, containerName string, opts StartOptions) error {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return fmt.Errorf("error getting home directory: %v", err)
+    }
+
+    // In sync mode the project is copied into a volume, for daemons that can't see the checkout;
+    // with --remote it is rsynced to the daemon's host and bound from there
+    projectSource := projectPath
+    if opts.Remote != "" {
+        remotePath, err := remoteSyncPath(opts.Remote)
+        if err != nil {
+            return err
+        }
+        if err := RsyncProject(context.Background(), projectPath, opts.Remote, false); err != nil {
+            return err
+        }
+        projectSource = remotePath
+    } else if viper.GetBool(repoSettingKey(projectDirName, repoName, "sync")) {
+        if err := SyncProject(context.Background(), projectPath, containerName, volumeLabels(projectDirName, repoName, opts.Branch)); err != nil {
+            return err
+        }
+        projectSource = syncVolumeName(containerName)
+    }
+
+    consistency, err := mountConsistency(projectDirName, repoName, opts)
+    if err != nil {
+        return err
+    }
+    if consistency != "" && !filepath.IsAbs(projectSource) {
+        logrus.Warnf("Ignoring mount consistency %s: the project is synced into a volume.", consistency)
+        consistency = ""
+    }
+    if err := validateSubpath(projectPath, repoSubpath(projectDirName, repoName, opts)); err != nil {
+        return err
+    }
+
+    // Automatically detect and set mounts, plus any volumes configured for the repo. The shared
+    // caches are writable by every project's container, so a sandbox doesn't get them.
+    mounts := getVolumeBindings(homeDir, projectPath, projectSource, mountTarget(projectDirName, repoName), !opts.NoSharedCache && !opts.Sandbox, opts.Sandbox, consistency)
+    volumes, err := expandEnvSlice(viper.GetStringSlice(repoFieldKey(projectDirName, repoName, "volumes")))
+    if err != nil {
+        return fmt.Errorf("error reading volumes config: %v", err)
+    }
+    if !opts.NoVerifyBinds {
+        // A missing source would silently become an empty directory in the container
+        if err := verifyBindSources(volumes); err != nil {
+            return err
+        }
+    }
+    var binds []string
+    for _, volume := range volumes {
+        m, err := parseVolumeSpec(volume)
+        if err != nil {
+            // Options such as SELinux relabeling only exist in the bind syntax
+            logrus.Debugf("Passing volume %s as a bind: %v", volume, err)
+            binds = append(binds, volume)
+            continue
+        }
+        if m.Type == mount.TypeBind && opts.NoVerifyBinds {
+            // A bind mount fails on a missing source, where the bind syntax creates it as before
+            binds = append(binds, volume)
+            continue
+        }
+        mounts = append(mounts, m)
+    }
+
+    // Environment variables
+    envName := repoName
+    if projectDirName != "" {
+        envName = fmt.Sprintf("%s/%s", projectDirName, repoName)
+    }
+    env := []string{"HOME=/home/cdaprod", fmt.Sprintf("DEV_ENV_NAME=%s", envName)}
+    configEnv, err := repoEnv(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if configEnv, err = withExtraEnv(configEnv, opts.ExtraEnv); err != nil {
+        return err
+    }
+    env = overrideEnv(env, configEnv)
+
+    // Show the host's local time in the container unless the env config sets TZ itself
+    tzEnv, tzMounts := timezoneSettings(projectDirName, repoName, opts, configEnv, mounts, binds)
+    env = append(env, tzEnv...)
+    mounts = append(mounts, tzMounts...)
+
+    // Source the project's shell rc file in container shells, if it has one
+    var shellEnv string
+    rcPath, err := shellRCPath(projectDirName, repoName, projectPath)
+    if err != nil {
+        return err
+    }
+    if rcPath != "" {
+        mounts = append(mounts, mount.Mount{Type: mount.TypeBind, Source: rcPath, Target: shellRCTarget, ReadOnly: true})
+        shellEnv = shellRCTarget
+    }
+
+    // Optionally prefix the shell prompt with the environment name; the snippet also sources the rc file
+    if opts.PromptHint || viper.GetBool(repoSettingKey(projectDirName, repoName, "prompt_hint")) {
+        snippetPath, err := writePromptSnippet()
+        if err != nil {
+            return fmt.Errorf("error writing prompt snippet: %v", err)
+        }
+        mounts = append(mounts, mount.Mount{Type: mount.TypeBind, Source: snippetPath, Target: promptSnippetTarget, ReadOnly: true})
+        shellEnv = promptSnippetTarget
+    }
+    if shellEnv != "" {
+        env = overrideEnv(env, []string{fmt.Sprintf("ENV=%s", shellEnv)})
+    }
+
+    // One-time setup commands need a named volume to remember that they already ran
+    initCommands := viper.GetStringSlice(repoFieldKey(projectDirName, repoName, "init_commands"))
+    if opts.Sandbox && len(initCommands) > 0 {
+        logrus.Warn("Sandbox mode: skipping init_commands.")
+        initCommands = nil
+    }
+    if opts.DebugShell != "" && len(initCommands) > 0 {
+        logrus.Info("Debug shell: skipping init_commands.")
+        initCommands = nil
+    }
+    if len(initCommands) > 0 {
+        mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: stateVolumeName(containerName), Target: stateVolumeTarget,
+            VolumeOptions: &mount.VolumeOptions{Labels: volumeLabels(projectDirName, repoName, opts.Branch)}})
+    }
+
+    // Resolve memory limits, persisting any flag overrides for this repository
+    resources, err := resolveMemoryResources(projectDirName, repoName, opts)
+    if err != nil {
+        return err
+    }
+
+    // Place the container under a specific cgroup hierarchy if requested
+    cgroupParent := opts.CgroupParent
+    if cgroupParent == "" {
+        cgroupParent = viper.GetString(repoSettingKey(projectDirName, repoName, "cgroup_parent"))
+    }
+    if cgroupParent != "" && !strings.HasPrefix(cgroupParent, "/") {
+        return fmt.Errorf("cgroup parent %q must be an absolute path", cgroupParent)
+    }
+    resources.CgroupParent = cgroupParent
+
+    // Pin the container to CPU cores and NUMA memory nodes if requested
+    if resources.CpusetCpus, err = resolveCPUSet(projectDirName, repoName, "cpu_set_cpus", opts.CpusetCpus); err != nil {
+        return err
+    }
+    if resources.CpusetMems, err = resolveCPUSet(projectDirName, repoName, "cpu_set_mems", opts.CpusetMems); err != nil {
+        return err
+    }
+
+    // Logging driver, persisting any flag overrides for this repository
+    logConfig, err := resolveLogConfig(projectDirName, repoName, opts)
+    if err != nil {
+        return err
+    }
+
+    // DNS servers for resolving internal hostnames, persisting any flag overrides
+    dnsServers, dnsSearch, dnsOptions, err := resolveDNS(projectDirName, repoName, opts)
+    if err != nil {
+        return err
+    }
+
+    // Request GPUs and keep the ML frameworks' view of them consistent with the request
+    gpuEnv, err := resolveGPUs(projectDirName, repoName, opts, &resources, env)
+    if err != nil {
+        return err
+    }
+    env = append(env, gpuEnv...)
+
+    // Command to run Neovim; it is exec'd on attach, so the container itself only idles
+    cmdArgs := devCommand(projectDirName, repoName, dockerImage, opts)
+    if viper.GetBool(repoSettingKey(projectDirName, repoName, "session_restore")) && len(opts.Cmd) == 0 && opts.DebugShell == "" && !opts.Sandbox {
+        sessionDir, sessionArgs, err := sessionRestore(homeDir, projectDirName, repoName, cmdArgs)
+        if err != nil {
+            return err
+        }
+        if sessionDir != "" {
+            mounts = append(mounts, mount.Mount{Type: mount.TypeBind, Source: sessionDir, Target: sessionTarget})
+            cmdArgs = sessionArgs
+        }
+    }
+
+    stopSig := stopSignal(projectDirName, repoName)
+    if opts.StopSignal != "" {
+        stopSig = opts.StopSignal
+    }
+    if err := checkStopSignal(stopSig); err != nil {
+        return err
+    }
+
+    // A debug shell is the entrypoint itself, running the idle loop as its -c script
+    idle := idleCommand(stopSig)
+    if opts.DebugShell != "" {
+        idle = idle[2:]
+    }
+
+    spec := ContainerSpec{
+        Image:       dockerImage,
+        Name:        containerName,
+        Hostname:    deriveHostname(projectDirName, repoName),
+        Binds:       binds,
+        Mounts:      mounts,
+        Cmd:         idle,
+        Entrypoint:  resolveEntrypoint(projectDirName, repoName, opts),
+        WorkingDir:  workDir(projectDirName, repoName, opts),
+        StopSignal:  stopSig,
+        StopTimeout: stopGracePeriod(projectDirName, repoName),
+        Env:         env,
+        Labels: map[string]string{
+            labelProject: projectDirName,
+            labelRepo:    repoName,
+        },
+        Resources:  resources,
+        LogConfig:  logConfig,
+        DNS:        dnsServers,
+        DNSSearch:  dnsSearch,
+        DNSOptions: dnsOptions,
+    }
+    if opts.Branch != "" {
+        spec.Labels[labelBranch] = opts.Branch
+    }
+    applyIsolation(projectDirName, repoName, opts.Sandbox, &spec)
+    spec.NetworkDisabled = networkDisabled(projectDirName, repoName, opts)
+    if err := resolveNetwork(projectDirName, repoName, opts, &spec); err != nil {
+        return err
+    }
+    if spec.IpcMode, err = ipcMode(projectDirName, repoName, opts); err != nil {
+        return err
+    }
+    if opts.StopTimeout < 0 {
+        return fmt.Errorf("--stop-timeout must not be negative")
+    } else if opts.StopTimeout > 0 {
+        spec.StopTimeout = opts.StopTimeout
+    }
+
+    // Docker accepts malformed entries silently, so check everything that was merged into the env
+    if err := checkEnv("container environment", spec.Env); err != nil {
+        return err
+    }
+
+    // Run Docker container with combined mounts
+    containerID, err := RunContainer(spec)
+    if err != nil {
+        if containerID != "" {
+            if rmErr := RemoveContainer(containerID); rmErr != nil {
+                logrus.Warnf("Error removing failed container: %v", rmErr)
+            }
+        }
+        return fmt.Errorf("error running container: %v", err)
+    }
+    if projectDirName != "" {
+        recordOpened(projectDirName, repoName)
+    }
+
+    // Materialize the env config as a dotenv file for tools that read one
+    if envFile := viper.GetString(repoSettingKey(projectDirName, repoName, "env_file")); envFile != "" && !opts.NoEnvFile {
+        if err := writeEnvFile(containerID, envFile, configEnv); err != nil {
+            if rmErr := RemoveContainer(containerID); rmErr != nil {
+                logrus.Warnf("Error removing container: %v", rmErr)
+            }
+            return fmt.Errorf("error writing env file: %v", err)
+        }
+    }
+
+    // Run one-time setup on the first start only
+    if len(initCommands) > 0 {
+        if err := RunInitCommands(containerID, initCommands); err != nil {
+            if rmErr := RemoveContainer(containerID); rmErr != nil {
+                logrus.Warnf("Error removing container after failed init: %v", rmErr)
+            }
+            return fmt.Errorf("error running init commands: %v", err)
+        }
+    }
+
+    if opts.Detached {
+        reattach := fmt.Sprintf("attach %s %s", projectDirName, repoName)
+        if opts.Branch != "" {
+            reattach += " --branch " + opts.Branch
+        }
+        logrus.Infof("Container %s is running; attach with `%s`.", containerName, reattach)
+        return nil
+    }
+
+    // VS Code attaches on its own; the CLI exits and the container normally stays up for it
+    if opts.VSCode {
+        if err := OpenInVSCode(containerName, workDir(projectDirName, repoName, opts)); err != nil {
+            return err
+        }
+        if opts.Keep {
+            logrus.Infof("Container %s left running for VS Code; remove it with `docker rm -f %s` when done.", containerName, containerName)
+            return nil
+        }
+        promptYesNo("Press Enter to stop the environment...", true)
+        if err := RemoveContainer(containerID); err != nil {
+            return fmt.Errorf("error removing container: %v", err)
+        }
+        return nil
+    }
+
+    // Fail clearly before the interactive attach if the image lacks the editor or git; a debug
+    // shell only needs itself
+    tools := []string{cmdArgs[0], "git"}
+    if opts.DebugShell != "" {
+        tools = tools[:1]
+    }
+    if err := probeTools(containerID, dockerImage, tools, opts.Force); err != nil {
+        if rmErr := RemoveContainer(containerID); rmErr != nil {
+            logrus.Warnf("Error removing container: %v", rmErr)
+        }
+        return err
+    }
+
+    if opts.Sandbox {
+        printSandboxBanner(spec)
+    }
+
+    if err := attachSession(projectDirName, repoName, containerID, containerName, cmdArgs, opts); err != nil {
+        return err
+    }
+
+    // Bring the session's changes back once the container is gone; a detached or kept
+    // environment still works on the remote copy
+    if opts.Remote != "" && containerRemoved(containerID) {
+        return RsyncProject(context.Background(), projectPath, opts.Remote, true)
+    }
+    return nil
+}
+
+// containerRemoved reports whether a container no longer exists
+func containerRemoved(containerID string) bool {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return false
+    }
+    _, err = cli.ContainerInspect(context.Background(), containerID)
+    return client.IsErrNotFound(err)
+}
+
+// attachSession runs the editor in the container and removes the container afterwards unless
+// --keep was given or the user detached, leaving the editor running to come back to
+func attachSession(projectDirName, repoName, containerID, containerName string, cmdArgs []string, opts StartOptions) error {
+    sessionID, err := newSessionID()
+    if err != nil {
+        return err
+    }
+
+    // Attach to the container, timing the session for local usage stats
+    sessionStart := time.Now()
+    err = AttachToContainer(containerID, cmdArgs, detachKeys(projectDirName, repoName, opts), sessionID)
+    recordSession(projectDirName, repoName, sessionStart, time.Now(), exitCodeOf(err))
+    if err != nil {
+        return fmt.Errorf("error attaching to container: %v", err)
+    }
+
+    detached, err := sessionRunning(containerID, sessionID)
+    if err != nil {
+        logrus.Warnf("Unable to tell whether the session was detached: %v", err)
+    }
+    if detached {
+        reattach := fmt.Sprintf("attach %s %s", projectDirName, repoName)
+        if opts.Branch != "" {
+            reattach += " --branch " + opts.Branch
+        }
+        fmt.Printf("Detached from %s, which keeps running; reattach with `%s`.\n", containerName, reattach)
+        return nil
+    }
+
+    // Cleanup after exit
+    if opts.Keep {
+        logrus.Infof("Container %s left running (--keep).", containerName)
+        return nil
+    }
+    err = RemoveContainer(containerID)
+    if err != nil {
+        return fmt.Errorf("error removing container: %v", err)
+    }
+    return nil
+}
+
+// detachKeys returns the detach key sequence from --detach-keys or the detach_keys key; empty
+// leaves docker's default of ctrl-p,ctrl-q
+func detachKeys(projectDirName, repoName string, opts StartOptions) string {
+    if opts.DetachKeys != "" {
+        return opts.DetachKeys
+    }
+    return viper.GetString(repoSettingKey(projectDirName, repoName, "detach_keys"))
+}
+
+// Variable marking the processes of an editor session in the container
+const sessionEnvVar = "DEV_ENV_SESSION"
+
+// newSessionID returns a random ID for an editor session
+func newSessionID() (string, error) {
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(id), nil
+}
+
+// sessionProbe is a command that succeeds while a process of the session runs where it executes
+func sessionProbe(sessionID string) []string {
+    return []string{"sh", "-c", `grep -qsa "$1" /proc/[0-9]*/environ`, "sh", sessionEnvVar + "=" + sessionID}
+}
+
+// sessionRunning reports whether the editor session sessionID still runs in the container. An
+// editor still running after the attached client returned is what docker exec leaves behind when
+// the detach keys are used; other sessions in the same container don't carry its ID.
+func sessionRunning(containerID, sessionID string) (bool, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return false, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(ctx, containerID)
+    if err != nil {
+        return false, err
+    }
+    if !info.State.Running {
+        return false, nil
+    }
+    code, err := execInContainer(ctx, cli, containerID, sessionProbe(sessionID), io.Discard)
+    if err != nil {
+        return false, err
+    }
+    return code == 0, nil
+}
+
+// AttachProject reattaches to a repository's running environment, starting a new editor session in it
+func AttachProject(projectDirName, repoName string, opts StartOptions) error {
+    _, dockerImage, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if opts.Branch != "" {
+        containerName = fmt.Sprintf("%s-%s", containerName, sanitizeHostname(opts.Branch))
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(context.Background(), containerName)
+    if client.IsErrNotFound(err) {
+        return fmt.Errorf("%s/%s has no container %s; start it first", projectDirName, repoName, containerName)
+    }
+    if err != nil {
+        return fmt.Errorf("error inspecting container %s: %v", containerName, err)
+    }
+    if !info.State.Running {
+        return fmt.Errorf("container %s is %s; start it first", containerName, info.State.Status)
+    }
+
+    cmdArgs := devCommand(projectDirName, repoName, dockerImage, opts)
+    return attachSession(projectDirName, repoName, info.ID, containerName, cmdArgs, opts)
+}
+
+// sessionLock marks the start that owns an environment's session: only it removes the container.
+// Locks live in a shared temp directory because container names are shared by everyone using the
+// Docker daemon, and are held until the owning session ends.
+type sessionLock struct {
+    PID       int       `json:"pid"`
+    User      string    `json:"user"`
+    StartedAt time.Time `json:"started_at"`
+    path      string
+}
+
+// sessionLockDir returns the directory holding session locks
+func sessionLockDir() (string, error) {
+    dir := filepath.Join(os.TempDir(), "dev-env-manager-sessions")
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+    // Let other users on a shared host take and clear locks too
+    os.Chmod(dir, os.ModeSticky|0777)
+    return dir, nil
+}
+
+// sessionWaitTimeout bounds how long a start waits for another one to create the container
+const sessionWaitTimeout = 10 * time.Minute
+
+// tryLockSession takes the session lock of a container, or returns its current holder. The lock
+// is written in full to a temp file and then linked into place, so a lock that exists is never
+// partly written. A lock whose process is gone is cleared and taken.
+func tryLockSession(containerName string) (mine, holder *sessionLock, err error) {
+    dir, err := sessionLockDir()
+    if err != nil {
+        return nil, nil, err
+    }
+    path := filepath.Join(dir, containerName+".lock")
+    username, _ := getUsername()
+
+    for attempt := 0; attempt < 2; attempt++ {
+        lock := &sessionLock{PID: os.Getpid(), User: username, StartedAt: time.Now(), path: path}
+        err := linkSessionLock(dir, lock)
+        if err == nil {
+            return lock, nil, nil
+        }
+        if !os.IsExist(err) {
+            return nil, nil, err
+        }
+
+        holder := &sessionLock{}
+        data, err := os.ReadFile(path)
+        if os.IsNotExist(err) {
+            continue
+        }
+        if err == nil && json.Unmarshal(data, holder) == nil && processAlive(holder.PID) {
+            return nil, holder, nil
+        }
+        if err := os.Remove(path); os.IsPermission(err) {
+            // The sticky lock directory only lets a lock's owner remove it
+            return nil, nil, fmt.Errorf("stale session lock %s for %s belongs to another user (%s, PID %d, which has exited); they or root must remove it",
+                path, containerName, holder.User, holder.PID)
+        } else if err != nil && !os.IsNotExist(err) {
+            return nil, nil, fmt.Errorf("error clearing stale session lock %s: %v", path, err)
+        }
+    }
+    return nil, nil, fmt.Errorf("could not take the session lock for %s", containerName)
+}
+
+// linkSessionLock writes lock to a temp file in dir and hard-links it to lock.path, failing with
+// an os.IsExist error when the lock is already held
+func linkSessionLock(dir string, lock *sessionLock) error {
+    f, err := os.CreateTemp(dir, ".lock-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+    err = json.NewEncoder(f).Encode(lock)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    if err := os.Chmod(f.Name(), 0644); err != nil {
+        return err
+    }
+    return os.Link(f.Name(), lock.path)
+}
+
+// release gives up the session lock
+func (l *sessionLock) release() {
+    if l != nil {
+        os.Remove(l.path)
+    }
+}
+
+// processAlive reports whether a process exists; one owned by another user counts
+func processAlive(pid int) bool {
+    if pid <= 0 {
+        return false
+    }
+    p, err := os.FindProcess(pid)
+    if err != nil {
+        return false
+    }
+    err = p.Signal(syscall.Signal(0))
+    return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+// claimSession decides how a start proceeds. It returns the session lock when this start owns
+// the environment and should create it. Otherwise it attaches to the running container and
+// returns joined: as a guest when another live start owns the session, or as the owner when the
+// container was left by a session that has ended. While another start is still creating the
+// container, it waits for up to sessionWaitTimeout.
+func claimSession(projectDirName, repoName, containerName, dockerImage string, opts StartOptions) (*sessionLock, bool, error) {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, false, fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    var deadline time.Time
+    for {
+        lock, holder, err := tryLockSession(containerName)
+        if err != nil {
+            return nil, false, err
+        }
+
+        info, err := cli.ContainerInspect(context.Background(), containerName)
+        running := err == nil && info.State != nil && info.State.Running
+        if err != nil && !client.IsErrNotFound(err) {
+            lock.release()
+            return nil, false, fmt.Errorf("error inspecting container %s: %v", containerName, err)
+        }
+
+        switch {
+        case running && opts.Detached:
+            lock.release()
+            logrus.Infof("Container %s is already running.", containerName)
+            return nil, true, nil
+        case lock != nil && !running:
+            return lock, false, nil
+        case lock != nil:
+            // Left running by a detached or kept session: this start takes over as the owner
+            defer lock.release()
+            logrus.Infof("Container %s is already running; attaching to it.", containerName)
+            cmdArgs := devCommand(projectDirName, repoName, dockerImage, opts)
+            return nil, true, attachSession(projectDirName, repoName, info.ID, containerName, cmdArgs, opts)
+        case running:
+            return nil, true, joinSession(projectDirName, repoName, info.ID, containerName, dockerImage, holder, opts)
+        }
+
+        if deadline.IsZero() {
+            logrus.Infof("Waiting for PID %d (%s), which is starting %s...", holder.PID, holder.User, containerName)
+            deadline = time.Now().Add(sessionWaitTimeout)
+        } else if time.Now().After(deadline) {
+            return nil, false, fmt.Errorf("gave up after %s waiting for PID %d (%s) to start %s; if it is stuck, stop that process and try again",
+                sessionWaitTimeout, holder.PID, holder.User, containerName)
+        }
+        time.Sleep(500 * time.Millisecond)
+    }
+}
+
+// joinSession attaches a new editor session to a container whose session another start owns.
+// Leaving it never removes the container; the owner's exit does.
+func joinSession(projectDirName, repoName, containerID, containerName, dockerImage string, holder *sessionLock, opts StartOptions) error {
+    fmt.Printf("Joining existing session started %s ago by PID %d (%s).\n",
+        time.Since(holder.StartedAt).Round(time.Second), holder.PID, holder.User)
+
+    cmdArgs := devCommand(projectDirName, repoName, dockerImage, opts)
+    sessionStart := time.Now()
+    err := AttachToContainer(containerID, cmdArgs, detachKeys(projectDirName, repoName, opts), "")
+    recordSession(projectDirName, repoName, sessionStart, time.Now(), exitCodeOf(err))
+    if err != nil && containerRemoved(containerID) {
+        fmt.Printf("PID %d ended the session and removed %s.\n", holder.PID, containerName)
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error attaching to container: %v", err)
+    }
+    fmt.Printf("Left the session; %s keeps running until PID %d's session ends.\n", containerName, holder.PID)
+    return nil
+}
+
+// vscodeAttachURI builds the folder URI VS Code's Dev Containers extension uses to attach to a running container
+func vscodeAttachURI(containerName, workdir string) string {
+    return fmt.Sprintf("vscode-remote://attached-container+%s%s", hex.EncodeToString([]byte(containerName)), workdir)
+}
+
+// OpenInVSCode launches VS Code attached to the container, or prints the URI when the code CLI is unavailable
+func OpenInVSCode(containerName, workdir string) error {
+    uri := vscodeAttachURI(containerName, workdir)
+
+    codePath, err := exec.LookPath("code")
+    if err != nil {
+        logrus.Warn("The VS Code `code` CLI was not found on PATH.")
+        fmt.Printf("Open this folder URI in VS Code (File > Open Folder... or `code --folder-uri`):\n  %s\n", uri)
+        return nil
+    }
+
+    logrus.Infof("Attaching VS Code to container %s...", containerName)
+    cmd := exec.Command(codePath, "--folder-uri", uri)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("error launching VS Code: %v", err)
+    }
+    return nil
+}
+
+// Named volumes shared by every project container of a given language
+const (
+    goModCacheVolume = "dev-env-manager-go-mod-cache"
+    npmCacheVolume   = "dev-env-manager-npm-cache"
+)
+
+// hostTimezone returns the host's IANA timezone name from $TZ, the /etc/localtime symlink or
+// /etc/timezone, or "" when it can't be told
+func hostTimezone() string {
+    if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" && !filepath.IsAbs(tz) {
+        return tz
+    }
+    if target, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+        if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+            return target[i+len("zoneinfo/"):]
+        }
+    }
+    if data, err := os.ReadFile("/etc/timezone"); err == nil {
+        return strings.TrimSpace(string(data))
+    }
+    return ""
+}
+
+// resolveTimezone returns the container's timezone from --timezone, the timezone key or the host;
+// --no-timezone or timezone: none leaves it unset
+func resolveTimezone(projectDirName, repoName string, opts StartOptions) string {
+    if opts.NoTimezone {
+        return ""
+    }
+    tz := opts.Timezone
+    if tz == "" {
+        tz = viper.GetString(repoSettingKey(projectDirName, repoName, "timezone"))
+    }
+    if tz == "none" {
+        return ""
+    }
+    if tz == "" {
+        return hostTimezone()
+    }
+    if _, err := time.LoadLocation(tz); err != nil {
+        logrus.Warnf("Timezone %s is unknown on this host; passing it on anyway: %v", tz, err)
+    }
+    return tz
+}
+
+// timezoneSettings returns the TZ variable for the container and, when it is the host's zone on
+// a local Linux daemon, read-only binds of /etc/localtime and /etc/timezone for tools that read
+// those files instead. A TZ in the env config, or existing mounts of the files, take precedence.
+func timezoneSettings(projectDirName, repoName string, opts StartOptions, configEnv []string, mounts []mount.Mount, binds []string) ([]string, []mount.Mount) {
+    tz := resolveTimezone(projectDirName, repoName, opts)
+    if tz == "" {
+        return nil, nil
+    }
+    for _, entry := range configEnv {
+        if strings.HasPrefix(entry, "TZ=") {
+            return nil, nil
+        }
+    }
+    env := []string{"TZ=" + tz}
+    if tz != hostTimezone() || runtime.GOOS != "linux" || opts.Remote != "" {
+        return env, nil
+    }
+
+    taken := map[string]bool{}
+    for _, m := range mounts {
+        taken[m.Target] = true
+    }
+    for _, bind := range binds {
+        if parts := strings.Split(bind, ":"); len(parts) > 1 {
+            taken[parts[1]] = true
+        }
+    }
+    var tzMounts []mount.Mount
+    for _, file := range []string{"/etc/localtime", "/etc/timezone"} {
+        if _, err := os.Stat(file); err == nil && !taken[file] {
+            tzMounts = append(tzMounts, mount.Mount{Type: mount.TypeBind, Source: file, Target: file, ReadOnly: true})
+        }
+    }
+    return env, tzMounts
+}
+
+// getVolumeBindings dynamically generates the default mounts: editor config, the project from
+// projectSource (a checkout path, or a volume name in sync mode) and the shared caches
+func getVolumeBindings(homeDir, projectPath, projectSource, target string, sharedCache, readOnlyProject bool, consistency string) []mount.Mount {
+    var mounts []mount.Mount
+
+    // Editor config from the host; unlike bind strings, mounts don't create missing sources
+    for _, config := range []struct{ source, target string }{
+        {filepath.Join(homeDir, ".config", "nvim"), "/root/.config/nvim"},
+        {filepath.Join(homeDir, ".vim"), "/root/.vim"},
+        {filepath.Join(homeDir, ".vimrc"), "/root/.vimrc"},
+    } {
+        if _, err := os.Stat(config.source); err != nil {
+            logrus.Debugf("Not mounting %s: %v", config.source, err)
+            continue
+        }
+        mounts = append(mounts, mount.Mount{Type: mount.TypeBind, Source: config.source, Target: config.target, ReadOnly: readOnlyProject})
+    }
+
+    project := mount.Mount{Type: mount.TypeBind, Source: projectSource, Target: target, ReadOnly: readOnlyProject}
+    if !filepath.IsAbs(projectSource) {
+        project.Type = mount.TypeVolume
+    }
+    project.Consistency = mount.Consistency(consistency)
+    mounts = append(mounts, project)
+
+    // Share package caches across projects so modules aren't downloaded once per container
+    if sharedCache {
+        if _, err := os.Stat(filepath.Join(projectPath, "go.mod")); err == nil {
+            mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: goModCacheVolume, Target: "/root/go/pkg/mod"})
+        }
+        if _, err := os.Stat(filepath.Join(projectPath, "package.json")); err == nil {
+            mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: npmCacheVolume, Target: "/root/.npm"})
+        }
+    }
+    return mounts
+}
+
+// parseVolumeSpec converts a docker run -v style spec (source:target[:options], or just a target
+// for an anonymous volume) to a typed mount. Sources starting with / are bind mounts, others
+// named volumes. Options the mount API can't express, such as z and Z, are an error.
+func parseVolumeSpec(spec string) (mount.Mount, error) {
+    parts := strings.Split(spec, ":")
+    var m mount.Mount
+    switch len(parts) {
+    case 1:
+        m = mount.Mount{Type: mount.TypeVolume, Target: parts[0]}
+    case 2, 3:
+        m = mount.Mount{Type: mount.TypeVolume, Source: parts[0], Target: parts[1]}
+        if filepath.IsAbs(parts[0]) {
+            m.Type = mount.TypeBind
+        }
+    default:
+        return m, fmt.Errorf("too many colons in %q", spec)
+    }
+    if !filepath.IsAbs(m.Target) {
+        return m, fmt.Errorf("target %q is not absolute", m.Target)
+    }
+    if len(parts) < 3 {
+        return m, nil
+    }
+
+    for _, option := range strings.Split(parts[2], ",") {
+        switch option {
+        case "ro":
+            m.ReadOnly = true
+        case "rw":
+            m.ReadOnly = false
+        case "cached", "delegated", "consistent":
+            m.Consistency = mount.Consistency(option)
+        case "shared", "rshared", "slave", "rslave", "private", "rprivate":
+            if m.Type != mount.TypeBind {
+                return m, fmt.Errorf("propagation %s only applies to bind mounts", option)
+            }
+            m.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(option)}
+        case "nocopy":
+            if m.Type != mount.TypeVolume {
+                return m, fmt.Errorf("nocopy only applies to volumes")
+            }
+            m.VolumeOptions = &mount.VolumeOptions{NoCopy: true}
+        default:
+            return m, fmt.Errorf("option %q has no mount equivalent", option)
+        }
+    }
+    return m, nil
+}
+
+// editorCommand expands an editor command template such as "hx {dir}" or "emacs -nw {dir}",
+// replacing {dir} with the project's directory in the container
+func editorCommand(template, dir string) []string {
+    fields := strings.Fields(template)
+    for i, field := range fields {
+        fields[i] = strings.ReplaceAll(field, "{dir}", dir)
+    }
+    return fields
+}
+
+// toolProbeCachePath returns the file caching which tools each image digest provides
+func toolProbeCachePath() (string, error) {
+    dir, err := cacheDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "tools.json"), nil
+}
+
+// probeTools checks that the tools the session needs can be found in the started container,
+// reporting every missing one in a single error, or only warning with force. Results are cached
+// per image digest, so an image is probed once.
+func probeTools(containerID, dockerImage string, tools []string, force bool) error {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    digest := ""
+    if info, err := InspectImage(ctx, cli, dockerImage); err == nil {
+        digest = info.Digest
+    }
+    cachePath, err := toolProbeCachePath()
+    if err != nil {
+        return err
+    }
+    cache := make(map[string]map[string]bool)
+    if data, err := os.ReadFile(cachePath); err == nil {
+        if err := json.Unmarshal(data, &cache); err != nil {
+            cache = make(map[string]map[string]bool)
+        }
+    }
+    known := cache[digest]
+    if known == nil || digest == "" {
+        known = make(map[string]bool)
+    }
+
+    var unknown []string
+    for _, tool := range tools {
+        if _, ok := known[tool]; !ok {
+            unknown = append(unknown, tool)
+        }
+    }
+    if len(unknown) > 0 {
+        var out bytes.Buffer
+        script := `for t; do command -v "$t" >/dev/null || echo "$t"; done`
+        if _, err := execInContainer(ctx, cli, containerID, append([]string{"sh", "-c", script, "sh"}, unknown...), &out); err != nil {
+            logrus.Warnf("Unable to check for %s in the container: %v", strings.Join(unknown, ", "), err)
+            return nil
+        }
+        for _, tool := range unknown {
+            known[tool] = true
+        }
+        for _, tool := range strings.Fields(out.String()) {
+            known[tool] = false
+        }
+        if digest != "" {
+            cache[digest] = known
+            if data, err := json.MarshalIndent(cache, "", "  "); err == nil {
+                if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+                    os.WriteFile(cachePath, data, 0644)
+                }
+            }
+        }
+    }
+
+    var missing []string
+    for _, tool := range tools {
+        if !known[tool] {
+            missing = append(missing, tool)
+        }
+    }
+    if len(missing) == 0 {
+        return nil
+    }
+    msg := fmt.Sprintf("image %s lacks %s; install it in the image or point docker_image at one that has it", dockerImage, strings.Join(missing, ", "))
+    if force {
+        logrus.Warnf("%s (continuing because of --force)", msg)
+        return nil
+    }
+    return fmt.Errorf("%s (or pass --force to attach anyway)", msg)
+}
+
+// sessionRestore sets up session_restore for nvim: the repo's session directory under
+// $XDG_STATE_HOME/dev-env-manager/sessions is mounted, nvim saves its session there on quit and
+// reopens it with -S next time. It returns the host directory to mount, or "" and the command
+// unchanged for other editors or when the nvim config already uses a session plugin.
+func sessionRestore(homeDir, projectDirName, repoName string, cmdArgs []string) (string, []string, error) {
+    if filepath.Base(cmdArgs[0]) != "nvim" {
+        logrus.Warnf("session_restore only supports nvim, not %s.", cmdArgs[0])
+        return "", cmdArgs, nil
+    }
+    if plugin := sessionPluginIn(filepath.Join(homeDir, ".config", "nvim")); plugin != "" {
+        logrus.Infof("Leaving sessions to %s from the nvim config.", plugin)
+        return "", cmdArgs, nil
+    }
+
+    base, err := stateDir()
+    if err != nil {
+        return "", nil, err
+    }
+    dir := filepath.Join(base, "sessions", fmt.Sprintf("%s-%s", projectDirName, repoName))
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", nil, fmt.Errorf("error creating session directory: %v", err)
+    }
+
+    sessionFile := sessionTarget + "/Session.vim"
+    args := append([]string{}, cmdArgs...)
+    args = append(args, "--cmd", fmt.Sprintf("autocmd VimLeavePre * mksession! %s", sessionFile))
+    if _, err := os.Stat(filepath.Join(dir, "Session.vim")); err == nil {
+        args = append(args, "-S", sessionFile)
+    }
+    return dir, args, nil
+}
+
+// sessionPluginIn returns the first known session plugin mentioned in an nvim config directory
+func sessionPluginIn(configDir string) string {
+    found := ""
+    filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+        if err != nil || found != "" {
+            return filepath.SkipDir
+        }
+        ext := filepath.Ext(path)
+        if info.IsDir() || (ext != ".lua" && ext != ".vim" && ext != ".json") || info.Size() > 1<<20 {
+            return nil
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil
+        }
+        for _, plugin := range sessionPlugins {
+            if bytes.Contains(data, []byte(plugin)) {
+                found = plugin
+                return filepath.SkipDir
+            }
+        }
+        return nil
+    })
+    return found
+}
+
+// mountConsistency returns the project bind's consistency mode from --mount-consistency or the
+// mount_consistency key; empty keeps the plain bind. Only Docker Desktop for Mac acts on it.
+func mountConsistency(projectDirName, repoName string, opts StartOptions) (string, error) {
+    consistency := opts.MountConsistency
+    if consistency == "" {
+        consistency = viper.GetString(repoSettingKey(projectDirName, repoName, "mount_consistency"))
+    }
+    switch mount.Consistency(consistency) {
+    case "", mount.ConsistencyFull, mount.ConsistencyCached, mount.ConsistencyDelegated, mount.ConsistencyDefault:
+        return consistency, nil
+    }
+    return "", fmt.Errorf("unknown mount consistency %q (want consistent, cached, delegated or default)", consistency)
+}
+
+// ipcMode returns the container's IPC namespace mode from --ipc or the ipc_mode key; empty keeps
+// the daemon default. A sandbox gets a private namespace: --ipc values sharing another one are
+// refused and the key is ignored.
+func ipcMode(projectDirName, repoName string, opts StartOptions) (string, error) {
+    if opts.Sandbox {
+        if ipc := container.IpcMode(opts.IpcMode); ipc.IsHost() || ipc.IsContainer() {
+            return "", fmt.Errorf("--ipc %s can't be used with --sandbox, which keeps its IPC namespace private", opts.IpcMode)
+        }
+        return "private", nil
+    }
+    mode := opts.IpcMode
+    if mode == "" {
+        mode = viper.GetString(repoSettingKey(projectDirName, repoName, "ipc_mode"))
+    }
+    ipc := container.IpcMode(mode)
+    if mode == "" || ipc.IsNone() || ipc.IsPrivate() || ipc.IsShareable() || ipc.IsHost() {
+        return mode, nil
+    }
+    if ipc.IsContainer() && ipc.Container() != "" {
+        return mode, nil
+    }
+    return "", fmt.Errorf("unknown IPC mode %q (want none, private, shareable, host or container:<name>)", mode)
+}
+
+// daemonInVM reports why the Docker daemon doesn't run on a native Linux kernel, or "" when it
+// does. Docker Desktop and WSL 2 run the daemon in a Linux VM, which its info gives away.
+func daemonInVM(info types.Info) string {
+    kernel := strings.ToLower(info.KernelVersion)
+    switch {
+    case info.OSType != "" && info.OSType != "linux":
+        return fmt.Sprintf("the daemon runs on %s/%s", info.OSType, info.Architecture)
+    case strings.Contains(info.OperatingSystem, "Docker Desktop"):
+        return fmt.Sprintf("the daemon runs in the Docker Desktop VM (%s)", info.Architecture)
+    case strings.Contains(kernel, "linuxkit"):
+        return fmt.Sprintf("the daemon runs in a LinuxKit VM (%s)", info.Architecture)
+    case strings.Contains(kernel, "microsoft") || strings.Contains(kernel, "wsl"):
+        return fmt.Sprintf("the daemon runs in the WSL 2 VM (%s)", info.Architecture)
+    }
+    return ""
+}
+
+// warnHostIPCInVM explains that --ipc=host shares the VM's IPC namespace, not the host's, when
+// the daemon isn't running on a native Linux kernel
+func warnHostIPCInVM(ctx context.Context, cli *client.Client, containerName string) {
+    info, err := cli.Info(ctx)
+    if err != nil {
+        logrus.Debugf("Unable to query the Docker daemon for the IPC mode check: %v", err)
+        return
+    }
+    reason := daemonInVM(info)
+    if reason == "" {
+        return
+    }
+    logrus.Warnf("IPC mode host on %s: %s, so the container shares the VM's IPC namespace "+
+        "(shared memory, semaphores, message queues), not your machine's. Processes on the host "+
+        "can't see it. To share IPC with another container, use --ipc=container:<name> instead.",
+        containerName, reason)
+}
+
+// devCommand picks the command run in the container: --debug-shell, --cmd, then --editor, the
+// editor key, the image's com.cdaprod.dev-cmd label, and finally nvim
+func devCommand(projectDirName, repoName, dockerImage string, opts StartOptions) []string {
+    if opts.DebugShell != "" {
+        return []string{opts.DebugShell}
+    }
+    if len(opts.Cmd) > 0 {
+        return opts.Cmd
+    }
+    if opts.Editor != "" {
+        return editorCommand(opts.Editor, workDir(projectDirName, repoName, opts))
+    }
+    if editor := viper.GetString(repoSettingKey(projectDirName, repoName, "editor")); editor != "" {
+        return editorCommand(editor, workDir(projectDirName, repoName, opts))
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err == nil {
+        info, err := InspectImage(context.Background(), cli, dockerImage)
+        if err != nil {
+            logrus.Warnf("Unable to read labels of %s: %v", dockerImage, err)
+        } else if fields, err := shellWords(info.Labels[labelDevCmd]); err != nil {
+            logrus.Warnf("Ignoring the %s label of %s: %v", labelDevCmd, dockerImage, err)
+        } else if len(fields) > 0 {
+            logrus.Infof("Using %s from the %s label of %s", info.Labels[labelDevCmd], labelDevCmd, dockerImage)
+            return fields
+        }
+    }
+    return []string{"nvim"}
+}
+
+// shellWords splits a command line into arguments the way sh does for plain words: whitespace
+// separates them, single quotes keep everything literal, double quotes keep whitespace and
+// honor backslash escapes of " \ $ and `, and an unquoted backslash escapes the next character.
+// Expansions and operators are not supported.
+func shellWords(line string) ([]string, error) {
+    var words []string
+    var word strings.Builder
+    inWord := false
+    for i := 0; i < len(line); i++ {
+        c := line[i]
+        switch {
+        case c == ' ' || c == '\t' || c == '\n':
+            if inWord {
+                words = append(words, word.String())
+                word.Reset()
+                inWord = false
+            }
+        case c == '\'':
+            end := strings.IndexByte(line[i+1:], '\'')
+            if end < 0 {
+                return nil, fmt.Errorf("unterminated single quote in %q", line)
+            }
+            word.WriteString(line[i+1 : i+1+end])
+            i += end + 1
+            inWord = true
+        case c == '"':
+            i++
+            for ; i < len(line) && line[i] != '"'; i++ {
+                if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\"\\$`", line[i+1]) >= 0 {
+                    i++
+                }
+                word.WriteByte(line[i])
+            }
+            if i == len(line) {
+                return nil, fmt.Errorf("unterminated double quote in %q", line)
+            }
+            inWord = true
+        case c == '\\':
+            if i+1 == len(line) {
+                return nil, fmt.Errorf("trailing backslash in %q", line)
+            }
+            i++
+            word.WriteByte(line[i])
+            inWord = true
+        default:
+            word.WriteByte(c)
+            inWord = true
+        }
+    }
+    if inWord {
+        words = append(words, word.String())
+    }
+    return words, nil
+}
+
+// resolveEntrypoint returns the container entrypoint from --entrypoint or the entrypoint key.
+// Docker runs Entrypoint with Cmd appended as its arguments, so an image entrypoint that ignores
+// its arguments never runs the idle command; an empty value clears the image's entrypoint.
+func resolveEntrypoint(projectDirName, repoName string, opts StartOptions) []string {
+    if opts.DebugShell != "" {
+        return []string{opts.DebugShell, "-c"}
+    }
+    if opts.Entrypoint != nil {
+        return opts.Entrypoint
+    }
+    key := repoSettingKey(projectDirName, repoName, "entrypoint")
+    if !viper.IsSet(key) {
+        return nil
+    }
+    if entrypoint := viper.GetStringSlice(key); len(entrypoint) > 0 {
+        return entrypoint
+    }
+    return []string{""}
+}
+
+// networkDisabled reports whether the container gets no networking at all, from --network-disabled
+// or the network_disabled key
+func networkDisabled(projectDirName, repoName string, opts StartOptions) bool {
+    return opts.NetworkDisabled || viper.GetBool(repoSettingKey(projectDirName, repoName, "network_disabled"))
+}
+
+// applyIsolation sets network and privilege options from config. Sandbox mode starts from
+// no network, no capabilities and a read-only rootfs with a tmpfs /tmp; the cap_add, cap_drop
+// and read_only keys still override each of those individually, but a sandbox never gets the
+// network_mode key's network. Every mount of a sandbox is read-only whatever the config says.
+func applyIsolation(projectDirName, repoName string, sandbox bool, spec *ContainerSpec) {
+    if sandbox {
+        spec.NetworkMode = "none"
+        spec.CapDrop = []string{"ALL"}
+        spec.ReadonlyRootfs = true
+        spec.Tmpfs = map[string]string{"/tmp": "rw,nosuid,nodev"}
+        spec.Mounts, spec.Binds = readOnlyMounts(spec.Mounts, spec.Binds)
+    }
+
+    if key := repoSettingKey(projectDirName, repoName, "network_mode"); viper.IsSet(key) && !sandbox {
+        spec.NetworkMode = viper.GetString(key)
+    }
+    if key := repoSettingKey(projectDirName, repoName, "cap_drop"); viper.IsSet(key) {
+        spec.CapDrop = viper.GetStringSlice(key)
+    }
+    if key := repoSettingKey(projectDirName, repoName, "cap_add"); viper.IsSet(key) {
+        spec.CapAdd = viper.GetStringSlice(key)
+    }
+    if key := repoSettingKey(projectDirName, repoName, "read_only"); viper.IsSet(key) {
+        spec.ReadonlyRootfs = viper.GetBool(key)
+    }
+}
+
+// readOnlyMounts returns copies of mounts and bind specs with every one of them read-only
+func readOnlyMounts(mounts []mount.Mount, binds []string) ([]mount.Mount, []string) {
+    roMounts := make([]mount.Mount, len(mounts))
+    for i, m := range mounts {
+        m.ReadOnly = true
+        roMounts[i] = m
+    }
+    var roBinds []string
+    for _, bind := range binds {
+        parts := strings.Split(bind, ":")
+        if len(parts) < 3 {
+            roBinds = append(roBinds, bind+":ro")
+            continue
+        }
+        options := []string{"ro"}
+        for _, option := range strings.Split(parts[len(parts)-1], ",") {
+            if option != "rw" && option != "ro" && option != "" {
+                options = append(options, option)
+            }
+        }
+        parts[len(parts)-1] = strings.Join(options, ",")
+        roBinds = append(roBinds, strings.Join(parts, ":"))
+    }
+    return roMounts, roBinds
+}
+
+// printSandboxBanner states plainly which protections are active before the session starts
+func printSandboxBanner(spec ContainerSpec) {
+    network := spec.NetworkMode
+    if network == "" {
+        network = "default (NOT isolated)"
+    }
+    caps := "dropped: " + strings.Join(spec.CapDrop, ",")
+    if len(spec.CapAdd) > 0 {
+        caps += "; added back: " + strings.Join(spec.CapAdd, ",")
+    }
+    rootfs := "read-only, /tmp is tmpfs"
+    if !spec.ReadonlyRootfs {
+        rootfs = "writable"
+    }
+
+    line := strings.Repeat("=", 64)
+    fmt.Println(line)
+    fmt.Println(" SANDBOXED ENVIRONMENT")
+    fmt.Println("   mounts:        all read-only, no shared caches")
+    fmt.Printf("   network:       %s\n", network)
+    fmt.Printf("   capabilities:  %s\n", caps)
+    fmt.Printf("   root fs:       %s\n", rootfs)
+    fmt.Println("   init_commands: skipped")
+    fmt.Println(line)
+}
+
+// Logging drivers built into Docker; plugin drivers are referenced as <repo>/<name>[:tag]
+var knownLogDrivers = map[string]bool{
+    "none": true, "local": true, "json-file": true, "syslog": true, "journald": true, "gelf": true,
+    "fluentd": true, "awslogs": true, "splunk": true, "etwlogs": true, "gcplogs": true, "logentries": true,
+}
+
+// resolveLogConfig builds the container's logging config from flags or config, saving flag values
+// as the repository's log_driver and log_opts. Options without a driver use json-file.
+func resolveLogConfig(projectDirName, repoName string, opts StartOptions) (container.LogConfig, error) {
+    var logConfig container.LogConfig
+
+    overrides := map[string]interface{}{}
+    if opts.LogDriver != "" {
+        overrides["log_driver"] = opts.LogDriver
+    }
+    if len(opts.LogOpts) > 0 {
+        overrides["log_opts"] = opts.LogOpts
+    }
+
+    driver := viper.GetString(repoSettingKey(projectDirName, repoName, "log_driver"))
+    if opts.LogDriver != "" {
+        driver = opts.LogDriver
+    }
+    logOpts := viper.GetStringSlice(repoSettingKey(projectDirName, repoName, "log_opts"))
+    if len(opts.LogOpts) > 0 {
+        logOpts = opts.LogOpts
+    }
+
+    if driver != "" && !knownLogDrivers[driver] && !strings.Contains(driver, "/") {
+        return logConfig, fmt.Errorf("unknown log driver %q", driver)
+    }
+    if len(logOpts) > 0 && driver == "" {
+        // The daemon's default driver may not take the options; json-file takes max-size and max-file
+        logrus.Infof("Using the json-file log driver for the log options; set log_driver to choose another.")
+        driver = "json-file"
+    }
+    logConfig.Type = driver
+    for _, opt := range logOpts {
+        eq := strings.Index(opt, "=")
+        if eq <= 0 {
+            return logConfig, fmt.Errorf("invalid log option %q, expected key=value", opt)
+        }
+        if logConfig.Config == nil {
+            logConfig.Config = map[string]string{}
+        }
+        logConfig.Config[opt[:eq]] = opt[eq+1:]
+    }
+
+    if err := saveFlagSettings(projectDirName, repoName, opts, overrides); err != nil {
+        return logConfig, err
+    }
+    return logConfig, nil
+}
+
+// resolveDNS returns the DNS settings from --dns, --dns-search and --dns-option or the dns,
+// dns_search and dns_options keys, saving flag values for the repository like docker run's
+func resolveDNS(projectDirName, repoName string, opts StartOptions) (servers, search, options []string, err error) {
+    overrides := map[string]interface{}{}
+    pick := func(flag []string, key string) []string {
+        if len(flag) > 0 {
+            overrides[key] = flag
+            return flag
+        }
+        return viper.GetStringSlice(repoSettingKey(projectDirName, repoName, key))
+    }
+    servers = pick(opts.DNS, "dns")
+    search = pick(opts.DNSSearch, "dns_search")
+    options = pick(opts.DNSOptions, "dns_options")
+
+    for _, server := range servers {
+        if net.ParseIP(server) == nil {
+            return nil, nil, nil, fmt.Errorf("invalid DNS server %q: not an IP address", server)
+        }
+    }
+
+    err = saveFlagSettings(projectDirName, repoName, opts, overrides)
+    return servers, search, options, err
+}
+
+// resolveNetwork applies --network and --network-alias, or the network_aliases key, to the spec,
+// saving flag values for the repository. Docker only resolves aliases on user-defined networks.
+// A sandbox stays off the network: the flags are refused and the key is ignored.
+func resolveNetwork(projectDirName, repoName string, opts StartOptions, spec *ContainerSpec) error {
+    if opts.Sandbox {
+        if opts.Network != "" || len(opts.NetworkAliases) > 0 {
+            return fmt.Errorf("--network and --network-alias can't be used with --sandbox, which has no network")
+        }
+        return nil
+    }
+    overrides := map[string]interface{}{}
+    if opts.Network != "" {
+        spec.NetworkMode = opts.Network
+        overrides["network_mode"] = opts.Network
+    }
+    aliases := opts.NetworkAliases
+    if len(aliases) > 0 {
+        overrides["network_aliases"] = aliases
+    } else {
+        aliases = viper.GetStringSlice(repoSettingKey(projectDirName, repoName, "network_aliases"))
+    }
+
+    if len(aliases) > 0 {
+        mode := container.NetworkMode(spec.NetworkMode)
+        if spec.NetworkMode == "" || !mode.IsUserDefined() {
+            return fmt.Errorf("network aliases need a named network (--network or network_mode), not %q", spec.NetworkMode)
+        }
+        spec.NetworkAliases = aliases
+    }
+    return saveFlagSettings(projectDirName, repoName, opts, overrides)
+}
+
+// resolveCPUSet returns a cpuset from its flag, or else the config key, after checking that it is
+// a comma-separated list of numbers and ranges such as 0-3,8
+func resolveCPUSet(projectDirName, repoName, key, flagValue string) (string, error) {
+    value := flagValue
+    if value == "" {
+        value = viper.GetString(repoSettingKey(projectDirName, repoName, key))
+    }
+    if value == "" {
+        return "", nil
+    }
+    for _, item := range strings.Split(value, ",") {
+        bounds := strings.SplitN(item, "-", 2)
+        low, err := strconv.ParseUint(bounds[0], 10, 16)
+        if err == nil && len(bounds) == 2 {
+            var high uint64
+            if high, err = strconv.ParseUint(bounds[1], 10, 16); err == nil && high < low {
+                err = fmt.Errorf("range is reversed")
+            }
+        }
+        if err != nil {
+            return "", fmt.Errorf("invalid %s %q: %q is not a number or range like 0-3", key, value, item)
+        }
+    }
+    return value, nil
+}
+
+// resolveMemoryResources builds the memory limits for a repository from flags and config, mirroring docker run
+func resolveMemoryResources(projectDirName, repoName string, opts StartOptions) (container.Resources, error) {
+    var resources container.Resources
+
+    overrides := map[string]interface{}{}
+    if opts.Memory != "" {
+        overrides["memory"] = opts.Memory
+    }
+    if opts.MemorySwap != "" {
+        overrides["memory_swap"] = opts.MemorySwap
+    }
+    if opts.MemorySwappiness >= 0 {
+        overrides["memory_swappiness"] = opts.MemorySwappiness
+    }
+
+    memory := viper.GetString(repoSettingKey(projectDirName, repoName, "memory"))
+    if opts.Memory != "" {
+        memory = opts.Memory
+    }
+    if memory != "" {
+        limit, err := units.RAMInBytes(memory)
+        if err != nil {
+            return resources, fmt.Errorf("invalid memory limit %q: %v", memory, err)
+        }
+        resources.Memory = limit
+    }
+
+    swap := viper.GetString(repoSettingKey(projectDirName, repoName, "memory_swap"))
+    if opts.MemorySwap != "" {
+        swap = opts.MemorySwap
+    }
+    if swap == "-1" {
+        resources.MemorySwap = -1
+    } else if swap != "" {
+        limit, err := units.RAMInBytes(swap)
+        if err != nil {
+            return resources, fmt.Errorf("invalid memory-swap limit %q: %v", swap, err)
+        }
+        resources.MemorySwap = limit
+    }
+
+    if resources.MemorySwap != 0 && resources.Memory == 0 {
+        return resources, fmt.Errorf("memory-swap requires a memory limit to be set")
+    }
+    if resources.MemorySwap > 0 && resources.MemorySwap < resources.Memory {
+        return resources, fmt.Errorf("memory-swap (%s) must be greater than or equal to memory (%s)", swap, memory)
+    }
+
+    swappinessKey := repoSettingKey(projectDirName, repoName, "memory_swappiness")
+    if opts.MemorySwappiness >= 0 || viper.IsSet(swappinessKey) {
+        swappiness := viper.GetInt64(swappinessKey)
+        if opts.MemorySwappiness >= 0 {
+            swappiness = opts.MemorySwappiness
+        }
+        if swappiness < 0 || swappiness > 100 {
+            return resources, fmt.Errorf("memory-swappiness must be between 0 and 100, got %d", swappiness)
+        }
+        resources.MemorySwappiness = &swappiness
+    }
+
+    // Without the OOM killer a runaway container stalls instead of dying, which can freeze the host
+    oomConfigured := viper.GetBool(repoSettingKey(projectDirName, repoName, "oom_kill_disable"))
+    if opts.OOMKillDisable || oomConfigured {
+        if resources.Memory == 0 {
+            return resources, fmt.Errorf("oom-kill-disable requires a memory limit (--memory or the memory key)")
+        }
+        if !oomConfigured {
+            logrus.Warn("Disabling the OOM killer lets a container that reaches its memory limit hang instead of being killed; under host memory pressure this can freeze the whole machine.")
+            if !opts.Yes && (opts.NonInteractive || !confirm("Disable the OOM killer anyway?")) {
+                return resources, fmt.Errorf("pass --yes to confirm --oom-kill-disable")
+            }
+            overrides["oom_kill_disable"] = true
+        }
+        disable := true
+        resources.OomKillDisable = &disable
+    }
+
+    if err := saveFlagSettings(projectDirName, repoName, opts, overrides); err != nil {
+        return resources, err
+    }
+    return resources, nil
+}
+
+// resolveGPUs adds a GPU device request (docker run --gpus syntax) to resources and returns the
+// visibility and framework env vars to inject. Variables already present in env are never overridden.
+//
+// Assumptions: the NVIDIA container runtime is installed and renumbers the requested devices from 0
+// inside the container, so CUDA_VISIBLE_DEVICES lists container-side indices while
+// NVIDIA_VISIBLE_DEVICES lists the host devices. The memory fraction is applied through
+// XLA_PYTHON_CLIENT_MEM_FRACTION (JAX/XLA) and TF_FORCE_GPU_ALLOW_GROWTH (TensorFlow); PyTorch
+// has no equivalent variable and must call torch.cuda.set_per_process_memory_fraction itself.
+func resolveGPUs(projectDirName, repoName string, opts StartOptions, resources *container.Resources, env []string) ([]string, error) {
+    gpus := opts.GPUs
+    if gpus == "" {
+        gpus = viper.GetString(repoSettingKey(projectDirName, repoName, "gpus"))
+    }
+    fraction := opts.GPUMemoryFraction
+    if fraction == 0 {
+        fraction = viper.GetFloat64(repoSettingKey(projectDirName, repoName, "gpu_memory_fraction"))
+    }
+    if gpus == "" {
+        if fraction != 0 {
+            return nil, fmt.Errorf("gpu-memory-fraction requires --gpus")
+        }
+        return nil, nil
+    }
+    if fraction < 0 || fraction > 1 {
+        return nil, fmt.Errorf("gpu-memory-fraction must be between 0 and 1, got %v", fraction)
+    }
+
+    request := container.DeviceRequest{Capabilities: [][]string{{"gpu"}}}
+    var visible, cudaVisible string
+    switch {
+    case gpus == "all":
+        request.Count = -1
+        visible = "all"
+    case strings.HasPrefix(gpus, "device="):
+        request.DeviceIDs = strings.Split(strings.TrimPrefix(gpus, "device="), ",")
+        visible = strings.Join(request.DeviceIDs, ",")
+        cudaVisible = containerGPUIndices(len(request.DeviceIDs))
+    default:
+        count, err := strconv.Atoi(gpus)
+        if err != nil || count < 1 {
+            return nil, fmt.Errorf("invalid --gpus value %q (expected all, a count, or device=ID[,ID...])", gpus)
+        }
+        request.Count = count
+        visible = containerGPUIndices(count)
+        cudaVisible = visible
+    }
+    resources.DeviceRequests = append(resources.DeviceRequests, request)
+
+    var injected []string
+    inject := func(key, value string) {
+        if value != "" && !envHasKey(env, key) {
+            injected = append(injected, fmt.Sprintf("%s=%s", key, value))
+        }
+    }
+    inject("NVIDIA_VISIBLE_DEVICES", visible)
+    inject("CUDA_VISIBLE_DEVICES", cudaVisible)
+    if fraction > 0 {
+        inject("XLA_PYTHON_CLIENT_MEM_FRACTION", strconv.FormatFloat(fraction, 'f', -1, 64))
+        inject("TF_FORCE_GPU_ALLOW_GROWTH", "true")
+    }
+    return injected, nil
+}
+
+// containerGPUIndices lists the first n device indices as seen inside the container
+func containerGPUIndices(n int) string {
+    indices := make([]string, n)
+    for i := range indices {
+        indices[i] = strconv.Itoa(i)
+    }
+    return strings.Join(indices, ",")
+}
+
+// envHasKey reports whether an environment list already defines key
+func envHasKey(env []string, key string) bool {
+    for _, entry := range env {
+        if strings.HasPrefix(entry, key+"=") {
+            return true
+        }
+    }
+    return false
+}
+
+// configMu serializes config updates made while environments start in parallel
+var configMu sync.Mutex
+
+// saveFlagSettings persists the settings a start's flags override unless opts.NoSave asks for
+// them to apply to this run only
+func saveFlagSettings(projectDirName, repoName string, opts StartOptions, settings map[string]interface{}) error {
+    if opts.NoSave {
+        if len(settings) > 0 {
+            logrus.Debugf("Not saving %s for %s/%s.", strings.Join(sortedKeys(settings), ", "), projectDirName, repoName)
+        }
+        return nil
+    }
+    return persistRepoSettings(projectDirName, repoName, settings)
+}
+
+// persistRepoSettings stores per-repo setting overrides in the repository's existing config entry
+// and writes them to the config file; it never creates a partial entry
+func persistRepoSettings(projectDirName, repoName string, settings map[string]interface{}) error {
+    if len(settings) == 0 {
+        return nil
+    }
+    if projectDirName == "" {
+        // Ad-hoc environments have no config entry to persist into
+        return nil
+    }
+    if configReadOnly {
+        logrus.Warnf("Config is read-only; not saving %s for %s/%s.", strings.Join(sortedKeys(settings), ", "), projectDirName, repoName)
+        return nil
+    }
+
+    configMu.Lock()
+    defer configMu.Unlock()
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return fmt.Errorf("%s/%s is not configured; not saving %s", projectDirName, repoName, strings.Join(sortedKeys(settings), ", "))
+    }
+    // A repository from the shared section gets personal overrides of just these fields, kept
+    // under the active profile so they aren't shadowed by its overrides
+    projectKey := userRepoKey(projectDirName, repoName)
+    if profile := activeProfile(); profile != "" {
+        projectKey = fmt.Sprintf("%s.profiles.%s", projectKey, profile)
+    }
+    for field, value := range settings {
+        viper.Set(fmt.Sprintf("%s.%s", projectKey, field), value)
+    }
+    return writeConfig()
+}
+
+// deriveHostname returns the container hostname for a repository, honoring the hostname config key
+func deriveHostname(projectDirName, repoName string) string {
+    hostname := viper.GetString(repoFieldKey(projectDirName, repoName, "hostname"))
+    if hostname == "" {
+        hostname = repoName
+    }
+    return sanitizeHostname(hostname)
+}
+
+// sanitizeHostname reduces a name to a valid RFC 1123 hostname label
+func sanitizeHostname(name string) string {
+    var b strings.Builder
+    for _, r := range strings.ToLower(name) {
+        if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+            b.WriteRune(r)
+        } else {
+            b.WriteRune('-')
+        }
+    }
+    hostname := strings.Trim(b.String(), "-")
+    if len(hostname) > 63 {
+        hostname = strings.TrimRight(hostname[:63], "-")
+    }
+    if hostname == "" {
+        hostname = "dev-env"
+    }
+    return hostname
+}
+
+// shellRCPath returns the host rc file to source in container shells, or "" if there is none.
+// shell_rc may be absolute or relative to the project directory (~/Projects/<project>); when it
+// isn't set, <project dir>/.dev-env-rc is used if present.
+func shellRCPath(projectDirName, repoName, projectPath string) (string, error) {
+    path, err := expandEnv(viper.GetString(repoSettingKey(projectDirName, repoName, "shell_rc")))
+    if err != nil {
+        return "", fmt.Errorf("shell_rc: %v", err)
+    }
+    configured := path != ""
+    if !configured {
+        if projectDirName == "" {
+            return "", nil
+        }
+        path = defaultShellRCName
+    }
+    if !filepath.IsAbs(path) {
+        path = filepath.Join(filepath.Dir(projectPath), path)
+    }
+
+    info, err := os.Stat(path)
+    if err != nil || info.IsDir() {
+        if configured {
+            logrus.Warnf("shell_rc %s not found; skipping.", path)
+        }
+        return "", nil
+    }
+    return path, nil
+}
+
+// writePromptSnippet writes the shell snippet that prefixes PS1 with DEV_ENV_NAME and returns its host path
+func writePromptSnippet() (string, error) {
+    dir, err := appDir()
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+
+    snippet := `# Managed by dev-environment-manager
+if [ -n "$DEV_ENV_NAME" ] && [ -n "$PS1" ]; then
+    PS1="[$DEV_ENV_NAME] $PS1"
+fi
+if [ -f ` + shellRCTarget + ` ]; then
+    . ` + shellRCTarget + `
+fi
+`
+    path := filepath.Join(dir, "prompt.sh")
+    if err := os.WriteFile(path, []byte(snippet), 0644); err != nil {
+        return "", err
+    }
+    return path, nil
+}
+
+// AddProjectConfig dynamically adds a new project configuration to the config file
+func AddProjectConfig(projectDirName, repoName, repoURL, dockerImage, containerName string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+
+    username, err := getUsername()
+    if err != nil {
+        return fmt.Errorf("error getting username: %v", err)
+    }
+
+    projectKey := fmt.Sprintf("users.%s.projects.%s.repos.%s", username, projectDirName, repoName)
+
+    // Check if repository already exists
+    if viper.IsSet(projectKey) {
+        return fmt.Errorf("repository %s already exists under project %s for user %s", repoName, projectDirName, username)
+    }
+
+    // Update Viper's in-memory config
+    viper.Set(fmt.Sprintf("%s.repo_url", projectKey), repoURL)
+    viper.Set(fmt.Sprintf("%s.docker_image", projectKey), dockerImage)
+    viper.Set(fmt.Sprintf("%s.container_name", projectKey), containerName)
+
+    // Persist changes to the config file
+    if err := writeConfig(); err != nil {
+        return err
+    }
+
+    // Record when the repository was added; metadata problems never fail the add
+    if err := WriteProjectMetadata(projectDirName, repoName, ProjectMetadata{AddedAt: time.Now().UTC()}); err != nil {
+        logrus.Warnf("Unable to write project metadata: %v", err)
+    }
+
+    logrus.Infof("Repository %s added under project %s for user %s.", repoName, projectDirName, username)
+    return nil
+}
+
+// CopyProjectConfig adds dst as a copy of src's config entry. Names derived from the repository
+// are re-derived for dst: container_name gets the default for dst, a hostname is dropped so it
+// defaults to the new repo name, and a repo_url ending in /<src-repo>.git is pointed at dst-repo
+// unless repoURL overrides it.
+func CopyProjectConfig(srcProject, srcRepo, dstProject, dstRepo, repoURL string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+    src := repoSettings(srcProject, srcRepo)
+    if src == nil {
+        return fmt.Errorf("%s/%s is not configured", srcProject, srcRepo)
+    }
+    if viper.IsSet(repoConfigKey(dstProject, dstRepo)) {
+        return fmt.Errorf("%s/%s already exists", dstProject, dstRepo)
+    }
+    dstKey := userRepoKey(dstProject, dstRepo)
+
+    settings := deepCopyConfig(src).(map[string]interface{})
+    settings["container_name"] = fmt.Sprintf("nvim-%s", strings.ToLower(dstRepo))
+    delete(settings, "hostname")
+    if repoURL == "" {
+        repoURL, _ = settings["repo_url"].(string)
+        suffix := "/" + srcRepo + ".git"
+        if strings.HasSuffix(strings.ToLower(repoURL), strings.ToLower(suffix)) {
+            repoURL = repoURL[:len(repoURL)-len(suffix)] + "/" + dstRepo + ".git"
+        } else if srcRepo != dstRepo {
+            logrus.Warnf("Keeping repo_url %s from %s/%s; pass --repo-url to change it.", repoURL, srcProject, srcRepo)
+        }
+    }
+    settings["repo_url"] = repoURL
+
+    viper.Set(dstKey, settings)
+    if err := writeConfig(); err != nil {
+        return err
+    }
+    if err := WriteProjectMetadata(dstProject, dstRepo, ProjectMetadata{AddedAt: time.Now().UTC()}); err != nil {
+        logrus.Warnf("Unable to write project metadata: %v", err)
+    }
+    logrus.Infof("Copied %s/%s to %s/%s.", srcProject, srcRepo, dstProject, dstRepo)
+    return nil
+}
+
+// deepCopyConfig copies a config value so nested maps and lists aren't shared with the original
+func deepCopyConfig(value interface{}) interface{} {
+    switch v := value.(type) {
+    case map[string]interface{}:
+        copied := make(map[string]interface{}, len(v))
+        for key, child := range v {
+            copied[key] = deepCopyConfig(child)
+        }
+        return copied
+    case []interface{}:
+        copied := make([]interface{}, len(v))
+        for i, child := range v {
+            copied[i] = deepCopyConfig(child)
+        }
+        return copied
+    case []string:
+        return append([]string(nil), v...)
+    default:
+        return v
+    }
+}
+
+// configFilePath returns the config file in use, or the default location if none was found
+func configFilePath() (string, error) {
+    if path := viper.ConfigFileUsed(); path != "" {
+        return path, nil
+    }
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("error getting home directory: %v", err)
+    }
+    return filepath.Join(homeDir, ".dev-env-manager.yaml"), nil
+}
+
+// configTempPath returns a sibling temp file that keeps the config's extension so Viper can infer its type
+func configTempPath(path string) string {
+    ext := filepath.Ext(path)
+    base := strings.TrimSuffix(filepath.Base(path), ext)
+    return filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.tmp-%d%s", base, os.Getpid(), ext))
+}
+
+// writeConfig atomically persists Viper's in-memory config to the config file
+func writeConfig() error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+
+    path, err := configFilePath()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("error creating config directory: %v", err)
+    }
+
+    tmp := configTempPath(path)
+    if err := viper.WriteConfigAs(tmp); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("error writing config file: %v", err)
+    }
+    if err := keepFileMode(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("error writing config file: %v", err)
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return fmt.Errorf("error replacing config file: %v", err)
+    }
+    viper.SetConfigFile(path)
+    return nil
+}
+
+// keepFileMode gives tmp the permissions of path, the file it is about to replace, if that exists
+func keepFileMode(tmp, path string) error {
+    info, err := os.Stat(path)
+    if err != nil {
+        return nil
+    }
+    return os.Chmod(tmp, info.Mode().Perm())
+}
+
+// writeFileAtomic replaces the config file at path with data, refusing when the config is read-only
+func writeFileAtomic(path string, data []byte) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+    return replaceFile(path, data)
+}
+
+// replaceFile replaces path with data via a temp file and rename, keeping path's permissions
+func replaceFile(path string, data []byte) error {
+    tmp := configTempPath(path)
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    if err := keepFileMode(tmp, path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// CloneRepo clones the repository to the destination path, removing any partial checkout on
+// failure. While it runs, progress is summarized every cloneProgressInterval.
+func CloneRepo(ctx context.Context, repoURL, destPath string, progress io.Writer) error {
+    logrus.Infof("Cloning repository %s into %s", repoURL, destPath)
+    tracker := &progressTracker{out: progress}
+    stopReport := reportCloneProgress(destPath, tracker)
+    defer stopReport()
+
+    _, err := git.PlainCloneContext(ctx, destPath, false, &git.CloneOptions{
+        URL:      repoURL,
+        Progress: tracker,
+    })
+    if err != nil {
+        os.RemoveAll(destPath)
+        if gitPath, lookErr := exec.LookPath("git"); lookErr == nil && goGitUnsupported(err) {
+            logrus.Warnf("go-git cannot clone %s (%v); falling back to %s.", repoURL, err, gitPath)
+            // Without a progress writer git runs quietly so its errors are kept
+            var gitProgress io.Writer
+            if progress != nil {
+                gitProgress = tracker
+            }
+            err = cloneWithGit(ctx, gitPath, repoURL, destPath, gitProgress)
+        }
+    }
+    if err != nil {
+        logrus.Errorf("Error cloning repository: %v", err)
+        os.RemoveAll(destPath)
+    }
+    return err
+}
+
+// cloneProgressInterval is how often a running clone reports how far it got
+const cloneProgressInterval = 10 * time.Second
+
+// progressTracker passes progress output through, remembering its latest line
+type progressTracker struct {
+    mu      sync.Mutex
+    out     io.Writer
+    last    string
+    pending []byte
+}
+
+func (t *progressTracker) Write(p []byte) (int, error) {
+    t.mu.Lock()
+    t.pending = append(t.pending, p...)
+    for {
+        i := bytes.IndexAny(t.pending, "\r\n")
+        if i < 0 {
+            break
+        }
+        if line := strings.TrimSpace(string(t.pending[:i])); line != "" {
+            t.last = line
+        }
+        t.pending = t.pending[i+1:]
+    }
+    t.mu.Unlock()
+    if t.out == nil {
+        return len(p), nil
+    }
+    return t.out.Write(p)
+}
+
+// Last returns the most recent complete progress line
+func (t *progressTracker) Last() string {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.last
+}
+
+// treeSize returns the total size of the files under dir
+func treeSize(dir string) int64 {
+    var size int64
+    filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+        if err == nil && !info.IsDir() {
+            size += info.Size()
+        }
+        return nil
+    })
+    return size
+}
+
+// reportCloneProgress logs the bytes received into destPath and the latest git progress line
+// (objects received) every cloneProgressInterval, saying so when nothing arrived since the
+// previous report, until the returned function is called
+func reportCloneProgress(destPath string, tracker *progressTracker) func() {
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(cloneProgressInterval)
+        defer ticker.Stop()
+        began := time.Now()
+        var lastSize int64
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            size := treeSize(destPath)
+            elapsed := time.Since(began).Round(time.Second)
+            status := tracker.Last()
+            if status == "" {
+                status = "no progress reported by the server"
+            }
+            if size == lastSize {
+                logrus.Warnf("Clone stalled: nothing received in the last %s (%s received in %s; %s)", cloneProgressInterval, units.BytesSize(float64(size)), elapsed, status)
+            } else {
+                logrus.Infof("Clone progress: %s received in %s; %s", units.BytesSize(float64(size)), elapsed, status)
+            }
+            lastSize = size
+        }
+    }()
+    return func() { close(done) }
+}
+
+// goGitUnsupported reports whether a clone error comes from a transport or protocol feature
+// go-git lacks, such as an unknown scheme, server capabilities it can't negotiate (multi_ack on
+// Azure DevOps) or SSH setups it can't follow, rather than from the repository or credentials
+func goGitUnsupported(err error) bool {
+    if errors.Is(err, context.Canceled) || errors.Is(err, transport.ErrRepositoryNotFound) ||
+        errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed) {
+        return false
+    }
+    msg := strings.ToLower(err.Error())
+    for _, marker := range []string{"unsupported", "capabilit", "multi_ack", "ssh: handshake failed", "knownhosts", "ssh_auth_sock"} {
+        if strings.Contains(msg, marker) {
+            return true
+        }
+    }
+    return false
+}
+
+// cloneWithGit clones with the system git binary, which honors ~/.ssh/config, credential helpers
+// and every transport. Its progress goes to progress; without one, only its errors are kept.
+func cloneWithGit(ctx context.Context, gitPath, repoURL, destPath string, progress io.Writer) error {
+    if progress != nil {
+        cmd := exec.CommandContext(ctx, gitPath, "clone", "--progress", repoURL, destPath)
+        cmd.Stdout = progress
+        cmd.Stderr = progress
+        if err := cmd.Run(); err != nil {
+            return fmt.Errorf("git clone failed: %v", err)
+        }
+        return nil
+    }
+    out, err := exec.CommandContext(ctx, gitPath, "clone", "--quiet", repoURL, destPath).CombinedOutput()
+    if err != nil {
+        return fmt.Errorf("git clone failed: %v: %s", err, strings.TrimSpace(string(out)))
+    }
+    return nil
+}
+
+// prefixWriter labels each line written to it so concurrent progress streams stay distinguishable
+type prefixWriter struct {
+    mu     *sync.Mutex
+    out    io.Writer
+    prefix string
+    buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+    w.buf = append(w.buf, p...)
+    for {
+        // go-git redraws progress with carriage returns, so treat them as line ends too
+        i := bytes.IndexAny(w.buf, "\r\n")
+        if i < 0 {
+            break
+        }
+        line := w.buf[:i+1]
+        w.mu.Lock()
+        _, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+        w.mu.Unlock()
+        w.buf = w.buf[i+1:]
+        if err != nil {
+            return len(p), err
+        }
+    }
+    return len(p), nil
+}
+
+// Flush writes any trailing partial line
+func (w *prefixWriter) Flush() {
+    if len(w.buf) == 0 {
+        return
+    }
+    w.mu.Lock()
+    fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf)
+    w.mu.Unlock()
+    w.buf = nil
+}
+
+// PoolTask is one unit of work for runPool. Output written to out is prefixed with Name.
+// Cleanup, if set, runs after Run returns, including when Run was cut short by cancellation.
+type PoolTask struct {
+    Name    string
+    Run     func(ctx context.Context, out io.Writer) error
+    Cleanup func()
+}
+
+// defaultParallelism is the worker count used when --parallel isn't given
+func defaultParallelism() int {
+    n := runtime.NumCPU()
+    if n > 4 {
+        n = 4
+    }
+    return n
+}
+
+// runPool runs tasks on at most parallel workers and reports every failure together once all
+// workers finish. Cancelling ctx stops tasks that haven't started; running tasks see ctx.Done().
+func runPool(ctx context.Context, parallel int, tasks []PoolTask) error {
+    if parallel < 1 {
+        parallel = 1
+    }
+
+    var mu sync.Mutex
+    errs := make([]error, len(tasks))
+    next := make(chan int)
+    var wg sync.WaitGroup
+    for w := 0; w < parallel && w < len(tasks); w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := range next {
+                errs[i] = runPoolTask(ctx, tasks[i], &prefixWriter{mu: &mu, out: os.Stdout, prefix: fmt.Sprintf("[%s] ", tasks[i].Name)})
+            }
+        }()
+    }
+
+feed:
+    for i := range tasks {
+        select {
+        case next <- i:
+        case <-ctx.Done():
+            for j := i; j < len(tasks); j++ {
+                errs[j] = fmt.Errorf("not started: %v", ctx.Err())
+            }
+            break feed
+        }
+    }
+    close(next)
+    wg.Wait()
+
+    var failed []string
+    for i, err := range errs {
+        if err != nil {
+            failed = append(failed, fmt.Sprintf("  - %s: %v", tasks[i].Name, err))
+        }
+    }
+    if len(failed) > 0 {
+        return fmt.Errorf("%d of %d failed:\n%s", len(failed), len(tasks), strings.Join(failed, "\n"))
+    }
+    return nil
+}
+
+// runPoolTask runs a single task, flushing its output and running its cleanup afterwards
+func runPoolTask(ctx context.Context, task PoolTask, out *prefixWriter) error {
+    defer func() {
+        out.Flush()
+        if task.Cleanup != nil {
+            task.Cleanup()
+        }
+    }()
+    if err := ctx.Err(); err != nil {
+        return fmt.Errorf("not started: %v", err)
+    }
+    return task.Run(ctx, out)
+}
+
+// UpdateImages pulls the images of all configured repositories, each image once, on parallel workers.
+// With relock, locked repositories whose image was pulled are locked again to its new digest.
+func UpdateImages(parallel int, quietPull, relock bool) error {
+    repos, err := configuredRepos(false)
+    if err != nil {
+        return err
+    }
+
+    var pulledMu sync.Mutex
+    pulled := make(map[string]bool)
+    seen := make(map[string]bool)
+    var tasks []PoolTask
+    for _, repo := range repos {
+        _, dockerImage, _, err := deriveProjectValues(repo.Project, repo.Repo)
+        if err != nil {
+            logrus.Warnf("Skipping %s/%s: %v", repo.Project, repo.Repo, err)
+            continue
+        }
+        if dockerImage == "" || seen[dockerImage] {
+            continue
+        }
+        seen[dockerImage] = true
+
+        image := dockerImage
+        tasks = append(tasks, PoolTask{
+            Name: image,
+            Run: func(ctx context.Context, out io.Writer) error {
+                if err := PullImage(ctx, image, pullProgress(out, quietPull)); err != nil {
+                    return err
+                }
+                pulledMu.Lock()
+                pulled[image] = true
+                pulledMu.Unlock()
+                return reportImage(ctx, image, out)
+            },
+        })
+    }
+    if len(tasks) == 0 {
+        logrus.Info("No images configured.")
+        return nil
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    poolErr := runPool(ctx, parallel, tasks)
+    if !relock {
+        return poolErr
+    }
+
+    for _, repo := range repos {
+        if viper.GetString(repo.Key()+".docker_image_digest") == "" {
+            continue
+        }
+        _, dockerImage, _, err := deriveProjectValues(repo.Project, repo.Repo)
+        if err != nil || !pulled[dockerImage] {
+            continue
+        }
+        locked, err := LockProjectImage(repo.Project, repo.Repo)
+        if err != nil {
+            logrus.Errorf("Unable to relock %s/%s: %v", repo.Project, repo.Repo, err)
+            if poolErr == nil {
+                poolErr = fmt.Errorf("some repositories could not be relocked")
+            }
+            continue
+        }
+        logrus.Infof("Relocked %s/%s to %s.", repo.Project, repo.Repo, locked)
+    }
+    return poolErr
+}
+
+// digestPattern matches the content digest of an image reference
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// unpinnedImage strips a @digest from an image reference, leaving its name and tag
+func unpinnedImage(image string) string {
+    if at := strings.Index(image, "@"); at >= 0 {
+        return image[:at]
+    }
+    return image
+}
+
+// resolveImageDigest returns the digest a tag currently points to: the registry's manifest digest,
+// which covers every platform, or the local image's repo digest when the registry can't be asked
+func resolveImageDigest(ctx context.Context, image string) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "", fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    dist, err := cli.DistributionInspect(ctx, image, "")
+    if err == nil {
+        return dist.Descriptor.Digest.String(), nil
+    }
+    logrus.Warnf("Unable to ask the registry about %s (%v); using the local image.", image, err)
+
+    inspect, _, inspectErr := cli.ImageInspectWithRaw(ctx, image)
+    if inspectErr != nil {
+        return "", fmt.Errorf("cannot resolve %s: %v", image, inspectErr)
+    }
+    name := image
+    if slash, colon := strings.LastIndex(name, "/"), strings.LastIndex(name, ":"); colon > slash {
+        name = name[:colon]
+    }
+    for _, repoDigest := range inspect.RepoDigests {
+        if at := strings.LastIndex(repoDigest, "@"); at >= 0 && strings.HasSuffix(repoDigest[:at], name) {
+            return repoDigest[at+1:], nil
+        }
+    }
+    return "", fmt.Errorf("local image %s has no registry digest; push or pull it first", image)
+}
+
+// PinProjectImage rewrites a repository's docker_image as name:tag@digest so every start uses
+// the same image bits. digest is resolved from the tag's current image when empty. Pinning a
+// pinned image again re-resolves its tag. It returns the new reference.
+func PinProjectImage(projectDirName, repoName, digest string) (string, error) {
+    if configReadOnly {
+        return "", errConfigReadOnly
+    }
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return "", fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    key := userRepoKey(projectDirName, repoName)
+    _, dockerImage, _, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return "", err
+    }
+    if strings.Contains(viper.GetString(repoFieldKey(projectDirName, repoName, "docker_image")), "$") {
+        logrus.Warnf("docker_image of %s/%s uses environment variables; the pinned reference stores their current values.", projectDirName, repoName)
+    }
+
+    base := unpinnedImage(dockerImage)
+    if digest == "" {
+        if digest, err = resolveImageDigest(context.Background(), base); err != nil {
+            return "", err
+        }
+    }
+    if !digestPattern.MatchString(digest) {
+        return "", fmt.Errorf("invalid digest %q: expected sha256:<64 hex digits>", digest)
+    }
+
+    pinned := base + "@" + digest
+    viper.Set(key+".docker_image", pinned)
+    if err := writeConfig(); err != nil {
+        return "", err
+    }
+    return pinned, nil
+}
+
+// lockedImage returns the reference start pulls and runs: the image at its docker_image_digest when
+// the repository is locked, else the image itself. The tag is kept in front of the digest so
+// Docker and the tool's output still show it.
+func lockedImage(projectDirName, repoName, dockerImage string) string {
+    digest := viper.GetString(repoFieldKey(projectDirName, repoName, "docker_image_digest"))
+    if digest == "" {
+        return dockerImage
+    }
+    return unpinnedImage(dockerImage) + "@" + digest
+}
+
+// LockProjectImage resolves the tag of a repository's docker_image to its current digest and
+// stores it as docker_image_digest, leaving docker_image as written. It returns the locked reference.
+func LockProjectImage(projectDirName, repoName string) (string, error) {
+    if configReadOnly {
+        return "", errConfigReadOnly
+    }
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return "", fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    key := userRepoKey(projectDirName, repoName)
+    _, dockerImage, _, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return "", err
+    }
+    if unpinnedImage(dockerImage) != dockerImage {
+        return "", fmt.Errorf("docker_image of %s/%s is already pinned to a digest by pin-project", projectDirName, repoName)
+    }
+
+    digest, err := resolveImageDigest(context.Background(), dockerImage)
+    if err != nil {
+        return "", err
+    }
+    viper.Set(key+".docker_image_digest", digest)
+    if err := writeConfig(); err != nil {
+        return "", err
+    }
+    return dockerImage + "@" + digest, nil
+}
+
+// UnlockProjectImage removes a repository's docker_image_digest so start follows its tag again.
+// The key is removed from the parsed file, like RemoveProjectConfig does.
+func UnlockProjectImage(projectDirName, repoName string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+
+    username, err := getUsername()
+    if err != nil {
+        return fmt.Errorf("error getting username: %v", err)
+    }
+    path, err := configFilePath()
+    if err != nil {
+        return err
+    }
+    _, tree, err := readConfigTree(path)
+    if err != nil {
+        return err
+    }
+    repos, repoKey, ok := repoSubtree(tree, username, projectDirName, repoName)
+    if !ok {
+        return fmt.Errorf("repository %s is not configured under project %s for user %s", repoName, projectDirName, username)
+    }
+    repo, _ := repos[repoKey].(map[string]interface{})
+    if _, locked := repo["docker_image_digest"]; !locked {
+        return fmt.Errorf("%s/%s is not locked", projectDirName, repoName)
+    }
+    delete(repo, "docker_image_digest")
+
+    data, err := yaml.Marshal(tree)
+    if err != nil {
+        return fmt.Errorf("error encoding config: %v", err)
+    }
+    if err := writeFileAtomic(path, data); err != nil {
+        return fmt.Errorf("error writing config file: %v", err)
+    }
+    if err := viper.ReadInConfig(); err != nil {
+        return fmt.Errorf("error reloading config: %v", err)
+    }
+    return nil
+}
+
+// entryImageAndContainer returns the Docker image and container name of a config entry, which may
+// belong to any user, like deriveProjectValues does for the current user's
+func entryImageAndContainer(entry RepoEntry) (string, string, error) {
+    settings := viper.GetStringMapString(entry.Key())
+    dockerImage, err := expandEnv(settings["docker_image"])
+    if err != nil {
+        return "", "", fmt.Errorf("docker_image: %v", err)
+    }
+    return dockerImage, settings["container_name"], nil
+}
+
+// deriveProjectValues uses the Registry pattern to derive repository URL, Docker image, and container name
+func deriveProjectValues(projectDirName, repoName string) (repoURL, dockerImage, containerName string, err error) {
+    if viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        if repoURL, err = expandEnv(viper.GetString(repoFieldKey(projectDirName, repoName, "repo_url"))); err != nil {
+            return "", "", "", fmt.Errorf("repo_url: %v", err)
+        }
+        if dockerImage, err = expandEnv(viper.GetString(repoFieldKey(projectDirName, repoName, "docker_image"))); err != nil {
+            return "", "", "", fmt.Errorf("docker_image: %v", err)
+        }
+        return repoURL, dockerImage, viper.GetString(repoFieldKey(projectDirName, repoName, "container_name")), nil
+    }
+
+    // If not set in config, derive defaults
+    repoURL = fmt.Sprintf("https://github.com/Cdaprod/%s.git", strings.ToLower(repoName))
+    dockerImage = fmt.Sprintf("cdaprod/%s:latest", strings.ToLower(repoName))
+    containerName = fmt.Sprintf("nvim-%s", strings.ToLower(repoName))
+
+    return repoURL, dockerImage, containerName, nil
+}
+
+// expandEnv expands $VAR and ${VAR} references in a config value against the host environment.
+// Undefined variables are an error unless allow_undefined_env is set, in which case they expand to "".
+func expandEnv(value string) (string, error) {
+    if !strings.Contains(value, "$") {
+        return value, nil
+    }
+
+    var missing []string
+    expanded := os.Expand(value, func(name string) string {
+        v, ok := os.LookupEnv(name)
+        if !ok {
+            missing = append(missing, name)
+        }
+        return v
+    })
+    if len(missing) > 0 && !viper.GetBool("allow_undefined_env") {
+        return "", fmt.Errorf("undefined environment variable(s) %s in %q", strings.Join(missing, ", "), value)
+    }
+    return expanded, nil
+}
+
+// expandEnvSlice applies expandEnv to every entry of a config list
+func expandEnvSlice(values []string) ([]string, error) {
+    expanded := make([]string, 0, len(values))
+    for _, value := range values {
+        v, err := expandEnv(value)
+        if err != nil {
+            return nil, err
+        }
+        expanded = append(expanded, v)
+    }
+    return expanded, nil
+}
+
+// repoEnv returns a repository's expanded env config, failing if any entry is malformed
+func repoEnv(projectDirName, repoName string) ([]string, error) {
+    env, err := expandEnvSlice(viper.GetStringSlice(repoFieldKey(projectDirName, repoName, "env")))
+    if err != nil {
+        return nil, fmt.Errorf("error reading env config: %v", err)
+    }
+    if err := checkEnv("env config", env); err != nil {
+        return nil, err
+    }
+    return env, nil
+}
+
+// withExtraEnv validates the --extra-env entries and applies them over the configured env, replacing
+// entries with the same key. They are never saved to the config.
+func withExtraEnv(env, extra []string) ([]string, error) {
+    if len(extra) == 0 {
+        return env, nil
+    }
+    if err := checkEnv("--extra-env", extra); err != nil {
+        return nil, err
+    }
+    return overrideEnv(env, extra), nil
+}
+
+// overrideEnv returns env with the entries of over appended, dropping entries of env whose key
+// over sets again
+func overrideEnv(env, over []string) []string {
+    overridden := make(map[string]bool)
+    for _, entry := range over {
+        overridden[strings.SplitN(entry, "=", 2)[0]] = true
+    }
+    merged := make([]string, 0, len(env)+len(over))
+    for _, entry := range env {
+        if key := strings.SplitN(entry, "=", 2)[0]; overridden[key] {
+            logrus.Debugf("Overriding %s", key)
+            continue
+        }
+        merged = append(merged, entry)
+    }
+    return append(merged, over...)
+}
+
+// checkEnv validates env entries, reporting every problem at once under what
+func checkEnv(what string, env []string) error {
+    errs := ValidateEnv(env)
+    if len(errs) == 0 {
+        return nil
+    }
+    msgs := make([]string, len(errs))
+    for i, e := range errs {
+        msgs[i] = "  - " + e.Error()
+    }
+    return fmt.Errorf("invalid %s:\n%s", what, strings.Join(msgs, "\n"))
+}
+
+// ValidateEnv checks KEY=value entries before they reach Docker, which accepts malformed ones silently.
+// Keys must match [A-Za-z_][A-Za-z0-9_]* and be unique; values may contain '=' but not NUL bytes.
+func ValidateEnv(env []string) []error {
+    var errs []error
+    seen := make(map[string]int)
+    for i, entry := range env {
+        eq := strings.Index(entry, "=")
+        if eq < 0 {
+            errs = append(errs, fmt.Errorf("entry %d %q: missing '='", i+1, entry))
+            continue
+        }
+        key, value := entry[:eq], entry[eq+1:]
+        if !validEnvKey(key) {
+            errs = append(errs, fmt.Errorf("entry %d %q: invalid key %q", i+1, entry, key))
+        } else if first, dup := seen[key]; dup {
+            errs = append(errs, fmt.Errorf("entry %d: key %s already set by entry %d", i+1, key, first))
+        } else {
+            seen[key] = i + 1
+        }
+        if strings.ContainsRune(value, 0) {
+            errs = append(errs, fmt.Errorf("entry %d: value of %s contains a NUL byte", i+1, key))
+        }
+    }
+    return errs
+}
+
+// validEnvKey reports whether key is a portable environment variable name
+func validEnvKey(key string) bool {
+    if key == "" {
+        return false
+    }
+    for i, r := range key {
+        letter := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r == '_'
+        if !letter && (i == 0 || r < '0' || r > '9') {
+            return false
+        }
+    }
+    return true
+}
+
+// userRepoKey returns the Viper key of a repository's entry in the current user's own section,
+// which is where changes are written even when the repository comes from the shared section
+func userRepoKey(projectDirName, repoName string) string {
+    username, err := getUsername()
+    if err != nil {
+        logrus.Warnf("Unable to get username, deriving defaults: %v", err)
+    }
+    return fmt.Sprintf("users.%s.projects.%s.repos.%s", username, projectDirName, repoName)
+}
+
+// repoConfigKey returns the Viper key of a repository's entry for the current user: the personal
+// entry, else a shared one of the same name. Use it to check that a repository is configured;
+// read its fields with repoFieldKey or repoSettings and write them under userRepoKey.
+func repoConfigKey(projectDirName, repoName string) string {
+    key := userRepoKey(projectDirName, repoName)
+    if shared := fmt.Sprintf("users.%s.projects.%s.repos.%s", sharedUser, projectDirName, repoName); !viper.IsSet(key) && viper.IsSet(shared) {
+        return shared
+    }
+    return key
+}
+
+// activeProfile returns the profile selected with --profile, else by the profile key, or "" for none
+func activeProfile() string {
+    if profileOverride != "" {
+        return profileOverride
+    }
+    return viper.GetString("profile")
+}
+
+// repoFieldKey returns the Viper key of one field of a repository's entry: the personal entry's
+// if it sets the field, else the shared entry's, so personal entries win field by field. The
+// active profile's override of the field in either entry wins over both.
+func repoFieldKey(projectDirName, repoName, field string) string {
+    key := userRepoKey(projectDirName, repoName) + "." + field
+    shared := fmt.Sprintf("users.%s.projects.%s.repos.%s.%s", sharedUser, projectDirName, repoName, field)
+    if profile := activeProfile(); profile != "" {
+        for _, entry := range []string{userRepoKey(projectDirName, repoName), fmt.Sprintf("users.%s.projects.%s.repos.%s", sharedUser, projectDirName, repoName)} {
+            if override := fmt.Sprintf("%s.profiles.%s.%s", entry, profile, field); viper.IsSet(override) {
+                return override
+            }
+        }
+    }
+    if !viper.IsSet(key) && viper.IsSet(shared) {
+        return shared
+    }
+    return key
+}
+
+// repoSettings returns a repository's entry with the shared entry's fields under the personal
+// entry's, or nil when neither exists
+func repoSettings(projectDirName, repoName string) map[string]interface{} {
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return nil
+    }
+    settings := map[string]interface{}{}
+    for _, key := range []string{fmt.Sprintf("users.%s.projects.%s.repos.%s", sharedUser, projectDirName, repoName), userRepoKey(projectDirName, repoName)} {
+        for field, value := range viper.GetStringMap(key) {
+            settings[field] = value
+        }
+    }
+    return settings
+}
+
+// repoSettingKey returns the per-repo key for a setting if present, otherwise the active profile's
+// global override, otherwise the global key of the same name
+func repoSettingKey(projectDirName, repoName, field string) string {
+    key := repoFieldKey(projectDirName, repoName, field)
+    if viper.IsSet(key) {
+        return key
+    }
+    if profile := activeProfile(); profile != "" {
+        if override := fmt.Sprintf("profiles.%s.%s", profile, field); viper.IsSet(override) {
+            return override
+        }
+    }
+    return field
+}
+
+// appDir returns the directory holding the tool's generated files, $DEV_ENV_MANAGER_HOME when set
+func appDir() (string, error) {
+    if dir := os.Getenv("DEV_ENV_MANAGER_HOME"); dir != "" {
+        return dir, nil
+    }
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("error getting home directory: %v", err)
+    }
+    return filepath.Join(homeDir, ".dev-env-manager"), nil
+}
+
+// ImageInfo is the subset of an image inspection the tool uses, as stored in the image cache
+type ImageInfo struct {
+    Digest   string            `json:"digest"`
+    Platform string            `json:"platform"`
+    Labels   map[string]string `json:"labels,omitempty"`
+    CachedAt time.Time         `json:"cached_at"`
+}
+
+// imageCacheMu serializes access to the image cache file between concurrent workers
+var imageCacheMu sync.Mutex
+
+// cacheDir returns the tool's directory under $XDG_CACHE_HOME
+func cacheDir() (string, error) {
+    base := os.Getenv("XDG_CACHE_HOME")
+    if base == "" {
+        homeDir, err := os.UserHomeDir()
+        if err != nil {
+            return "", fmt.Errorf("error getting home directory: %v", err)
+        }
+        base = filepath.Join(homeDir, ".cache")
+    }
+    return filepath.Join(base, "dev-env-manager"), nil
+}
+
+// imageCachePath returns the file holding cached image inspections
+func imageCachePath() (string, error) {
+    dir, err := cacheDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "images.json"), nil
+}
+
+// readImageCache loads the image cache; a missing or corrupt file is an empty cache
+func readImageCache(path string) map[string]ImageInfo {
+    cache := make(map[string]ImageInfo)
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return cache
+    }
+    if err := json.Unmarshal(data, &cache); err != nil {
+        logrus.Debugf("Ignoring unreadable image cache %s: %v", path, err)
+        return make(map[string]ImageInfo)
+    }
+    return cache
+}
+
+// writeImageCache replaces the image cache file
+func writeImageCache(path string, cache map[string]ImageInfo) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(cache, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := configTempPath(path)
+    if err := os.WriteFile(tmp, data, 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, path); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// InspectImage returns details of a local image, served from the on-disk cache while fresh
+func InspectImage(ctx context.Context, cli *client.Client, imageRef string) (ImageInfo, error) {
+    path, err := imageCachePath()
+    if err != nil {
+        return ImageInfo{}, err
+    }
+    if !noImageCache {
+        imageCacheMu.Lock()
+        cached, ok := readImageCache(path)[imageRef]
+        imageCacheMu.Unlock()
+        if ok && time.Since(cached.CachedAt) < imageCacheTTL {
+            return cached, nil
+        }
+    }
+
+    inspect, _, err := cli.ImageInspectWithRaw(ctx, imageRef)
+    if err != nil {
+        return ImageInfo{}, fmt.Errorf("error inspecting image %s: %v", imageRef, err)
+    }
+    info := ImageInfo{
+        Digest:   inspect.ID,
+        Platform: inspect.Os + "/" + inspect.Architecture,
+        CachedAt: time.Now(),
+    }
+    if inspect.Variant != "" {
+        info.Platform += "/" + inspect.Variant
+    }
+    if len(inspect.RepoDigests) > 0 {
+        if at := strings.LastIndex(inspect.RepoDigests[0], "@"); at >= 0 {
+            info.Digest = inspect.RepoDigests[0][at+1:]
+        }
+    }
+    if inspect.Config != nil {
+        info.Labels = inspect.Config.Labels
+    }
+
+    if !noImageCache {
+        imageCacheMu.Lock()
+        cache := readImageCache(path)
+        cache[imageRef] = info
+        if err := writeImageCache(path, cache); err != nil {
+            logrus.Debugf("Unable to update image cache: %v", err)
+        }
+        imageCacheMu.Unlock()
+    }
+    return info, nil
+}
+
+// invalidateImage drops the cached inspection of an image whose tag may now point elsewhere
+func invalidateImage(imageRef string) {
+    path, err := imageCachePath()
+    if err != nil {
+        return
+    }
+    imageCacheMu.Lock()
+    defer imageCacheMu.Unlock()
+    cache := readImageCache(path)
+    if _, ok := cache[imageRef]; !ok {
+        return
+    }
+    delete(cache, imageRef)
+    if err := writeImageCache(path, cache); err != nil {
+        // A stale entry must not survive a pull, so fall back to discarding the whole cache
+        logrus.Warnf("Unable to update image cache, clearing it: %v", err)
+        os.Remove(path)
+    }
+}
+
+// ClearImageCache removes every cached image inspection
+func ClearImageCache() error {
+    path, err := imageCachePath()
+    if err != nil {
+        return err
+    }
+    if skipForDryRun("remove %s", path) {
+        return nil
+    }
+    imageCacheMu.Lock()
+    defer imageCacheMu.Unlock()
+    if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// reportImage prints the digest and platform an image resolved to
+func reportImage(ctx context.Context, imageRef string, out io.Writer) error {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := InspectImage(ctx, cli, imageRef)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(out, "%s (%s)\n", info.Digest, info.Platform)
+    return nil
+}
+
+// pullProgress returns where image pull progress should go: w, or nowhere when quiet is set
+func pullProgress(w io.Writer, quiet bool) io.Writer {
+    if quiet {
+        return io.Discard
+    }
+    return w
+}
+
+// PullImage pulls an image, writing the daemon's progress stream to progress. An image the
+// registry rules of the policy section forbid is refused before anything is pulled.
+func PullImage(ctx context.Context, imageName string, progress io.Writer) error {
+    if err := checkImagePolicy(imageName); err != nil {
+        return err
+    }
+    return pullImage(ctx, imageName, progress)
+}
+
+// pullImage pulls an image without checking the policy, for start, which has already enforced it
+// with --override-policy taken into account
+func pullImage(ctx context.Context, imageName string, progress io.Writer) error {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    logrus.Infof("Pulling Docker image %s...", imageName)
+    // Even a failed pull may have moved the tag, so never trust the cached inspection afterwards
+    defer invalidateImage(imageName)
+    reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
+    if err != nil {
+        logrus.Errorf("Error pulling image %s: %v", imageName, err)
+        return err
+    }
+    defer reader.Close()
+    if _, err := io.Copy(progress, reader); err != nil { // Display pull progress
+        return fmt.Errorf("error reading pull progress: %v", err)
+    }
+    auditImagePulled(imageName)
+    return nil
+}
+
+// specHostConfig returns the host configuration, volume bindings included, of a container spec
+func specHostConfig(spec ContainerSpec) *container.HostConfig {
+    return &container.HostConfig{
+        Binds:          spec.Binds, // volumes whose options only the bind syntax can express
+        Mounts:         spec.Mounts,
+        Resources:      spec.Resources,
+        LogConfig:      spec.LogConfig,
+        DNS:            spec.DNS,
+        DNSSearch:      spec.DNSSearch,
+        DNSOptions:     spec.DNSOptions,
+        NetworkMode:    container.NetworkMode(spec.NetworkMode),
+        IpcMode:        container.IpcMode(spec.IpcMode),
+        CapAdd:         spec.CapAdd,
+        CapDrop:        spec.CapDrop,
+        ReadonlyRootfs: spec.ReadonlyRootfs,
+        Tmpfs:          spec.Tmpfs,
+    }
+}
+
+// RunContainer creates and starts a Docker container described by spec; the image must already be pulled.
+// If the container was created but failed to start or exited immediately, its ID is returned with the error.
+func RunContainer(spec ContainerSpec) (string, error) {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        logrus.Errorf("Error creating Docker client: %v", err)
+        return "", err
+    }
+    return runContainer(context.Background(), cli, spec)
+}
+
+// runContainer is RunContainer with a Docker client
+func runContainer(ctx context.Context, cli *client.Client, spec ContainerSpec) (string, error) {
+    imageName, containerName := spec.Image, spec.Name
+
+    // Give each running instance a distinct hostname
+    hostname := spec.Hostname
+    if hostname != "" {
+        hostname = uniqueHostname(ctx, cli, hostname)
+    }
+    labels := map[string]string{labelHostname: hostname, labelManaged: "true"}
+    for k, v := range spec.Labels {
+        labels[k] = v
+    }
+
+    // Define container configuration
+    containerConfig := &container.Config{
+        Image:           imageName,
+        Hostname:        hostname,
+        Entrypoint:      spec.Entrypoint,
+        WorkingDir:      spec.WorkingDir,
+        StopSignal:      spec.StopSignal,
+        Cmd:             spec.Cmd,
+        Env:             spec.Env,
+        Labels:          labels,
+        NetworkDisabled: spec.NetworkDisabled,
+        Tty:             true, // Allocate a pseudo-TTY
+    }
+
+    hostConfig := specHostConfig(spec)
+
+    if hostConfig.IpcMode.IsHost() {
+        warnHostIPCInVM(ctx, cli, containerName)
+    }
+
+    // Create the container
+    logrus.Infof("Creating Docker container %s...", containerName)
+    if spec.StopTimeout > 0 {
+        timeout := wholeSeconds(spec.StopTimeout)
+        containerConfig.StopTimeout = &timeout
+    }
+
+    var networkingConfig *network.NetworkingConfig
+    if len(spec.NetworkAliases) > 0 {
+        networkingConfig = &network.NetworkingConfig{
+            EndpointsConfig: map[string]*network.EndpointSettings{
+                spec.NetworkMode: {Aliases: spec.NetworkAliases},
+            },
+        }
+    }
+    resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, containerName)
+    if errdefs.IsConflict(err) {
+        err = fmt.Errorf("%w: %v", errContainerConflict, err)
+    }
+    if err != nil {
+        logrus.Errorf("Error creating container %s: %v", containerName, err)
+        return "", err
+    }
+    auditContainerCreated(resp.ID)
+
+    // Start the container
+    logrus.Infof("Starting Docker container %s...", containerName)
+    if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+        logrus.Errorf("Error starting container %s: %v", containerName, err)
+        return resp.ID, err
+    }
+
+    // A broken entrypoint lets ContainerStart succeed and then exits; catch that before attaching
+    if !spec.OneShot {
+        if err := checkContainerRunning(ctx, cli, resp.ID, containerName); err != nil {
+            return resp.ID, err
+        }
+    }
+
+    logrus.Infof("Container %s started successfully with ID %s", containerName, resp.ID)
+    return resp.ID, nil
+}
+
+// How long a freshly started container must keep running to count as started, how often its
+// state is polled meanwhile, and how long it may take to get there
+const (
+    startSettleDelay   = 300 * time.Millisecond
+    startPollInterval  = 50 * time.Millisecond
+    startSettleTimeout = 10 * time.Second
+)
+
+// Number of log lines shown when a container exits right after starting
+const exitedLogTail = "20"
+
+// checkContainerRunning polls the container's state until it has run for startSettleDelay,
+// returning an error describing the exit code and last log lines as soon as it stops
+func checkContainerRunning(ctx context.Context, cli *client.Client, containerID, containerName string) error {
+    began := time.Now()
+    var info types.ContainerJSON
+    for {
+        var err error
+        if info, err = cli.ContainerInspect(ctx, containerID); err != nil {
+            return fmt.Errorf("error inspecting container %s: %v", containerName, err)
+        }
+        if info.State == nil || (info.State.Running && time.Since(began) >= startSettleDelay) {
+            return nil
+        }
+        if !info.State.Running && !info.State.Restarting && info.State.Status != "created" {
+            break
+        }
+        if time.Since(began) >= startSettleTimeout {
+            return fmt.Errorf("container %s is still %s %s after starting", containerName, info.State.Status, startSettleTimeout)
+        }
+        time.Sleep(startPollInterval)
+    }
+
+    logs, err := cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
+        ShowStdout: true,
+        ShowStderr: true,
+        Tail:       exitedLogTail,
+    })
+    if err != nil {
+        logrus.Warnf("Unable to read logs of container %s: %v", containerName, err)
+    } else {
+        // Containers are created with a TTY, so the log stream is not multiplexed
+        fmt.Fprintf(os.Stderr, "--- last %s log lines of %s ---\n", exitedLogTail, containerName)
+        io.Copy(os.Stderr, logs)
+        logs.Close()
+        fmt.Fprintln(os.Stderr, "---")
+    }
+
+    reason := fmt.Sprintf("exit code %d", info.State.ExitCode)
+    if info.State.Error != "" {
+        reason += ": " + info.State.Error
+    }
+    return fmt.Errorf("container %s exited right after starting (%s); check the image's entrypoint/command", containerName, reason)
+}
+
+// uniqueHostname appends an instance suffix when another running container already uses hostname
+func uniqueHostname(ctx context.Context, cli *client.Client, hostname string) string {
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+        Filters: filters.NewArgs(filters.Arg("label", labelHostname)),
+    })
+    if err != nil {
+        logrus.Warnf("Unable to check for hostname conflicts: %v", err)
+        return hostname
+    }
+
+    taken := make(map[string]bool)
+    for _, c := range containers {
+        taken[c.Labels[labelHostname]] = true
+    }
+
+    candidate := hostname
+    for i := 2; taken[candidate]; i++ {
+        suffix := fmt.Sprintf("-%d", i)
+        base := hostname
+        if len(base)+len(suffix) > 63 {
+            base = base[:63-len(suffix)]
+        }
+        candidate = base + suffix
+    }
+    if candidate != hostname {
+        logrus.Infof("Hostname %s is in use; using %s", hostname, candidate)
+    }
+    return candidate
+}
+
+// syncVolumeName returns the named volume holding the synced copy of a project in sync mode
+func syncVolumeName(containerName string) string {
+    return syncVolumePrefix + containerName
+}
+
+// Name prefixes of the per-container volumes the tool creates
+const (
+    syncVolumePrefix  = "dev-env-manager-src-"
+    stateVolumePrefix = "dev-env-manager-state-"
+)
+
+// PrunableVolume is a volume prune volumes removes, with its size in bytes (-1 if unknown)
+type PrunableVolume struct {
+    Name      string
+    Container string // container the volume was created for
+    Size      int64
+}
+
+// volumeOwner returns the container a tool-created per-container volume belongs to, or ""
+func volumeOwner(name string) string {
+    for _, prefix := range []string{syncVolumePrefix, stateVolumePrefix} {
+        if strings.HasPrefix(name, prefix) {
+            return strings.TrimPrefix(name, prefix)
+        }
+    }
+    return ""
+}
+
+// volumeLabels returns the labels a per-container volume is created with, naming the repository
+// and branch it belongs to so prune doesn't have to guess from the volume name
+func volumeLabels(projectDirName, repoName, branch string) map[string]string {
+    labels := map[string]string{labelManaged: "true", labelProject: projectDirName, labelRepo: repoName}
+    if branch != "" {
+        labels[labelBranch] = branch
+    }
+    return labels
+}
+
+// volumeRepo returns the project and repository a per-container volume belongs to: from its
+// labels, or for volumes created before they were labelled, from the exact name of a configured
+// container or of a branch container labelled with its repository
+func volumeRepo(v *types.Volume, owner string, containers map[string]string) (string, bool) {
+    if project, ok := v.Labels[labelProject]; ok {
+        return project + "/" + v.Labels[labelRepo], true
+    }
+    repo, ok := containers[owner]
+    return repo, ok
+}
+
+// FindPrunableVolumes returns the sync and state volumes whose container belongs to no configured
+// repository of any user, or with project and repo set, that repository's volumes. The shared
+// cache volumes and volumes named in any volumes key are never included.
+func FindPrunableVolumes(project, repo string) ([]PrunableVolume, error) {
+    entries, err := configuredRepos(true)
+    if err != nil {
+        return nil, err
+    }
+    configured := map[string]bool{}
+    containers := map[string]string{} // container name to project/repo
+    protected := map[string]bool{goModCacheVolume: true, npmCacheVolume: true}
+    for _, entry := range entries {
+        key := fmt.Sprintf("users.%s.projects.%s.repos.%s", entry.User, entry.Project, entry.Repo)
+        configured[entry.Project+"/"+entry.Repo] = true
+        if name := viper.GetString(key + ".container_name"); name != "" {
+            containers[name] = entry.Project + "/" + entry.Repo
+        }
+        for _, spec := range viper.GetStringSlice(key + ".volumes") {
+            if m, err := parseVolumeSpec(os.ExpandEnv(spec)); err == nil && m.Type == mount.TypeVolume && m.Source != "" {
+                protected[m.Source] = true
+            }
+        }
+    }
+
+    var target string
+    if project != "" {
+        _, _, containerName, err := deriveProjectValues(project, repo)
+        if err != nil {
+            return nil, err
+        }
+        target = project + "/" + repo
+        containers[containerName] = target
+    }
+
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    branchContainers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", labelBranch))})
+    if err != nil {
+        return nil, fmt.Errorf("error listing containers: %v", err)
+    }
+    for _, c := range branchContainers {
+        for _, name := range c.Names {
+            containers[strings.TrimPrefix(name, "/")] = c.Labels[labelProject] + "/" + c.Labels[labelRepo]
+        }
+    }
+    usage, err := cli.DiskUsage(ctx)
+    if err != nil {
+        return nil, fmt.Errorf("error listing volumes: %v", err)
+    }
+
+    var volumes []PrunableVolume
+    for _, v := range usage.Volumes {
+        owner := volumeOwner(v.Name)
+        if owner == "" || protected[v.Name] {
+            continue
+        }
+        belongsTo, known := volumeRepo(v, owner, containers)
+        if target != "" && belongsTo != target {
+            continue
+        }
+        if target == "" && known && configured[belongsTo] {
+            continue
+        }
+        size := int64(-1)
+        if v.UsageData != nil {
+            size = v.UsageData.Size
+        }
+        volumes = append(volumes, PrunableVolume{Name: v.Name, Container: owner, Size: size})
+    }
+    sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+    return volumes, nil
+}
+
+// RemoveVolume removes a named volume; a volume still used by a container is left alone
+func RemoveVolume(name string) error {
+    if skipForDryRun("remove volume %s", name) {
+        return nil
+    }
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if err := cli.VolumeRemove(context.Background(), name, false); err != nil {
+        return fmt.Errorf("error removing volume %s: %v", name, err)
+    }
+    return nil
+}
+
+// stateVolumeName returns the named volume holding a container's persistent tool state
+func stateVolumeName(containerName string) string {
+    return stateVolumePrefix + containerName
+}
+
+// RunInitCommands executes init_commands inside the container unless the first-run marker exists
+func RunInitCommands(containerID string, commands []string) error {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    exitCode, err := execInContainer(ctx, cli, containerID, []string{"test", "-f", initMarkerPath}, io.Discard)
+    if err != nil {
+        return err
+    }
+    if exitCode == 0 {
+        logrus.Info("Init commands already ran for this environment. Skipping.")
+        return nil
+    }
+
+    for _, command := range commands {
+        logrus.Infof("Running init command: %s", command)
+        exitCode, err := execInContainer(ctx, cli, containerID, []string{"sh", "-c", command}, os.Stdout)
+        if err != nil {
+            return err
+        }
+        if exitCode != 0 {
+            return fmt.Errorf("init command %q exited with code %d", command, exitCode)
+        }
+    }
+
+    if _, err := execInContainer(ctx, cli, containerID, []string{"touch", initMarkerPath}, io.Discard); err != nil {
+        return fmt.Errorf("error writing init marker: %v", err)
+    }
+    logrus.Info("Init commands completed.")
+    return nil
+}
+
+// ensureImage pulls imageRef, subject to the policy like PullImage, unless it is already present locally
+func ensureImage(ctx context.Context, cli *client.Client, imageRef string) error {
+    if _, _, err := cli.ImageInspectWithRaw(ctx, imageRef); err == nil {
+        return nil
+    }
+    return PullImage(ctx, imageRef, io.Discard)
+}
+
+// Image of the short-lived container used to check bind sources on a remote daemon host
+const bindCheckImage = "alpine:3"
+
+// bindSource returns the host path of a bind spec, or "" for named volumes
+func bindSource(bind string) string {
+    source := bind
+    if i := strings.Index(bind, ":"); i >= 0 {
+        source = bind[:i]
+    }
+    if !strings.HasPrefix(source, "/") {
+        return ""
+    }
+    return source
+}
+
+// verifyBindSources checks that every bind source exists where the daemon runs, reporting all
+// missing ones together. Local daemons are checked with stat; remote ones need a helper container.
+func verifyBindSources(binds []string) error {
+    var sources []string
+    for _, bind := range binds {
+        if source := bindSource(bind); source != "" {
+            sources = append(sources, source)
+        }
+    }
+    if len(sources) == 0 {
+        return nil
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    var missing []string
+    host := cli.DaemonHost()
+    if strings.HasPrefix(host, "unix://") || strings.HasPrefix(host, "npipe://") {
+        for _, source := range sources {
+            if _, err := os.Stat(source); err != nil {
+                missing = append(missing, source)
+            }
+        }
+    } else {
+        logrus.Infof("Checking bind sources on %s...", host)
+        if missing, err = remoteMissingPaths(context.Background(), cli, sources); err != nil {
+            return fmt.Errorf("error checking bind sources (use --no-verify-binds to skip): %v", err)
+        }
+    }
+
+    if len(missing) > 0 {
+        return fmt.Errorf("bind source(s) not found on the Docker host (use --no-verify-binds to skip):\n  %s", strings.Join(missing, "\n  "))
+    }
+    return nil
+}
+
+// remoteMissingPaths lists which paths don't exist on the daemon host, using a helper container
+// that mounts the host root read-only
+func remoteMissingPaths(ctx context.Context, cli *client.Client, paths []string) ([]string, error) {
+    if err := ensureImage(ctx, cli, bindCheckImage); err != nil {
+        return nil, err
+    }
+
+    script := `for p; do [ -e "/host$p" ] || echo "$p"; done`
+    resp, err := cli.ContainerCreate(ctx, &container.Config{
+        Image: bindCheckImage,
+        Cmd:   append([]string{"sh", "-c", script, "sh"}, paths...),
+    }, &container.HostConfig{
+        Mounts:      []mount.Mount{{Type: mount.TypeBind, Source: "/", Target: "/host", ReadOnly: true}},
+        NetworkMode: "none",
+    }, nil, nil, "")
+    if err != nil {
+        return nil, err
+    }
+    defer cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+
+    if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+        return nil, err
+    }
+    waitCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+    select {
+    case err := <-errCh:
+        return nil, err
+    case <-waitCh:
+    }
+
+    logs, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true})
+    if err != nil {
+        return nil, err
+    }
+    defer logs.Close()
+    var out bytes.Buffer
+    if _, err := stdcopy.StdCopy(&out, io.Discard, logs); err != nil {
+        return nil, err
+    }
+    var missing []string
+    for _, line := range strings.Split(out.String(), "\n") {
+        if line != "" {
+            missing = append(missing, line)
+        }
+    }
+    return missing, nil
+}
+
+// execInContainer runs a command in the container, copying its output to out, and returns its exit code
+func execInContainer(ctx context.Context, cli *client.Client, containerID string, cmd []string, out io.Writer) (int, error) {
+    return execInContainerDir(ctx, cli, containerID, "", cmd, out)
+}
+
+// execInContainerDir is execInContainer with a working directory; an empty dir uses the image's
+func execInContainerDir(ctx context.Context, cli *client.Client, containerID, dir string, cmd []string, out io.Writer) (int, error) {
+    execResp, err := cli.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+        Cmd:          cmd,
+        WorkingDir:   dir,
+        AttachStdout: true,
+        AttachStderr: true,
+    })
+    if err != nil {
+        return 0, fmt.Errorf("error creating exec for %v: %v", cmd, err)
+    }
+
+    resp, err := cli.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{})
+    if err != nil {
+        return 0, fmt.Errorf("error starting exec for %v: %v", cmd, err)
+    }
+    defer resp.Close()
+
+    if _, err := stdcopy.StdCopy(out, out, resp.Reader); err != nil {
+        return 0, fmt.Errorf("error reading exec output: %v", err)
+    }
+
+    inspect, err := cli.ContainerExecInspect(ctx, execResp.ID)
+    if err != nil {
+        return 0, fmt.Errorf("error inspecting exec: %v", err)
+    }
+    return inspect.ExitCode, nil
+}
+
+// AttachToContainer attaches the user's terminal to the running container and starts devCmd in it.
+// docker exec keeps the editor sized to the terminal and detaches on detachKeys (its default when empty).
+// A non-empty sessionID marks the editor's processes for sessionRunning.
+func AttachToContainer(containerID string, devCmd []string, detachKeys, sessionID string) error {
+    // Use Docker's exec to run the editor interactively
+    args := []string{"exec", "-it"}
+    if detachKeys != "" {
+        args = append(args, "--detach-keys", detachKeys)
+    }
+    if sessionID != "" {
+        args = append(args, "--env", sessionEnvVar+"="+sessionID)
+    }
+    cmd := exec.Command("docker", append(append(args, containerID), devCmd...)...)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+
+    logrus.Infof("Attaching to container %s with %s...", containerID, strings.Join(devCmd, " "))
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("error executing %s: %w", devCmd[0], err)
+    }
+
+    return nil
+}
+
+// Defaults of the stop_grace_period and stop_signal keys
+const (
+    defaultStopGracePeriod = 10 * time.Second
+    defaultStopSignal      = "SIGTERM"
+)
+
+// stopGracePeriod returns how long a container gets to exit after its stop signal, from the
+// stop_grace_period key
+func stopGracePeriod(projectDirName, repoName string) time.Duration {
+    value := viper.GetString(repoSettingKey(projectDirName, repoName, "stop_grace_period"))
+    if value == "" {
+        return defaultStopGracePeriod
+    }
+    grace, err := time.ParseDuration(value)
+    if err != nil || grace < 0 {
+        logrus.Warnf("Ignoring invalid stop_grace_period %q; using %s.", value, defaultStopGracePeriod)
+        return defaultStopGracePeriod
+    }
+    return grace
+}
+
+// stopSignal returns the signal that asks a container to exit, from the stop_signal key
+func stopSignal(projectDirName, repoName string) string {
+    if signal := viper.GetString(repoSettingKey(projectDirName, repoName, "stop_signal")); signal != "" {
+        return signal
+    }
+    return defaultStopSignal
+}
+
+// RemoveContainer stops the Docker container after use, giving it its stop grace period to exit
+// after its stop signal, and then removes it
+func RemoveContainer(containerID string) error {
+    return removeContainer(containerID, false)
+}
+
+// removeContainer removes a container; without force a running one is first sent its stop
+// signal and waited for, and only killed once the grace period is over
+func removeContainer(containerID string, force bool) error {
+    if skipForDryRun("remove container %s", containerID) {
+        return nil
+    }
+
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    if info, err := cli.ContainerInspect(ctx, containerID); err == nil && !force && info.State != nil && info.State.Running {
+        // The container's own settings win, so a session's --stop-signal and --stop-timeout apply
+        project, repo := info.Config.Labels[labelProject], info.Config.Labels[labelRepo]
+        signal, grace := stopSignal(project, repo), stopGracePeriod(project, repo)
+        if info.Config.StopSignal != "" {
+            signal = info.Config.StopSignal
+        }
+        if info.Config.StopTimeout != nil {
+            grace = time.Duration(*info.Config.StopTimeout) * time.Second
+        }
+        stopContainerGracefully(ctx, cli, containerID, signal, grace)
+    }
+
+    logrus.Infof("Removing Docker container %s...", containerID)
+    // Remove the container
+    err = cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true})
+    if err != nil {
+        logrus.Errorf("Error removing container %s: %v", containerID, err)
+        return err
+    }
+    auditContainerRemoved(containerID)
+
+    logrus.Infof("Container %s removed successfully.", containerID)
+    return nil
+}
+
+// stopContainerGracefully sends signal to the container and waits up to grace for it to exit,
+// leaving a container that is still running to the forced removal
+func stopContainerGracefully(ctx context.Context, cli *client.Client, containerID, signal string, grace time.Duration) {
+    logrus.Infof("Stopping container %s with %s (grace period %s)...", containerID, signal, grace)
+    if err := cli.ContainerKill(ctx, containerID, signal); err != nil {
+        logrus.Warnf("Error sending %s to %s: %v", signal, containerID, err)
+        return
+    }
+    waitCtx, cancel := context.WithTimeout(ctx, grace)
+    defer cancel()
+    exited, waitErr := cli.ContainerWait(waitCtx, containerID, container.WaitConditionNotRunning)
+    select {
+    case <-exited:
+    case err := <-waitErr:
+        if waitCtx.Err() != nil {
+            logrus.Warnf("Container %s did not exit within %s of %s; forcing removal.", containerID, grace, signal)
+        } else {
+            logrus.Warnf("Error waiting for %s to exit: %v", containerID, err)
+        }
+    }
+}
+
+// StopProject stops and removes a repository's container; force skips the grace period
+func StopProject(projectDirName, repoName string, force bool) error {
+    _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    return removeContainer(containerName, force)
+}
+
+// BenchmarkResult holds the startup latency of each benchmark run and their summary
+type BenchmarkResult struct {
+    Runs []time.Duration
+    Min  time.Duration
+    Max  time.Duration
+    Mean time.Duration
+    P95  time.Duration
+}
+
+// BenchmarkStartup creates and starts a container from the repository's image runs times, with
+// echo ok in place of the editor, timing RunContainer from create to started and removing each
+// container before the next run. The image is pulled once beforehand unless skipPull is set.
+func BenchmarkStartup(projectDirName, repoName string, runs int, skipPull bool) (BenchmarkResult, error) {
+    var result BenchmarkResult
+    if runs < 1 {
+        return result, fmt.Errorf("runs must be at least 1")
+    }
+    _, dockerImage, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return result, err
+    }
+
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return result, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if skipPull {
+        if _, _, err := cli.ImageInspectWithRaw(ctx, dockerImage); err != nil {
+            return result, fmt.Errorf("image %s is not available locally and pulling is disabled: %v", dockerImage, err)
+        }
+    } else if err := PullImage(ctx, dockerImage, io.Discard); err != nil {
+        return result, fmt.Errorf("error pulling image: %v", err)
+    }
+
+    for i := 1; i <= runs; i++ {
+        began := time.Now()
+        containerID, err := runContainer(ctx, cli, ContainerSpec{
+            Image:   dockerImage,
+            Name:    fmt.Sprintf("%s-bench-%d", containerName, i),
+            Cmd:     []string{"echo", "ok"},
+            Labels:  map[string]string{labelProject: projectDirName, labelRepo: repoName},
+            OneShot: true,
+        })
+        elapsed := time.Since(began)
+        if containerID != "" {
+            if rmErr := RemoveContainer(containerID); rmErr != nil {
+                logrus.Warnf("Error removing container: %v", rmErr)
+            }
+        }
+        if err != nil {
+            return result, fmt.Errorf("run %d: %v", i, err)
+        }
+        result.Runs = append(result.Runs, elapsed)
+    }
+
+    sorted := append([]time.Duration(nil), result.Runs...)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+    var total time.Duration
+    for _, d := range sorted {
+        total += d
+    }
+    result.Min = sorted[0]
+    result.Max = sorted[len(sorted)-1]
+    result.Mean = total / time.Duration(len(sorted))
+    // Nearest-rank percentile
+    result.P95 = sorted[(len(sorted)*95+99)/100-1]
+    return result, nil
+}
+
+// TailContainerLogs writes the logs of a repository's container to stdout and stderr, like
+// docker logs. tail is a line count or "all"; since is a duration such as 10m or a timestamp.
+// With follow it keeps streaming until the container stops or Ctrl-C.
+func TailContainerLogs(projectDirName, repoName string, follow bool, tail string, since string) error {
+    _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if tail != "all" {
+        if _, err := strconv.ParseUint(tail, 10, 64); err != nil {
+            return fmt.Errorf("invalid --tail %q: want a line count or all", tail)
+        }
+    }
+
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(ctx, containerName)
+    if err != nil {
+        return fmt.Errorf("container %s not found: %v", containerName, err)
+    }
+
+    logs, err := cli.ContainerLogs(ctx, info.ID, types.ContainerLogsOptions{
+        ShowStdout: true,
+        ShowStderr: true,
+        Follow:     follow,
+        Tail:       tail,
+        Since:      since,
+    })
+    if err != nil {
+        return fmt.Errorf("error reading logs of %s: %v", containerName, err)
+    }
+    defer logs.Close()
+
+    // A TTY container's log is a single raw stream; otherwise stdout and stderr are multiplexed
+    if info.Config != nil && info.Config.Tty {
+        _, err = io.Copy(os.Stdout, logs)
+    } else {
+        _, err = stdcopy.StdCopy(os.Stdout, os.Stderr, logs)
+    }
+    if err != nil && ctx.Err() == nil {
+        return fmt.Errorf("error reading logs of %s: %v", containerName, err)
+    }
+    return nil
+}
+
+// RenameContainer renames a repository's existing container and records the new name as its
+// container_name. Docker labels are immutable after creation, so labels set at create time
+// (project, repo, hostname) are left as they are; they don't carry the container name.
+func RenameContainer(projectDirName, repoName, newName string) error {
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    if !validContainerName(newName) {
+        return fmt.Errorf("invalid container name %q: must start with a letter or digit and contain only [a-zA-Z0-9_.-]", newName)
+    }
+    _, _, oldName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if oldName == newName {
+        logrus.Infof("Container for %s/%s is already named %s.", projectDirName, repoName, newName)
+        return nil
+    }
+
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    if oldName == "" {
+        logrus.Infof("No container_name set for %s/%s; only updating the config.", projectDirName, repoName)
+    } else if err := cli.ContainerRename(ctx, oldName, newName); err != nil {
+        if !client.IsErrNotFound(err) {
+            return fmt.Errorf("error renaming container %s to %s: %v", oldName, newName, err)
+        }
+        logrus.Infof("No container named %s exists; only updating the config.", oldName)
+    } else {
+        logrus.Infof("Renamed container %s to %s.", oldName, newName)
+    }
+
+    return persistRepoSettings(projectDirName, repoName, map[string]interface{}{"container_name": newName})
+}
+
+// Label Docker Compose puts on the containers of a stack
+const labelComposeProject = "com.docker.compose.project"
+
+// AdoptContainer registers a container made outside this tool as projectDirName/repoName, recording its
+// image, binds, env and ports in a new config entry. Labels can't be changed on an existing container,
+// so with consent (or yes) it is committed and recreated from that image with the manager's labels.
+// Compose containers are refused unless force is set.
+func AdoptContainer(containerName, projectDirName, repoName, repoURL string, force bool) error {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(ctx, containerName)
+    if err != nil {
+        return fmt.Errorf("error inspecting container %s: %v", containerName, err)
+    }
+    containerName = strings.TrimPrefix(info.Name, "/")
+    if info.Config.Labels[labelManaged] == "true" {
+        return fmt.Errorf("container %s is already managed", containerName)
+    }
+    if stack := info.Config.Labels[labelComposeProject]; stack != "" && !force {
+        return fmt.Errorf("container %s belongs to compose project %s; pass --force to adopt it anyway", containerName, stack)
+    }
+
+    if projectDirName == "" {
+        projectDirName = "adopted"
+    }
+    if repoName == "" {
+        repoName = containerName
+    }
+    if viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return fmt.Errorf("%s/%s is already configured", projectDirName, repoName)
+    }
+    if repoURL == "" {
+        fmt.Printf("Repository URL for %s/%s (can't be read from the container): ", projectDirName, repoName)
+        line, _ := stdinReader.ReadString('\n')
+        if repoURL = strings.TrimSpace(line); repoURL == "" {
+            return fmt.Errorf("a repository URL is required (--repo-url)")
+        }
+    }
+
+    // Only env the container added on top of its image belongs in the config
+    imageEnv := make(map[string]bool)
+    if image, _, err := cli.ImageInspectWithRaw(ctx, info.Image); err == nil && image.Config != nil {
+        for _, entry := range image.Config.Env {
+            imageEnv[entry] = true
+        }
+    }
+    var env []string
+    for _, entry := range info.Config.Env {
+        if !imageEnv[entry] {
+            env = append(env, entry)
+        }
+    }
+    volumes := append([]string{}, info.HostConfig.Binds...)
+    for _, m := range append(append([]mount.Mount{}, info.HostConfig.Mounts...), anonymousVolumes(info)...) {
+        volume := fmt.Sprintf("%s:%s", m.Source, m.Target)
+        if m.ReadOnly {
+            volume += ":ro"
+        }
+        volumes = append(volumes, volume)
+    }
+    ports := publishedPorts(info.HostConfig)
+
+    if err := AddProjectConfig(projectDirName, repoName, repoURL, info.Config.Image, containerName); err != nil {
+        return err
+    }
+    settings := map[string]interface{}{}
+    if len(env) > 0 {
+        settings["env"] = env
+    }
+    if len(volumes) > 0 {
+        settings["volumes"] = volumes
+    }
+    if len(ports) > 0 {
+        settings["ports"] = ports
+    }
+    if err := persistRepoSettings(projectDirName, repoName, settings); err != nil {
+        return err
+    }
+
+    if !confirm(fmt.Sprintf("Recreate %s with the manager's labels? Its filesystem is kept by committing it to an image first.", containerName)) {
+        logrus.Warnf("Container %s keeps its labels; list, status and clean won't see it until it is recreated by start.", containerName)
+        return nil
+    }
+    return relabelContainer(ctx, cli, info, map[string]string{
+        labelManaged: "true",
+        labelProject: projectDirName,
+        labelRepo:    repoName,
+    })
+}
+
+// publishedPorts returns a container's port bindings as [host_ip:]host_port:container_port/protocol
+func publishedPorts(hostConfig *container.HostConfig) []string {
+    var ports []string
+    for port, bindings := range hostConfig.PortBindings {
+        for _, b := range bindings {
+            published := b.HostPort + ":" + string(port)
+            if b.HostIP != "" {
+                published = b.HostIP + ":" + published
+            }
+            ports = append(ports, published)
+        }
+    }
+    sort.Strings(ports)
+    return ports
+}
+
+// anonymousVolumes returns the volumes a container got from its image's VOLUME declarations,
+// which its Binds and Mounts don't mention, as mounts of the same volumes
+func anonymousVolumes(info types.ContainerJSON) []mount.Mount {
+    declared := make(map[string]bool)
+    for _, bind := range info.HostConfig.Binds {
+        if parts := strings.Split(bind, ":"); len(parts) > 1 {
+            declared[filepath.Clean(parts[1])] = true
+        }
+    }
+    for _, m := range info.HostConfig.Mounts {
+        declared[filepath.Clean(m.Target)] = true
+    }
+    var mounts []mount.Mount
+    for _, m := range info.Mounts {
+        if m.Type != mount.TypeVolume || m.Name == "" || declared[filepath.Clean(m.Destination)] {
+            continue
+        }
+        mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Source: m.Name, Target: m.Destination, ReadOnly: !m.RW})
+    }
+    return mounts
+}
+
+// endpointSettings returns the endpoint configuration of each network a container is attached
+// to, without the runtime state Docker assigns on connect
+func endpointSettings(info types.ContainerJSON) map[string]*network.EndpointSettings {
+    endpoints := make(map[string]*network.EndpointSettings)
+    if info.NetworkSettings == nil {
+        return endpoints
+    }
+    for name, ep := range info.NetworkSettings.Networks {
+        if ep == nil {
+            continue
+        }
+        var aliases []string
+        for _, alias := range ep.Aliases {
+            // Docker adds the short container ID itself
+            if !strings.HasPrefix(info.ID, alias) {
+                aliases = append(aliases, alias)
+            }
+        }
+        endpoints[name] = &network.EndpointSettings{
+            IPAMConfig: ep.IPAMConfig,
+            Links:      ep.Links,
+            Aliases:    aliases,
+            DriverOpts: ep.DriverOpts,
+        }
+    }
+    return endpoints
+}
+
+// relabelContainer replaces a container with one created from a commit of it, with extra labels.
+// The replacement keeps the original's port bindings, mounts (anonymous volumes included, so
+// their data carries over) and network attachments.
+func relabelContainer(ctx context.Context, cli *client.Client, info types.ContainerJSON, labels map[string]string) error {
+    name := strings.TrimPrefix(info.Name, "/")
+    if info.State.Running {
+        logrus.Infof("Stopping %s...", name)
+        if err := cli.ContainerStop(ctx, info.ID, nil); err != nil {
+            return fmt.Errorf("error stopping %s: %v", name, err)
+        }
+    }
+    reference := "dev-env-adopted/" + strings.ToLower(name) + ":latest"
+    if _, err := cli.ContainerCommit(ctx, info.ID, types.ContainerCommitOptions{Reference: reference}); err != nil {
+        return fmt.Errorf("error committing %s: %v", name, err)
+    }
+
+    // Move the original aside so the replacement can take its name, and restore it on failure
+    backup := name + "-pre-adopt"
+    if err := cli.ContainerRename(ctx, info.ID, backup); err != nil {
+        return fmt.Errorf("error renaming %s: %v", name, err)
+    }
+    config := *info.Config
+    config.Image = reference
+    config.Labels = make(map[string]string)
+    for k, v := range info.Config.Labels {
+        config.Labels[k] = v
+    }
+    for k, v := range labels {
+        config.Labels[k] = v
+    }
+    hostConfig := *info.HostConfig
+    hostConfig.Mounts = append(append([]mount.Mount{}, info.HostConfig.Mounts...), anonymousVolumes(info)...)
+
+    // Older daemons take a single network on create; the others are connected afterwards
+    endpoints := endpointSettings(info)
+    primary := hostConfig.NetworkMode.NetworkName()
+    if hostConfig.NetworkMode.IsHost() || hostConfig.NetworkMode.IsNone() || hostConfig.NetworkMode.IsContainer() {
+        endpoints = nil
+    }
+    var networkingConfig *network.NetworkingConfig
+    if ep, ok := endpoints[primary]; ok {
+        networkingConfig = &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{primary: ep}}
+        delete(endpoints, primary)
+    }
+    resp, err := cli.ContainerCreate(ctx, &config, &hostConfig, networkingConfig, nil, name)
+    for net, ep := range endpoints {
+        if err != nil {
+            break
+        }
+        err = cli.NetworkConnect(ctx, net, resp.ID, ep)
+    }
+    if err == nil && info.State.Running {
+        err = cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+    }
+    if err != nil {
+        if resp.ID != "" {
+            cli.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+        }
+        cli.ContainerRename(ctx, info.ID, name)
+        return fmt.Errorf("error recreating %s: %v", name, err)
+    }
+
+    if err := cli.ContainerRemove(ctx, info.ID, types.ContainerRemoveOptions{}); err != nil {
+        logrus.Warnf("Unable to remove the original container, now %s: %v", backup, err)
+    }
+    logrus.Infof("Recreated %s from %s with the manager's labels.", name, reference)
+    return nil
+}
+
+// ManagedContainer summarizes a container created by this tool
+type ManagedContainer struct {
+    Name       string        `json:"name"`
+    ProjectDir string        `json:"project_dir"`
+    Repo       string        `json:"repo"`
+    Image      string        `json:"image"`
+    Status     string        `json:"status"`
+    State      string        `json:"state"`
+    Uptime     time.Duration `json:"uptime_ns"` // zero unless running
+    Ports      []string      `json:"ports,omitempty"`
+}
+
+// ListManagedContainers returns the running containers created by this tool, or all of them with all set
+func ListManagedContainers(all bool) ([]ManagedContainer, error) {
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, fmt.Errorf("error creating Docker client: %v", err)
+    }
+
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+        All:     all,
+        Filters: filters.NewArgs(filters.Arg("label", labelManaged+"=true")),
+    })
+    if err != nil {
+        return nil, fmt.Errorf("error listing containers: %v", err)
+    }
+
+    managed := make([]ManagedContainer, 0, len(containers))
+    for _, c := range containers {
+        mc := ManagedContainer{
+            ProjectDir: c.Labels[labelProject],
+            Repo:       c.Labels[labelRepo],
+            Image:      c.Image,
+            Status:     c.Status,
+            State:      c.State,
+        }
+        if len(c.Names) > 0 {
+            mc.Name = strings.TrimPrefix(c.Names[0], "/")
+        }
+        // A restarted container was created long before it started; only inspect tells when
+        if c.State == "running" {
+            if info, err := cli.ContainerInspect(ctx, c.ID); err == nil && info.State != nil {
+                mc.Uptime = uptimeSince(info.State.StartedAt, time.Now())
+            }
+        }
+        for _, p := range c.Ports {
+            if p.PublicPort != 0 {
+                mc.Ports = append(mc.Ports, fmt.Sprintf("%s:%d->%d/%s", p.IP, p.PublicPort, p.PrivatePort, p.Type))
+            } else {
+                mc.Ports = append(mc.Ports, fmt.Sprintf("%d/%s", p.PrivatePort, p.Type))
+            }
+        }
+        managed = append(managed, mc)
+    }
+    sort.Slice(managed, func(i, j int) bool { return managed[i].Name < managed[j].Name })
+    return managed, nil
+}
+
+// uptimeSince returns how long a container has run given its State.StartedAt, zero if unknown
+func uptimeSince(startedAt string, now time.Time) time.Duration {
+    started, err := time.Parse(time.RFC3339Nano, startedAt)
+    if err != nil || started.IsZero() || started.After(now) {
+        return 0
+    }
+    return now.Sub(started).Truncate(time.Second)
+}
+
+// validContainerName reports whether name is accepted by Docker as a container name
+func validContainerName(name string) bool {
+    if len(name) < 2 {
+        return false
+    }
+    for i, r := range name {
+        alnum := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+        if !alnum && (i == 0 || (r != '_' && r != '.' && r != '-')) {
+            return false
+        }
+    }
+    return true
+}
+
+// getUsername retrieves the current user's username, unless --user overrides it
+func getUsername() (string, error) {
+    if userOverride != "" {
+        return userOverride, nil
+    }
+    usr, err := user.Current()
+    if err != nil {
+        return "", err
+    }
+    return normalizeUsername(usr.Username, runtime.GOOS), nil
+}
+
+// normalizeUsername strips the DOMAIN\ prefix Windows puts on account names; Unix names are used as they are
+func normalizeUsername(username, goos string) string {
+    if goos == "windows" {
+        if i := strings.LastIndex(username, `\`); i >= 0 {
+            return username[i+1:]
+        }
+    }
+    return username
+}
+
+// AuditEntry is a single JSON line in the audit log
+type AuditEntry struct {
+    Time              time.Time `json:"time"`
+    Command           string    `json:"command"`
+    Args              []string  `json:"args,omitempty"`
+    Project           string    `json:"project,omitempty"`
+    Repo              string    `json:"repo,omitempty"`
+    ContainersCreated []string  `json:"containers_created,omitempty"`
+    ContainersRemoved []string  `json:"containers_removed,omitempty"`
+    ImagesPulled      []string  `json:"images_pulled,omitempty"`
+    ExitStatus        int       `json:"exit_status"`
+    Error             string    `json:"error,omitempty"`
+}
+
+// Rotate the audit log once it grows past this size
+const auditLogMaxSize = 1 << 20
+
+var (
+    auditMu      sync.Mutex
+    currentAudit *AuditEntry
+)
+
+// auditHook captures the message of a fatal log entry for the audit record
+type auditHook struct{}
+
+func (auditHook) Levels() []logrus.Level {
+    return []logrus.Level{logrus.FatalLevel}
+}
+
+func (auditHook) Fire(entry *logrus.Entry) error {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    if currentAudit != nil {
+        currentAudit.Error = entry.Message
+    }
+    return nil
+}
+
+// logFileHook copies every log entry to a file, formatted independently of the terminal output
+type logFileHook struct {
+    mu        sync.Mutex
+    out       io.Writer
+    formatter logrus.Formatter
+}
+
+func (h *logFileHook) Levels() []logrus.Level {
+    return logrus.AllLevels
+}
+
+func (h *logFileHook) Fire(entry *logrus.Entry) error {
+    line, err := h.formatter.Format(entry)
+    if err != nil {
+        return err
+    }
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    _, err = h.out.Write(line)
+    return err
+}
+
+// OpenLogFile copies all log output to path in the given format (text or json), keeping the terminal
+// output as it is. Unless appendLog is set, an existing file is moved aside to path.1 first.
+func OpenLogFile(path, format string, appendLog bool) error {
+    var formatter logrus.Formatter
+    switch format {
+    case "text":
+        formatter = &logrus.TextFormatter{FullTimestamp: true, DisableColors: true}
+    case "json":
+        formatter = &logrus.JSONFormatter{}
+    default:
+        return fmt.Errorf("unknown log format %q (want text or json)", format)
+    }
+
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return fmt.Errorf("error creating log directory: %v", err)
+    }
+    flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+    if !appendLog {
+        if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+            if err := os.Rename(path, path+".1"); err != nil {
+                return fmt.Errorf("error rotating log file: %v", err)
+            }
+        }
+        flags |= os.O_TRUNC
+    }
+    file, err := os.OpenFile(path, flags, 0644)
+    if err != nil {
+        return fmt.Errorf("error opening log file: %v", err)
+    }
+
+    logrus.AddHook(&logFileHook{out: file, formatter: formatter})
+    return nil
+}
+
+// stateDir returns the tool's directory under $XDG_STATE_HOME
+func stateDir() (string, error) {
+    base := os.Getenv("XDG_STATE_HOME")
+    if base == "" {
+        homeDir, err := os.UserHomeDir()
+        if err != nil {
+            return "", fmt.Errorf("error getting home directory: %v", err)
+        }
+        base = filepath.Join(homeDir, ".local", "state")
+    }
+    return filepath.Join(base, "dev-env-manager"), nil
+}
+
+// auditLogPath returns the location of the audit log
+func auditLogPath() (string, error) {
+    dir, err := stateDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "audit.log"), nil
+}
+
+// beginAudit starts recording an operation for the audit log
+func beginAudit(command string, args []string) {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    currentAudit = &AuditEntry{
+        Time:    time.Now().UTC(),
+        Command: command,
+        Args:    args,
+    }
+}
+
+// auditTarget records the resolved project and repository of the current operation
+func auditTarget(projectDirName, repoName string) {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    if currentAudit != nil {
+        currentAudit.Project = projectDirName
+        currentAudit.Repo = repoName
+    }
+}
+
+// auditContainerCreated records a container created by the current operation
+func auditContainerCreated(containerID string) {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    if currentAudit != nil {
+        currentAudit.ContainersCreated = append(currentAudit.ContainersCreated, containerID)
+    }
+}
+
+// auditContainerRemoved records a container removed by the current operation
+func auditContainerRemoved(containerID string) {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    if currentAudit != nil {
+        currentAudit.ContainersRemoved = append(currentAudit.ContainersRemoved, containerID)
+    }
+}
+
+// auditImagePulled records an image pulled by the current operation
+func auditImagePulled(imageName string) {
+    auditMu.Lock()
+    defer auditMu.Unlock()
+    if currentAudit != nil {
+        currentAudit.ImagesPulled = append(currentAudit.ImagesPulled, imageName)
+    }
+}
+
+// finishAudit appends the current operation to the audit log; failures are only logged as warnings
+func finishAudit(exitStatus int) {
+    auditMu.Lock()
+    entry := currentAudit
+    currentAudit = nil
+    auditMu.Unlock()
+    if entry == nil {
+        return
+    }
+    entry.ExitStatus = exitStatus
+
+    if err := appendAuditEntry(entry); err != nil {
+        logrus.Warnf("Unable to write audit log: %v", err)
+    }
+}
+
+// appendAuditEntry writes one entry to the audit log, rotating it when it is too large
+func appendAuditEntry(entry *AuditEntry) error {
+    path, err := auditLogPath()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+
+    if info, err := os.Stat(path); err == nil && info.Size() >= auditLogMaxSize {
+        if err := os.Rename(path, path+".1"); err != nil {
+            return fmt.Errorf("error rotating audit log: %v", err)
+        }
+    }
+
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+
+    f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    _, err = f.Write(append(line, '\n'))
+    return err
+}
+
+// ReadAuditLog returns audit entries oldest first, including the rotated log
+func ReadAuditLog() ([]AuditEntry, error) {
+    path, err := auditLogPath()
+    if err != nil {
+        return nil, err
+    }
+
+    var entries []AuditEntry
+    for _, p := range []string{path + ".1", path} {
+        f, err := os.Open(p)
+        if os.IsNotExist(err) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+            var entry AuditEntry
+            if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+                logrus.Warnf("Skipping malformed audit log line in %s: %v", p, err)
+                continue
+            }
+            entries = append(entries, entry)
+        }
+        err = scanner.Err()
+        f.Close()
+        if err != nil {
+            return nil, fmt.Errorf("error reading audit log: %v", err)
+        }
+    }
+    return entries, nil
+}
+
+// parseSince parses a lookback duration, accepting a "d" suffix for days in addition to time.ParseDuration units
+func parseSince(value string) (time.Duration, error) {
+    if strings.HasSuffix(value, "d") {
+        days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+        if err != nil {
+            return 0, fmt.Errorf("invalid duration %q", value)
+        }
+        return time.Duration(days) * 24 * time.Hour, nil
+    }
+    return time.ParseDuration(value)
+}
+
+// RepoEntry identifies a repository configured under a user's project directory
+type RepoEntry struct {
+    User    string `json:"user"`
+    Project string `json:"project"`
+    Repo    string `json:"repo"`
+}
+
+// Key returns the Viper key holding the repository's settings
+func (e RepoEntry) Key() string {
+    return fmt.Sprintf("users.%s.projects.%s.repos.%s", e.User, e.Project, e.Repo)
+}
+
+// configuredRepos lists configured repositories for the current user, followed by the shared ones
+// the user has no personal entry for, or every user's when allUsers is set
+func configuredRepos(allUsers bool) ([]RepoEntry, error) {
+    var users []string
+    if allUsers {
+        users = sortedKeys(viper.GetStringMap("users"))
+    } else {
+        username, err := getUsername()
+        if err != nil {
+            return nil, fmt.Errorf("error getting username: %v", err)
+        }
+        users = []string{username}
+        if username != sharedUser {
+            users = append(users, sharedUser)
+        }
+    }
+
+    var entries []RepoEntry
+    seen := map[string]bool{}
+    for _, user := range users {
+        projects := viper.GetStringMap(fmt.Sprintf("users.%s.projects", user))
+        for _, project := range sortedKeys(projects) {
+            repos := viper.GetStringMap(fmt.Sprintf("users.%s.projects.%s.repos", user, project))
+            for _, repo := range sortedKeys(repos) {
+                if !allUsers && seen[project+"/"+repo] {
+                    continue
+                }
+                seen[project+"/"+repo] = true
+                entries = append(entries, RepoEntry{User: user, Project: project, Repo: repo})
+            }
+        }
+    }
+    return entries, nil
+}
+
+// sortedKeys returns the keys of a config map in sorted order
+func sortedKeys(m map[string]interface{}) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// sensitiveEnvKey reports whether an environment key looks like it holds a credential
+func sensitiveEnvKey(key string) bool {
+    key = strings.ToUpper(key)
+    for _, marker := range []string{"TOKEN", "SECRET", "KEY", "PASSWORD"} {
+        if strings.Contains(key, marker) {
+            return true
+        }
+    }
+    return false
+}
+
+// redactEnv masks values of environment entries whose keys look like credentials
+func redactEnv(env []string) []string {
+    redacted := make([]string, len(env))
+    for i, entry := range env {
+        parts := strings.SplitN(entry, "=", 2)
+        if len(parts) == 2 && sensitiveEnvKey(parts[0]) {
+            entry = parts[0] + "=****"
+        }
+        redacted[i] = entry
+    }
+    return redacted
+}
+
+// shellQuote quotes a value for POSIX shells
+func shellQuote(value string) string {
+    return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// dotenvLine formats a KEY=value entry for a .env file, double-quoting values that need it
+func dotenvLine(entry string) string {
+    eq := strings.Index(entry, "=")
+    key, value := entry[:eq], entry[eq+1:]
+    if value == "" || strings.IndexFunc(value, func(r rune) bool {
+        return !(r == '_' || r == '-' || r == '.' || r == '/' || r == ':' || r == ',' || r == '@' || r == '+' ||
+            (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+    }) < 0 {
+        return key + "=" + value
+    }
+    value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`).Replace(value)
+    return key + `="` + value + `"`
+}
+
+// hostBackedMount returns the bind mount whose destination holds path, if any. A file written
+// there lands on the host, in the checkout for the workspace mount.
+func hostBackedMount(mounts []types.MountPoint, path string) (types.MountPoint, bool) {
+    path = filepath.Clean(path)
+    for _, m := range mounts {
+        if m.Type != mount.TypeBind {
+            continue
+        }
+        dest := filepath.Clean(m.Destination)
+        if path == dest || strings.HasPrefix(path, strings.TrimSuffix(dest, "/")+"/") {
+            return m, true
+        }
+    }
+    return types.MountPoint{}, false
+}
+
+// writeEnvFile copies env into the container as a dotenv file at path, readable only by the
+// container's user. The values are never logged, and the file is refused inside a bind mount
+// so secrets never end up on the host.
+func writeEnvFile(containerID, path string, env []string) error {
+    if !strings.HasPrefix(path, "/") {
+        return fmt.Errorf("env_file %q must be an absolute path in the container", path)
+    }
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(context.Background(), containerID)
+    if err != nil {
+        return err
+    }
+    if m, ok := hostBackedMount(info.Mounts, path); ok {
+        return fmt.Errorf("env_file %q is inside the bind mount of %s and would write secrets to the host; use a path outside it, e.g. /run/devenv/.env", path, m.Source)
+    }
+    var content bytes.Buffer
+    content.WriteString("# Generated by dev-environment-manager from the env config\n")
+    for _, entry := range env {
+        content.WriteString(dotenvLine(entry) + "\n")
+    }
+
+    var archive bytes.Buffer
+    tw := tar.NewWriter(&archive)
+    hdr := &tar.Header{Name: filepath.Base(path), Mode: 0600, Size: int64(content.Len()), ModTime: time.Now()}
+    if err := tw.WriteHeader(hdr); err != nil {
+        return err
+    }
+    if _, err := tw.Write(content.Bytes()); err != nil {
+        return err
+    }
+    if err := tw.Close(); err != nil {
+        return err
+    }
+
+    dir := filepath.Dir(path)
+    if _, err := execInContainer(context.Background(), cli, containerID, []string{"mkdir", "-p", dir}, io.Discard); err != nil {
+        return err
+    }
+    if err := cli.CopyToContainer(context.Background(), containerID, dir, &archive, types.CopyToContainerOptions{CopyUIDGID: true}); err != nil {
+        return err
+    }
+    logrus.Infof("Wrote %d env variable(s) to %s in the container.", len(env), path)
+    return nil
+}
+
+// ExportEnv returns a repository's env config as `export KEY=value` lines for eval in a host
+// shell. Credential-looking keys are left out, with a comment in their place, unless reveal is
+// set: exporting a masked value would overwrite the real one in the shell.
+func ExportEnv(projectDirName, repoName string, reveal bool) ([]string, error) {
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return nil, fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    env, err := repoEnv(projectDirName, repoName)
+    if err != nil {
+        return nil, err
+    }
+    lines := make([]string, len(env))
+    for i, entry := range env {
+        parts := strings.SplitN(entry, "=", 2)
+        if !reveal && sensitiveEnvKey(parts[0]) {
+            lines[i] = fmt.Sprintf("# %s not exported; pass --reveal to include it", parts[0])
+            continue
+        }
+        lines[i] = fmt.Sprintf("export %s=%s", parts[0], shellQuote(parts[1]))
+    }
+    return lines, nil
+}
+
+// reportRepo is one table row of the project report
+type reportRepo struct {
+    Name   string
+    Image  string
+    URL    string
+    Editor string
+    Ports  []string
+    Env    []string
+}
+
+// reportProject groups report rows by project directory
+type reportProject struct {
+    User  string
+    Name  string
+    Repos []reportRepo
+}
+
+// reportData is passed to the report templates
+type reportData struct {
+    Generated string
+    AllUsers  bool
+    Projects  []reportProject
+}
+
+const markdownReportTemplate = `# Development Environments
+
+Generated {{.Generated}}
+{{range .Projects}}
+## {{.Name}}{{if $.AllUsers}} ({{.User}}){{end}}
+
+| Repo | Docker Image | Repo URL | Editor | Ports | Environment |
+|------|--------------|----------|--------|-------|-------------|
+{{range .Repos}}| {{md .Name}} | {{md .Image}} | {{md .URL}} | {{md .Editor}} | {{md (join .Ports)}} | {{md (join .Env)}} |
+{{end}}{{end}}`
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Development Environments</title></head>
+<body>
+<h1>Development Environments</h1>
+<p>Generated {{.Generated}}</p>
+{{range .Projects}}
+<h2>{{.Name}}{{if $.AllUsers}} ({{.User}}){{end}}</h2>
+<table border="1">
+<tr><th>Repo</th><th>Docker Image</th><th>Repo URL</th><th>Editor</th><th>Ports</th><th>Environment</th></tr>
+{{range .Repos}}<tr><td>{{.Name}}</td><td>{{.Image}}</td><td>{{.URL}}</td><td>{{.Editor}}</td><td>{{join .Ports}}</td><td>{{join .Env}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`
+
+// GenerateReport writes a Markdown or HTML summary of all configured projects to w
+func GenerateReport(w io.Writer, allUsers bool, format string) error {
+    entries, err := configuredRepos(allUsers)
+    if err != nil {
+        return err
+    }
+
+    data := reportData{
+        Generated: time.Now().Format(time.RFC1123),
+        AllUsers:  allUsers,
+    }
+    for _, entry := range entries {
+        n := len(data.Projects)
+        if n == 0 || data.Projects[n-1].User != entry.User || data.Projects[n-1].Name != entry.Project {
+            data.Projects = append(data.Projects, reportProject{User: entry.User, Name: entry.Project})
+            n++
+        }
+
+        editor := viper.GetString(entry.Key() + ".editor")
+        if editor == "" {
+            editor = "nvim"
+        }
+        data.Projects[n-1].Repos = append(data.Projects[n-1].Repos, reportRepo{
+            Name:   entry.Repo,
+            Image:  viper.GetString(entry.Key() + ".docker_image"),
+            URL:    viper.GetString(entry.Key() + ".repo_url"),
+            Editor: editor,
+            Ports:  viper.GetStringSlice(entry.Key() + ".ports"),
+            Env:    redactEnv(viper.GetStringSlice(entry.Key() + ".env")),
+        })
+    }
+
+    join := func(values []string) string { return strings.Join(values, ", ") }
+
+    switch format {
+    case "markdown", "md", "":
+        md := func(value string) string { return strings.ReplaceAll(value, "|", "\\|") }
+        tmpl, err := texttemplate.New("report").Funcs(texttemplate.FuncMap{"join": join, "md": md}).Parse(markdownReportTemplate)
+        if err != nil {
+            return err
+        }
+        return tmpl.Execute(w, data)
+    case "html":
+        tmpl, err := htmltemplate.New("report").Funcs(htmltemplate.FuncMap{"join": join}).Parse(htmlReportTemplate)
+        if err != nil {
+            return err
+        }
+        return tmpl.Execute(w, data)
+    default:
+        return fmt.Errorf("unknown report format %q (expected markdown or html)", format)
+    }
+}
+
+// Version of the session record format written to sessions.jsonl
+const sessionRecordVersion = 1
+
+// SessionRecord is one attach session appended to the local usage log
+type SessionRecord struct {
+    Version  int       `json:"version"`
+    Project  string    `json:"project"`
+    Repo     string    `json:"repo"`
+    Start    time.Time `json:"start"`
+    End      time.Time `json:"end"`
+    Duration float64   `json:"duration_seconds"`
+    ExitCode int       `json:"exit_code"`
+}
+
+// UsageTotal aggregates session time for one repository
+type UsageTotal struct {
+    Project  string  `json:"project"`
+    Repo     string  `json:"repo"`
+    Sessions int     `json:"sessions"`
+    Seconds  float64 `json:"total_seconds"`
+}
+
+// localTelemetryEnabled reports whether session usage may be recorded; it never leaves the machine
+func localTelemetryEnabled() bool {
+    return !viper.IsSet("telemetry_local") || viper.GetBool("telemetry_local")
+}
+
+// sessionLogPath returns the location of the session usage log
+func sessionLogPath() (string, error) {
+    dir, err := stateDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "sessions.jsonl"), nil
+}
+
+// recordSession appends an attach session to the usage log; failures are only logged as warnings
+func recordSession(projectDirName, repoName string, start, end time.Time, exitCode int) {
+    if !localTelemetryEnabled() {
+        return
+    }
+
+    record := SessionRecord{
+        Version:  sessionRecordVersion,
+        Project:  projectDirName,
+        Repo:     repoName,
+        Start:    start.UTC(),
+        End:      end.UTC(),
+        Duration: end.Sub(start).Seconds(),
+        ExitCode: exitCode,
+    }
+
+    if err := appendSessionRecord(record); err != nil {
+        logrus.Warnf("Unable to record session usage: %v", err)
+    }
+}
+
+// appendSessionRecord writes one record to the usage log
+func appendSessionRecord(record SessionRecord) error {
+    path, err := sessionLogPath()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+
+    line, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+
+    f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    _, err = f.Write(append(line, '\n'))
+    return err
+}
+
+// UsageSince aggregates recorded sessions that started after the cutoff, largest total first
+func UsageSince(cutoff time.Time) ([]UsageTotal, error) {
+    path, err := sessionLogPath()
+    if err != nil {
+        return nil, err
+    }
+
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    totals := map[string]*UsageTotal{}
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        var record SessionRecord
+        if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+            logrus.Warnf("Skipping malformed session record: %v", err)
+            continue
+        }
+        if record.Version > sessionRecordVersion {
+            logrus.Warnf("Skipping session record with unsupported version %d", record.Version)
+            continue
+        }
+        if record.Start.Before(cutoff) {
+            continue
+        }
+
+        key := record.Project + "/" + record.Repo
+        total, ok := totals[key]
+        if !ok {
+            total = &UsageTotal{Project: record.Project, Repo: record.Repo}
+            totals[key] = total
+        }
+        total.Sessions++
+        total.Seconds += record.Duration
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, fmt.Errorf("error reading session log: %v", err)
+    }
+
+    result := make([]UsageTotal, 0, len(totals))
+    for _, total := range totals {
+        result = append(result, *total)
+    }
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Seconds != result[j].Seconds {
+            return result[i].Seconds > result[j].Seconds
+        }
+        return result[i].Project+"/"+result[i].Repo < result[j].Project+"/"+result[j].Repo
+    })
+    return result, nil
+}
+
+// exitCodeOf extracts a process exit code from an error returned by an exec'd command
+func exitCodeOf(err error) int {
+    if err == nil {
+        return 0
+    }
+    var exitErr *exec.ExitError
+    if errors.As(err, &exitErr) {
+        return exitErr.ExitCode()
+    }
+    return 1
+}
+
+// ConfigValue is one key of the effective config and where its value came from
+type ConfigValue struct {
+    Key    string      `json:"key"`
+    Value  interface{} `json:"value"`
+    Source string      `json:"source"`
+}
+
+// preferredConfigFile returns the location of the file recording the `config use` choice
+func preferredConfigFile() (string, error) {
+    dir, err := appDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "config-path"), nil
+}
+
+// preferredConfigPath returns the config path recorded by `config use`, or "" if none
+func preferredConfigPath() string {
+    path, err := preferredConfigFile()
+    if err != nil {
+        return ""
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(data))
+}
+
+// SetPreferredConfigPath records the config file to use when --config is not given
+func SetPreferredConfigPath(configPath string) error {
+    abs, err := filepath.Abs(configPath)
+    if err != nil {
+        return fmt.Errorf("error resolving %s: %v", configPath, err)
+    }
+    if _, err := os.Stat(abs); os.IsNotExist(err) {
+        logrus.Warnf("Config file %s does not exist yet; it will be created on the next write.", abs)
+    }
+
+    path, err := preferredConfigFile()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    if err := os.WriteFile(path, []byte(abs+"\n"), 0644); err != nil {
+        return fmt.Errorf("error recording preferred config: %v", err)
+    }
+    logrus.Infof("Using %s as the config file from now on.", abs)
+    return nil
+}
+
+// EffectiveConfig lists every key of the merged config with the source of its value
+func EffectiveConfig() ([]ConfigValue, error) {
+    // Re-read the config file on its own so keys can be attributed to it
+    fileConfig := viper.New()
+    configFile := viper.ConfigFileUsed()
+    if configFile != "" {
+        fileConfig.SetConfigFile(configFile)
+        if err := fileConfig.ReadInConfig(); err != nil && !os.IsNotExist(err) {
+            return nil, fmt.Errorf("error reading %s: %v", configFile, err)
+        }
+    }
+
+    keys := viper.AllKeys()
+    sort.Strings(keys)
+
+    values := make([]ConfigValue, 0, len(keys))
+    for _, key := range keys {
+        source := "default"
+        if _, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+            source = "env:" + strings.ToUpper(key)
+        } else if fileConfig.IsSet(key) {
+            source = configFile
+        }
+        values = append(values, ConfigValue{Key: key, Value: viper.Get(key), Source: source})
+    }
+    return values, nil
+}
+
+// repoCheckoutPath returns where a project's repository is checked out on the host
+func repoCheckoutPath(projectDirName, repoName string) (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("error getting home directory: %v", err)
+    }
+    return filepath.Join(homeDir, "Projects", projectDirName, repoName), nil
+}
+
+// CheckoutPath returns the directory start works in: the repository's checkout, or the worktree
+// of branch when one is given
+func CheckoutPath(projectDirName, repoName, branch string) (string, error) {
+    if branch != "" {
+        return worktreePath(projectDirName, repoName, branch)
+    }
+    return repoCheckoutPath(projectDirName, repoName)
+}
+
+// worktreePath returns where the worktree of a branch is checked out:
+// ~/Projects/<project>/.worktrees/<repo>/<branch>, with slashes in the branch replaced
+func worktreePath(projectDirName, repoName, branch string) (string, error) {
+    root, err := projectsRoot()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(root, projectDirName, ".worktrees", repoName, strings.ReplaceAll(branch, "/", "-")), nil
+}
+
+// ensureWorktree returns the worktree of branch, adding it to the base clone if it doesn't exist yet
+func ensureWorktree(basePath, projectDirName, repoName, branch string) (string, error) {
+    path, err := worktreePath(projectDirName, repoName, branch)
+    if err != nil {
+        return "", err
+    }
+    if _, err := os.Stat(path); err == nil {
+        logrus.Infof("Using existing worktree %s", path)
+        return path, nil
+    }
+
+    // Drop records of worktrees deleted by hand so the branch isn't reported as checked out
+    if err := PruneWorktrees(basePath); err != nil {
+        return "", err
+    }
+    logrus.Infof("Adding worktree for branch %s at %s", branch, path)
+    cmd := exec.Command("git", "-C", basePath, "worktree", "add", path, branch)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return "", fmt.Errorf("error adding worktree for branch %s: %v", branch, err)
+    }
+    return path, nil
+}
+
+// PruneWorktrees removes the base clone's records of worktrees whose directories no longer exist
+func PruneWorktrees(basePath string) error {
+    args := []string{"-C", basePath, "worktree", "prune", "-v"}
+    if dryRun {
+        // git lists what it would prune
+        args = append(args, "-n")
+    }
+    cmd := exec.Command("git", args...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("error pruning worktrees of %s: %v", basePath, err)
+    }
+    return nil
+}
+
+// gitSignature builds a commit signature from the user's git config
+func gitSignature(repo *git.Repository) (*object.Signature, error) {
+    cfg, err := repo.ConfigScoped(gitconfig.SystemScope)
+    if err != nil {
+        return nil, fmt.Errorf("error reading git config: %v", err)
+    }
+    if cfg.User.Name == "" || cfg.User.Email == "" {
+        return nil, fmt.Errorf("git user.name and user.email must be configured")
+    }
+    return &object.Signature{Name: cfg.User.Name, Email: cfg.User.Email, When: time.Now()}, nil
+}
+
+// SquashCommits replaces the last n commits on the current branch with a single commit holding HEAD's tree.
+// An empty message joins the squashed commit messages.
+func SquashCommits(projectPath string, n int, message string) error {
+    if n < 2 {
+        return fmt.Errorf("need at least 2 commits to squash, got %d", n)
+    }
+
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return fmt.Errorf("error opening repository %s: %v", projectPath, err)
+    }
+    head, err := repo.Head()
+    if err != nil {
+        return fmt.Errorf("error resolving HEAD: %v", err)
+    }
+    if !head.Name().IsBranch() {
+        return fmt.Errorf("HEAD is detached; check out a branch before squashing")
+    }
+    headCommit, err := repo.CommitObject(head.Hash())
+    if err != nil {
+        return fmt.Errorf("error reading HEAD commit: %v", err)
+    }
+
+    // Walk first parents back to HEAD~n, collecting the messages being squashed
+    var messages []string
+    base := headCommit
+    for i := 0; i < n; i++ {
+        if base.NumParents() == 0 {
+            return fmt.Errorf("branch has fewer than %d commits", n+1)
+        }
+        if base.NumParents() > 1 {
+            return fmt.Errorf("cannot squash across merge commit %s", base.Hash.String()[:7])
+        }
+        messages = append([]string{strings.TrimSpace(base.Message)}, messages...)
+        if base, err = base.Parent(0); err != nil {
+            return fmt.Errorf("error walking history: %v", err)
+        }
+    }
+
+    if message == "" {
+        message = strings.Join(messages, "\n\n")
+    }
+
+    signature, err := gitSignature(repo)
+    if err != nil {
+        return err
+    }
+    squashed := &object.Commit{
+        Author:       *signature,
+        Committer:    *signature,
+        Message:      message + "\n",
+        TreeHash:     headCommit.TreeHash,
+        ParentHashes: []plumbing.Hash{base.Hash},
+    }
+    obj := repo.Storer.NewEncodedObject()
+    if err := squashed.Encode(obj); err != nil {
+        return fmt.Errorf("error encoding commit: %v", err)
+    }
+    hash, err := repo.Storer.SetEncodedObject(obj)
+    if err != nil {
+        return fmt.Errorf("error writing commit: %v", err)
+    }
+
+    // Soft reset moves the branch to the new commit without touching the index or working tree
+    worktree, err := repo.Worktree()
+    if err != nil {
+        return fmt.Errorf("error opening worktree: %v", err)
+    }
+    if err := worktree.Reset(&git.ResetOptions{Commit: hash, Mode: git.SoftReset}); err != nil {
+        return fmt.Errorf("error resetting branch: %v", err)
+    }
+
+    logrus.Infof("Squashed %d commits on %s into %s", n, head.Name().Short(), hash.String()[:7])
+    return nil
+}
+
+// PushBranch force-pushes the current branch to the given remote, as needed after rewriting history
+func PushBranch(projectPath, remoteName string) error {
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return fmt.Errorf("error opening repository %s: %v", projectPath, err)
+    }
+    head, err := repo.Head()
+    if err != nil {
+        return fmt.Errorf("error resolving HEAD: %v", err)
+    }
+
+    refSpec := gitconfig.RefSpec(fmt.Sprintf("+%s:%s", head.Name(), head.Name()))
+    logrus.Infof("Pushing %s to %s...", head.Name().Short(), remoteName)
+    err = repo.Push(&git.PushOptions{
+        RemoteName: remoteName,
+        RefSpecs:   []gitconfig.RefSpec{refSpec},
+        Progress:   os.Stdout,
+    })
+    if err == git.NoErrAlreadyUpToDate {
+        logrus.Info("Remote already up to date.")
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("error pushing to %s: %v", remoteName, err)
+    }
+    return nil
+}
+
+// CommitChanges commits the staged changes of a checkout, staging every change first with addAll.
+// An empty name or email falls back to the repository's git config, then the user's.
+func CommitChanges(projectPath, message, name, email string, addAll bool) (plumbing.Hash, error) {
+    if strings.TrimSpace(message) == "" {
+        return plumbing.ZeroHash, fmt.Errorf("a commit message is required")
+    }
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return plumbing.ZeroHash, fmt.Errorf("error opening repository %s: %v", projectPath, err)
+    }
+    worktree, err := repo.Worktree()
+    if err != nil {
+        return plumbing.ZeroHash, fmt.Errorf("error opening worktree: %v", err)
+    }
+
+    var signature *object.Signature
+    if name != "" && email != "" {
+        signature = &object.Signature{Name: name, Email: email, When: time.Now()}
+    } else if signature, err = gitSignature(repo); err != nil {
+        return plumbing.ZeroHash, err
+    }
+
+    if addAll {
+        if _, err := worktree.Add("."); err != nil {
+            return plumbing.ZeroHash, fmt.Errorf("error staging changes: %v", err)
+        }
+    }
+    status, err := worktree.Status()
+    if err != nil {
+        return plumbing.ZeroHash, fmt.Errorf("error reading status: %v", err)
+    }
+    staged := false
+    for _, s := range status {
+        if s.Staging != git.Unmodified && s.Staging != git.Untracked {
+            staged = true
+            break
+        }
+    }
+    if !staged {
+        return plumbing.ZeroHash, fmt.Errorf("nothing to commit (use --all to stage every change)")
+    }
+
+    hash, err := worktree.Commit(message, &git.CommitOptions{Author: signature})
+    if err != nil {
+        return plumbing.ZeroHash, fmt.Errorf("error committing: %v", err)
+    }
+    return hash, nil
+}
+
+// PushChanges pushes a branch, HEAD's when branch is empty, to a remote without forcing.
+// A nil auth uses go-git's defaults like CloneRepo does: ssh-agent for SSH URLs, none for HTTPS.
+func PushChanges(projectPath, remote, branch string, auth transport.AuthMethod) error {
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return fmt.Errorf("error opening repository %s: %v", projectPath, err)
+    }
+    ref := plumbing.NewBranchReferenceName(branch)
+    if branch == "" {
+        head, err := repo.Head()
+        if err != nil {
+            return fmt.Errorf("error resolving HEAD: %v", err)
+        }
+        if !head.Name().IsBranch() {
+            return fmt.Errorf("HEAD is detached; pass --branch")
+        }
+        ref = head.Name()
+    }
+
+    logrus.Infof("Pushing %s to %s...", ref.Short(), remote)
+    err = repo.Push(&git.PushOptions{
+        RemoteName: remote,
+        RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec(fmt.Sprintf("%s:%s", ref, ref))},
+        Auth:       auth,
+        Progress:   os.Stdout,
+    })
+    if err == git.NoErrAlreadyUpToDate {
+        logrus.Info("Remote already up to date.")
+        return nil
+    }
+    if err != nil && strings.Contains(err.Error(), "non-fast-forward") {
+        return fmt.Errorf("%s on %s has commits that aren't in the local branch; pull them first (%v)", ref.Short(), remote, err)
+    }
+    if err != nil {
+        return fmt.Errorf("error pushing to %s: %v", remote, err)
+    }
+    return nil
+}
+
+// parseAuthor splits a "Name <email>" author string
+func parseAuthor(author string) (string, string, error) {
+    open := strings.LastIndex(author, "<")
+    if open < 0 || !strings.HasSuffix(author, ">") {
+        return "", "", fmt.Errorf("author %q is not of the form \"Name <email>\"", author)
+    }
+    name := strings.TrimSpace(author[:open])
+    email := author[open+1 : len(author)-1]
+    if name == "" || email == "" {
+        return "", "", fmt.Errorf("author %q is not of the form \"Name <email>\"", author)
+    }
+    return name, email, nil
+}
+
+// Value kinds accepted by config keys
+const (
+    kindString = "string"
+    kindBool   = "bool"
+    kindInt    = "int"
+    kindFloat  = "float"
+    kindList   = "list"
+)
+
+// repoConfigSchema lists the keys accepted in a repository entry; most may also be set globally as defaults
+var repoConfigSchema = map[string]string{
+    "repo_url":            kindString,
+    "docker_image":        kindString,
+    "docker_image_digest": kindString,
+    "container_name":      kindString,
+    "hostname":            kindString,
+    "prompt_hint":         kindBool,
+    "memory":              kindString,
+    "memory_swap":         kindString,
+    "memory_swappiness":   kindInt,
+    "oom_kill_disable":    kindBool,
+    "cgroup_parent":       kindString,
+    "cpu_set_cpus":        kindString,
+    "cpu_set_mems":        kindString,
+    "log_driver":          kindString,
+    "log_opts":            kindList,
+    "entrypoint":          kindList,
+    "network_mode":        kindString,
+    "network_aliases":     kindList,
+    "network_disabled":    kindBool,
+    "dns":                 kindList,
+    "dns_search":          kindList,
+    "dns_options":         kindList,
+    "cap_add":             kindList,
+    "cap_drop":            kindList,
+    "read_only":           kindBool,
+    "gpus":                kindString,
+    "gpu_memory_fraction": kindFloat,
+    "init_commands":       kindList,
+    "env":                 kindList,
+    "volumes":             kindList,
+    "ports":               kindList,
+    "shell_rc":            kindString,
+    "sync":                kindBool,
+    "editor":              kindString,
+    "session_restore":     kindBool,
+    "detach_keys":         kindString,
+    "mount_target":        kindString,
+    "verify_modules":      kindBool,
+    "timezone":            kindString,
+    "stop_grace_period":   kindString,
+    "stop_signal":         kindString,
+    "env_file":            kindString,
+    "mount_consistency":   kindString,
+    "ipc_mode":            kindString,
+    "subpath":             kindString,
+}
+
+// globalConfigSchema lists top-level keys that only make sense globally
+var globalConfigSchema = map[string]string{
+    "telemetry_local":           kindBool,
+    "allow_undefined_env":       kindBool,
+    "template_registry_url":     kindString,
+    "template_registry_timeout": kindString,
+    "profile":                   kindString,
+}
+
+// checkKind reports whether a YAML value matches a schema kind
+func checkKind(kind string, value interface{}) bool {
+    switch kind {
+    case kindString:
+        switch value.(type) {
+        case string, int, int64, float64:
+            return true
+        }
+    case kindBool:
+        _, ok := value.(bool)
+        return ok
+    case kindInt:
+        switch value.(type) {
+        case int, int64:
+            return true
+        }
+    case kindFloat:
+        switch value.(type) {
+        case int, int64, float64:
+            return true
+        }
+    case kindList:
+        _, ok := value.([]interface{})
+        return ok
+    }
+    return false
+}
+
+// ValidateRepoSettings checks a repository entry against the schema
+func ValidateRepoSettings(prefix string, settings map[string]interface{}) []error {
+    var errs []error
+    for _, key := range sortedKeys(settings) {
+        if strings.ToLower(key) == "profiles" {
+            errs = append(errs, validateProfilesTree(prefix+key, settings[key])...)
+            continue
+        }
+        kind, ok := repoConfigSchema[strings.ToLower(key)]
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s%s: unknown key", prefix, key))
+            continue
+        }
+        if !checkKind(kind, settings[key]) {
+            errs = append(errs, fmt.Errorf("%s%s: expected %s", prefix, key, kind))
+        }
+    }
+    return errs
+}
+
+// ValidateConfigTree checks a whole parsed config file against the schema
+func ValidateConfigTree(tree map[string]interface{}) []error {
+    var errs []error
+    for _, key := range sortedKeys(tree) {
+        lower := strings.ToLower(key)
+        if lower == "users" {
+            errs = append(errs, validateUsersTree(key, tree[key])...)
+            continue
+        }
+        if lower == "updates" {
+            errs = append(errs, validateUpdatesTree(key, tree[key])...)
+            continue
+        }
+        if lower == "policy" {
+            errs = append(errs, validatePolicyTree(key, tree[key])...)
+            continue
+        }
+        if lower == "workspaces" {
+            errs = append(errs, validateWorkspacesTree(key, tree[key])...)
+            continue
+        }
+        if lower == "profiles" {
+            errs = append(errs, validateProfilesTree(key, tree[key])...)
+            continue
+        }
+        kind, ok := globalConfigSchema[lower]
+        if !ok {
+            kind, ok = repoConfigSchema[lower]
+        }
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s: unknown key", key))
+            continue
+        }
+        if !checkKind(kind, tree[key]) {
+            errs = append(errs, fmt.Errorf("%s: expected %s", key, kind))
+        }
+    }
+    return errs
+}
+
+// validateProfilesTree checks a profiles section, which maps profile names to overrides of
+// repository settings; profiles don't nest
+func validateProfilesTree(prefix string, value interface{}) []error {
+    profiles, ok := value.(map[string]interface{})
+    if !ok {
+        return []error{fmt.Errorf("%s: expected a mapping of profiles", prefix)}
+    }
+    var errs []error
+    for _, name := range sortedKeys(profiles) {
+        settings, ok := profiles[name].(map[string]interface{})
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s.%s: expected a mapping", prefix, name))
+            continue
+        }
+        overrides := map[string]interface{}{}
+        for key, v := range settings {
+            if strings.ToLower(key) == "profiles" {
+                errs = append(errs, fmt.Errorf("%s.%s.%s: profiles can't be nested", prefix, name, key))
+                continue
+            }
+            overrides[key] = v
+        }
+        errs = append(errs, ValidateRepoSettings(fmt.Sprintf("%s.%s.", prefix, name), overrides)...)
+    }
+    return errs
+}
+
+// validateUpdatesTree checks the updates section, whose only key is check
+func validateUpdatesTree(prefix string, value interface{}) []error {
+    updates, ok := value.(map[string]interface{})
+    if !ok {
+        return []error{fmt.Errorf("%s: expected a mapping", prefix)}
+    }
+    var errs []error
+    for _, key := range sortedKeys(updates) {
+        if strings.ToLower(key) != "check" {
+            errs = append(errs, fmt.Errorf("%s.%s: unknown key", prefix, key))
+        } else if !checkKind(kindBool, updates[key]) {
+            errs = append(errs, fmt.Errorf("%s.%s: expected %s", prefix, key, kindBool))
+        }
+    }
+    return errs
+}
+
+// validateUsersTree checks the users.<user>.projects.<dir>.repos.<repo> hierarchy
+func validateUsersTree(prefix string, value interface{}) []error {
+    users, ok := value.(map[string]interface{})
+    if !ok {
+        return []error{fmt.Errorf("%s: expected a mapping of users", prefix)}
+    }
+
+    var errs []error
+    for _, user := range sortedKeys(users) {
+        userTree, ok := users[user].(map[string]interface{})
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s.%s: expected a mapping", prefix, user))
+            continue
+        }
+        for _, key := range sortedKeys(userTree) {
+            if strings.ToLower(key) != "projects" {
+                errs = append(errs, fmt.Errorf("%s.%s.%s: unknown key", prefix, user, key))
+                continue
+            }
+            projects, ok := userTree[key].(map[string]interface{})
+            if !ok {
+                errs = append(errs, fmt.Errorf("%s.%s.%s: expected a mapping of projects", prefix, user, key))
+                continue
+            }
+            for _, project := range sortedKeys(projects) {
+                projectPrefix := fmt.Sprintf("%s.%s.%s.%s", prefix, user, key, project)
+                projectTree, ok := projects[project].(map[string]interface{})
+                if !ok {
+                    errs = append(errs, fmt.Errorf("%s: expected a mapping", projectPrefix))
+                    continue
+                }
+                for _, projectKey := range sortedKeys(projectTree) {
+                    if strings.ToLower(projectKey) != "repos" {
+                        errs = append(errs, fmt.Errorf("%s.%s: unknown key", projectPrefix, projectKey))
+                        continue
+                    }
+                    repos, ok := projectTree[projectKey].(map[string]interface{})
+                    if !ok {
+                        errs = append(errs, fmt.Errorf("%s.%s: expected a mapping of repos", projectPrefix, projectKey))
+                        continue
+                    }
+                    for _, repo := range sortedKeys(repos) {
+                        repoPrefix := fmt.Sprintf("%s.%s.%s.", projectPrefix, projectKey, repo)
+                        settings, ok := repos[repo].(map[string]interface{})
+                        if !ok {
+                            errs = append(errs, fmt.Errorf("%s: expected a mapping", strings.TrimSuffix(repoPrefix, ".")))
+                            continue
+                        }
+                        errs = append(errs, ValidateRepoSettings(repoPrefix, settings)...)
+                    }
+                }
+            }
+        }
+    }
+    return errs
+}
+
+// lookupMap finds a nested mapping by case-insensitive key, as Viper matches keys
+func lookupMap(m map[string]interface{}, key string) (string, map[string]interface{}, bool) {
+    for k, v := range m {
+        if strings.EqualFold(k, key) {
+            child, ok := v.(map[string]interface{})
+            return k, child, ok
+        }
+    }
+    return "", nil, false
+}
+
+// readConfigTree parses the raw config file, returning an empty tree if it does not exist
+func readConfigTree(path string) ([]byte, map[string]interface{}, error) {
+    tree := map[string]interface{}{}
+    raw, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, tree, nil
+    }
+    if err != nil {
+        return nil, nil, err
+    }
+    if err := yaml.Unmarshal(raw, &tree); err != nil {
+        return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    if tree == nil {
+        tree = map[string]interface{}{}
+    }
+    return raw, tree, nil
+}
+
+// readConfigDocument parses the raw config file as a YAML node tree, which keeps comments and key
+// order for rewrites. A missing or empty file gives a document holding an empty mapping.
+func readConfigDocument(path string) ([]byte, *yaml.Node, error) {
+    raw, err := os.ReadFile(path)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, nil, err
+    }
+    doc := &yaml.Node{}
+    if err := yaml.Unmarshal(raw, doc); err != nil {
+        return nil, nil, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    if len(doc.Content) == 0 {
+        doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+    }
+    if doc.Content[0].Kind != yaml.MappingNode {
+        return nil, nil, fmt.Errorf("error parsing %s: the top level is not a mapping", path)
+    }
+    return raw, doc, nil
+}
+
+// nodeLookup returns the index of a key's value in a mapping node, matching keys case-insensitively
+// like Viper does, or -1
+func nodeLookup(m *yaml.Node, key string) int {
+    for i := 0; i+1 < len(m.Content); i += 2 {
+        if strings.EqualFold(m.Content[i].Value, key) {
+            return i + 1
+        }
+    }
+    return -1
+}
+
+// nodeChildMap returns the mapping under a key of a mapping node, adding an empty one if the key
+// is missing or holds no mapping
+func nodeChildMap(m *yaml.Node, key string) *yaml.Node {
+    i := nodeLookup(m, key)
+    if i >= 0 && m.Content[i].Kind == yaml.MappingNode {
+        return m.Content[i]
+    }
+    child := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+    if i >= 0 {
+        m.Content[i] = child
+    } else {
+        m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+    }
+    return child
+}
+
+// nodeSet sets a key of a mapping node to value. An existing key keeps its place and comments.
+func nodeSet(m *yaml.Node, key string, value interface{}) error {
+    v := &yaml.Node{}
+    if err := v.Encode(value); err != nil {
+        return err
+    }
+    if i := nodeLookup(m, key); i >= 0 {
+        v.HeadComment, v.LineComment, v.FootComment = m.Content[i].HeadComment, m.Content[i].LineComment, m.Content[i].FootComment
+        m.Content[i] = v
+        return nil
+    }
+    m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, v)
+    return nil
+}
+
+// encodeConfigDocument encodes a config document with the indentation raw, its original text,
+// uses; YAML's default of four spaces when it has no nested lines
+func encodeConfigDocument(doc *yaml.Node, raw []byte) ([]byte, error) {
+    indent := 4
+    for _, line := range strings.Split(string(raw), "\n") {
+        trimmed := strings.TrimLeft(line, " ")
+        if n := len(line) - len(trimmed); n > 0 && trimmed != "" && !strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(trimmed, "- ") {
+            indent = n
+            break
+        }
+    }
+    var buf bytes.Buffer
+    enc := yaml.NewEncoder(&buf)
+    enc.SetIndent(indent)
+    if err := enc.Encode(doc); err != nil {
+        return nil, err
+    }
+    if err := enc.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+// repoNode locates a repository's entry in a config document, returning the repos mapping holding
+// it and the index of the entry's value there
+func repoNode(doc *yaml.Node, username, projectDirName, repoName string) (*yaml.Node, int, bool) {
+    node := doc.Content[0]
+    for _, key := range []string{"users", username, "projects", projectDirName, "repos"} {
+        i := nodeLookup(node, key)
+        if i < 0 || node.Content[i].Kind != yaml.MappingNode {
+            return nil, -1, false
+        }
+        node = node.Content[i]
+    }
+    i := nodeLookup(node, repoName)
+    return node, i, i >= 0
+}
+
+// repoSubtree locates a repository's mapping inside a parsed config tree
+func repoSubtree(tree map[string]interface{}, username, projectDirName, repoName string) (map[string]interface{}, string, bool) {
+    node := tree
+    for _, key := range []string{"users", username, "projects", projectDirName, "repos"} {
+        var ok bool
+        if _, node, ok = lookupMap(node, key); !ok {
+            return nil, "", false
+        }
+    }
+    repoKey, _, ok := lookupMap(node, repoName)
+    return node, repoKey, ok
+}
+
+// configSnapshot flattens a parsed config tree into repository settings keyed like RepoEntry.Key
+func configSnapshot(tree map[string]interface{}) map[string]map[string]interface{} {
+    snapshot := make(map[string]map[string]interface{})
+    users, _ := tree["users"].(map[string]interface{})
+    for user, u := range users {
+        userTree, _ := u.(map[string]interface{})
+        projects, _ := userTree["projects"].(map[string]interface{})
+        for project, p := range projects {
+            projectTree, _ := p.(map[string]interface{})
+            repos, _ := projectTree["repos"].(map[string]interface{})
+            for repo, r := range repos {
+                settings, _ := r.(map[string]interface{})
+                snapshot[RepoEntry{User: user, Project: project, Repo: repo}.Key()] = settings
+            }
+        }
+    }
+    return snapshot
+}
+
+// diffSnapshots prints the repositories added, removed or modified between two config snapshots
+func diffSnapshots(out io.Writer, before, after map[string]map[string]interface{}) {
+    changed := false
+    keys := make(map[string]interface{}, len(before)+len(after))
+    for k := range before {
+        keys[k] = nil
+    }
+    for k := range after {
+        keys[k] = nil
+    }
+    for _, key := range sortedKeys(keys) {
+        old, hadOld := before[key]
+        cur, hasCur := after[key]
+        switch {
+        case !hadOld:
+            fmt.Fprintf(out, "  + %s\n", key)
+        case !hasCur:
+            fmt.Fprintf(out, "  - %s\n", key)
+        case !reflect.DeepEqual(old, cur):
+            fmt.Fprintf(out, "  ~ %s\n", key)
+        default:
+            continue
+        }
+        changed = true
+    }
+    if !changed {
+        fmt.Fprintln(out, "  no project changes")
+    }
+}
+
+// WatchConfig reports project changes and validation problems each time the config file at path
+// is saved, until ctx is cancelled. The directory is watched because editors often replace the file.
+func WatchConfig(ctx context.Context, path string, out io.Writer) error {
+    if path == "" {
+        return fmt.Errorf("no config file in use")
+    }
+    path, err := filepath.Abs(path)
+    if err != nil {
+        return err
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("error creating watcher: %v", err)
+    }
+    defer watcher.Close()
+    if err := watcher.Add(filepath.Dir(path)); err != nil {
+        return fmt.Errorf("error watching %s: %v", filepath.Dir(path), err)
+    }
+
+    _, tree, err := readConfigTree(path)
+    if err != nil {
+        return err
+    }
+    snapshot := configSnapshot(tree)
+    fmt.Fprintf(out, "Watching %s (%d repositories). Press Ctrl-C to stop.\n", path, len(snapshot))
+
+    // Editors emit several events per save; reload once things settle
+    var reload <-chan time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case err := <-watcher.Errors:
+            logrus.Warnf("Watch error: %v", err)
+        case event := <-watcher.Events:
+            if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+                reload = time.After(100 * time.Millisecond)
+            }
+        case <-reload:
+            reload = nil
+            _, tree, err := readConfigTree(path)
+            fmt.Fprintf(out, "[%s] %s changed\n", time.Now().Format("15:04:05"), filepath.Base(path))
+            if err != nil {
+                fmt.Fprintf(out, "  %v\n", err)
+                continue
+            }
+            next := configSnapshot(tree)
+            diffSnapshots(out, snapshot, next)
+            snapshot = next
+            for _, verr := range ValidateConfigTree(tree) {
+                fmt.Fprintf(out, "  warning: %v\n", verr)
+            }
+        }
+    }
+}
+
+// runEditor opens path in $VISUAL or $EDITOR, falling back to vi
+func runEditor(path string) error {
+    editor := os.Getenv("VISUAL")
+    if editor == "" {
+        editor = os.Getenv("EDITOR")
+    }
+    if editor == "" {
+        editor = "vi"
+    }
+
+    // Run through the shell so editors configured with arguments (e.g. "code --wait") work
+    cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+    cmd.Stdin = os.Stdin
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("editor %q failed: %v", editor, err)
+    }
+    return nil
+}
+
+// assumeYes answers every confirmation prompt with yes (--yes / -y)
+var assumeYes bool
+
+// stdinInteractive reports whether confirm can ask on stdin; tests replace it along with stdinReader
+var stdinInteractive = stdinIsTerminal
+
+// stdinIsTerminal reports whether prompts can be answered interactively; /dev/null is a character
+// device too, but nobody is there to answer
+func stdinIsTerminal() bool {
+    info, err := os.Stdin.Stat()
+    if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+        return false
+    }
+    null, err := os.Stat(os.DevNull)
+    return err != nil || !os.SameFile(info, null)
+}
+
+// confirm asks before a destructive action. --yes confirms without asking; without a terminal
+// to ask on the answer is no, so scripts must opt in with --yes.
+func confirm(prompt string) bool {
+    if assumeYes {
+        return true
+    }
+    if !stdinInteractive() {
+        logrus.Warnf("%s Not confirmed: stdin is not a terminal; pass --yes to proceed.", prompt)
+        return false
+    }
+    return promptYesNo(prompt, false)
+}
+
+// stdinReader is shared by prompts so buffered input isn't lost between questions
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// promptYesNo asks a yes/no question on the terminal; an empty answer selects def
+func promptYesNo(question string, def bool) bool {
+    hint := "[y/N]"
+    if def {
+        hint = "[Y/n]"
+    }
+    fmt.Printf("%s %s ", question, hint)
+
+    answer, err := stdinReader.ReadString('\n')
+    if err != nil {
+        return def
+    }
+    switch strings.ToLower(strings.TrimSpace(answer)) {
+    case "y", "yes":
+        return true
+    case "n", "no":
+        return false
+    }
+    return def
+}
+
+// EditConfig opens a repository's entry, or the whole config file when projectDirName is empty, in the user's
+// editor. The edit is validated against the schema before it replaces the config file; comments and layout
+// outside an edited entry are kept.
+func EditConfig(projectDirName, repoName string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+
+    path, err := configFilePath()
+    if err != nil {
+        return err
+    }
+    raw, doc, err := readConfigDocument(path)
+    if err != nil {
+        return err
+    }
+
+    wholeFile := projectDirName == ""
+    var repos *yaml.Node
+    var repoIndex int
+    content := raw
+    if !wholeFile {
+        username, err := getUsername()
+        if err != nil {
+            return fmt.Errorf("error getting username: %v", err)
+        }
+        var ok bool
+        repos, repoIndex, ok = repoNode(doc, username, projectDirName, repoName)
+        if !ok {
+            return fmt.Errorf("repository %s is not configured under project %s for user %s", repoName, projectDirName, username)
+        }
+        if content, err = encodeConfigDocument(repos.Content[repoIndex], raw); err != nil {
+            return fmt.Errorf("error extracting repository config: %v", err)
+        }
+    }
+
+    tmp, err := os.CreateTemp("", "dev-env-manager-*.yaml")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    _, err = tmp.Write(content)
+    tmp.Close()
+    if err != nil {
+        return err
+    }
+
+    var edited []byte
+    for {
+        if err := runEditor(tmp.Name()); err != nil {
+            return err
+        }
+        if edited, err = os.ReadFile(tmp.Name()); err != nil {
+            return err
+        }
+
+        var errs []error
+        parsed := map[string]interface{}{}
+        if err := yaml.Unmarshal(edited, &parsed); err != nil {
+            errs = []error{err}
+        } else if wholeFile {
+            errs = ValidateConfigTree(parsed)
+        } else if errs = ValidateRepoSettings("", parsed); len(errs) == 0 {
+            entry := &yaml.Node{}
+            if err := yaml.Unmarshal(edited, entry); err != nil {
+                return err
+            }
+            if len(entry.Content) == 0 {
+                repos.Content[repoIndex] = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+            } else {
+                repos.Content[repoIndex] = entry.Content[0]
+            }
+        }
+        if len(errs) == 0 {
+            break
+        }
+
+        fmt.Println("The edited config is invalid:")
+        for _, e := range errs {
+            fmt.Printf("  - %v\n", e)
+        }
+        if !promptYesNo("Reopen the editor?", true) {
+            return fmt.Errorf("edit discarded; %s was left unchanged", path)
+        }
+    }
+
+    if bytes.Equal(edited, content) {
+        logrus.Info("No changes made.")
+        return nil
+    }
+    if !wholeFile {
+        if edited, err = encodeConfigDocument(doc, raw); err != nil {
+            return fmt.Errorf("error encoding config: %v", err)
+        }
+    }
+    if err := writeFileAtomic(path, edited); err != nil {
+        return fmt.Errorf("error writing config file: %v", err)
+    }
+
+    logrus.Infof("Updated %s", path)
+    return nil
+}
+
+// projectsRoot returns the directory holding all project checkouts
+func projectsRoot() (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("error getting home directory: %v", err)
+    }
+    return filepath.Join(homeDir, "Projects"), nil
+}
+
+// ResolveProjectFromDir infers the project and repo that contain dir, first from the
+// ~/Projects/<project>/<repo> layout and then by matching the checkout's origin URL against repo_url.
+func ResolveProjectFromDir(dir string) (projectDirName, repoName string, err error) {
+    var attempts []string
+
+    root, err := projectsRoot()
+    if err != nil {
+        return "", "", err
+    }
+    if resolved, err := filepath.EvalSymlinks(root); err == nil {
+        root = resolved
+    }
+    if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+        dir = resolved
+    }
+
+    rel, err := filepath.Rel(root, dir)
+    if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+        parts := strings.Split(rel, string(filepath.Separator))
+        if len(parts) >= 2 {
+            return parts[0], parts[1], nil
+        }
+        attempts = append(attempts, fmt.Sprintf("%s is not inside a <project>/<repo> directory under %s", dir, root))
+    } else {
+        attempts = append(attempts, fmt.Sprintf("%s is not under the projects root %s", dir, root))
+    }
+
+    repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+    if err != nil {
+        attempts = append(attempts, fmt.Sprintf("no git repository found at or above %s", dir))
+        return "", "", fmt.Errorf("could not infer project:\n  - %s", strings.Join(attempts, "\n  - "))
+    }
+    origin, err := repo.Remote("origin")
+    if err != nil || len(origin.Config().URLs) == 0 {
+        attempts = append(attempts, "git repository has no origin remote to match against repo_url")
+        return "", "", fmt.Errorf("could not infer project:\n  - %s", strings.Join(attempts, "\n  - "))
+    }
+
+    originURL := normalizeRepoURL(origin.Config().URLs[0])
+    entries, err := configuredRepos(false)
+    if err != nil {
+        return "", "", err
+    }
+    for _, entry := range entries {
+        repoURL, err := expandEnv(viper.GetString(entry.Key() + ".repo_url"))
+        if err != nil {
+            continue
+        }
+        if normalizeRepoURL(repoURL) == originURL {
+            return entry.Project, entry.Repo, nil
+        }
+    }
+    attempts = append(attempts, fmt.Sprintf("origin %s does not match any configured repo_url", origin.Config().URLs[0]))
+    return "", "", fmt.Errorf("could not infer project:\n  - %s", strings.Join(attempts, "\n  - "))
+}
+
+// normalizeRepoURL reduces HTTPS and SSH forms of a git URL to host/owner/repo for comparison
+func normalizeRepoURL(repoURL string) string {
+    u := strings.ToLower(strings.TrimSpace(repoURL))
+    hasScheme := strings.Contains(u, "://")
+    for _, scheme := range []string{"https://", "http://", "ssh://", "git://"} {
+        u = strings.TrimPrefix(u, scheme)
+    }
+    if i := strings.Index(u, "@"); i >= 0 {
+        u = u[i+1:]
+    }
+    // host:port/owner/repo with a scheme, or scp-like host:owner/repo without one
+    if i := strings.Index(u, ":"); i >= 0 && !strings.Contains(u[:i], "/") {
+        rest := u[i+1:]
+        if hasScheme {
+            rest = strings.TrimLeft(rest, "0123456789")
+        }
+        u = u[:i] + "/" + strings.TrimLeft(rest, "/")
+    }
+    u = strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git")
+    return u
+}
+
+// ProjectMetadata is tool-maintained bookkeeping for a repository, kept outside the user-edited config
+type ProjectMetadata struct {
+    AddedAt    time.Time `json:"added_at"`
+    LastOpened time.Time `json:"last_opened,omitempty"`
+}
+
+// LastActive is when the repository was last opened, or added if it never was
+func (m ProjectMetadata) LastActive() time.Time {
+    if !m.LastOpened.IsZero() {
+        return m.LastOpened
+    }
+    return m.AddedAt
+}
+
+// metadataPath returns the metadata file of a repository under ~/.dev-env-manager/projects/
+func metadataPath(projectDirName, repoName string) (string, error) {
+    dir, err := appDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "projects", projectDirName, repoName+".json"), nil
+}
+
+// ReadProjectMetadata loads a repository's metadata; a missing file yields zero values
+func ReadProjectMetadata(projectDirName, repoName string) (ProjectMetadata, error) {
+    var meta ProjectMetadata
+    path, err := metadataPath(projectDirName, repoName)
+    if err != nil {
+        return meta, err
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return meta, nil
+    }
+    if err != nil {
+        return meta, err
+    }
+    if err := json.Unmarshal(data, &meta); err != nil {
+        return meta, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    return meta, nil
+}
+
+// WriteProjectMetadata stores a repository's metadata
+func WriteProjectMetadata(projectDirName, repoName string, meta ProjectMetadata) error {
+    path, err := metadataPath(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(meta, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// recordOpened stores when a repository's environment was last started; failures only warn
+func recordOpened(projectDirName, repoName string) {
+    meta, err := ReadProjectMetadata(projectDirName, repoName)
+    if err == nil {
+        meta.LastOpened = time.Now().UTC()
+        err = WriteProjectMetadata(projectDirName, repoName, meta)
+    }
+    if err != nil {
+        logrus.Warnf("Unable to record when %s/%s was opened: %v", projectDirName, repoName, err)
+    }
+}
+
+// ActivityFilter limits repositories by when they were last active (see ProjectMetadata.LastActive).
+// Zero bounds are open; a repository with no recorded activity only passes a Before-only filter.
+type ActivityFilter struct {
+    Since  time.Time
+    Before time.Time
+}
+
+// Match reports whether a last-active time passes the filter
+func (f ActivityFilter) Match(active time.Time) bool {
+    if active.IsZero() {
+        return f.Since.IsZero()
+    }
+    if !f.Since.IsZero() && active.Before(f.Since) {
+        return false
+    }
+    if !f.Before.IsZero() && !active.Before(f.Before) {
+        return false
+    }
+    return true
+}
+
+// ListedRepo is one row of the project-list command
+type ListedRepo struct {
+    RepoEntry
+    Image      string    `json:"image"`
+    AddedAt    time.Time `json:"added_at"`
+    LastOpened time.Time `json:"last_opened"`
+}
+
+// ListProjects returns the current user's repositories that pass filter, or every user's with
+// allUsers. Metadata lives in each user's home, so other users' repositories have no times.
+func ListProjects(filter ActivityFilter, allUsers bool) ([]ListedRepo, error) {
+    entries, err := configuredRepos(allUsers)
+    if err != nil {
+        return nil, err
+    }
+    username, err := getUsername()
+    if err != nil {
+        return nil, fmt.Errorf("error getting username: %v", err)
+    }
+
+    listed := []ListedRepo{}
+    for _, entry := range entries {
+        var meta ProjectMetadata
+        if entry.User == username || entry.User == sharedUser {
+            if meta, err = ReadProjectMetadata(entry.Project, entry.Repo); err != nil {
+                logrus.Warnf("Unable to read metadata for %s/%s: %v", entry.Project, entry.Repo, err)
+            }
+        }
+        if !filter.Match(meta.LastActive()) {
+            continue
+        }
+        listed = append(listed, ListedRepo{
+            RepoEntry:  entry,
+            Image:      viper.GetString(entry.Key() + ".docker_image"),
+            AddedAt:    meta.AddedAt,
+            LastOpened: meta.LastOpened,
+        })
+    }
+    return listed, nil
+}
+
+// RepoStatus is one row of the status command: a configured repository and its container
+type RepoStatus struct {
+    ListedRepo
+    Container string `json:"container"`
+    State     string `json:"state"`          // container state, or "absent"
+    Lock      string `json:"lock,omitempty"` // "locked", or with checkLocks "outdated" when the tag has moved past the locked digest
+}
+
+// ProjectStatus returns the current user's repositories, or every user's with allUsers, that pass
+// filter with their container states, only those with a running container when runningOnly is set.
+// checkLocks asks the registry whether each locked repository's tag has moved on, which costs a
+// request per image.
+func ProjectStatus(filter ActivityFilter, runningOnly, allUsers, checkLocks bool) ([]RepoStatus, error) {
+    listed, err := ListProjects(filter, allUsers)
+    if err != nil {
+        return nil, err
+    }
+    containers, err := ListManagedContainers(true)
+    if err != nil {
+        return nil, err
+    }
+
+    statuses := []RepoStatus{}
+    tagDigests := make(map[string]string)
+    for _, repo := range listed {
+        dockerImage, containerName, err := entryImageAndContainer(repo.RepoEntry)
+        if err != nil {
+            return nil, err
+        }
+        status := RepoStatus{ListedRepo: repo, Container: containerName, State: "absent"}
+        if locked := viper.GetString(repo.Key() + ".docker_image_digest"); locked != "" {
+            status.Lock = "locked"
+            if checkLocks {
+                current, seen := tagDigests[dockerImage]
+                if !seen {
+                    if current, err = resolveImageDigest(context.Background(), dockerImage); err != nil {
+                        logrus.Warnf("Unable to check the lock of %s/%s: %v", repo.Project, repo.Repo, err)
+                    }
+                    tagDigests[dockerImage] = current
+                }
+                if current != "" && current != locked {
+                    status.Lock = "outdated"
+                }
+            }
+        }
+        for _, c := range containers {
+            if c.Name == containerName {
+                status.State = c.State
+            }
+        }
+        if runningOnly && status.State != "running" {
+            continue
+        }
+        statuses = append(statuses, status)
+    }
+    return statuses, nil
+}
+
+// Kinds of drift between checkouts, config entries and containers
+const (
+    driftUnregisteredCheckout = "unregistered checkout"
+    driftMissingCheckout      = "missing checkout"
+    driftOrphanContainer      = "orphaned container"
+)
+
+// DriftFinding is one inconsistency reported by the audit command
+type DriftFinding struct {
+    Kind      string
+    Project   string
+    Repo      string
+    Container string // orphaned containers only
+    Detail    string
+    Remedy    string // command that resolves the finding by hand
+}
+
+// AuditDrift cross-references the checkouts under ~/Projects, the current user's config entries and
+// the managed containers. A configured repository without a checkout only counts once it was opened,
+// since add never clones. Containers are shared by everyone using the Docker daemon, so one is only
+// orphaned when no user's config has its repository. It changes nothing.
+func AuditDrift() ([]DriftFinding, error) {
+    entries, err := configuredRepos(false)
+    if err != nil {
+        return nil, err
+    }
+    configured := map[string]bool{}
+    for _, entry := range entries {
+        configured[entry.Project+"/"+entry.Repo] = true
+    }
+
+    var findings []DriftFinding
+    root, err := projectsRoot()
+    if err != nil {
+        return nil, err
+    }
+    projects, err := os.ReadDir(root)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    for _, project := range projects {
+        if !project.IsDir() || strings.HasPrefix(project.Name(), ".") {
+            continue
+        }
+        repos, err := os.ReadDir(filepath.Join(root, project.Name()))
+        if err != nil {
+            return nil, err
+        }
+        for _, repo := range repos {
+            path := filepath.Join(root, project.Name(), repo.Name())
+            if !repo.IsDir() || strings.HasPrefix(repo.Name(), ".") || configured[project.Name()+"/"+repo.Name()] {
+                continue
+            }
+            if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+                continue
+            }
+            originURL := checkoutOriginURL(path)
+            remedy := fmt.Sprintf("dev-environment-manager add %s %s %s", project.Name(), repo.Name(), originURL)
+            if originURL == "" {
+                remedy = fmt.Sprintf("dev-environment-manager add %s %s <repo_url>", project.Name(), repo.Name())
+            }
+            findings = append(findings, DriftFinding{
+                Kind:    driftUnregisteredCheckout,
+                Project: project.Name(),
+                Repo:    repo.Name(),
+                Detail:  fmt.Sprintf("%s has no config entry", path),
+                Remedy:  remedy,
+            })
+        }
+    }
+
+    for _, entry := range entries {
+        path, err := repoCheckoutPath(entry.Project, entry.Repo)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := os.Stat(path); !os.IsNotExist(err) {
+            continue
+        }
+        meta, err := ReadProjectMetadata(entry.Project, entry.Repo)
+        if err != nil || meta.LastOpened.IsZero() {
+            continue
+        }
+        findings = append(findings, DriftFinding{
+            Kind:    driftMissingCheckout,
+            Project: entry.Project,
+            Repo:    entry.Repo,
+            Detail:  fmt.Sprintf("%s was deleted (last opened %s)", path, meta.LastOpened.Local().Format("2006-01-02")),
+            Remedy:  fmt.Sprintf("dev-environment-manager start %s %s to clone it again, or audit --fix to remove the entry", entry.Project, entry.Repo),
+        })
+    }
+
+    everyone, err := configuredRepos(true)
+    if err != nil {
+        return nil, err
+    }
+    anyUser := map[string]bool{}
+    for _, entry := range everyone {
+        anyUser[entry.Project+"/"+entry.Repo] = true
+    }
+    containers, err := ListManagedContainers(true)
+    if err != nil {
+        return nil, err
+    }
+    for _, c := range containers {
+        if anyUser[c.ProjectDir+"/"+c.Repo] {
+            continue
+        }
+        findings = append(findings, DriftFinding{
+            Kind:      driftOrphanContainer,
+            Project:   c.ProjectDir,
+            Repo:      c.Repo,
+            Container: c.Name,
+            Detail:    fmt.Sprintf("%s (%s) belongs to %s/%s, which no user has configured", c.Name, c.State, c.ProjectDir, c.Repo),
+            Remedy:    fmt.Sprintf("docker rm -f %s", c.Name),
+        })
+    }
+    return findings, nil
+}
+
+// checkoutOriginURL returns the origin URL of a checkout, or "" if it has none
+func checkoutOriginURL(path string) string {
+    repo, err := git.PlainOpen(path)
+    if err != nil {
+        return ""
+    }
+    origin, err := repo.Remote("origin")
+    if err != nil || len(origin.Config().URLs) == 0 {
+        return ""
+    }
+    return origin.Config().URLs[0]
+}
+
+// FixDrift resolves a finding: it registers an unregistered checkout with its origin URL and the
+// default image, removes the config entry and metadata of a missing checkout, or removes an
+// orphaned container.
+func FixDrift(finding DriftFinding) error {
+    switch finding.Kind {
+    case driftUnregisteredCheckout:
+        path, err := repoCheckoutPath(finding.Project, finding.Repo)
+        if err != nil {
+            return err
+        }
+        repoURL, dockerImage, containerName, err := deriveProjectValues(finding.Project, finding.Repo)
+        if err != nil {
+            return err
+        }
+        if originURL := checkoutOriginURL(path); originURL != "" {
+            repoURL = originURL
+        }
+        return AddProjectConfig(finding.Project, finding.Repo, repoURL, dockerImage, containerName)
+    case driftMissingCheckout:
+        return RemoveProjectConfig(finding.Project, finding.Repo)
+    case driftOrphanContainer:
+        return RemoveContainer(finding.Container)
+    }
+    return fmt.Errorf("unknown finding kind %q", finding.Kind)
+}
+
+// RemoveProjectConfig deletes a repository's config entry and its metadata. The entry is removed
+// from the parsed file, like EditConfig does, because Viper cannot unset a key.
+func RemoveProjectConfig(projectDirName, repoName string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+
+    username, err := getUsername()
+    if err != nil {
+        return fmt.Errorf("error getting username: %v", err)
+    }
+    path, err := configFilePath()
+    if err != nil {
+        return err
+    }
+    _, tree, err := readConfigTree(path)
+    if err != nil {
+        return err
+    }
+    repos, repoKey, ok := repoSubtree(tree, username, projectDirName, repoName)
+    if !ok {
+        return fmt.Errorf("repository %s is not configured under project %s for user %s", repoName, projectDirName, username)
+    }
+    delete(repos, repoKey)
+
+    data, err := yaml.Marshal(tree)
+    if err != nil {
+        return fmt.Errorf("error encoding config: %v", err)
+    }
+    if err := writeFileAtomic(path, data); err != nil {
+        return fmt.Errorf("error writing config file: %v", err)
+    }
+    if err := viper.ReadInConfig(); err != nil {
+        return fmt.Errorf("error reloading config: %v", err)
+    }
+
+    if metaPath, err := metadataPath(projectDirName, repoName); err == nil {
+        if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+            logrus.Warnf("Unable to remove project metadata: %v", err)
+        }
+    }
+    logrus.Infof("Repository %s removed from project %s for user %s.", repoName, projectDirName, username)
+    return nil
+}
+
+// Prerequisite is a host binary the tool relies on and the oldest version that works
+type Prerequisite struct {
+    Binary     string
+    MinVersion string
+    Reason     string
+}
+
+// hostPrerequisites are checked by the doctor command
+var hostPrerequisites = []Prerequisite{
+    {Binary: "docker", MinVersion: "20.10", Reason: "--init support"},
+    {Binary: "git", MinVersion: "2.25", Reason: "sparse checkout"},
+    {Binary: "ssh", MinVersion: "7.0", Reason: "agent forwarding"},
+}
+
+// versionPattern matches the first dotted version number in --version output
+var versionPattern = regexp.MustCompile(`\d+\.\d+(\.\d+)?`)
+
+// CheckBinaryVersion runs `<binary> --version` (`ssh -V`, which has no --version) and compares
+// the first version number it prints with minVersion
+func CheckBinaryVersion(binary, minVersion string) (actual string, ok bool, err error) {
+    path, err := exec.LookPath(binary)
+    if err != nil {
+        return "", false, fmt.Errorf("%s not found on PATH", binary)
+    }
+    flag := "--version"
+    if binary == "ssh" {
+        flag = "-V"
+    }
+    out, err := exec.Command(path, flag).CombinedOutput()
+    if err != nil {
+        return "", false, fmt.Errorf("%s %s failed: %v", binary, flag, err)
+    }
+    actual = versionPattern.FindString(string(out))
+    if actual == "" {
+        return "", false, fmt.Errorf("no version number in the output of %s %s", binary, flag)
+    }
+    return actual, semver.Compare("v"+actual, "v"+minVersion) >= 0, nil
+}
+
+// ConfigBundle is the portable form of repository entries written by config export
+type ConfigBundle struct {
+    Version  int                      `yaml:"version"`
+    Projects map[string]BundleProject `yaml:"projects"`
+}
+
+// BundleProject holds a project's repository settings keyed by repo name, as in the config file
+type BundleProject struct {
+    Repos map[string]map[string]interface{} `yaml:"repos"`
+}
+
+// machineSpecificKeys describe the exporting host's hardware and are left out of bundles
+var machineSpecificKeys = map[string]bool{"cgroup_parent": true, "cpu_set_cpus": true, "cpu_set_mems": true}
+
+// ExportConfig bundles the current user's repository entries as YAML, only project's when it is set.
+// Host paths under the home directory become $HOME/..., which entries expand on the importing
+// machine; other absolute host paths and machine-specific keys are dropped with a warning.
+func ExportConfig(project string) ([]byte, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return nil, fmt.Errorf("error getting home directory: %v", err)
+    }
+    entries, err := configuredRepos(false)
+    if err != nil {
+        return nil, err
+    }
+
+    bundle := &ConfigBundle{Version: 1, Projects: map[string]BundleProject{}}
+    for _, entry := range entries {
+        if project != "" && entry.Project != project {
+            continue
+        }
+        settings := map[string]interface{}{}
+        for key, value := range viper.GetStringMap(entry.Key()) {
+            if machineSpecificKeys[key] {
+                logrus.Warnf("Not exporting %s of %s/%s: it is specific to this machine.", key, entry.Project, entry.Repo)
+                continue
+            }
+            if portable, ok := portableValue(key, value, homeDir); ok {
+                settings[key] = portable
+            } else {
+                logrus.Warnf("Not exporting %s of %s/%s: it refers to an absolute host path.", key, entry.Project, entry.Repo)
+            }
+        }
+        if _, ok := bundle.Projects[entry.Project]; !ok {
+            bundle.Projects[entry.Project] = BundleProject{Repos: map[string]map[string]interface{}{}}
+        }
+        bundle.Projects[entry.Project].Repos[entry.Repo] = settings
+    }
+    if project != "" && len(bundle.Projects) == 0 {
+        return nil, fmt.Errorf("project %s has no configured repositories", project)
+    }
+    return yaml.Marshal(bundle)
+}
+
+// portableValue rewrites host paths in the settings that hold them (volumes sources and shell_rc)
+// relative to $HOME, reporting false when a path lies outside the home directory. Volumes
+// outside it are dropped from the list instead.
+func portableValue(key string, value interface{}, homeDir string) (interface{}, bool) {
+    portablePath := func(path string) (string, bool) {
+        if path == homeDir || strings.HasPrefix(path, homeDir+"/") {
+            return "$HOME" + strings.TrimPrefix(path, homeDir), true
+        }
+        return path, !filepath.IsAbs(path)
+    }
+
+    switch key {
+    case "shell_rc":
+        path, ok := value.(string)
+        if !ok {
+            return value, true
+        }
+        return portablePath(path)
+    case "volumes":
+        items, ok := value.([]interface{})
+        if !ok {
+            return value, true
+        }
+        var kept []interface{}
+        for _, item := range items {
+            spec, ok := item.(string)
+            if !ok {
+                kept = append(kept, item)
+                continue
+            }
+            parts := strings.SplitN(spec, ":", 2)
+            source, portable := portablePath(parts[0])
+            if !portable {
+                logrus.Warnf("Not exporting volume %s: its source is outside the home directory.", spec)
+                continue
+            }
+            parts[0] = source
+            kept = append(kept, strings.Join(parts, ":"))
+        }
+        return kept, true
+    }
+    return value, true
+}
+
+// Ways config import resolves a repository that is already configured
+const (
+    ImportAsk       = "ask"
+    ImportOverwrite = "overwrite"
+    ImportSkip      = "skip"
+)
+
+// ImportConfig merges a YAML bundle into the current user's entries. Existing repositories are
+// replaced, kept or asked about according to onConflict. Every entry is validated before
+// anything is written. It returns the number of repositories imported.
+func ImportConfig(data []byte, onConflict string) (int, error) {
+    if configReadOnly {
+        return 0, errConfigReadOnly
+    }
+    var bundle ConfigBundle
+    if err := yaml.Unmarshal(data, &bundle); err != nil {
+        return 0, fmt.Errorf("error parsing bundle: %v", err)
+    }
+    if bundle.Version != 1 {
+        return 0, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+    }
+    return importBundle(bundle.Projects, nil, onConflict)
+}
+
+// importBundle merges repository entries, and workspace definitions when given, into the current
+// user's config, resolving existing ones according to onConflict. Everything is validated before
+// anything is written. It returns the number of repositories imported.
+func importBundle(projects map[string]BundleProject, workspaces map[string]interface{}, onConflict string) (int, error) {
+    var errs []string
+    for _, err := range validateWorkspacesTree("workspaces", workspaces) {
+        errs = append(errs, "  - "+err.Error())
+    }
+    for _, project := range sortedBundleKeys(projects) {
+        for repo, settings := range projects[project].Repos {
+            for _, err := range ValidateRepoSettings(fmt.Sprintf("%s/%s: ", project, repo), settings) {
+                errs = append(errs, "  - "+err.Error())
+            }
+        }
+    }
+    if len(errs) > 0 {
+        return 0, fmt.Errorf("invalid bundle:\n%s", strings.Join(errs, "\n"))
+    }
+
+    username, err := getUsername()
+    if err != nil {
+        return 0, fmt.Errorf("error getting username: %v", err)
+    }
+    path, err := configFilePath()
+    if err != nil {
+        return 0, err
+    }
+    // The file is patched as a YAML node tree so its comments and layout survive the import
+    raw, doc, err := readConfigDocument(path)
+    if err != nil {
+        return 0, err
+    }
+    root := doc.Content[0]
+
+    imported := 0
+    var added []RepoEntry
+    for _, project := range sortedBundleKeys(projects) {
+        repos := projects[project].Repos
+        names := make([]string, 0, len(repos))
+        for name := range repos {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, repo := range names {
+            node := root
+            for _, key := range []string{"users", username, "projects", project, "repos"} {
+                node = nodeChildMap(node, key)
+            }
+            if nodeLookup(node, repo) >= 0 {
+                switch onConflict {
+                case ImportSkip:
+                    logrus.Infof("Skipping %s/%s: already configured.", project, repo)
+                    continue
+                case ImportAsk:
+                    if !confirm(fmt.Sprintf("%s/%s is already configured. Overwrite it?", project, repo)) {
+                        continue
+                    }
+                }
+            } else {
+                added = append(added, RepoEntry{User: username, Project: project, Repo: repo})
+            }
+            if err := nodeSet(node, repo, repos[repo]); err != nil {
+                return 0, fmt.Errorf("error encoding %s/%s: %v", project, repo, err)
+            }
+            imported++
+        }
+    }
+    definedWorkspaces := 0
+    for _, name := range sortedKeys(workspaces) {
+        node := nodeChildMap(root, "workspaces")
+        if nodeLookup(node, name) >= 0 {
+            switch onConflict {
+            case ImportSkip:
+                logrus.Infof("Skipping workspace %s: already defined.", name)
+                continue
+            case ImportAsk:
+                if !confirm(fmt.Sprintf("Workspace %s is already defined. Overwrite it?", name)) {
+                    continue
+                }
+            }
+        }
+        if err := nodeSet(node, name, workspaces[name]); err != nil {
+            return 0, fmt.Errorf("error encoding workspace %s: %v", name, err)
+        }
+        definedWorkspaces++
+    }
+    if imported == 0 && definedWorkspaces == 0 {
+        return 0, nil
+    }
+
+    data, err := encodeConfigDocument(doc, raw)
+    if err != nil {
+        return 0, fmt.Errorf("error encoding config: %v", err)
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return 0, err
+    }
+    if err := writeFileAtomic(path, data); err != nil {
+        return 0, fmt.Errorf("error writing config file: %v", err)
+    }
+    viper.SetConfigFile(path)
+    if err := viper.ReadInConfig(); err != nil {
+        return 0, fmt.Errorf("error reloading config: %v", err)
+    }
+    for _, entry := range added {
+        if err := WriteProjectMetadata(entry.Project, entry.Repo, ProjectMetadata{AddedAt: time.Now().UTC()}); err != nil {
+            logrus.Warnf("Unable to write project metadata: %v", err)
+        }
+    }
+    return imported, nil
+}
+
+// WorkspaceMember is one environment of a workspace in the workspaces section
+type WorkspaceMember struct {
+    Project string
+    Repo    string
+    Branch  string // start a worktree of this branch; empty for the base clone
+}
+
+// parseWorkspaceMember reads a workspaces entry: "project/repo", or a mapping with repo and an
+// optional branch
+func parseWorkspaceMember(entry interface{}) (WorkspaceMember, error) {
+    ref, ok := entry.(string)
+    var branch string
+    if !ok {
+        fields, isMap := entry.(map[string]interface{})
+        if !isMap {
+            return WorkspaceMember{}, fmt.Errorf("expected project/repo or a mapping with repo")
+        }
+        for key, value := range fields {
+            s, isString := value.(string)
+            switch strings.ToLower(key) {
+            case "repo":
+                ref = s
+            case "branch":
+                branch = s
+            default:
+                return WorkspaceMember{}, fmt.Errorf("%s: unknown key", key)
+            }
+            if !isString {
+                return WorkspaceMember{}, fmt.Errorf("%s: expected string", key)
+            }
+        }
+    }
+    project, repo, err := splitRepoRef(ref)
+    if err != nil {
+        return WorkspaceMember{}, err
+    }
+    return WorkspaceMember{Project: project, Repo: repo, Branch: branch}, nil
+}
+
+// validateWorkspacesTree checks the workspaces section, which maps each name to a list of members
+func validateWorkspacesTree(prefix string, value interface{}) []error {
+    workspaces, ok := value.(map[string]interface{})
+    if !ok {
+        return []error{fmt.Errorf("%s: expected a mapping", prefix)}
+    }
+    var errs []error
+    for _, name := range sortedKeys(workspaces) {
+        members, ok := workspaces[name].([]interface{})
+        if !ok || len(members) == 0 {
+            errs = append(errs, fmt.Errorf("%s.%s: expected a list of project/repo entries", prefix, name))
+            continue
+        }
+        for i, member := range members {
+            if _, err := parseWorkspaceMember(member); err != nil {
+                errs = append(errs, fmt.Errorf("%s.%s[%d]: %v", prefix, name, i, err))
+            }
+        }
+    }
+    return errs
+}
+
+// Workspace returns the members of a workspace in their configured order
+func Workspace(name string) ([]WorkspaceMember, error) {
+    key := "workspaces." + name
+    if !viper.IsSet(key) {
+        return nil, fmt.Errorf("workspace %s is not defined", name)
+    }
+    items, ok := viper.Get(key).([]interface{})
+    if !ok || len(items) == 0 {
+        return nil, fmt.Errorf("workspace %s: expected a list of project/repo entries", name)
+    }
+    members := make([]WorkspaceMember, 0, len(items))
+    for i, item := range items {
+        member, err := parseWorkspaceMember(item)
+        if err != nil {
+            return nil, fmt.Errorf("workspace %s, entry %d: %v", name, i, err)
+        }
+        members = append(members, member)
+    }
+    return members, nil
+}
+
+// workspaceExportUser stands in for the exporting user in workspace files
+const workspaceExportUser = "default"
+
+// WorkspaceFile is the portable form of a workspace written by workspace export: its definition
+// and its members' repository entries, laid out like the config file under users.default
+type WorkspaceFile struct {
+    Workspaces map[string]interface{}       `yaml:"workspaces"`
+    Users      map[string]WorkspaceFileUser `yaml:"users"`
+}
+
+// WorkspaceFileUser holds the projects of the user section of a workspace file
+type WorkspaceFileUser struct {
+    Projects map[string]BundleProject `yaml:"projects"`
+}
+
+// workspacePathKeys hold host paths, which mean nothing on another machine
+var workspacePathKeys = map[string]bool{"shell_rc": true, "env_file": true}
+
+// ExportWorkspace writes a workspace's definition and its members' repository entries as a
+// portable YAML file. Personal bind mounts, host paths and machine-specific keys are left out
+// with a warning; images, repository URLs and named volumes are kept.
+func ExportWorkspace(name string) ([]byte, error) {
+    members, err := Workspace(name)
+    if err != nil {
+        return nil, err
+    }
+
+    projects := map[string]BundleProject{}
+    for _, member := range members {
+        if _, done := projects[member.Project].Repos[member.Repo]; done {
+            continue
+        }
+        entry := repoSettings(member.Project, member.Repo)
+        if entry == nil {
+            return nil, fmt.Errorf("workspace %s: %s/%s is not configured", name, member.Project, member.Repo)
+        }
+        settings := map[string]interface{}{}
+        for field, value := range entry {
+            switch {
+            case machineSpecificKeys[field]:
+                logrus.Warnf("Not exporting %s of %s/%s: it is specific to this machine.", field, member.Project, member.Repo)
+            case workspacePathKeys[field]:
+                logrus.Warnf("Not exporting %s of %s/%s: it refers to a host path.", field, member.Project, member.Repo)
+            case field == "volumes":
+                if volumes := namedVolumes(value, member); len(volumes) > 0 {
+                    settings[field] = volumes
+                }
+            default:
+                settings[field] = value
+            }
+        }
+        if _, ok := projects[member.Project]; !ok {
+            projects[member.Project] = BundleProject{Repos: map[string]map[string]interface{}{}}
+        }
+        projects[member.Project].Repos[member.Repo] = settings
+    }
+
+    return yaml.Marshal(&WorkspaceFile{
+        Workspaces: map[string]interface{}{name: viper.Get("workspaces." + name)},
+        Users:      map[string]WorkspaceFileUser{workspaceExportUser: {Projects: projects}},
+    })
+}
+
+// namedVolumes keeps the named-volume entries of a volumes setting, dropping binds of host paths
+func namedVolumes(value interface{}, member WorkspaceMember) []interface{} {
+    items, _ := value.([]interface{})
+    var kept []interface{}
+    for _, item := range items {
+        spec, ok := item.(string)
+        if !ok {
+            continue
+        }
+        source := strings.SplitN(spec, ":", 2)[0]
+        if source == "" || strings.ContainsAny(source[:1], "/~$.") {
+            logrus.Warnf("Not exporting volume %s of %s/%s: it binds a host path.", spec, member.Project, member.Repo)
+            continue
+        }
+        kept = append(kept, spec)
+    }
+    return kept
+}
+
+// ImportWorkspace merges a file written by workspace export into the config: its repositories
+// become the current user's, as with config import, and its workspaces are defined. Existing
+// ones are resolved according to onConflict. It returns the number of repositories imported.
+func ImportWorkspace(data []byte, onConflict string) (int, error) {
+    if configReadOnly {
+        return 0, errConfigReadOnly
+    }
+    var file WorkspaceFile
+    if err := yaml.Unmarshal(data, &file); err != nil {
+        return 0, fmt.Errorf("error parsing workspace file: %v", err)
+    }
+    if len(file.Workspaces) == 0 {
+        return 0, fmt.Errorf("the file defines no workspace")
+    }
+    for user := range file.Users {
+        if user != workspaceExportUser {
+            return 0, fmt.Errorf("unexpected user section %s: workspace files keep their repositories under users.%s", user, workspaceExportUser)
+        }
+    }
+    return importBundle(file.Users[workspaceExportUser].Projects, file.Workspaces, onConflict)
+}
+
+// WorkspaceResult is one member's outcome of workspace up, down or status
+type WorkspaceResult struct {
+    Member    WorkspaceMember
+    Container string
+    State     string // started, already running, rolled back, stopped, not running, failed, or a container state
+    Duration  time.Duration
+    Err       error
+}
+
+// Name returns the member as project/repo, with @branch for a worktree
+func (m WorkspaceMember) Name() string {
+    if m.Branch != "" {
+        return fmt.Sprintf("%s/%s@%s", m.Project, m.Repo, m.Branch)
+    }
+    return m.Project + "/" + m.Repo
+}
+
+// memberContainer returns the container name of a workspace member, as start derives it
+func memberContainer(member WorkspaceMember) (string, error) {
+    _, _, containerName, err := deriveProjectValues(member.Project, member.Repo)
+    if err != nil {
+        return "", err
+    }
+    if member.Branch != "" {
+        containerName = fmt.Sprintf("%s-%s", containerName, sanitizeHostname(member.Branch))
+    }
+    return containerName, nil
+}
+
+// containerRunning reports whether a container exists and runs
+func containerRunning(ctx context.Context, cli *client.Client, name string) (bool, error) {
+    info, err := cli.ContainerInspect(ctx, name)
+    if client.IsErrNotFound(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return info.State != nil && info.State.Running, nil
+}
+
+// runWorkspace runs fn for every member of a workspace on parallel workers and returns the
+// members' results in workspace order along with runPool's summary of the failures
+func runWorkspace(ctx context.Context, name string, parallel int, fn func(ctx context.Context, member WorkspaceMember, result *WorkspaceResult) error) ([]WorkspaceResult, error) {
+    members, err := Workspace(name)
+    if err != nil {
+        return nil, err
+    }
+    results := make([]WorkspaceResult, len(members))
+    tasks := make([]PoolTask, len(members))
+    for i, member := range members {
+        i, member := i, member
+        results[i] = WorkspaceResult{Member: member, State: "failed"}
+        tasks[i] = PoolTask{
+            Name: member.Name(),
+            Run: func(ctx context.Context, out io.Writer) error {
+                began := time.Now()
+                err := fn(ctx, member, &results[i])
+                results[i].Duration = time.Since(began)
+                if err != nil {
+                    results[i].State = "failed"
+                    results[i].Err = err
+                }
+                fmt.Fprintln(out, results[i].State)
+                return err
+            },
+        }
+    }
+    return results, runPool(ctx, parallel, tasks)
+}
+
+// WorkspaceUp starts every member of a workspace on parallel workers, without attaching, and
+// leaves them running; members already running are left alone. When a member fails the others
+// keep running unless atomic is set, which stops the ones this call started. The members share
+// the config and the terminal, so flag values aren't saved and nothing prompts.
+func WorkspaceUp(ctx context.Context, name string, parallel int, atomic bool, opts StartOptions) ([]WorkspaceResult, error) {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    opts.Detached = true
+    opts.QuietPull = true
+    opts.NoSave = true
+    opts.NonInteractive = true
+
+    results, poolErr := runWorkspace(ctx, name, parallel, func(ctx context.Context, member WorkspaceMember, result *WorkspaceResult) error {
+        containerName, err := memberContainer(member)
+        if err != nil {
+            return err
+        }
+        result.Container = containerName
+        if running, err := containerRunning(ctx, cli, containerName); err != nil {
+            return err
+        } else if running {
+            result.State = "already running"
+            return nil
+        }
+        memberOpts := opts
+        memberOpts.Branch = member.Branch
+        if err := StartProject(member.Project, member.Repo, memberOpts); err != nil {
+            return err
+        }
+        result.State = "started"
+        return nil
+    })
+    if poolErr == nil || !atomic {
+        return results, poolErr
+    }
+
+    for i := range results {
+        if results[i].State != "started" {
+            continue
+        }
+        if err := RemoveContainer(results[i].Container); err != nil {
+            logrus.Errorf("Unable to roll back %s: %v", results[i].Member.Name(), err)
+            continue
+        }
+        results[i].State = "rolled back"
+    }
+    return results, poolErr
+}
+
+// WorkspaceDown stops and removes the containers of every member of a workspace on parallel
+// workers, giving each its stop grace period
+func WorkspaceDown(ctx context.Context, name string, parallel int) ([]WorkspaceResult, error) {
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    return runWorkspace(ctx, name, parallel, func(ctx context.Context, member WorkspaceMember, result *WorkspaceResult) error {
+        containerName, err := memberContainer(member)
+        if err != nil {
+            return err
+        }
+        result.Container = containerName
+        if _, err := cli.ContainerInspect(ctx, containerName); client.IsErrNotFound(err) {
+            result.State = "not running"
+            return nil
+        }
+        if err := RemoveContainer(containerName); err != nil {
+            return err
+        }
+        result.State = "stopped"
+        return nil
+    })
+}
+
+// WorkspaceStatus returns the container state of every member of a workspace and the group's
+// combined state: running when all members run, stopped when none does, else partial
+func WorkspaceStatus(name string) ([]WorkspaceResult, string, error) {
+    members, err := Workspace(name)
+    if err != nil {
+        return nil, "", err
+    }
+    containers, err := ListManagedContainers(true)
+    if err != nil {
+        return nil, "", err
+    }
+
+    results := make([]WorkspaceResult, 0, len(members))
+    running := 0
+    for _, member := range members {
+        containerName, err := memberContainer(member)
+        if err != nil {
+            return nil, "", err
+        }
+        result := WorkspaceResult{Member: member, Container: containerName, State: "absent"}
+        for _, c := range containers {
+            if c.Name == containerName {
+                result.State = c.State
+            }
+        }
+        if result.State == "running" {
+            running++
+        }
+        results = append(results, result)
+    }
+
+    combined := "partial"
+    switch running {
+    case len(members):
+        combined = "running"
+    case 0:
+        combined = "stopped"
+    }
+    return results, combined, nil
+}
+
+// sortedBundleKeys returns a bundle's project names in sorted order
+func sortedBundleKeys(projects map[string]BundleProject) []string {
+    keys := make([]string, 0, len(projects))
+    for k := range projects {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// runtimeProbe describes how to find a language runtime's version inside a container
+type runtimeProbe struct {
+    Name    string   // product name on endoflife.date
+    Cmd     []string // command printing the version
+    Prefix  string   // text preceding the version in the command's output
+    CycleOf func(version string) string
+}
+
+// RuntimeVersion is the outcome of checking one runtime in an image
+type RuntimeVersion struct {
+    Runtime string
+    Version string
+    Latest  string
+    Status  string // current, outdated, EOL or unknown
+}
+
+// Release cycles as published by https://endoflife.date/api/<product>.json
+type releaseCycle struct {
+    Cycle  string      `json:"cycle"`
+    Latest string      `json:"latest"`
+    EOL    interface{} `json:"eol"` // false, true or an end date
+}
+
+// majorMinor returns the first two components of a dotted version
+func majorMinor(version string) string {
+    parts := strings.SplitN(version, ".", 3)
+    if len(parts) < 2 {
+        return version
+    }
+    return parts[0] + "." + parts[1]
+}
+
+// majorOnly returns the first component of a dotted version
+func majorOnly(version string) string {
+    return strings.SplitN(version, ".", 2)[0]
+}
+
+// Runtimes probed by `versions check`
+var runtimeProbes = []runtimeProbe{
+    {Name: "go", Cmd: []string{"go", "version"}, Prefix: "go version go", CycleOf: majorMinor},
+    {Name: "nodejs", Cmd: []string{"node", "--version"}, Prefix: "v", CycleOf: majorOnly},
+    {Name: "python", Cmd: []string{"python3", "--version"}, Prefix: "Python ", CycleOf: majorMinor},
+}
+
+// CheckRuntimeVersions starts a throwaway container from a repository's image, probes the
+// language runtimes it ships and compares them with the latest releases
+func CheckRuntimeVersions(projectDirName, repoName string) ([]RuntimeVersion, error) {
+    _, dockerImage, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil, fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if err := ensureImage(ctx, cli, dockerImage); err != nil {
+        return nil, err
+    }
+
+    containerID, err := RunContainer(ContainerSpec{
+        Image:  dockerImage,
+        Name:   containerName + "-versions",
+        Labels: map[string]string{labelProject: projectDirName, labelRepo: repoName},
+    })
+    if containerID != "" {
+        defer RemoveContainer(containerID)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var results []RuntimeVersion
+    for _, probe := range runtimeProbes {
+        var out bytes.Buffer
+        exitCode, err := execInContainer(ctx, cli, containerID, probe.Cmd, &out)
+        if err != nil || exitCode != 0 {
+            continue // not installed
+        }
+        version := strings.TrimSpace(out.String())
+        if i := strings.Index(version, probe.Prefix); i >= 0 {
+            version = version[i+len(probe.Prefix):]
+        }
+        version = strings.Fields(version + " ")[0]
+
+        result := RuntimeVersion{Runtime: probe.Name, Version: version, Status: "unknown"}
+        cycles, err := fetchReleaseCycles(ctx, probe.Name)
+        if err != nil {
+            logrus.Warnf("Unable to fetch %s releases: %v", probe.Name, err)
+        } else {
+            result.Latest, result.Status = classifyVersion(version, probe.CycleOf(version), cycles)
+        }
+        results = append(results, result)
+    }
+    return results, nil
+}
+
+// fetchReleaseCycles downloads a product's release cycles, newest first
+func fetchReleaseCycles(ctx context.Context, product string) ([]releaseCycle, error) {
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://endoflife.date/api/%s.json", product), nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+
+    var cycles []releaseCycle
+    if err := json.NewDecoder(resp.Body).Decode(&cycles); err != nil {
+        return nil, fmt.Errorf("error decoding releases: %v", err)
+    }
+    if len(cycles) == 0 {
+        return nil, fmt.Errorf("no releases listed")
+    }
+    return cycles, nil
+}
+
+// classifyVersion compares version against the published cycles, returning the newest release and
+// whether version is current, outdated (a newer release exists) or EOL (its cycle is unsupported)
+func classifyVersion(version, cycle string, cycles []releaseCycle) (latest, status string) {
+    latest = cycles[0].Latest
+    for _, c := range cycles {
+        if c.Cycle != cycle {
+            continue
+        }
+        switch eol := c.EOL.(type) {
+        case bool:
+            if eol {
+                return latest, "EOL"
+            }
+        case string:
+            if end, err := time.Parse("2006-01-02", eol); err == nil && time.Now().After(end) {
+                return latest, "EOL"
+            }
+        }
+        break
+    }
+    if version == latest {
+        return latest, "current"
+    }
+    return latest, "outdated"
+}
+
+// effectiveRepoSettings returns a repository's settings as start resolves them: the active
+// profile's overrides applied, and global defaults filled in for keys the repository doesn't set
+func effectiveRepoSettings(projectDirName, repoName string) (map[string]interface{}, error) {
+    entry := repoSettings(projectDirName, repoName)
+    if entry == nil {
+        return nil, fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    fields := map[string]bool{}
+    for key := range repoConfigSchema {
+        fields[key] = true
+    }
+    for key := range entry {
+        fields[strings.ToLower(key)] = true
+    }
+    delete(fields, "profiles")
+
+    settings := make(map[string]interface{})
+    for field := range fields {
+        if key := repoSettingKey(projectDirName, repoName, field); viper.IsSet(key) {
+            settings[field] = viper.Get(key)
+        }
+    }
+    return settings, nil
+}
+
+// colorEnabled reports whether stdout is a terminal that should get ANSI colors
+func colorEnabled() bool {
+    if os.Getenv("NO_COLOR") != "" {
+        return false
+    }
+    info, err := os.Stdout.Stat()
+    return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// DiffRepoSettings prints a line diff of two repositories' effective settings as YAML and
+// reports whether they differ
+func DiffRepoSettings(out io.Writer, projectA, repoA, projectB, repoB string) (bool, error) {
+    var docs [2]string
+    for i, target := range [][2]string{{projectA, repoA}, {projectB, repoB}} {
+        settings, err := effectiveRepoSettings(target[0], target[1])
+        if err != nil {
+            return false, err
+        }
+        data, err := yaml.Marshal(settings)
+        if err != nil {
+            return false, fmt.Errorf("error encoding %s/%s: %v", target[0], target[1], err)
+        }
+        docs[i] = string(data)
+    }
+
+    dmp := diffmatchpatch.New()
+    a, b, lines := dmp.DiffLinesToChars(docs[0], docs[1])
+    diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+    red, green, reset := "\x1b[31m", "\x1b[32m", "\x1b[0m"
+    if !colorEnabled() {
+        red, green, reset = "", "", ""
+    }
+    fmt.Fprintf(out, "--- %s/%s\n+++ %s/%s\n", projectA, repoA, projectB, repoB)
+    differ := false
+    for _, d := range diffs {
+        for _, line := range strings.SplitAfter(d.Text, "\n") {
+            if line == "" {
+                continue
+            }
+            line = strings.TrimSuffix(line, "\n")
+            switch d.Type {
+            case diffmatchpatch.DiffDelete:
+                differ = true
+                fmt.Fprintf(out, "%s- %s%s\n", red, line, reset)
+            case diffmatchpatch.DiffInsert:
+                differ = true
+                fmt.Fprintf(out, "%s+ %s%s\n", green, line, reset)
+            default:
+                fmt.Fprintf(out, "  %s\n", line)
+            }
+        }
+    }
+    return differ, nil
+}
+
+// Name of the ignore file read from the project root by sync
+const syncIgnoreFile = ".devenvignore"
+
+// Where the sync manifest is kept inside the synced volume
+const syncManifestName = ".devenv-manifest.json"
+
+// Paths never synced, in addition to the project's .devenvignore
+var defaultSyncIgnores = []string{".git", "node_modules", "target", "dist"}
+
+// syncFile is the manifest record of a synced file, used to detect changes
+type syncFile struct {
+    Size    int64 `json:"size"`
+    ModTime int64 `json:"mtime"` // unix nanoseconds
+}
+
+// syncMatcher returns a matcher for the default ignores plus the project's .devenvignore
+func syncMatcher(projectPath string) (gitignore.Matcher, error) {
+    var patterns []gitignore.Pattern
+    for _, p := range defaultSyncIgnores {
+        patterns = append(patterns, gitignore.ParsePattern(p, nil))
+    }
+    patterns = append(patterns, gitignore.ParsePattern("/"+syncManifestName, nil))
+
+    data, err := os.ReadFile(filepath.Join(projectPath, syncIgnoreFile))
+    if err != nil && !os.IsNotExist(err) {
+        return nil, err
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimRight(line, "\r")
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        patterns = append(patterns, gitignore.ParsePattern(line, nil))
+    }
+    return gitignore.NewMatcher(patterns), nil
+}
+
+// scanSyncTree lists the regular files and symlinks under projectPath that aren't ignored
+func scanSyncTree(projectPath string, matcher gitignore.Matcher) (map[string]syncFile, error) {
+    files := make(map[string]syncFile)
+    err := filepath.Walk(projectPath, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(projectPath, path)
+        if err != nil || rel == "." {
+            return err
+        }
+        if matcher.Match(strings.Split(filepath.ToSlash(rel), "/"), info.IsDir()) {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
+            files[filepath.ToSlash(rel)] = syncFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+        }
+        return nil
+    })
+    return files, err
+}
+
+// readSyncManifest fetches the manifest of the last sync from the volume, empty if there is none
+func readSyncManifest(ctx context.Context, cli *client.Client, containerID string) (map[string]syncFile, error) {
+    manifest := make(map[string]syncFile)
+    reader, _, err := cli.CopyFromContainer(ctx, containerID, "/src/"+syncManifestName)
+    if client.IsErrNotFound(err) {
+        return manifest, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+
+    tr := tar.NewReader(reader)
+    if _, err := tr.Next(); err != nil {
+        return nil, fmt.Errorf("error reading sync manifest: %v", err)
+    }
+    if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+        logrus.Warnf("Ignoring unreadable sync manifest, doing a full sync: %v", err)
+        return make(map[string]syncFile), nil
+    }
+    return manifest, nil
+}
+
+// writeSyncArchive writes the changed files and the new manifest to w as a tar stream,
+// returning the number of file bytes written
+func writeSyncArchive(w io.Writer, projectPath string, changed []string, manifest map[string]syncFile) (int64, error) {
+    tw := tar.NewWriter(w)
+    var total int64
+    for _, rel := range changed {
+        path := filepath.Join(projectPath, filepath.FromSlash(rel))
+        info, err := os.Lstat(path)
+        if err != nil {
+            return total, err
+        }
+        link := ""
+        if info.Mode()&os.ModeSymlink != 0 {
+            if link, err = os.Readlink(path); err != nil {
+                return total, err
+            }
+        }
+        hdr, err := tar.FileInfoHeader(info, link)
+        if err != nil {
+            return total, err
+        }
+        hdr.Name = rel
+        if err := tw.WriteHeader(hdr); err != nil {
+            return total, err
+        }
+        if info.Mode().IsRegular() {
+            f, err := os.Open(path)
+            if err != nil {
+                return total, err
+            }
+            n, err := io.Copy(tw, f)
+            f.Close()
+            total += n
+            if err != nil {
+                return total, err
+            }
+        }
+    }
+
+    data, err := json.Marshal(manifest)
+    if err != nil {
+        return total, err
+    }
+    if err := tw.WriteHeader(&tar.Header{Name: syncManifestName, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+        return total, err
+    }
+    if _, err := tw.Write(data); err != nil {
+        return total, err
+    }
+    return total, tw.Close()
+}
+
+// SyncProject copies a project into its sync volume, sending only files whose size or mtime
+// changed since the last sync and deleting files that disappeared. A new volume gets labels.
+func SyncProject(ctx context.Context, projectPath, containerName string, labels map[string]string) error {
+    matcher, err := syncMatcher(projectPath)
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", syncIgnoreFile, err)
+    }
+    files, err := scanSyncTree(projectPath, matcher)
+    if err != nil {
+        return fmt.Errorf("error scanning %s: %v", projectPath, err)
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if err := ensureImage(ctx, cli, bindCheckImage); err != nil {
+        return err
+    }
+
+    // A helper container gives access to the volume for copying and deleting
+    resp, err := cli.ContainerCreate(ctx, &container.Config{
+        Image: bindCheckImage,
+        Cmd:   []string{"sleep", "600"},
+    }, &container.HostConfig{
+        Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: syncVolumeName(containerName), Target: "/src",
+            VolumeOptions: &mount.VolumeOptions{Labels: labels}}},
+        NetworkMode: "none",
+    }, nil, nil, "")
+    if err != nil {
+        return fmt.Errorf("error creating sync container: %v", err)
+    }
+    defer cli.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+    if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+        return fmt.Errorf("error starting sync container: %v", err)
+    }
+
+    previous, err := readSyncManifest(ctx, cli, resp.ID)
+    if err != nil {
+        return err
+    }
+    var changed, removed []string
+    for rel, f := range files {
+        if old, ok := previous[rel]; !ok || old != f {
+            changed = append(changed, rel)
+        }
+    }
+    for rel := range previous {
+        if _, ok := files[rel]; !ok {
+            removed = append(removed, "/src/"+rel)
+        }
+    }
+    sort.Strings(changed)
+    sort.Strings(removed)
+
+    pr, pw := io.Pipe()
+    sent := make(chan int64, 1)
+    go func() {
+        n, err := writeSyncArchive(pw, projectPath, changed, files)
+        pw.CloseWithError(err)
+        sent <- n
+    }()
+    if err := cli.CopyToContainer(ctx, resp.ID, "/src", pr, types.CopyToContainerOptions{}); err != nil {
+        pr.CloseWithError(err)
+        <-sent
+        return fmt.Errorf("error copying files: %v", err)
+    }
+    bytesSent := <-sent
+
+    if len(removed) > 0 {
+        exitCode, err := execInContainer(ctx, cli, resp.ID, append([]string{"rm", "-f", "--"}, removed...), os.Stderr)
+        if err != nil {
+            return err
+        }
+        if exitCode != 0 {
+            return fmt.Errorf("error removing deleted files (exit code %d)", exitCode)
+        }
+    }
+
+    logrus.Infof("Synced %s: %d changed, %d removed, %s transferred", projectPath, len(changed), len(removed), units.BytesSize(float64(bytesSent)))
+    return nil
+}
+
+// watchProjectTree adds every directory under projectPath that isn't ignored to watcher,
+// since fsnotify doesn't watch recursively
+func watchProjectTree(watcher *fsnotify.Watcher, projectPath string, matcher gitignore.Matcher) error {
+    return filepath.Walk(projectPath, func(path string, info os.FileInfo, err error) error {
+        if err != nil || !info.IsDir() {
+            return err
+        }
+        rel, _ := filepath.Rel(projectPath, path)
+        if rel != "." && matcher.Match(strings.Split(filepath.ToSlash(rel), "/"), true) {
+            return filepath.SkipDir
+        }
+        return watcher.Add(path)
+    })
+}
+
+// trackProjectEvent reports whether a watch event concerns a file that isn't ignored, and starts
+// watching directories created under the project
+func trackProjectEvent(watcher *fsnotify.Watcher, projectPath string, matcher gitignore.Matcher, event fsnotify.Event) bool {
+    rel, err := filepath.Rel(projectPath, event.Name)
+    if err != nil {
+        return false
+    }
+    info, statErr := os.Stat(event.Name)
+    isDir := statErr == nil && info.IsDir()
+    if matcher.Match(strings.Split(filepath.ToSlash(rel), "/"), isDir) {
+        return false
+    }
+    if isDir && event.Op&fsnotify.Create != 0 {
+        watchProjectTree(watcher, event.Name, matcher)
+    }
+    return true
+}
+
+// WatchSync re-syncs a project after file changes until ctx is cancelled
+func WatchSync(ctx context.Context, projectPath, containerName string, labels map[string]string) error {
+    return watchAndSync(ctx, projectPath, 500*time.Millisecond, func() error {
+        return SyncProject(ctx, projectPath, containerName, labels)
+    })
+}
+
+// watchAndSync runs sync once, then again each time files in the checkout have been quiet for
+// debounce after a change, until ctx is cancelled
+func watchAndSync(ctx context.Context, projectPath string, debounce time.Duration, sync func() error) error {
+    if err := sync(); err != nil {
+        return err
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("error creating watcher: %v", err)
+    }
+    defer watcher.Close()
+
+    matcher, err := syncMatcher(projectPath)
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", syncIgnoreFile, err)
+    }
+    if err := watchProjectTree(watcher, projectPath, matcher); err != nil {
+        return fmt.Errorf("error watching %s: %v", projectPath, err)
+    }
+    logrus.Infof("Watching %s for changes. Press Ctrl-C to stop.", projectPath)
+
+    var resync <-chan time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case err := <-watcher.Errors:
+            logrus.Warnf("Watch error: %v", err)
+        case event := <-watcher.Events:
+            if !trackProjectEvent(watcher, projectPath, matcher, event) {
+                continue
+            }
+            resync = time.After(debounce)
+        case <-resync:
+            resync = nil
+            if err := sync(); err != nil {
+                logrus.Errorf("Sync failed: %v", err)
+            }
+        }
+    }
+}
+
+// remoteSyncPath returns the directory part of a user@host:/path rsync destination, which is
+// where the remote Docker daemon sees the project
+func remoteSyncPath(remote string) (string, error) {
+    i := strings.Index(remote, ":")
+    if i <= 0 || !strings.HasPrefix(remote[i+1:], "/") {
+        return "", fmt.Errorf("invalid remote %q: expected user@host:/absolute/path", remote)
+    }
+    return strings.TrimSuffix(remote[i+1:], "/"), nil
+}
+
+// RsyncProject mirrors a checkout to a user@host:/path remote with rsync -avz --delete, or with
+// back copies the remote's changes into the checkout without deleting anything there. Both
+// directions exclude the patterns in the checkout's .devenvignore files, which are also left
+// alone on the receiving side.
+func RsyncProject(ctx context.Context, projectPath, remote string, back bool) error {
+    src, dst := strings.TrimSuffix(projectPath, "/")+"/", strings.TrimSuffix(remote, "/")
+    args := []string{"-avz", "--filter=:- " + syncIgnoreFile}
+    if back {
+        src, dst = dst+"/", projectPath
+    } else {
+        args = append(args, "--delete")
+    }
+    // The sender's .devenvignore files apply per directory; the checkout's top-level one applies
+    // either way, so a pattern missing on the remote doesn't bring excluded files back
+    ignore := filepath.Join(projectPath, syncIgnoreFile)
+    if _, err := os.Stat(ignore); err == nil {
+        args = append(args, "--exclude-from="+ignore)
+    }
+
+    logrus.Infof("Syncing %s to %s...", src, dst)
+    cmd := exec.CommandContext(ctx, "rsync", append(args, src, dst)...)
+    cmd.Stdout = os.Stdout
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("rsync to %s failed: %v", dst, err)
+    }
+    return nil
+}
+
+// WatchRemoteSync rsyncs a checkout to remote, then again a second after files stop changing,
+// until ctx is cancelled
+func WatchRemoteSync(ctx context.Context, projectPath, remote string) error {
+    if _, err := remoteSyncPath(remote); err != nil {
+        return err
+    }
+    dst := strings.TrimSuffix(remote, "/")
+    return watchAndSync(ctx, projectPath, time.Second, func() error {
+        return RsyncProject(ctx, projectPath, dst, false)
+    })
+}
+
+// WatchAndRun runs cmd in a project's running container each time files in its checkout change,
+// until ctx is cancelled. The container is left as it is.
+func WatchAndRun(ctx context.Context, projectDirName, repoName string, cmd []string, initialRun bool) error {
+    _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    projectPath, err := repoCheckoutPath(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    info, err := cli.ContainerInspect(ctx, containerName)
+    if err != nil {
+        return fmt.Errorf("container %s not found; start the environment first: %v", containerName, err)
+    }
+    if info.State == nil || !info.State.Running {
+        return fmt.Errorf("%w: %s; start the environment first", errContainerNotRunning, containerName)
+    }
+
+    watcher, err := fsnotify.NewWatcher()
+    if err != nil {
+        return fmt.Errorf("error creating watcher: %v", err)
+    }
+    defer watcher.Close()
+    matcher, err := syncMatcher(projectPath)
+    if err != nil {
+        return fmt.Errorf("error reading %s: %v", syncIgnoreFile, err)
+    }
+    if err := watchProjectTree(watcher, projectPath, matcher); err != nil {
+        return fmt.Errorf("error watching %s: %v", projectPath, err)
+    }
+
+    target := mountTarget(projectDirName, repoName)
+    runs := 0
+    run := func() {
+        runs++
+        fmt.Printf("\n==== %s  run #%d: %s ====\n", time.Now().Format("15:04:05"), runs, strings.Join(cmd, " "))
+        exitCode, err := execInContainerDir(ctx, cli, info.ID, target, cmd, os.Stdout)
+        switch {
+        case ctx.Err() != nil:
+        case err != nil:
+            logrus.Errorf("Error running command: %v", err)
+        default:
+            fmt.Printf("==== exit code %d ====\n", exitCode)
+        }
+    }
+
+    if initialRun {
+        run()
+    }
+    logrus.Infof("Watching %s; running %q in %s on changes. Press Ctrl-C to stop.", projectPath, strings.Join(cmd, " "), containerName)
+
+    // Editors save through temp files and renames, so wait for the burst of events to settle
+    var rerun <-chan time.Time
+    for {
+        select {
+        case <-ctx.Done():
+            return nil
+        case err := <-watcher.Errors:
+            logrus.Warnf("Watch error: %v", err)
+        case event := <-watcher.Events:
+            if trackProjectEvent(watcher, projectPath, matcher, event) {
+                rerun = time.After(300 * time.Millisecond)
+            }
+        case <-rerun:
+            rerun = nil
+            run()
+        }
+    }
+}
+
+// ScheduleEntry is a recurring action on a repository, stored in ~/.dev-env-manager/schedule.json
+type ScheduleEntry struct {
+    ID      string    `json:"id"`
+    Project string    `json:"project"`
+    Repo    string    `json:"repo"`
+    Cron    string    `json:"cron"`
+    Command []string  `json:"command"` // action name followed by its arguments
+    AddedAt time.Time `json:"added_at"`
+}
+
+// scheduleActions are the commands a schedule entry can run, keyed by name
+var scheduleActions = map[string]func(ctx context.Context, projectDirName, repoName string, args []string) error{
+    "pull": func(ctx context.Context, projectDirName, repoName string, args []string) error {
+        return PullCheckout(ctx, projectDirName, repoName)
+    },
+    "update-image": func(ctx context.Context, projectDirName, repoName string, args []string) error {
+        _, dockerImage, _, err := deriveProjectValues(projectDirName, repoName)
+        if err != nil {
+            return err
+        }
+        return PullImage(ctx, dockerImage, io.Discard)
+    },
+    "run-in": func(ctx context.Context, projectDirName, repoName string, args []string) error {
+        return RunInEnvironment(ctx, projectDirName, repoName, args)
+    },
+}
+
+// scheduleActionNames lists the valid schedule actions for messages
+func scheduleActionNames() string {
+    names := make([]string, 0, len(scheduleActions))
+    for name := range scheduleActions {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, ", ")
+}
+
+// schedulePath returns the file holding scheduled actions
+func schedulePath() (string, error) {
+    dir, err := appDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "schedule.json"), nil
+}
+
+// ReadSchedule returns the scheduled actions, none if the file doesn't exist
+func ReadSchedule() ([]ScheduleEntry, error) {
+    path, err := schedulePath()
+    if err != nil {
+        return nil, err
+    }
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var entries []ScheduleEntry
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, fmt.Errorf("error parsing %s: %v", path, err)
+    }
+    return entries, nil
+}
+
+// writeSchedule replaces the schedule file atomically. It is state rather than config, so it is
+// written even when the config is read-only.
+func writeSchedule(entries []ScheduleEntry) error {
+    path, err := schedulePath()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return err
+    }
+    data, err := json.MarshalIndent(entries, "", "  ")
+    if err != nil {
+        return err
+    }
+    return replaceFile(path, data)
+}
+
+// AddSchedule validates and records a recurring action, returning the new entry
+func AddSchedule(projectDirName, repoName, cronExpr string, command []string) (ScheduleEntry, error) {
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return ScheduleEntry{}, fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    if _, err := cron.ParseStandard(cronExpr); err != nil {
+        return ScheduleEntry{}, fmt.Errorf("invalid cron expression %q: %v", cronExpr, err)
+    }
+    if len(command) == 0 {
+        return ScheduleEntry{}, fmt.Errorf("a command is required (one of %s)", scheduleActionNames())
+    }
+    if _, ok := scheduleActions[command[0]]; !ok {
+        return ScheduleEntry{}, fmt.Errorf("unknown command %q (want one of %s)", command[0], scheduleActionNames())
+    }
+    if command[0] == "run-in" && len(command) < 2 {
+        return ScheduleEntry{}, fmt.Errorf("run-in needs a command to run, e.g. run-in -- go test ./...")
+    }
+
+    entries, err := ReadSchedule()
+    if err != nil {
+        return ScheduleEntry{}, err
+    }
+    id := make([]byte, 4)
+    if _, err := rand.Read(id); err != nil {
+        return ScheduleEntry{}, err
+    }
+    entry := ScheduleEntry{
+        ID:      hex.EncodeToString(id),
+        Project: projectDirName,
+        Repo:    repoName,
+        Cron:    cronExpr,
+        Command: command,
+        AddedAt: time.Now().UTC(),
+    }
+    return entry, writeSchedule(append(entries, entry))
+}
+
+// RemoveSchedule deletes the scheduled action with the given ID
+func RemoveSchedule(id string) error {
+    entries, err := ReadSchedule()
+    if err != nil {
+        return err
+    }
+    for i, entry := range entries {
+        if entry.ID == id {
+            if skipForDryRun("remove schedule entry %s (%s %s)", id, entry.Cron, strings.Join(entry.Command, " ")) {
+                return nil
+            }
+            return writeSchedule(append(entries[:i], entries[i+1:]...))
+        }
+    }
+    return fmt.Errorf("no schedule entry with ID %s", id)
+}
+
+// NextScheduleRun returns when an entry fires next after now
+func NextScheduleRun(entry ScheduleEntry, now time.Time) (time.Time, error) {
+    schedule, err := cron.ParseStandard(entry.Cron)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return schedule.Next(now), nil
+}
+
+// RunScheduleDaemon fires every scheduled action at its times until ctx is cancelled
+func RunScheduleDaemon(ctx context.Context) error {
+    entries, err := ReadSchedule()
+    if err != nil {
+        return err
+    }
+    if len(entries) == 0 {
+        return fmt.Errorf("nothing scheduled; add entries with `schedule add`")
+    }
+
+    c := cron.New()
+    for _, entry := range entries {
+        entry := entry
+        if len(entry.Command) == 0 {
+            logrus.Warnf("Skipping schedule entry %s: it has no command", entry.ID)
+            continue
+        }
+        action, ok := scheduleActions[entry.Command[0]]
+        if !ok {
+            logrus.Warnf("Skipping schedule entry %s: unknown command %q", entry.ID, entry.Command[0])
+            continue
+        }
+        _, err := c.AddFunc(entry.Cron, func() {
+            logrus.Infof("Running %s for %s/%s (%s)", strings.Join(entry.Command, " "), entry.Project, entry.Repo, entry.ID)
+            if err := action(ctx, entry.Project, entry.Repo, entry.Command[1:]); err != nil {
+                logrus.Errorf("Schedule entry %s failed: %v", entry.ID, err)
+                return
+            }
+            logrus.Infof("Schedule entry %s finished", entry.ID)
+        })
+        if err != nil {
+            logrus.Warnf("Skipping schedule entry %s: %v", entry.ID, err)
+        }
+    }
+
+    logrus.Infof("Running %d scheduled entries. Press Ctrl-C to stop.", len(entries))
+    c.Start()
+    <-ctx.Done()
+    // Let running actions finish
+    <-c.Stop().Done()
+    return nil
+}
+
+// PullCheckout fast-forwards a repository's checkout from its origin remote
+func PullCheckout(ctx context.Context, projectDirName, repoName string) error {
+    projectPath, err := repoCheckoutPath(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    repo, err := git.PlainOpen(projectPath)
+    if err != nil {
+        return fmt.Errorf("error opening repository: %v", err)
+    }
+    worktree, err := repo.Worktree()
+    if err != nil {
+        return err
+    }
+    err = worktree.PullContext(ctx, &git.PullOptions{RemoteName: "origin"})
+    if err == git.NoErrAlreadyUpToDate {
+        logrus.Infof("%s is already up to date", projectPath)
+        return nil
+    }
+    return err
+}
+
+// RunInEnvironment runs a command in a repository's running container, in the project directory
+func RunInEnvironment(ctx context.Context, projectDirName, repoName string, cmd []string) error {
+    _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    exitCode, err := execInContainerDir(ctx, cli, containerName, mountTarget(projectDirName, repoName), cmd, os.Stdout)
+    if err != nil {
+        return err
+    }
+    if exitCode != 0 {
+        return fmt.Errorf("%s exited with code %d", strings.Join(cmd, " "), exitCode)
+    }
+    return nil
+}
+
+// How long a container state looked up for the shell prompt is reused
+const promptStateTTL = 5 * time.Second
+
+// Longest the prompt lookup waits for the Docker daemon
+const promptDockerTimeout = 40 * time.Millisecond
+
+// PromptEnv describes the environment for a directory, as printed by `env`
+type PromptEnv struct {
+    Project   string
+    Repo      string
+    Container string
+    State     string // running, exited, ..., absent, or unknown if Docker didn't answer in time
+    Image     string
+}
+
+// promptStateEntry is a cached container state
+type promptStateEntry struct {
+    State     string    `json:"state"`
+    CheckedAt time.Time `json:"checked_at"`
+}
+
+// ResolvePromptEnv returns the configured environment containing dir. It has to be fast enough
+// to run on every prompt, so Docker gets a short timeout and container states are cached briefly.
+func ResolvePromptEnv(dir string) (PromptEnv, error) {
+    projectDirName, repoName, err := ResolveProjectFromDir(dir)
+    if err != nil {
+        return PromptEnv{}, err
+    }
+    if !viper.IsSet(repoConfigKey(projectDirName, repoName)) {
+        return PromptEnv{}, fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+    }
+    _, dockerImage, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return PromptEnv{}, err
+    }
+    return PromptEnv{
+        Project:   projectDirName,
+        Repo:      repoName,
+        Container: containerName,
+        State:     promptContainerState(containerName),
+        Image:     dockerImage,
+    }, nil
+}
+
+// promptContainerState returns a container's state from the cache or, failing that, the daemon
+func promptContainerState(containerName string) string {
+    dir, err := cacheDir()
+    if err != nil {
+        return "unknown"
+    }
+    path := filepath.Join(dir, "prompt-state.json")
+    cache := make(map[string]promptStateEntry)
+    if data, err := os.ReadFile(path); err == nil {
+        json.Unmarshal(data, &cache)
+    }
+    if entry, ok := cache[containerName]; ok && time.Since(entry.CheckedAt) < promptStateTTL {
+        return entry.State
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), promptDockerTimeout)
+    defer cancel()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return "unknown"
+    }
+    state := "absent"
+    info, err := cli.ContainerInspect(ctx, containerName)
+    switch {
+    case client.IsErrNotFound(err):
+    case err != nil:
+        return "unknown"
+    case info.State != nil:
+        state = info.State.Status
+    }
+
+    cache[containerName] = promptStateEntry{State: state, CheckedAt: time.Now()}
+    if data, err := json.Marshal(cache); err == nil && os.MkdirAll(dir, 0755) == nil {
+        os.WriteFile(path, data, 0644)
+    }
+    return state
+}
+
+// PromptInitScript returns a snippet for the given shell that exposes the environment of the
+// current directory as $DEM_ENV ("project/repo:state") and shows it in the prompt
+func PromptInitScript(shell, binary string) (string, error) {
+    switch shell {
+    case "zsh":
+        return `# dev-environment-manager prompt: add to ~/.zshrc with
+#   eval "$(` + binary + ` prompt-init zsh)"
+_dem_prompt_env() {
+    local out
+    DEM_ENV=""
+    out=$(` + binary + ` env --porcelain 2>/dev/null) || return
+    DEM_ENV="${${out#*PROJECT=}%%$'
+'*}/${${out#*REPO=}%%$'
+'*}:${${out#*STATE=}%%$'
+'*}"
+}
+typeset -ag precmd_functions
+precmd_functions+=(_dem_prompt_env)
+setopt prompt_subst
+RPROMPT='${DEM_ENV:+[$DEM_ENV]}'"$RPROMPT"
+`, nil
+    case "bash":
+        return `# dev-environment-manager prompt: add to ~/.bashrc with
+#   eval "$(` + binary + ` prompt-init bash)"
+_dem_prompt_env() {
+    local out line project repo state
+    DEM_ENV=""
+    out=$(` + binary + ` env --porcelain 2>/dev/null) || return
+    while IFS= read -r line; do
+        case $line in
+            PROJECT=*) project=${line#PROJECT=} ;;
+            REPO=*) repo=${line#REPO=} ;;
+            STATE=*) state=${line#STATE=} ;;
+        esac
+    done <<< "$out"
+    DEM_ENV="$project/$repo:$state"
+}
+PROMPT_COMMAND="_dem_prompt_env${PROMPT_COMMAND:+; $PROMPT_COMMAND}"
+PS1='${DEM_ENV:+[$DEM_ENV] }'"$PS1"
+`, nil
+    case "fish":
+        return `# dev-environment-manager prompt: add to ~/.config/fish/config.fish with
+#   ` + binary + ` prompt-init fish | source
+function _dem_prompt_env
+    set -l out (` + binary + ` env --porcelain 2>/dev/null); or return
+    set -l project (string replace -r -f '^PROJECT=' '' $out)
+    set -l repo (string replace -r -f '^REPO=' '' $out)
+    set -l state (string replace -r -f '^STATE=' '' $out)
+    echo -n "[$project/$repo:$state]"
+end
+function fish_right_prompt
+    _dem_prompt_env
+end
+`, nil
+    }
+    return "", fmt.Errorf("unsupported shell %q (want zsh, bash or fish)", shell)
+}
+
+// CdInitScript returns a shell function, devcd, that changes to a project's checkout via the path command
+func CdInitScript(shell, binary string) (string, error) {
+    switch shell {
+    case "zsh", "bash":
+        return `# dev-environment-manager cd helper: add to ~/.` + shell + `rc with
+#   eval "$(` + binary + ` cd-init ` + shell + `)"
+devcd() {
+    local dir
+    dir=$(` + binary + ` path "$@") || return
+    cd -- "$dir"
+}
+`, nil
+    case "fish":
+        return `# dev-environment-manager cd helper: add to ~/.config/fish/config.fish with
+#   ` + binary + ` cd-init fish | source
+function devcd
+    set -l dir (` + binary + ` path $argv); or return
+    cd -- $dir
+end
+`, nil
+    }
+    return "", fmt.Errorf("unsupported shell %q (want zsh, bash or fish)", shell)
+}
+
+// ShellInitScript returns the shell integration snippet for an rc file: the dem alias, completion
+// for the binary and the alias, and DEV_ENV_MANAGER_HOME. Every line is safe to evaluate again.
+func ShellInitScript(shell, binary string) (string, error) {
+    switch shell {
+    case "bash":
+        return `# dev-environment-manager shell integration: add to ~/.bashrc with
+#   eval "$(` + binary + ` shell-init bash)"
+export DEV_ENV_MANAGER_HOME="${DEV_ENV_MANAGER_HOME:-$HOME/.dev-env-manager}"
+alias dem='` + binary + `'
+source <(` + binary + ` completion bash)
+complete -o default -F __start_` + binary + ` dem
+`, nil
+    case "zsh":
+        return `# dev-environment-manager shell integration: add to ~/.zshrc with
+#   eval "$(` + binary + ` shell-init zsh)"
+export DEV_ENV_MANAGER_HOME="${DEV_ENV_MANAGER_HOME:-$HOME/.dev-env-manager}"
+alias dem='` + binary + `'
+(( $+functions[compdef] )) || { autoload -Uz compinit && compinit }
+source <(` + binary + ` completion zsh)
+compdef _` + binary + ` dem
+`, nil
+    case "fish":
+        return `# dev-environment-manager shell integration: add to ~/.config/fish/config.fish with
+#   ` + binary + ` shell-init fish | source
+set -q DEV_ENV_MANAGER_HOME; or set -gx DEV_ENV_MANAGER_HOME $HOME/.dev-env-manager
+alias dem '` + binary + `'
+` + binary + ` completion fish | source
+complete -c dem -w ` + binary + `
+`, nil
+    }
+    return "", fmt.Errorf("unsupported shell %q (want bash, zsh or fish)", shell)
+}
+
+// InstallCompletion writes a shell's completion script for the program name to the shell's usual
+// completion directory and makes the shell's rc file load it, unless it already does. Fish loads
+// its completions directory by itself, so its config is left alone. It returns the script path.
+func InstallCompletion(shell, name string, script []byte) (string, error) {
+    homeDir, err := os.UserHomeDir()
+    if err != nil {
+        return "", fmt.Errorf("error getting home directory: %v", err)
+    }
+
+    var path, rcPath, rcLine string
+    switch shell {
+    case "bash":
+        path = filepath.Join(homeDir, ".bash_completion.d", name)
+        rcPath = filepath.Join(homeDir, ".bashrc")
+        rcLine = fmt.Sprintf(`[ -f "$HOME/.bash_completion.d/%s" ] && . "$HOME/.bash_completion.d/%s"`, name, name)
+    case "zsh":
+        path = filepath.Join(homeDir, ".zsh", "completions", "_"+name)
+        rcPath = filepath.Join(homeDir, ".zshrc")
+        rcLine = `fpath=("$HOME/.zsh/completions" $fpath); autoload -Uz compinit && compinit`
+    case "fish":
+        path = filepath.Join(homeDir, ".config", "fish", "completions", name+".fish")
+    default:
+        return "", fmt.Errorf("unsupported shell %q (want bash, zsh or fish)", shell)
+    }
+
+    if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+        return "", err
+    }
+    if err := os.WriteFile(path, script, 0644); err != nil {
+        return "", err
+    }
+    if rcPath == "" {
+        return path, nil
+    }
+
+    rc, err := os.ReadFile(rcPath)
+    if err != nil && !os.IsNotExist(err) {
+        return path, err
+    }
+    if bytes.Contains(rc, []byte(rcLine)) {
+        return path, nil
+    }
+    f, err := os.OpenFile(rcPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        return path, err
+    }
+    defer f.Close()
+    prefix := ""
+    if len(rc) > 0 {
+        prefix = "\n"
+        if !bytes.HasSuffix(rc, []byte("\n")) {
+            prefix = "\n\n"
+        }
+    }
+    _, err = fmt.Fprintf(f, "%s# %s completion\n%s\n", prefix, name, rcLine)
+    return path, err
+}
+
+// Longest shell completion waits for the Docker daemon
+const completionDockerTimeout = 300 * time.Millisecond
+
+// LocalImageRefs returns the tagged local image references starting with prefix, sorted. Docker
+// errors and timeouts yield no references so completion never hangs or fails on them.
+func LocalImageRefs(prefix string) []string {
+    ctx, cancel := context.WithTimeout(context.Background(), completionDockerTimeout)
+    defer cancel()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return nil
+    }
+    images, err := cli.ImageList(ctx, types.ImageListOptions{})
+    if err != nil {
+        return nil
+    }
+
+    var refs []string
+    for _, image := range images {
+        for _, tag := range image.RepoTags {
+            if tag != "<none>:<none>" && strings.HasPrefix(tag, prefix) {
+                refs = append(refs, tag)
+            }
+        }
+    }
+    sort.Strings(refs)
+    return refs
+}
+
+// CompletionSet holds the projects and repos offered by shell completion
+type CompletionSet struct {
+    configured map[string]map[string]bool     // project -> repo
+    states     map[string]map[string][]string // project -> repo -> container states
+}
+
+// CompletionCandidates collects configured repositories and, with withContainers, those of managed
+// containers. Docker errors and timeouts are ignored so completion never hangs or fails on them.
+func CompletionCandidates(withContainers bool) (*CompletionSet, error) {
+    set := &CompletionSet{
+        configured: make(map[string]map[string]bool),
+        states:     make(map[string]map[string][]string),
+    }
+    repos, err := configuredRepos(false)
+    if err != nil {
+        return nil, err
+    }
+    for _, repo := range repos {
+        if set.configured[repo.Project] == nil {
+            set.configured[repo.Project] = make(map[string]bool)
+        }
+        set.configured[repo.Project][repo.Repo] = true
+    }
+    if !withContainers {
+        return set, nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), completionDockerTimeout)
+    defer cancel()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return set, nil
+    }
+    containers, err := cli.ContainerList(ctx, types.ContainerListOptions{
+        All:     true,
+        Filters: filters.NewArgs(filters.Arg("label", labelManaged+"=true")),
+    })
+    if err != nil {
+        return set, nil
+    }
+    for _, c := range containers {
+        project, repo := c.Labels[labelProject], c.Labels[labelRepo]
+        if project == "" || repo == "" {
+            continue
+        }
+        if set.states[project] == nil {
+            set.states[project] = make(map[string][]string)
+        }
+        set.states[project][repo] = append(set.states[project][repo], c.State)
+    }
+    return set, nil
+}
+
+// Projects returns every known project, sorted
+func (s *CompletionSet) Projects() []string {
+    seen := make(map[string]interface{})
+    for project := range s.configured {
+        seen[project] = nil
+    }
+    for project := range s.states {
+        seen[project] = nil
+    }
+    return sortedKeys(seen)
+}
+
+// Repos returns the known repos of a project, sorted
+func (s *CompletionSet) Repos(project string) []string {
+    seen := make(map[string]interface{})
+    for repo := range s.configured[project] {
+        seen[repo] = nil
+    }
+    for repo := range s.states[project] {
+        seen[repo] = nil
+    }
+    return sortedKeys(seen)
+}
+
+// Describe summarizes the containers of a repo for the completion description, flagging repos
+// that only exist as containers
+func (s *CompletionSet) Describe(project, repo string) string {
+    states := s.states[project][repo]
+    var parts []string
+    if len(states) == 1 {
+        parts = append(parts, states[0])
+    } else if len(states) > 1 {
+        parts = append(parts, fmt.Sprintf("%d containers: %s", len(states), strings.Join(states, ", ")))
+    }
+    if !s.configured[project][repo] {
+        parts = append(parts, "not configured")
+    }
+    return strings.Join(parts, ", ")
+}
+
+// Names of the git bundle and config subtree stored beside the checkout in a project archive
+const (
+    archiveBundleName   = "bundle.git"
+    archiveMetadataName = "dev-env-metadata.yaml"
+)
+
+// archiveMetadata is the dev-env-metadata.yaml entry of a project archive
+type archiveMetadata struct {
+    Project string                 `yaml:"project"`
+    Repo    string                 `yaml:"repo"`
+    Config  map[string]interface{} `yaml:"config"`
+}
+
+// ArchiveOptions selects what ArchiveProject writes
+type ArchiveOptions struct {
+    Output     string   // archive path; empty means <project>-<repo>.tar.gz
+    Metadata   bool     // include the repository's config entry
+    IncludeGit bool     // include the checkout's .git directory; the bundle keeps the history either way
+    Exclude    []string // gitignore-style patterns of checkout paths to leave out
+    Container  bool     // also export the container's filesystem next to the archive
+}
+
+// ArchiveProject writes a gzipped tarball of a repository's checkout under <repo>/, uncommitted
+// changes included, a git bundle of all its refs, and with opts.Metadata its config entry, for
+// restoring with ImportArchive
+func ArchiveProject(projectDirName, repoName string, opts ArchiveOptions) error {
+    projectPath, err := repoCheckoutPath(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    if _, err := os.Stat(filepath.Join(projectPath, ".git")); err != nil {
+        return fmt.Errorf("%s is not a git checkout", projectPath)
+    }
+    output := opts.Output
+    if output == "" {
+        output = fmt.Sprintf("%s-%s.tar.gz", projectDirName, repoName)
+    }
+
+    var patterns []gitignore.Pattern
+    if !opts.IncludeGit {
+        patterns = append(patterns, gitignore.ParsePattern("/.git", nil))
+    }
+    for _, p := range opts.Exclude {
+        patterns = append(patterns, gitignore.ParsePattern(p, nil))
+    }
+    matcher := gitignore.NewMatcher(patterns)
+
+    tmpDir, err := os.MkdirTemp("", "dev-env-archive-")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(tmpDir)
+    bundlePath := filepath.Join(tmpDir, archiveBundleName)
+    logrus.Infof("Bundling the history of %s...", projectPath)
+    cmd := exec.Command("git", "-C", projectPath, "bundle", "create", bundlePath, "--all")
+    cmd.Stderr = os.Stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("error creating git bundle: %v", err)
+    }
+
+    var metadata []byte
+    if opts.Metadata {
+        settings := repoSettings(projectDirName, repoName)
+        if settings == nil {
+            return fmt.Errorf("%s/%s is not configured", projectDirName, repoName)
+        }
+        settings = deepCopyConfig(settings).(map[string]interface{})
+        if metadata, err = yaml.Marshal(archiveMetadata{Project: projectDirName, Repo: repoName, Config: settings}); err != nil {
+            return err
+        }
+    }
+
+    f, err := os.Create(output)
+    if err != nil {
+        return err
+    }
+    if err := writeProjectArchive(f, projectPath, repoName, bundlePath, metadata, matcher); err != nil {
+        f.Close()
+        os.Remove(output)
+        return fmt.Errorf("error writing %s: %v", output, err)
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(output)
+        return err
+    }
+    logrus.Infof("Archived %s/%s to %s.", projectDirName, repoName, output)
+
+    if opts.Container {
+        return exportProjectContainer(projectDirName, repoName, strings.TrimSuffix(strings.TrimSuffix(output, ".gz"), ".tar")+"-container.tar")
+    }
+    return nil
+}
+
+// exportProjectContainer writes the filesystem of the repository's container, running or
+// stopped, as a tar to output, like docker export
+func exportProjectContainer(projectDirName, repoName, output string) error {
+    _, _, containerName, err := deriveProjectValues(projectDirName, repoName)
+    if err != nil {
+        return err
+    }
+    ctx := context.Background()
+    cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+    if err != nil {
+        return fmt.Errorf("error creating Docker client: %v", err)
+    }
+    if _, err := cli.ContainerInspect(ctx, containerName); err != nil {
+        return fmt.Errorf("container %s not found; only the checkout was archived: %v", containerName, err)
+    }
+
+    logrus.Infof("Exporting container %s...", containerName)
+    stream, err := cli.ContainerExport(ctx, containerName)
+    if err != nil {
+        return fmt.Errorf("error exporting container %s: %v", containerName, err)
+    }
+    defer stream.Close()
+    f, err := os.Create(output)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(f, stream); err != nil {
+        f.Close()
+        os.Remove(output)
+        return fmt.Errorf("error writing %s: %v", output, err)
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(output)
+        return err
+    }
+    logrus.Infof("Exported container %s to %s.", containerName, output)
+    return nil
+}
+
+// writeProjectArchive streams the checkout, minus paths the matcher excludes, the bundle and the
+// metadata, if any, as a tar.gz
+func writeProjectArchive(w io.Writer, projectPath, repoName, bundlePath string, metadata []byte, matcher gitignore.Matcher) error {
+    zw := gzip.NewWriter(w)
+    tw := tar.NewWriter(zw)
+
+    addFile := func(path, name string, info os.FileInfo) error {
+        link := ""
+        if info.Mode()&os.ModeSymlink != 0 {
+            var err error
+            if link, err = os.Readlink(path); err != nil {
+                return err
+            }
+        }
+        hdr, err := tar.FileInfoHeader(info, link)
+        if err != nil {
+            return err
+        }
+        hdr.Name = name
+        if err := tw.WriteHeader(hdr); err != nil {
+            return err
+        }
+        if !info.Mode().IsRegular() {
+            return nil
+        }
+        src, err := os.Open(path)
+        if err != nil {
+            return err
+        }
+        defer src.Close()
+        _, err = io.Copy(tw, src)
+        return err
+    }
+
+    err := filepath.Walk(projectPath, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        rel, err := filepath.Rel(projectPath, path)
+        if err != nil {
+            return err
+        }
+        if rel != "." && matcher.Match(strings.Split(filepath.ToSlash(rel), "/"), info.IsDir()) {
+            if info.IsDir() {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        return addFile(path, filepath.ToSlash(filepath.Join(repoName, rel)), info)
+    })
+    if err != nil {
+        return err
+    }
+
+    info, err := os.Stat(bundlePath)
+    if err != nil {
+        return err
+    }
+    if err := addFile(bundlePath, archiveBundleName, info); err != nil {
+        return err
+    }
+    if metadata != nil {
+        if err := tw.WriteHeader(&tar.Header{Name: archiveMetadataName, Mode: 0644, Size: int64(len(metadata)), ModTime: time.Now()}); err != nil {
+            return err
+        }
+        if _, err := tw.Write(metadata); err != nil {
+            return err
+        }
+    }
+
+    if err := tw.Close(); err != nil {
+        return err
+    }
+    return zw.Close()
+}
+
+// ImportArchive restores an archive written by ArchiveProject: the checkout goes to
+// ~/Projects/<project>/<repo> and the config entry is registered through AddProjectConfig. A
+// checkout archived without its .git directory gets its history back from the bundle.
+func ImportArchive(archivePath string) error {
+    if configReadOnly {
+        return errConfigReadOnly
+    }
+    root, err := projectsRoot()
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(root, 0755); err != nil {
+        return err
+    }
+    // Extract next to the destination so the checkout can be moved into place with a rename
+    staging, err := os.MkdirTemp(root, ".import-")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(staging)
+
+    f, err := os.Open(archivePath)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    if err := extractArchive(f, staging); err != nil {
+        return fmt.Errorf("error extracting %s: %v", archivePath, err)
+    }
+
+    data, err := os.ReadFile(filepath.Join(staging, archiveMetadataName))
+    if os.IsNotExist(err) {
+        return fmt.Errorf("%s has no %s; it was archived without its config", archivePath, archiveMetadataName)
+    }
+    if err != nil {
+        return err
+    }
+    var meta archiveMetadata
+    if err := yaml.Unmarshal(data, &meta); err != nil {
+        return fmt.Errorf("error parsing %s: %v", archiveMetadataName, err)
+    }
+    if meta.Project == "" || meta.Repo == "" {
+        return fmt.Errorf("%s doesn't name a project and repo", archiveMetadataName)
+    }
+    for _, name := range []string{meta.Project, meta.Repo} {
+        if err := validatePathComponent(name); err != nil {
+            return fmt.Errorf("%s: %v", archiveMetadataName, err)
+        }
+    }
+
+    if viper.IsSet(repoConfigKey(meta.Project, meta.Repo)) {
+        return fmt.Errorf("%s/%s is already configured", meta.Project, meta.Repo)
+    }
+    target, err := repoCheckoutPath(meta.Project, meta.Repo)
+    if err != nil {
+        return err
+    }
+    if _, err := os.Stat(target); err == nil {
+        return fmt.Errorf("%s already exists", target)
+    }
+    if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+        return err
+    }
+    if err := os.Rename(filepath.Join(staging, meta.Repo), target); err != nil {
+        return fmt.Errorf("error moving the checkout into place: %v", err)
+    }
+    str := func(key string) string {
+        value, _ := meta.Config[key].(string)
+        return value
+    }
+    if _, err := os.Stat(filepath.Join(target, ".git")); os.IsNotExist(err) {
+        if err := restoreFromBundle(target, filepath.Join(staging, archiveBundleName), str("repo_url")); err != nil {
+            return err
+        }
+    }
+    if err := AddProjectConfig(meta.Project, meta.Repo, str("repo_url"), str("docker_image"), str("container_name")); err != nil {
+        return err
+    }
+    key := userRepoKey(meta.Project, meta.Repo)
+    for field, value := range meta.Config {
+        viper.Set(key+"."+field, value)
+    }
+    if err := writeConfig(); err != nil {
+        return err
+    }
+    logrus.Infof("Imported %s/%s into %s.", meta.Project, meta.Repo, target)
+    return nil
+}
+
+// validatePathComponent checks that a project or repo name from untrusted input is a single path
+// component, so joining it to a directory can't leave that directory
+func validatePathComponent(name string) error {
+    if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+        return fmt.Errorf("invalid name %q: must be a single path component", name)
+    }
+    return nil
+}
+
+// insideDir reports whether a relative, cleaned path stays within its root
+func insideDir(rel string) bool {
+    return !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkNoSymlinkParents refuses a path inside dir whose parent directories include a symlink,
+// which an earlier entry of the archive could have pointed anywhere
+func checkNoSymlinkParents(dir, name string) error {
+    parent := dir
+    parts := strings.Split(filepath.Dir(name), string(filepath.Separator))
+    for _, part := range parts {
+        if part == "." {
+            continue
+        }
+        parent = filepath.Join(parent, part)
+        info, err := os.Lstat(parent)
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if info.Mode()&os.ModeSymlink != 0 {
+            return fmt.Errorf("entry %s is below the symlink %s", name, parent)
+        }
+    }
+    return nil
+}
+
+// extractArchive unpacks a tar.gz into dir, refusing entries that would land outside it: paths
+// escaping dir, entries below a symlink and symlinks pointing outside dir
+func extractArchive(r io.Reader, dir string) error {
+    zr, err := gzip.NewReader(r)
+    if err != nil {
+        return err
+    }
+    defer zr.Close()
+
+    tr := tar.NewReader(zr)
+    for {
+        hdr, err := tr.Next()
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        name := filepath.Clean(filepath.FromSlash(hdr.Name))
+        if !insideDir(name) {
+            return fmt.Errorf("entry %s points outside the archive", hdr.Name)
+        }
+        if err := checkNoSymlinkParents(dir, name); err != nil {
+            return err
+        }
+        path := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+            return err
+        }
+        // Writing over an existing symlink would follow it
+        if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+            return fmt.Errorf("entry %s would replace a symlink", hdr.Name)
+        }
+
+        switch hdr.Typeflag {
+        case tar.TypeDir:
+            if err := os.MkdirAll(path, os.FileMode(hdr.Mode).Perm()); err != nil {
+                return err
+            }
+        case tar.TypeSymlink:
+            target := filepath.FromSlash(hdr.Linkname)
+            if filepath.IsAbs(target) || !insideDir(filepath.Join(filepath.Dir(name), target)) {
+                return fmt.Errorf("symlink %s points outside the archive (%s)", hdr.Name, hdr.Linkname)
+            }
+            if err := os.Symlink(hdr.Linkname, path); err != nil {
+                return err
+            }
+        case tar.TypeReg:
+            out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+            if err != nil {
+                return err
+            }
+            _, err = io.Copy(out, tr)
+            out.Close()
+            if err != nil {
+                return err
+            }
+        default:
+            logrus.Warnf("Skipping %s: unsupported entry type", hdr.Name)
+        }
+    }
+}
+
+// restoreFromBundle recreates a checkout's git history from a bundle of all its refs, pointing
+// origin back at repoURL
+func restoreFromBundle(target, bundlePath, repoURL string) error {
+    if _, err := os.Stat(bundlePath); err != nil {
+        return fmt.Errorf("the archive has neither a .git directory nor %s", archiveBundleName)
+    }
+    // A bare clone keeps every branch and tag and the bundle's HEAD
+    steps := [][]string{
+        {"clone", "-q", "--bare", bundlePath, filepath.Join(target, ".git")},
+        {"-C", target, "config", "core.bare", "false"},
+        {"-C", target, "reset", "-q"},
+        {"-C", target, "remote", "remove", "origin"},
+    }
+    if repoURL != "" {
+        steps = append(steps, []string{"-C", target, "remote", "add", "origin", repoURL})
+    }
+    for _, args := range steps {
+        cmd := exec.Command("git", args...)
+        cmd.Stderr = os.Stderr
+        if err := cmd.Run(); err != nil {
+            return fmt.Errorf("error restoring history from the bundle (git %s): %v", strings.Join(args, " "), err)
+        }
+    }
+    return nil
+}
+
+// TemplateInfo describes a project template, as listed in a registry index
+type TemplateInfo struct {
+    Name        string `yaml:"name"`
+    Description string `yaml:"description"`
+    URL         string `yaml:"url"` // .tar.gz of the template's files
+}
+
+// templateIndex is the YAML file template_registry_url points at
+type templateIndex struct {
+    Templates []TemplateInfo `yaml:"templates"`
+}
+
+// templatesDir returns the directory holding installed templates, one subdirectory each
+func templatesDir() (string, error) {
+    dir, err := appDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "templates"), nil
+}
+
+// ListLocalTemplates returns the names of the installed templates
+func ListLocalTemplates() ([]string, error) {
+    dir, err := templatesDir()
+    if err != nil {
+        return nil, err
+    }
+    entries, err := os.ReadDir(dir)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var names []string
+    for _, entry := range entries {
+        if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+            names = append(names, entry.Name())
+        }
+    }
+    return names, nil
+}
+
+// templateRegistryTimeout returns the template_registry_timeout setting, 10s by default
+func templateRegistryTimeout() (time.Duration, error) {
+    value := viper.GetString("template_registry_timeout")
+    if value == "" {
+        return 10 * time.Second, nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        return 0, fmt.Errorf("invalid template_registry_timeout %q: %v", value, err)
+    }
+    return d, nil
+}
+
+// httpGet fetches url within timeout, failing on any status but 200
+func httpGet(ctx context.Context, url string, timeout time.Duration) ([]byte, error) {
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := http.DefaultClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+    }
+    return io.ReadAll(resp.Body)
+}
+
+// FetchTemplateIndex downloads the index at template_registry_url and caches it under
+// ~/.dev-env-manager/template-cache/. When the registry can't be reached, the cached index is
+// used with a warning.
+func FetchTemplateIndex(ctx context.Context) ([]TemplateInfo, error) {
+    registry := viper.GetString("template_registry_url")
+    if registry == "" {
+        return nil, fmt.Errorf("template_registry_url is not set")
+    }
+    timeout, err := templateRegistryTimeout()
+    if err != nil {
+        return nil, err
+    }
+    dir, err := appDir()
+    if err != nil {
+        return nil, err
+    }
+    cachePath := filepath.Join(dir, "template-cache", "index.yaml")
+
+    data, err := httpGet(ctx, registry, timeout)
+    if err != nil {
+        cached, cacheErr := os.ReadFile(cachePath)
+        if cacheErr != nil {
+            return nil, fmt.Errorf("error fetching %s: %v", registry, err)
+        }
+        logrus.Warnf("Unable to fetch %s (%v); using the cached index.", registry, err)
+        data = cached
+    } else {
+        if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+            return nil, err
+        }
+        if err := os.WriteFile(cachePath, data, 0644); err != nil {
+            logrus.Warnf("Unable to cache the template index: %v", err)
+        }
+    }
+
+    var index templateIndex
+    if err := yaml.Unmarshal(data, &index); err != nil {
+        return nil, fmt.Errorf("error parsing template index: %v", err)
+    }
+    return index.Templates, nil
+}
+
+// InstallTemplate downloads a template listed in the registry index and expands it into the
+// templates directory, replacing an older install of it
+func InstallTemplate(ctx context.Context, name string) (string, error) {
+    templates, err := FetchTemplateIndex(ctx)
+    if err != nil {
+        return "", err
+    }
+    var info *TemplateInfo
+    for i := range templates {
+        if templates[i].Name == name {
+            info = &templates[i]
+        }
+    }
+    if info == nil {
+        return "", fmt.Errorf("template %s is not in the registry index", name)
+    }
+    if err := validatePathComponent(name); err != nil || strings.HasPrefix(name, ".") {
+        return "", fmt.Errorf("invalid template name %q", name)
+    }
+
+    timeout, err := templateRegistryTimeout()
+    if err != nil {
+        return "", err
+    }
+    logrus.Infof("Downloading template %s from %s...", name, info.URL)
+    data, err := httpGet(ctx, info.URL, timeout)
+    if err != nil {
+        return "", fmt.Errorf("error downloading template %s: %v", name, err)
+    }
+
+    dir, err := templatesDir()
+    if err != nil {
+        return "", err
+    }
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+    staging, err := os.MkdirTemp(dir, "."+name+"-")
+    if err != nil {
+        return "", err
+    }
+    defer os.RemoveAll(staging)
+    if err := extractArchive(bytes.NewReader(data), staging); err != nil {
+        return "", fmt.Errorf("error expanding template %s: %v", name, err)
+    }
+
+    if err := os.Chmod(staging, 0755); err != nil {
+        return "", err
+    }
+    target := filepath.Join(dir, name)
+    if err := os.RemoveAll(target); err != nil {
+        return "", err
+    }
+    if err := os.Rename(staging, target); err != nil {
+        return "", err
+    }
+    return target, nil
+}
+
+// version is the release this binary was built from, set with -ldflags "-X main.version=v1.2.3";
+// development builds are never reported as outdated
+var version = "dev"
+
+// releasesAPIURL is the GitHub API endpoint for the tool's latest release
+const releasesAPIURL = "https://api.github.com/repos/Cdaprod/dev-environment-manager/releases/latest"
+
+const (
+    updateCheckInterval = 24 * time.Hour
+    updateCheckTimeout  = 2 * time.Second
+    selfUpdateTimeout   = 30 * time.Second
+    checksumsAssetName  = "checksums.txt"
+)
+
+// packageManagerPrefixes are install locations owned by package managers, which self-update
+// leaves alone
+var packageManagerPrefixes = []string{"/usr/bin/", "/usr/sbin/", "/usr/lib/", "/usr/share/", "/opt/homebrew/", "/usr/local/Cellar/", "/home/linuxbrew/", "/nix/store/", "/snap/"}
+
+type githubRelease struct {
+    TagName string `json:"tag_name"`
+    Assets  []struct {
+        Name string `json:"name"`
+        URL  string `json:"browser_download_url"`
+    } `json:"assets"`
+}
+
+// updateCheckState is cached in the state dir so the releases API is queried at most once a day
+type updateCheckState struct {
+    CheckedAt time.Time `json:"checked_at"`
+    Latest    string    `json:"latest"`
+}
+
+// updateChecksEnabled reports whether updates.check allows the update check and self-update
+func updateChecksEnabled() bool {
+    return !viper.IsSet("updates.check") || viper.GetBool("updates.check")
+}
+
+// updateCheckPath returns the file caching the last update check
+func updateCheckPath() (string, error) {
+    dir, err := stateDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "update-check.json"), nil
+}
+
+// fetchLatestRelease queries the GitHub releases API for the newest release
+func fetchLatestRelease(ctx context.Context, timeout time.Duration) (githubRelease, error) {
+    var release githubRelease
+    data, err := httpGet(ctx, releasesAPIURL, timeout)
+    if err != nil {
+        return release, err
+    }
+    if err := json.Unmarshal(data, &release); err != nil {
+        return release, fmt.Errorf("error parsing release data: %v", err)
+    }
+    if !semver.IsValid(release.TagName) {
+        return release, fmt.Errorf("latest release %q is not a semantic version", release.TagName)
+    }
+    return release, nil
+}
+
+// updateHint returns the one-line notice for a newer release, or "" when latest isn't newer
+func updateHint(latest string) string {
+    if !semver.IsValid(latest) || semver.Compare(latest, version) <= 0 {
+        return ""
+    }
+    return fmt.Sprintf("A newer release is available: %s (you have %s). Run dev-environment-manager self-update to install it.", latest, version)
+}
+
+// StartUpdateCheck begins the daily update check without blocking the command. The returned
+// channel yields the hint to print, or "" when there is nothing to report; it is filled at once
+// from the cached result when the last check is less than a day old, and otherwise by a
+// background query of the releases API that gives up after updateCheckTimeout.
+func StartUpdateCheck() <-chan string {
+    hint := make(chan string, 1)
+    if !updateChecksEnabled() || !semver.IsValid(version) {
+        hint <- ""
+        return hint
+    }
+    path, err := updateCheckPath()
+    if err != nil {
+        hint <- ""
+        return hint
+    }
+
+    var state updateCheckState
+    if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &state) == nil && time.Since(state.CheckedAt) < updateCheckInterval {
+        hint <- updateHint(state.Latest)
+        return hint
+    }
+
+    go func() {
+        // A failed check is recorded too, so being offline costs one attempt a day
+        release, err := fetchLatestRelease(context.Background(), updateCheckTimeout)
+        if err != nil {
+            logrus.Debugf("Update check failed: %v", err)
+        } else {
+            state.Latest = release.TagName
+        }
+        state.CheckedAt = time.Now()
+        if data, err := json.Marshal(state); err == nil {
+            if err := os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+                os.WriteFile(path, data, 0644)
+            }
+        }
+        hint <- updateHint(state.Latest)
+    }()
+    return hint
+}
+
+// releaseAssetName returns the name of the release binary for this platform
+func releaseAssetName() string {
+    name := fmt.Sprintf("dev-environment-manager_%s_%s", runtime.GOOS, runtime.GOARCH)
+    if runtime.GOOS == "windows" {
+        name += ".exe"
+    }
+    return name
+}
+
+// checksumFor returns the SHA-256 listed for name in a sha256sum-style checksums file
+func checksumFor(checksums []byte, name string) (string, error) {
+    for _, line := range strings.Split(string(checksums), "\n") {
+        fields := strings.Fields(line)
+        if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+            return strings.ToLower(fields[0]), nil
+        }
+    }
+    return "", fmt.Errorf("%s has no checksum for %s", checksumsAssetName, name)
+}
+
+// SelfUpdate replaces the running binary with the latest release's asset for GOOS/GOARCH after
+// verifying it against the release's checksums file. It returns the installed version, or ""
+// when this binary is already the latest release.
+func SelfUpdate(ctx context.Context) (string, error) {
+    if !updateChecksEnabled() {
+        return "", fmt.Errorf("updates are disabled by updates.check: false")
+    }
+
+    executable, err := os.Executable()
+    if err != nil {
+        return "", fmt.Errorf("error locating the running binary: %v", err)
+    }
+    if executable, err = filepath.EvalSymlinks(executable); err != nil {
+        return "", fmt.Errorf("error locating the running binary: %v", err)
+    }
+    for _, prefix := range packageManagerPrefixes {
+        if strings.HasPrefix(executable, prefix) {
+            return "", fmt.Errorf("%s is managed by a package manager; update it with that package manager instead", executable)
+        }
+    }
+
+    release, err := fetchLatestRelease(ctx, selfUpdateTimeout)
+    if err != nil {
+        return "", fmt.Errorf("error checking the latest release: %v", err)
+    }
+    if semver.IsValid(version) && semver.Compare(release.TagName, version) <= 0 {
+        return "", nil
+    }
+
+    assets := map[string]string{}
+    for _, asset := range release.Assets {
+        assets[asset.Name] = asset.URL
+    }
+    name := releaseAssetName()
+    if assets[name] == "" {
+        return "", fmt.Errorf("release %s has no binary for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+    }
+    if assets[checksumsAssetName] == "" {
+        return "", fmt.Errorf("release %s publishes no %s to verify the download against", release.TagName, checksumsAssetName)
+    }
+
+    checksums, err := httpGet(ctx, assets[checksumsAssetName], selfUpdateTimeout)
+    if err != nil {
+        return "", fmt.Errorf("error downloading %s: %v", checksumsAssetName, err)
+    }
+    want, err := checksumFor(checksums, name)
+    if err != nil {
+        return "", err
+    }
+    logrus.Infof("Downloading %s %s...", name, release.TagName)
+    binary, err := httpGet(ctx, assets[name], 10*selfUpdateTimeout)
+    if err != nil {
+        return "", fmt.Errorf("error downloading %s: %v", name, err)
+    }
+    sum := sha256.Sum256(binary)
+    if got := hex.EncodeToString(sum[:]); got != want {
+        return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, want, got)
+    }
+
+    // Write next to the binary, then move the running one aside: Windows can't replace a running
+    // executable, but it can rename it. The old copy is removed where the OS allows it.
+    tmp, old := executable+".update", executable+".old"
+    os.Remove(old)
+    if err := os.WriteFile(tmp, binary, 0755); err != nil {
+        return "", fmt.Errorf("cannot write to %s: %v", filepath.Dir(executable), err)
+    }
+    if err := os.Rename(executable, old); err != nil {
+        os.Remove(tmp)
+        return "", fmt.Errorf("error moving %s aside: %v", executable, err)
+    }
+    if err := os.Rename(tmp, executable); err != nil {
+        os.Rename(old, executable)
+        os.Remove(tmp)
+        return "", fmt.Errorf("error replacing %s: %v", executable, err)
+    }
+    os.Remove(old)
+    return release.TagName, nil
+}
+
+// Throwaway resources of the self-test: a small image and a tiny public repository
+const (
+    selfTestImage   = "alpine:3"
+    selfTestRepoURL = "https://github.com/octocat/Hello-World.git"
+)
+
+// SelfTestStep is the outcome of one step of SelfTest
+type SelfTestStep struct {
+    Name     string
+    Duration time.Duration
+    Err      error
+    Skipped  bool // an earlier step it depends on failed
+}
+
+// SelfTest exercises the tool's flow against a throwaway environment: it pulls a small image,
+// runs a container with a temp directory bound, checks a command's output in it, removes the
+// container and clones a tiny repository. It only uses its own temp directory and a uniquely
+// named, unlabeled container, never the config, ~/Projects or existing containers, and cleans
+// up after itself. report is called as each step finishes.
+func SelfTest(ctx context.Context, report func(SelfTestStep)) []SelfTestStep {
+    var steps []SelfTestStep
+    record := func(step SelfTestStep) bool {
+        steps = append(steps, step)
+        report(step)
+        return step.Err == nil && !step.Skipped
+    }
+    timed := func(name string, fn func() error) SelfTestStep {
+        start := time.Now()
+        err := fn()
+        return SelfTestStep{Name: name, Duration: time.Since(start), Err: err}
+    }
+
+    var tmpDir string
+    if !record(timed("create a temp directory", func() (err error) {
+        tmpDir, err = os.MkdirTemp("", "dev-env-manager-selftest-")
+        return err
+    })) {
+        return steps
+    }
+    defer os.RemoveAll(tmpDir)
+
+    // Docker steps depend on each other; the clone runs regardless
+    var cli *client.Client
+    var containerID, token string
+    dockerOK := true
+    docker := func(name string, fn func() error) {
+        if !dockerOK {
+            record(SelfTestStep{Name: name, Skipped: true})
+            return
+        }
+        dockerOK = record(timed(name, fn))
+    }
+
+    docker("connect to the Docker daemon", func() (err error) {
+        if cli, err = client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation()); err != nil {
+            return err
+        }
+        _, err = cli.Ping(ctx)
+        return err
+    })
+    docker("pull "+selfTestImage, func() error {
+        return PullImage(ctx, selfTestImage, io.Discard)
+    })
+    docker("create a container with a temp directory bind", func() error {
+        id := make([]byte, 4)
+        if _, err := rand.Read(id); err != nil {
+            return err
+        }
+        token = hex.EncodeToString(id)
+        if err := os.WriteFile(filepath.Join(tmpDir, "probe"), []byte(token), 0644); err != nil {
+            return err
+        }
+        resp, err := cli.ContainerCreate(ctx, &container.Config{
+            Image: selfTestImage,
+            Cmd:   []string{"sleep", "300"},
+        }, &container.HostConfig{
+            Mounts:      []mount.Mount{{Type: mount.TypeBind, Source: tmpDir, Target: "/selftest", ReadOnly: true}},
+            NetworkMode: "none",
+        }, nil, nil, "dev-env-manager-selftest-"+token)
+        if err != nil {
+            return err
+        }
+        containerID = resp.ID
+        return cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{})
+    })
+    if containerID != "" {
+        // Removed here too in case the removal step below is skipped or fails
+        defer cli.ContainerRemove(context.Background(), containerID, types.ContainerRemoveOptions{Force: true})
+    }
+    docker("exec a command in the container", func() error {
+        var out bytes.Buffer
+        code, err := execInContainer(ctx, cli, containerID, []string{"cat", "/selftest/probe"}, &out)
+        if err != nil {
+            return err
+        }
+        if code != 0 {
+            return fmt.Errorf("exited with %d: %s", code, strings.TrimSpace(out.String()))
+        }
+        if got := strings.TrimSpace(out.String()); got != token {
+            return fmt.Errorf("read %q from the bind, want %q", got, token)
+        }
+        return nil
+    })
+    if containerID == "" {
+        record(SelfTestStep{Name: "remove the container", Skipped: true})
+    } else {
+        record(timed("remove the container", func() error {
+            return cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: true})
+        }))
+    }
+
+    record(timed("clone "+selfTestRepoURL, func() error {
+        dest := filepath.Join(tmpDir, "repo")
+        if err := CloneRepo(ctx, selfTestRepoURL, dest, nil); err != nil {
+            return err
+        }
+        if _, err := os.Stat(filepath.Join(dest, ".git")); err != nil {
+            return fmt.Errorf("clone has no .git: %v", err)
+        }
+        return nil
+    }))
+    record(timed("clean up", func() error {
+        return os.RemoveAll(tmpDir)
+    }))
+    return steps
+}
@@ -0,0 +1,1313 @@
+package main
+
+import (
+    "archive/tar"
+    "bufio"
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/docker/docker/api/types"
+    "github.com/docker/docker/api/types/mount"
+    "github.com/spf13/viper"
+)
+
+// tarEntry is one entry of a crafted test archive
+type tarEntry struct {
+    name     string
+    body     string
+    linkname string // makes the entry a symlink
+    dir      bool
+}
+
+// craftArchive builds a tar.gz from entries, as a malicious template or archive could
+func craftArchive(t *testing.T, entries []tarEntry) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    tw := tar.NewWriter(zw)
+    for _, e := range entries {
+        hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body)), Typeflag: tar.TypeReg}
+        switch {
+        case e.linkname != "":
+            hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.linkname, 0
+        case e.dir:
+            hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+        }
+        if err := tw.WriteHeader(hdr); err != nil {
+            t.Fatal(err)
+        }
+        if hdr.Size > 0 {
+            if _, err := tw.Write([]byte(e.body)); err != nil {
+                t.Fatal(err)
+            }
+        }
+    }
+    if err := tw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes()
+}
+
+func TestExtractArchiveRefusesTraversal(t *testing.T) {
+    tests := []struct {
+        name    string
+        entries []tarEntry
+    }{
+        {"parent path", []tarEntry{{name: "../escaped", body: "x"}}},
+        {"nested parent path", []tarEntry{{name: "a/../../escaped", body: "x"}}},
+        {"absolute path", []tarEntry{{name: "/tmp/escaped", body: "x"}}},
+        {"symlink to parent", []tarEntry{{name: "link", linkname: "../.."}}},
+        {"symlink to absolute target", []tarEntry{{name: "link", linkname: "/etc"}}},
+        {"write below symlink", []tarEntry{
+            {name: "sub", dir: true},
+            {name: "sub/link", linkname: "."},
+            {name: "sub/link/escaped", body: "x"},
+        }},
+        {"overwrite symlink", []tarEntry{
+            {name: "link", linkname: "file"},
+            {name: "link", body: "x"},
+        }},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            root := t.TempDir()
+            dir := filepath.Join(root, "staging")
+            if err := os.Mkdir(dir, 0755); err != nil {
+                t.Fatal(err)
+            }
+            err := extractArchive(bytes.NewReader(craftArchive(t, tt.entries)), dir)
+            if err == nil {
+                t.Fatal("extractArchive accepted a malicious archive")
+            }
+            if _, err := os.Lstat(filepath.Join(root, "escaped")); !os.IsNotExist(err) {
+                t.Errorf("a file was written outside the staging directory")
+            }
+        })
+    }
+}
+
+func TestExtractArchiveKeepsInnerSymlinks(t *testing.T) {
+    dir := t.TempDir()
+    data := craftArchive(t, []tarEntry{
+        {name: "repo", dir: true},
+        {name: "repo/README.md", body: "hello"},
+        {name: "repo/docs", dir: true},
+        {name: "repo/docs/readme", linkname: "../README.md"},
+    })
+    if err := extractArchive(bytes.NewReader(data), dir); err != nil {
+        t.Fatalf("extractArchive: %v", err)
+    }
+    got, err := os.ReadFile(filepath.Join(dir, "repo", "docs", "readme"))
+    if err != nil || string(got) != "hello" {
+        t.Errorf("readme = %q, %v; want hello", got, err)
+    }
+}
+
+func TestValidatePathComponent(t *testing.T) {
+    for _, name := range []string{"web", "api-server", "my.repo"} {
+        if err := validatePathComponent(name); err != nil {
+            t.Errorf("validatePathComponent(%q) = %v, want nil", name, err)
+        }
+    }
+    for _, name := range []string{"", ".", "..", "../x", "a/b", `a\b`, "/abs", "x\x00"} {
+        if err := validatePathComponent(name); err == nil || !strings.Contains(err.Error(), "single path component") {
+            t.Errorf("validatePathComponent(%q) = %v, want an error", name, err)
+        }
+    }
+}
+
+// loadTestConfig points Viper at a temporary config file holding content, as user alice
+func loadTestConfig(t *testing.T, content string) string {
+    t.Helper()
+    path := filepath.Join(t.TempDir(), "config.yaml")
+    if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    viper.Reset()
+    viper.SetConfigFile(path)
+    if err := viper.ReadInConfig(); err != nil {
+        t.Fatal(err)
+    }
+    previous := userOverride
+    userOverride = "alice"
+    t.Cleanup(func() {
+        userOverride = previous
+        viper.Reset()
+    })
+    return path
+}
+
+func TestPersistRepoSettings(t *testing.T) {
+    path := loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+`)
+    if err := persistRepoSettings("web", "api", map[string]interface{}{"memory": "4g"}); err != nil {
+        t.Fatalf("persistRepoSettings: %v", err)
+    }
+    if got := viper.GetString("users.alice.projects.web.repos.api.memory"); got != "4g" {
+        t.Errorf("memory = %q, want 4g", got)
+    }
+
+    before, _ := os.ReadFile(path)
+    if err := persistRepoSettings("web", "missing", map[string]interface{}{"memory": "4g"}); err == nil {
+        t.Error("persistRepoSettings created an entry for an unconfigured repository")
+    }
+    if viper.IsSet("users.alice.projects.web.repos.missing") {
+        t.Error("a partial entry was left in the config")
+    }
+    if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+        t.Error("the config file changed")
+    }
+}
+
+func TestSandboxMountsReadOnly(t *testing.T) {
+    loadTestConfig(t, "users: {}\n")
+    home, project := t.TempDir(), t.TempDir()
+    for _, path := range []string{filepath.Join(home, ".vimrc"), filepath.Join(project, "go.mod")} {
+        if err := os.WriteFile(path, nil, 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := os.MkdirAll(filepath.Join(home, ".config", "nvim"), 0755); err != nil {
+        t.Fatal(err)
+    }
+
+    mounts := getVolumeBindings(home, project, project, "/workspace", false, true, "")
+    user, err := parseVolumeSpec("/srv/data:/data:rw")
+    if err != nil {
+        t.Fatal(err)
+    }
+    spec := ContainerSpec{
+        Mounts: append(mounts, user, mount.Mount{Type: mount.TypeVolume, Source: "shared", Target: "/shared"}),
+        Binds:  []string{"/srv/a:/a", "/srv/b:/b:z", "/srv/c:/c:rw,Z"},
+    }
+    applyIsolation("web", "api", true, &spec)
+
+    hostConfig := specHostConfig(spec)
+    for _, m := range hostConfig.Mounts {
+        if !m.ReadOnly {
+            t.Errorf("mount %s -> %s is writable in a sandbox", m.Source, m.Target)
+        }
+    }
+    want := []string{"/srv/a:/a:ro", "/srv/b:/b:ro,z", "/srv/c:/c:ro,Z"}
+    if strings.Join(hostConfig.Binds, " ") != strings.Join(want, " ") {
+        t.Errorf("binds = %q, want %q", hostConfig.Binds, want)
+    }
+    if hostConfig.NetworkMode != "none" || !hostConfig.ReadonlyRootfs {
+        t.Errorf("network %q, read-only rootfs %v; want none, true", hostConfig.NetworkMode, hostConfig.ReadonlyRootfs)
+    }
+}
+
+func TestTryLockSession(t *testing.T) {
+    t.Setenv("TMPDIR", t.TempDir())
+    userOverride = "alice"
+    defer func() { userOverride = "" }()
+
+    lock, holder, err := tryLockSession("dev-web-api")
+    if err != nil || lock == nil || holder != nil {
+        t.Fatalf("first tryLockSession = %v, %v, %v; want the lock", lock, holder, err)
+    }
+    again, holder, err := tryLockSession("dev-web-api")
+    if err != nil || again != nil || holder == nil || holder.PID != os.Getpid() || holder.User != "alice" {
+        t.Fatalf("second tryLockSession = %v, %+v, %v; want the holder", again, holder, err)
+    }
+    lock.release()
+
+    // A lock left by a process that has gone, or that can't be read, is stale
+    for _, content := range []string{`{"pid": -1, "user": "bob"}`, "", "{"} {
+        if err := os.WriteFile(lock.path, []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+        stale, holder, err := tryLockSession("dev-web-api")
+        if err != nil || stale == nil || holder != nil {
+            t.Fatalf("tryLockSession over %q = %v, %v, %v; want the lock", content, stale, holder, err)
+        }
+        stale.release()
+    }
+
+    entries, _ := os.ReadDir(filepath.Dir(lock.path))
+    if len(entries) != 0 {
+        t.Errorf("lock directory not empty after release: %v", entries)
+    }
+}
+
+func TestExportEnvOmitsCredentials(t *testing.T) {
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            env:
+              - PORT=8080
+              - API_TOKEN=s3cret
+`)
+    lines, err := ExportEnv("web", "api", false)
+    if err != nil {
+        t.Fatalf("ExportEnv: %v", err)
+    }
+    want := []string{"export PORT='8080'", "# API_TOKEN not exported; pass --reveal to include it"}
+    if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+        t.Errorf("ExportEnv = %q, want %q", lines, want)
+    }
+
+    lines, err = ExportEnv("web", "api", true)
+    if err != nil || len(lines) != 2 || lines[1] != "export API_TOKEN='s3cret'" {
+        t.Errorf("ExportEnv with reveal = %q, %v", lines, err)
+    }
+}
+
+func TestConfirm(t *testing.T) {
+    defer func(reader *bufio.Reader, interactive func() bool, yes bool) {
+        stdinReader, stdinInteractive, assumeYes = reader, interactive, yes
+    }(stdinReader, stdinInteractive, assumeYes)
+
+    tests := []struct {
+        name        string
+        input       string
+        interactive bool
+        yes         bool
+        want        bool
+    }{
+        {"yes answer", "y\n", true, false, true},
+        {"full yes answer", " YES \n", true, false, true},
+        {"no answer", "n\n", true, false, false},
+        {"empty answer defaults to no", "\n", true, false, false},
+        {"end of input", "", true, false, false},
+        {"not a terminal", "y\n", false, false, false},
+        {"--yes without a terminal", "", false, true, true},
+        {"--yes skips the question", "n\n", true, true, true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            input := strings.NewReader(tt.input)
+            stdinReader = bufio.NewReader(input)
+            stdinInteractive = func() bool { return tt.interactive }
+            assumeYes = tt.yes
+            if got := confirm("Proceed?"); got != tt.want {
+                t.Errorf("confirm = %v, want %v", got, tt.want)
+            }
+            if (tt.yes || !tt.interactive) && input.Len() != len(tt.input) {
+                t.Error("confirm read stdin without asking")
+            }
+        })
+    }
+}
+
+func TestSandboxIgnoresNetworkMode(t *testing.T) {
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            network_mode: host
+            network_aliases: [api]
+`)
+    spec := ContainerSpec{}
+    applyIsolation("web", "api", true, &spec)
+    if err := resolveNetwork("web", "api", StartOptions{Sandbox: true}, &spec); err != nil {
+        t.Fatalf("resolveNetwork: %v", err)
+    }
+    if spec.NetworkMode != "none" || len(spec.NetworkAliases) != 0 {
+        t.Errorf("sandbox network = %q aliases %q, want none and no aliases", spec.NetworkMode, spec.NetworkAliases)
+    }
+    if err := resolveNetwork("web", "api", StartOptions{Sandbox: true, Network: "dev"}, &spec); err == nil {
+        t.Error("resolveNetwork accepted --network in a sandbox")
+    }
+
+    spec = ContainerSpec{}
+    applyIsolation("web", "api", false, &spec)
+    if spec.NetworkMode != "host" {
+        t.Errorf("network = %q, want the network_mode key's host", spec.NetworkMode)
+    }
+}
+
+func TestVolumeRepo(t *testing.T) {
+    containers := map[string]string{"dev-web": "web/site", "dev-web-api": "web/api"}
+    tests := []struct {
+        name   string
+        volume types.Volume
+        want   string
+        known  bool
+    }{
+        {"labelled", types.Volume{Name: stateVolumePrefix + "anything", Labels: volumeLabels("web", "api", "next")}, "web/api", true},
+        {"exact container name", types.Volume{Name: stateVolumePrefix + "dev-web-api"}, "web/api", true},
+        {"name prefix is not ownership", types.Volume{Name: stateVolumePrefix + "dev-web-other"}, "", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, known := volumeRepo(&tt.volume, volumeOwner(tt.volume.Name), containers)
+            if got != tt.want || known != tt.known {
+                t.Errorf("volumeRepo = %q, %v; want %q, %v", got, known, tt.want, tt.known)
+            }
+        })
+    }
+}
+
+func TestNormalizeUsername(t *testing.T) {
+    tests := []struct {
+        username, goos, want string
+    }{
+        {"alice", "linux", "alice"},
+        {`CORP\alice`, "windows", "alice"},
+        {`alice`, "windows", "alice"},
+        {`CORP\sub\alice`, "windows", "alice"},
+        {`CORP\alice`, "linux", `CORP\alice`}, // a backslash is legal in Unix names
+        {"alice@example.com", "darwin", "alice@example.com"},
+    }
+    for _, tt := range tests {
+        if got := normalizeUsername(tt.username, tt.goos); got != tt.want {
+            t.Errorf("normalizeUsername(%q, %q) = %q, want %q", tt.username, tt.goos, got, tt.want)
+        }
+    }
+}
+
+func TestSharedEntryMergesPerField(t *testing.T) {
+    loadTestConfig(t, `memory: 1g
+users:
+  shared:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+            docker_image: team/api:latest
+            container_name: nvim-api
+            env: [TEAM=1]
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            docker_image: alice/api:dev
+`)
+    repoURL, image, container, err := deriveProjectValues("web", "api")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if repoURL != "https://example.com/api.git" || image != "alice/api:dev" || container != "nvim-api" {
+        t.Errorf("deriveProjectValues = %q, %q, %q; want the shared URL and container with alice's image", repoURL, image, container)
+    }
+    if env, _ := repoEnv("web", "api"); len(env) != 1 || env[0] != "TEAM=1" {
+        t.Errorf("repoEnv = %q, want the shared env", env)
+    }
+    if key := repoSettingKey("web", "api", "memory"); key != "memory" {
+        t.Errorf("repoSettingKey(memory) = %q, want the global key", key)
+    }
+
+    if err := persistRepoSettings("web", "api", map[string]interface{}{"memory": "4g"}); err != nil {
+        t.Fatalf("persistRepoSettings: %v", err)
+    }
+    if got := viper.GetString("users.alice.projects.web.repos.api.memory"); got != "4g" {
+        t.Errorf("alice's memory = %q, want 4g", got)
+    }
+    if viper.IsSet("users.shared.projects.web.repos.api.memory") {
+        t.Error("persistRepoSettings wrote into the shared entry")
+    }
+    if settings := repoSettings("web", "api"); settings["memory"] != "4g" || settings["repo_url"] != "https://example.com/api.git" {
+        t.Errorf("repoSettings = %v, want shared fields under alice's", settings)
+    }
+}
+
+func TestConfigExportImportRoundTrip(t *testing.T) {
+    home := t.TempDir()
+    t.Setenv("HOME", home)
+    t.Setenv("DEV_ENV_MANAGER_HOME", filepath.Join(home, ".dev-env-manager"))
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+            docker_image: team/api:latest
+            container_name: nvim-api
+            cpu_set_cpus: 0-3
+            volumes:
+              - `+home+`/data:/data
+              - /srv/cache:/cache
+`)
+    bundle, err := ExportConfig("")
+    if err != nil {
+        t.Fatalf("ExportConfig: %v", err)
+    }
+    for _, unwanted := range []string{"cpu_set_cpus", "/srv/cache", home} {
+        if strings.Contains(string(bundle), unwanted) {
+            t.Errorf("bundle contains %q:\n%s", unwanted, bundle)
+        }
+    }
+
+    const target = `# Team config, kept by hand
+users:
+  alice:
+    projects:
+      tools:
+        repos:
+          cli:
+            repo_url: https://example.com/cli.git # the fork
+            docker_image: team/cli:latest
+            container_name: nvim-cli
+`
+    path := loadTestConfig(t, target)
+    imported, err := ImportConfig(bundle, ImportSkip)
+    if err != nil || imported != 1 {
+        t.Fatalf("ImportConfig = %d, %v; want 1 repository", imported, err)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, kept := range []string{"# Team config, kept by hand", "# the fork", "\n          cli:\n"} {
+        if !strings.Contains(string(data), kept) {
+            t.Errorf("import lost %q:\n%s", kept, data)
+        }
+    }
+    if got := viper.GetStringSlice("users.alice.projects.web.repos.api.volumes"); len(got) != 1 || got[0] != "$HOME/data:/data" {
+        t.Errorf("imported volumes = %q, want [$HOME/data:/data]", got)
+    }
+
+    if imported, err := ImportConfig(bundle, ImportSkip); err != nil || imported != 0 {
+        t.Errorf("second ImportConfig = %d, %v; want the existing entry skipped", imported, err)
+    }
+}
+
+func TestValidateEnv(t *testing.T) {
+    tests := []struct {
+        name string
+        env  []string
+        errs int
+    }{
+        {"valid", []string{"A=1", "_B=x=y", "C2="}, 0},
+        {"missing equals", []string{"A"}, 1},
+        {"empty key", []string{"=1"}, 1},
+        {"key with a space", []string{"MY VAR=1"}, 1},
+        {"key starting with a digit", []string{"1A=1"}, 1},
+        {"stray newline in key", []string{"A\nB=1"}, 1},
+        {"duplicate key", []string{"A=1", "A=2"}, 1},
+        {"NUL in value", []string{"A=x\x00y"}, 1},
+        {"all reported at once", []string{"A", "B C=1", "D=1", "D=2"}, 3},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if errs := ValidateEnv(tt.env); len(errs) != tt.errs {
+                t.Errorf("ValidateEnv(%q) = %v, want %d error(s)", tt.env, errs, tt.errs)
+            }
+        })
+    }
+}
+
+func TestOverrideEnv(t *testing.T) {
+    got := overrideEnv([]string{"HOME=/home/cdaprod", "A=1", "B=2"}, []string{"HOME=/root", "C=3"})
+    want := []string{"A=1", "B=2", "HOME=/root", "C=3"}
+    if strings.Join(got, " ") != strings.Join(want, " ") {
+        t.Errorf("overrideEnv = %q, want %q", got, want)
+    }
+    if errs := ValidateEnv(got); len(errs) != 0 {
+        t.Errorf("merged env is invalid: %v", errs)
+    }
+    if err := checkEnv("test env", []string{"A=1", "A=2"}); err == nil || !strings.Contains(err.Error(), "invalid test env") {
+        t.Errorf("checkEnv = %v, want an invalid test env error", err)
+    }
+}
+
+func TestPullImageEnforcesPolicy(t *testing.T) {
+    loadTestConfig(t, `policy:
+  allowed_registries: [registry.corp.example.com]
+users: {}
+`)
+    // The policy is checked before a Docker client is even created
+    err := PullImage(context.Background(), "docker.io/library/alpine:3", io.Discard)
+    var violation *PolicyViolation
+    if !errors.As(err, &violation) || violation.Rule != "allowed_registries" {
+        t.Errorf("PullImage = %v, want an allowed_registries violation", err)
+    }
+}
+
+func TestModuleChecksumFailures(t *testing.T) {
+    tests := []struct {
+        name string
+        out  string
+        want int
+    }{
+        {"verified", "all modules verified\n", 0},
+        {"download failure", "go: github.com/x/y@v1.0.0: Get \"https://proxy.golang.org/...\": dial tcp: lookup proxy.golang.org: no such host\n", 0},
+        {"modified module", "github.com/x/y v1.0.0: dir has been modified (/root/go/pkg/mod/github.com/x/y@v1.0.0)\n", 1},
+        {"checksum mismatch", "verifying github.com/x/y@v1.0.0: checksum mismatch\n\tdownloaded: h1:aaa=\n\tgo.sum:     h1:bbb=\n\nSECURITY ERROR\nThis download does NOT match an earlier download recorded in go.sum.\n", 2},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := moduleChecksumFailures(tt.out); len(got) != tt.want {
+                t.Errorf("moduleChecksumFailures = %q, want %d line(s)", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestIdleCommandTrapsStopSignal(t *testing.T) {
+    tests := []struct {
+        signal, traps string
+    }{
+        {"SIGTERM", "TERM INT"},
+        {"SIGINT", "TERM INT"},
+        {"SIGHUP", "TERM INT HUP"},
+        {"usr1", "TERM INT USR1"},
+        {"SIGKILL", "TERM INT"},
+    }
+    for _, tt := range tests {
+        if err := checkStopSignal(tt.signal); err != nil {
+            t.Errorf("checkStopSignal(%q) = %v", tt.signal, err)
+        }
+        if script := idleCommand(tt.signal)[2]; !strings.HasPrefix(script, "trap 'exit 0' "+tt.traps+";") {
+            t.Errorf("idleCommand(%q) = %q, want it to trap %s", tt.signal, script, tt.traps)
+        }
+    }
+    for _, signal := range []string{"SIGRTMIN+3", "15", "TERM; rm -rf /"} {
+        if checkStopSignal(signal) == nil {
+            t.Errorf("checkStopSignal(%q) accepted a signal the idle loop can't trap", signal)
+        }
+    }
+}
+
+func TestWholeSeconds(t *testing.T) {
+    for d, want := range map[time.Duration]int{0: 0, 500 * time.Millisecond: 1, time.Second: 1, 1500 * time.Millisecond: 2, 10 * time.Second: 10} {
+        if got := wholeSeconds(d); got != want {
+            t.Errorf("wholeSeconds(%s) = %d, want %d", d, got, want)
+        }
+    }
+}
+
+func TestHostBackedMount(t *testing.T) {
+    mounts := []types.MountPoint{
+        {Type: mount.TypeBind, Source: "/home/alice/proj", Destination: "/usr/src/app"},
+        {Type: mount.TypeVolume, Name: "cache", Destination: "/cache"},
+    }
+    for path, want := range map[string]bool{
+        "/usr/src/app/.env":           true,
+        "/usr/src/app/config/../.env": true,
+        "/usr/src/app":                true,
+        "/usr/src/application/.env":   false,
+        "/cache/.env":                 false,
+        "/run/devenv/.env":            false,
+    } {
+        if _, got := hostBackedMount(mounts, path); got != want {
+            t.Errorf("hostBackedMount(%q) = %v, want %v", path, got, want)
+        }
+    }
+}
+
+func TestRelabelKeepsPortsVolumesAndNetworks(t *testing.T) {
+    var info types.ContainerJSON
+    err := json.Unmarshal([]byte(`{
+        "Id": "0123456789abcdef",
+        "HostConfig": {
+            "Binds": ["/home/alice/proj:/usr/src/app", "cache:/cache"],
+            "PortBindings": {"80/tcp": [{"HostIp": "127.0.0.1", "HostPort": "8080"}], "53/udp": [{"HostPort": "5353"}]}
+        },
+        "Mounts": [
+            {"Type": "bind", "Source": "/home/alice/proj", "Destination": "/usr/src/app", "RW": true},
+            {"Type": "volume", "Name": "cache", "Destination": "/cache", "RW": true},
+            {"Type": "volume", "Name": "3f9a", "Destination": "/var/lib/data", "RW": true}
+        ],
+        "NetworkSettings": {"Networks": {"backend": {"Aliases": ["db", "0123456789ab"], "NetworkID": "n1", "EndpointID": "e1"}}}
+    }`), &info)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    ports := publishedPorts(info.HostConfig)
+    if want := []string{"127.0.0.1:8080:80/tcp", "5353:53/udp"}; strings.Join(ports, ",") != strings.Join(want, ",") {
+        t.Errorf("publishedPorts = %v, want %v", ports, want)
+    }
+    volumes := anonymousVolumes(info)
+    if len(volumes) != 1 || volumes[0].Source != "3f9a" || volumes[0].Target != "/var/lib/data" || volumes[0].ReadOnly {
+        t.Errorf("anonymousVolumes = %+v, want only 3f9a at /var/lib/data", volumes)
+    }
+    endpoints := endpointSettings(info)
+    ep := endpoints["backend"]
+    if ep == nil || len(ep.Aliases) != 1 || ep.Aliases[0] != "db" || ep.EndpointID != "" {
+        t.Errorf("endpointSettings = %+v, want backend with alias db and no runtime state", endpoints)
+    }
+}
+
+func TestScheduleDaemonSkipsEmptyCommand(t *testing.T) {
+    t.Setenv("DEV_ENV_MANAGER_HOME", t.TempDir())
+    if err := writeSchedule([]ScheduleEntry{{ID: "empty", Cron: "@hourly"}}); err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if err := RunScheduleDaemon(ctx); err != nil {
+        t.Errorf("RunScheduleDaemon = %v", err)
+    }
+}
+
+func TestWriteScheduleIgnoresReadOnlyConfig(t *testing.T) {
+    t.Setenv("DEV_ENV_MANAGER_HOME", t.TempDir())
+    configReadOnly = true
+    defer func() { configReadOnly = false }()
+    entries := []ScheduleEntry{{ID: "nightly", Project: "web", Repo: "api", Cron: "0 3 * * *", Command: []string{"update"}}}
+    if err := writeSchedule(entries); err != nil {
+        t.Fatalf("writeSchedule with a read-only config: %v", err)
+    }
+    got, err := ReadSchedule()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(got) != 1 || got[0].ID != "nightly" {
+        t.Errorf("schedule = %+v, want the nightly entry", got)
+    }
+}
+
+func TestSessionProbeFindsOnlyItsSession(t *testing.T) {
+    if _, err := os.Stat("/proc/self/environ"); err != nil {
+        t.Skip("no /proc to probe")
+    }
+    editor := exec.Command("sleep", "30")
+    editor.Env = append(os.Environ(), sessionEnvVar+"=abc123")
+    if err := editor.Start(); err != nil {
+        t.Fatal(err)
+    }
+    defer editor.Process.Kill()
+
+    probe := func(id string) bool {
+        args := sessionProbe(id)
+        return exec.Command(args[0], args[1:]...).Run() == nil
+    }
+    if !probe("abc123") {
+        t.Error("the probe didn't find the running session")
+    }
+    if probe("def456") {
+        t.Error("the probe found a session that never ran")
+    }
+    editor.Process.Kill()
+    editor.Wait()
+    if probe("abc123") {
+        t.Error("the probe still found the session after it ended")
+    }
+}
+
+func TestDetachKeys(t *testing.T) {
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      proj:
+        repos:
+          app:
+            repo_url: https://example.com/app.git
+            detach_keys: ctrl-x,x
+          other:
+            repo_url: https://example.com/other.git
+`)
+    if got := detachKeys("proj", "app", StartOptions{}); got != "ctrl-x,x" {
+        t.Errorf("detachKeys from config = %q, want ctrl-x,x", got)
+    }
+    if got := detachKeys("proj", "app", StartOptions{DetachKeys: "ctrl-a,d"}); got != "ctrl-a,d" {
+        t.Errorf("--detach-keys = %q, want it to win over the config", got)
+    }
+    if got := detachKeys("proj", "other", StartOptions{}); got != "" {
+        t.Errorf("detachKeys without config = %q, want docker's default", got)
+    }
+}
+
+func TestDryRunHasNoSideEffects(t *testing.T) {
+    t.Setenv("XDG_CACHE_HOME", t.TempDir())
+    t.Setenv("DEV_ENV_MANAGER_HOME", t.TempDir())
+    // Any Docker call would fail against a daemon that isn't there
+    t.Setenv("DOCKER_HOST", "unix:///nonexistent/docker.sock")
+
+    cachePath, err := imageCachePath()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(cachePath, []byte("{}"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    entry := ScheduleEntry{ID: "keep", Cron: "@daily", Command: []string{"pull"}}
+    if err := writeSchedule([]ScheduleEntry{entry}); err != nil {
+        t.Fatal(err)
+    }
+
+    dryRun = true
+    defer func() { dryRun = false }()
+    if err := ClearImageCache(); err != nil {
+        t.Errorf("ClearImageCache = %v", err)
+    }
+    if _, err := os.Stat(cachePath); err != nil {
+        t.Errorf("dry-run removed the image cache: %v", err)
+    }
+    if err := RemoveSchedule("keep"); err != nil {
+        t.Errorf("RemoveSchedule = %v", err)
+    }
+    if entries, err := ReadSchedule(); err != nil || len(entries) != 1 {
+        t.Errorf("dry-run changed the schedule: %v, %v", entries, err)
+    }
+    if err := RemoveVolume("data"); err != nil {
+        t.Errorf("RemoveVolume reached Docker under dry-run: %v", err)
+    }
+    if err := RemoveContainer("app"); err != nil {
+        t.Errorf("RemoveContainer reached Docker under dry-run: %v", err)
+    }
+
+    dryRun = false
+    if err := RemoveVolume("data"); err == nil {
+        t.Error("RemoveVolume succeeded without a daemon; the dry-run checks above prove nothing")
+    }
+}
+
+func TestErrorCode(t *testing.T) {
+    tests := []struct {
+        err  error
+        code string
+    }{
+        {errConfigReadOnly, "config_read_only"},
+        {fmt.Errorf("error saving settings: %w", errConfigReadOnly), "config_read_only"},
+        {fmt.Errorf("error saving settings: %v", errConfigReadOnly), "config_read_only"},
+        {fmt.Errorf("ping: %w", errDaemonUnreachable), "daemon_unreachable"},
+        {fmt.Errorf("error running container: %v", fmt.Errorf("%w: Conflict", errContainerConflict)), "container_conflict"},
+        {fmt.Errorf("attach: %w", errContainerNotRunning), "container_not_running"},
+        {fmt.Errorf("%w: image alpine:3 is not allowed", errPolicyViolation), "policy_violation"},
+        {errors.New("something else went wrong"), "error"},
+    }
+    for _, tt := range tests {
+        if got := errorCode(tt.err.Error()); got != tt.code {
+            t.Errorf("errorCode(%q) = %s, want %s", tt.err, got, tt.code)
+        }
+    }
+}
+
+func TestExpandEnv(t *testing.T) {
+    t.Setenv("GIT_HOST", "git.example.com")
+    t.Setenv("OWNER", "team")
+    t.Setenv("DEM_TEST_UNDEFINED", "")
+    os.Unsetenv("DEM_TEST_UNDEFINED")
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      proj:
+        repos:
+          app:
+            repo_url: https://$GIT_HOST/${OWNER}/app.git
+            docker_image: registry.example.com/app:latest
+            env:
+              - REGISTRY=${GIT_HOST}
+`)
+
+    repoURL, dockerImage, _, err := deriveProjectValues("proj", "app")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if repoURL != "https://git.example.com/team/app.git" {
+        t.Errorf("repo_url = %q, want the variables expanded", repoURL)
+    }
+    if dockerImage != "registry.example.com/app:latest" {
+        t.Errorf("docker_image = %q, want it untouched", dockerImage)
+    }
+    if env, err := repoEnv("proj", "app"); err != nil || len(env) != 1 || env[0] != "REGISTRY=git.example.com" {
+        t.Errorf("repoEnv = %v, %v, want REGISTRY=git.example.com", env, err)
+    }
+
+    if _, err := expandEnv("https://$DEM_TEST_UNDEFINED/app.git"); err == nil || !strings.Contains(err.Error(), "DEM_TEST_UNDEFINED") {
+        t.Errorf("expandEnv with an undefined variable = %v, want an error naming it", err)
+    }
+    viper.Set("allow_undefined_env", true)
+    if got, err := expandEnv("https://$DEM_TEST_UNDEFINED/app.git"); err != nil || got != "https:///app.git" {
+        t.Errorf("expandEnv with allow_undefined_env = %q, %v, want the variable expanded to empty", got, err)
+    }
+}
+
+func TestEditConfigKeepsCommentsAndMode(t *testing.T) {
+    path := loadTestConfig(t, `# shared settings live below
+users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+            memory: 4g # enough for the test suite
+          ui:
+            # the frontend
+            repo_url: https://example.com/ui.git
+`)
+    if err := os.Chmod(path, 0600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("VISUAL", "sed -i -e s/4g/8g/")
+
+    if err := EditConfig("web", "api"); err != nil {
+        t.Fatal(err)
+    }
+    data, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, want := range []string{"# shared settings live below", "memory: 8g # enough for the test suite", "# the frontend"} {
+        if !strings.Contains(string(data), want) {
+            t.Errorf("edited config lost %q:\n%s", want, data)
+        }
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Mode().Perm() != 0600 {
+        t.Errorf("edited config mode = %v, want 0600", info.Mode().Perm())
+    }
+}
+
+func TestUptimeSince(t *testing.T) {
+    now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        startedAt string
+        want      time.Duration
+    }{
+        {"2024-05-01T11:58:29.123456789Z", 90 * time.Second},
+        {"0001-01-01T00:00:00Z", 0},
+        {"", 0},
+        {"2024-05-01T12:00:05Z", 0},
+    }
+    for _, tt := range tests {
+        if got := uptimeSince(tt.startedAt, now); got != tt.want {
+            t.Errorf("uptimeSince(%q) = %s, want %s", tt.startedAt, got, tt.want)
+        }
+    }
+}
+
+func TestShellWords(t *testing.T) {
+    tests := []struct {
+        line string
+        want []string
+    }{
+        {"nvim", []string{"nvim"}},
+        {"  code  --wait \t. ", []string{"code", "--wait", "."}},
+        {`bash -lc 'make dev && tail -f log'`, []string{"bash", "-lc", "make dev && tail -f log"}},
+        {`emacs --eval "(setq x \"y\")"`, []string{"emacs", "--eval", `(setq x "y")`}},
+        {`a\ b "c\d" ''`, []string{"a b", `c\d`, ""}},
+        {"", nil},
+    }
+    for _, tt := range tests {
+        got, err := shellWords(tt.line)
+        if err != nil || strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+            t.Errorf("shellWords(%q) = %q, %v, want %q", tt.line, got, err, tt.want)
+        }
+    }
+    for _, line := range []string{`sh -c 'echo`, `echo "hi`, `echo \`} {
+        if _, err := shellWords(line); err == nil {
+            t.Errorf("shellWords(%q) accepted an unterminated line", line)
+        }
+    }
+}
+
+func TestResolveLogConfig(t *testing.T) {
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+          ui:
+            repo_url: https://example.com/ui.git
+            log_driver: local
+            log_opts: [max-size=5m]
+`)
+    opts := StartOptions{LogOpts: []string{"max-size=10m", "max-file=3"}, NoSave: true}
+    logConfig, err := resolveLogConfig("web", "api", opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if logConfig.Type != "json-file" || logConfig.Config["max-size"] != "10m" || logConfig.Config["max-file"] != "3" {
+        t.Errorf("log options without a driver = %+v, want json-file with both options", logConfig)
+    }
+    if logConfig, err = resolveLogConfig("web", "ui", StartOptions{NoSave: true}); err != nil || logConfig.Type != "local" || logConfig.Config["max-size"] != "5m" {
+        t.Errorf("configured log settings = %+v, %v, want local with max-size=5m", logConfig, err)
+    }
+    if _, err := resolveLogConfig("web", "api", StartOptions{LogDriver: "bogus", NoSave: true}); err == nil {
+        t.Error("an unknown log driver was accepted")
+    }
+}
+
+func TestSandboxKeepsIPCPrivate(t *testing.T) {
+    loadTestConfig(t, `users:
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+            ipc_mode: host
+`)
+    if mode, err := ipcMode("web", "api", StartOptions{}); err != nil || mode != "host" {
+        t.Errorf("ipcMode = %q, %v, want host from the config", mode, err)
+    }
+    if mode, err := ipcMode("web", "api", StartOptions{Sandbox: true}); err != nil || mode != "private" {
+        t.Errorf("sandbox ipcMode = %q, %v, want private despite the config", mode, err)
+    }
+    for _, flag := range []string{"host", "container:db"} {
+        if _, err := ipcMode("web", "api", StartOptions{Sandbox: true, IpcMode: flag}); err == nil {
+            t.Errorf("--ipc %s was accepted with --sandbox", flag)
+        }
+    }
+}
+
+func TestProfileOverrides(t *testing.T) {
+    loadTestConfig(t, `memory: 1g
+profiles:
+  staging:
+    memory: 2g
+    dns: [10.0.0.53]
+users:
+  shared:
+    projects:
+      web:
+        repos:
+          api:
+            hostname: api-shared
+            profiles:
+              staging:
+                hostname: api-staging
+  alice:
+    projects:
+      web:
+        repos:
+          api:
+            repo_url: https://example.com/api.git
+            docker_image: app:dev
+            profiles:
+              staging:
+                docker_image: app:staging
+`)
+    previous := profileOverride
+    t.Cleanup(func() { profileOverride = previous })
+
+    setting := func(field string) string {
+        return viper.GetString(repoSettingKey("web", "api", field))
+    }
+    if got := setting("docker_image"); got != "app:dev" {
+        t.Errorf("docker_image without a profile = %q, want app:dev", got)
+    }
+    if got := setting("memory"); got != "1g" {
+        t.Errorf("memory without a profile = %q, want 1g", got)
+    }
+
+    profileOverride = "staging"
+    for field, want := range map[string]string{
+        "docker_image": "app:staging", // the personal entry's override
+        "hostname":     "api-staging", // the shared entry's override
+        "repo_url":     "https://example.com/api.git",
+        "memory":       "2g", // the top-level profile's default
+    } {
+        if got := setting(field); got != want {
+            t.Errorf("%s with profile staging = %q, want %s", field, got, want)
+        }
+    }
+
+    settings, err := effectiveRepoSettings("web", "api")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if settings["docker_image"] != "app:staging" || settings["memory"] != "2g" {
+        t.Errorf("effective settings = %v, want the staging overrides", settings)
+    }
+    if _, ok := settings["profiles"]; ok {
+        t.Error("effective settings still contain the profiles section")
+    }
+
+    if err := persistRepoSettings("web", "api", map[string]interface{}{"memory": "8g"}); err != nil {
+        t.Fatalf("persistRepoSettings: %v", err)
+    }
+    if got := viper.GetString("users.alice.projects.web.repos.api.profiles.staging.memory"); got != "8g" {
+        t.Errorf("saved memory = %q, want 8g under the active profile", got)
+    }
+    if viper.IsSet("users.alice.projects.web.repos.api.memory") {
+        t.Error("a setting saved under a profile leaked into the base entry")
+    }
+}
+
+func TestValidateProfiles(t *testing.T) {
+    tree := map[string]interface{}{
+        "profile": "staging",
+        "profiles": map[string]interface{}{
+            "staging": map[string]interface{}{
+                "memory":   "2g",
+                "bogus":    true,
+                "profiles": map[string]interface{}{},
+            },
+            "broken": "memory: 2g",
+        },
+    }
+    var got []string
+    for _, err := range ValidateConfigTree(tree) {
+        got = append(got, err.Error())
+    }
+    want := []string{
+        "profiles.broken: expected a mapping",
+        "profiles.staging.profiles: profiles can't be nested",
+        "profiles.staging.bogus: unknown key",
+    }
+    if strings.Join(got, "\n") != strings.Join(want, "\n") {
+        t.Errorf("errors = %q, want %q", got, want)
+    }
+}
+
+func TestRunPool(t *testing.T) {
+    // poolRecorder tracks which tasks ran and were cleaned up, and how many ran at once
+    type poolRecorder struct {
+        mu      sync.Mutex
+        ran     map[string]bool
+        cleaned map[string]bool
+        active  int
+        peak    int
+    }
+    task := func(r *poolRecorder, name string, run func(ctx context.Context) error) PoolTask {
+        return PoolTask{
+            Name: name,
+            Run: func(ctx context.Context, out io.Writer) error {
+                r.mu.Lock()
+                r.ran[name] = true
+                if r.active++; r.active > r.peak {
+                    r.peak = r.active
+                }
+                r.mu.Unlock()
+                defer func() {
+                    r.mu.Lock()
+                    r.active--
+                    r.mu.Unlock()
+                }()
+                return run(ctx)
+            },
+            Cleanup: func() {
+                r.mu.Lock()
+                r.cleaned[name] = true
+                r.mu.Unlock()
+            },
+        }
+    }
+    succeed := func(ctx context.Context) error {
+        time.Sleep(5 * time.Millisecond)
+        return nil
+    }
+
+    tests := []struct {
+        name       string
+        parallel   int
+        tasks      func(r *poolRecorder, cancel context.CancelFunc) []PoolTask
+        precancel  bool
+        wantErr    []string // substrings of the aggregated error, in order
+        wantRan    []string
+        wantClean  []string
+        notRan     []string
+        wantPeakLE int
+    }{
+        {
+            name:     "partial failure",
+            parallel: 2,
+            tasks: func(r *poolRecorder, _ context.CancelFunc) []PoolTask {
+                return []PoolTask{
+                    task(r, "a", succeed),
+                    task(r, "b", func(context.Context) error { return errors.New("pull denied") }),
+                    task(r, "c", succeed),
+                    task(r, "d", func(context.Context) error { return errors.New("no space left") }),
+                }
+            },
+            wantErr:   []string{"2 of 4 failed", "- b: pull denied", "- d: no space left"},
+            wantRan:   []string{"a", "b", "c", "d"},
+            wantClean: []string{"a", "b", "c", "d"},
+        },
+        {
+            name:     "cancelled before feeding",
+            parallel: 2,
+            tasks: func(r *poolRecorder, _ context.CancelFunc) []PoolTask {
+                return []PoolTask{task(r, "a", succeed), task(r, "b", succeed), task(r, "c", succeed)}
+            },
+            precancel: true,
+            wantErr:   []string{"3 of 3 failed", "- a: not started", "- b: not started", "- c: not started"},
+            notRan:    []string{"a", "b", "c"},
+        },
+        {
+            name:     "cancelled while running",
+            parallel: 1,
+            tasks: func(r *poolRecorder, cancel context.CancelFunc) []PoolTask {
+                return []PoolTask{
+                    task(r, "a", func(ctx context.Context) error {
+                        cancel()
+                        <-ctx.Done()
+                        return ctx.Err()
+                    }),
+                    task(r, "b", succeed),
+                    task(r, "c", succeed),
+                }
+            },
+            wantErr:   []string{"3 of 3 failed", "- a: context canceled", "- b: not started", "- c: not started"},
+            wantRan:   []string{"a"},
+            wantClean: []string{"a"},
+            notRan:    []string{"b", "c"},
+        },
+        {
+            name:     "parallel clamped to one",
+            parallel: 0,
+            tasks: func(r *poolRecorder, _ context.CancelFunc) []PoolTask {
+                return []PoolTask{task(r, "a", succeed), task(r, "b", succeed), task(r, "c", succeed)}
+            },
+            wantRan:    []string{"a", "b", "c"},
+            wantClean:  []string{"a", "b", "c"},
+            wantPeakLE: 1,
+        },
+        {
+            name:     "negative parallel clamped to one",
+            parallel: -3,
+            tasks: func(r *poolRecorder, _ context.CancelFunc) []PoolTask {
+                return []PoolTask{task(r, "a", succeed), task(r, "b", succeed)}
+            },
+            wantRan:    []string{"a", "b"},
+            wantClean:  []string{"a", "b"},
+            wantPeakLE: 1,
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := &poolRecorder{ran: map[string]bool{}, cleaned: map[string]bool{}}
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+            tasks := tt.tasks(r, cancel)
+            if tt.precancel {
+                cancel()
+            }
+
+            err := runPool(ctx, tt.parallel, tasks)
+            if len(tt.wantErr) == 0 {
+                if err != nil {
+                    t.Fatalf("runPool: %v", err)
+                }
+            } else {
+                if err == nil {
+                    t.Fatal("runPool succeeded, want an aggregated error")
+                }
+                msg := err.Error()
+                for _, want := range tt.wantErr {
+                    i := strings.Index(msg, want)
+                    if i < 0 {
+                        t.Fatalf("error %q doesn't contain %q", err, want)
+                    }
+                    msg = msg[i+len(want):]
+                }
+            }
+            for _, name := range tt.wantRan {
+                if !r.ran[name] {
+                    t.Errorf("task %s didn't run", name)
+                }
+            }
+            for _, name := range tt.notRan {
+                if r.ran[name] {
+                    t.Errorf("task %s ran after cancellation", name)
+                }
+            }
+            for _, name := range tt.wantClean {
+                if !r.cleaned[name] {
+                    t.Errorf("task %s wasn't cleaned up", name)
+                }
+            }
+            if tt.wantPeakLE > 0 && r.peak > tt.wantPeakLE {
+                t.Errorf("%d tasks ran at once, want at most %d", r.peak, tt.wantPeakLE)
+            }
+        })
+    }
+}
+
+func TestPrefixWriter(t *testing.T) {
+    // write is one Write call on the writer with the given prefix
+    type write struct {
+        writer string
+        data   string
+    }
+    tests := []struct {
+        name   string
+        writes []write
+        want   string
+    }{
+        {
+            name:   "lines split across writes",
+            writes: []write{{"a", "hel"}, {"a", "lo\nwor"}, {"a", "ld\n"}},
+            want:   "[a] hello\n[a] world\n",
+        },
+        {
+            name:   "partial lines don't interleave",
+            writes: []write{{"a", "par"}, {"b", "full\n"}, {"a", "tial\n"}, {"b", "half"}, {"a", "next\n"}, {"b", " done\n"}},
+            want:   "[b] full\n[a] partial\n[a] next\n[b] half done\n",
+        },
+        {
+            name:   "carriage return redraws",
+            writes: []write{{"a", "Receiving 10%\r"}, {"b", "Receiving 5"}, {"a", "Receiving 50%\r"}, {"b", "0%\r"}, {"a", "done\n"}},
+            want:   "[a] Receiving 10%\r[a] Receiving 50%\r[b] Receiving 50%\r[a] done\n",
+        },
+        {
+            name:   "trailing partial line flushed",
+            writes: []write{{"a", "line\ntail"}},
+            want:   "[a] line\n[a] tail\n",
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var mu sync.Mutex
+            var out bytes.Buffer
+            writers := map[string]*prefixWriter{}
+            for _, w := range tt.writes {
+                pw, ok := writers[w.writer]
+                if !ok {
+                    pw = &prefixWriter{mu: &mu, out: &out, prefix: "[" + w.writer + "] "}
+                    writers[w.writer] = pw
+                }
+                if n, err := pw.Write([]byte(w.data)); err != nil || n != len(w.data) {
+                    t.Fatalf("Write(%q) = %d, %v", w.data, n, err)
+                }
+            }
+            for _, name := range []string{"a", "b"} {
+                if pw, ok := writers[name]; ok {
+                    pw.Flush()
+                }
+            }
+            if got := out.String(); got != tt.want {
+                t.Errorf("output = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestOfflineSkipsUpdateCheck(t *testing.T) {
+    t.Setenv("DEV_ENV_MANAGER_HOME", t.TempDir())
+    args, previous := os.Args, pendingUpdateHint
+    os.Args = []string{"dev-environment-manager", "start", "--offline", "web", "api"}
+    offline, pendingUpdateHint = true, nil
+    defer func() {
+        os.Args, pendingUpdateHint, offline = args, previous, false
+    }()
+
+    beginUpdateCheck()
+    if pendingUpdateHint != nil {
+        t.Error("an --offline start began an update check")
+    }
+}